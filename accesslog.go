@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requestInfo collects what the proxy learns about a request while serving it, for the access log
+type requestInfo struct {
+	// host is the normalized public host of the request, which stays available after the director
+	// has rewritten the Host header
+	host string
+	// publicHost is the Host header of the request as the client sent it, port included
+	publicHost string
+	// target is the url of the upstream target the request was forwarded to, if any
+	target string
+	// cacheHit is true when the upstream of the host was already cached
+	cacheHit bool
+	// requestID is the ID of the request, or empty if request IDs are disabled
+	requestID string
+}
+
+// requestInfoContextKey is the request context key holding the *requestInfo of the request
+type requestInfoContextKey struct{}
+
+// requestInfoFromContext returns the *requestInfo stored in the context, or nil
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	return info
+}
+
+// responseRecorder is an http.ResponseWriter that records the status code and number of bytes written
+type responseRecorder struct {
+	http.ResponseWriter
+	// status is the status code written, or zero if none was written yet
+	status int
+	// bytes is the number of body bytes written
+	bytes int64
+}
+
+// WriteHeader records the status code and writes it to the underlying response writer
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the number of bytes written and writes them to the underlying response writer
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// written returns the status code of the response
+func (r *responseRecorder) written() int {
+	if r.status == 0 {
+		// a hijacked connection, or a handler that wrote nothing, which net/http answers with 200
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// Flush flushes the underlying response writer, if it supports flushing
+func (r *responseRecorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying response writer so that http.ResponseController can reach it,
+// which the reverse proxy relies on to hijack upgraded connections
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logRequest writes the access log line for a served request and records it in the metrics
+func (s *ProxyServer) logRequest(r *http.Request, info *requestInfo, rec *responseRecorder, start time.Time) {
+	status := rec.written()
+	s.logger().LogAttrs(r.Context(), slog.LevelInfo, "request",
+		slog.String("method", r.Method),
+		slog.String("host", info.host),
+		slog.String("path", r.URL.Path),
+		slog.String("client_ip", s.clientIP(r)),
+		slog.String("target", info.target),
+		slog.Int("status", status),
+		slog.Int64("bytes", rec.bytes),
+		slog.Duration("duration", time.Since(start)),
+		slog.Bool("cache_hit", info.cacheHit),
+		slog.String("request_id", info.requestID),
+	)
+	s.Metrics.ObserveRequest(status)
+}
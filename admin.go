@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/balancer"
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// readinessTimeout bounds how long the readiness probe waits for the store to answer
+const readinessTimeout = time.Second
+
+// readinessTTL is how long the result of probing the store is reused, so that frequent probes of
+// /readyz do not reach the store every time
+const readinessTTL = 2 * time.Second
+
+// AdminHandler returns the handler for the admin api of the proxy server. It is kept separate from the
+// proxy handler so that it can be bound to a different listener. The metrics are served on /metrics
+// when they are enabled, and the liveness and readiness probes on /healthz and /readyz. When the proxy
+// server has an AdminToken, every request but the probes must carry it as a bearer token
+func AdminHandler(proxyServer *ProxyServer) http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /admin/cache", listCacheHandler(proxyServer.Cache))
+	api.HandleFunc("GET /admin/cache/stats", cacheStatsHandler(proxyServer.Cache))
+	api.HandleFunc("DELETE /admin/cache/{host}", invalidateCacheHandler(proxyServer.Cache))
+	api.HandleFunc("GET /admin/health", healthHandler(proxyServer.Cache))
+	api.HandleFunc("GET /admin/routes", routesHandler(proxyServer))
+	api.HandleFunc("PUT /admin/routes/{host}", setRouteHandler(proxyServer))
+	api.HandleFunc("DELETE /admin/routes/{host}", deleteRouteHandler(proxyServer))
+	api.HandleFunc("GET /admin/maintenance/{host}", maintenanceHandler(proxyServer))
+	api.HandleFunc("PUT /admin/maintenance/{host}", setMaintenanceHandler(proxyServer, true))
+	api.HandleFunc("DELETE /admin/maintenance/{host}", setMaintenanceHandler(proxyServer, false))
+	api.HandleFunc("GET /admin/drain/{host}", drainHandler(proxyServer))
+	api.HandleFunc("PUT /admin/drain/{host}", setDrainHandler(proxyServer, true))
+	api.HandleFunc("DELETE /admin/drain/{host}", setDrainHandler(proxyServer, false))
+	if proxyServer.Metrics != nil {
+		api.Handle("GET /metrics", proxyServer.Metrics.Handler())
+	}
+
+	// the probes stay open so that orchestrators can reach them without the token
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", livenessHandler)
+	mux.Handle("GET /readyz", &readinessHandler{proxyServer: proxyServer})
+	mux.Handle("/", requireBearerToken(proxyServer.AdminToken, api))
+	return mux
+}
+
+// requireBearerToken answers 401 Unauthorized to the requests that do not carry the token in an
+// "Authorization: Bearer" header, and passes the others to next. The tokens are compared in constant time.
+// If the token is empty, all requests are passed to next
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	// comparing digests keeps the comparison constant-time regardless of the length of the sent token
+	want := sha256.Sum256([]byte(token))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, sent, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		got := sha256.Sum256([]byte(sent))
+		if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="proxy-host admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// livenessHandler answers 200 OK for as long as the process is able to serve requests
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readinessHandler answers 200 OK once the proxy server has a store and that store is reachable, and 503
+// Service Unavailable otherwise. Stores that cannot become unreachable, such as a MemoryStore, are always
+// ready. The result of probing the store is reused for readinessTTL
+type readinessHandler struct {
+	// proxyServer is the proxy server whose store is probed
+	proxyServer *ProxyServer
+	// mutex is used to synchronize access to the fields below and lets a single request probe at a time
+	mutex sync.Mutex
+	// checkedAt is when the store was last probed
+	checkedAt time.Time
+	// err is the result of the last probe
+	err error
+}
+
+// ServeHTTP writes the readiness of the proxy server
+func (h *readinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.check(r.Context()); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// check returns why the proxy server is not ready, or nil if it is
+func (h *readinessHandler) check(ctx context.Context) error {
+	hostStore := h.proxyServer.Store
+	if hostStore == nil {
+		return errors.New("routes not loaded")
+	}
+	pinger, ok := hostStore.(store.Pinger)
+	if !ok {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.checkedAt.IsZero() && time.Since(h.checkedAt) < readinessTTL {
+		return h.err
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	h.err = pinger.Ping(ctx)
+	h.checkedAt = time.Now()
+	return h.err
+}
+
+// listCacheHandler writes the hosts that currently have a cached proxy as a json array
+func listCacheHandler(proxyCache *cache.TypedCache[*Upstream]) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hosts := proxyCache.Keys()
+		sort.Strings(hosts)
+		writeJSON(w, http.StatusOK, hosts)
+	}
+}
+
+// cacheStatsHandler writes the hit, miss, set, delete and eviction counters and the size of the proxy cache as
+// json
+func cacheStatsHandler(proxyCache *cache.TypedCache[*Upstream]) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, proxyCache.Stats())
+	}
+}
+
+// invalidateCacheHandler removes the cached proxy for a host, and those of its path rules, so that it is
+// re-resolved on the next request. A wildcard such as *.example.com removes all the cached subdomains of
+// example.com at once
+func invalidateCacheHandler(proxyCache *cache.TypedCache[*Upstream]) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if invalidateHost(proxyCache, normalizeHost(r.PathValue("host"))) == 0 {
+			http.Error(w, "host not cached", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// invalidateHost removes the cached upstreams of the host and of its path rules, or of all the subdomains of
+// a wildcard such as *.example.com, and returns the number of cache entries removed
+func invalidateHost(proxyCache *cache.TypedCache[*Upstream], host string) int {
+	if domain, ok := strings.CutPrefix(host, "*."); ok {
+		return proxyCache.DeleteMatching(func(key string) bool {
+			keyHost, _, _ := strings.Cut(key, "/")
+			return strings.HasSuffix(keyHost, "."+domain)
+		})
+	}
+	return proxyCache.DeleteMatching(func(key string) bool {
+		return key == host || strings.HasPrefix(key, host+"/")
+	})
+}
+
+// healthHandler writes the health of the targets of each cached host as json
+func healthHandler(proxyCache *cache.TypedCache[*Upstream]) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := make(map[string][]balancer.TargetHealth)
+		for _, host := range proxyCache.Keys() {
+			if upstream, ok := proxyCache.Get(host); ok && upstream.Balancer != nil {
+				health[host] = upstream.Balancer.Health()
+			}
+		}
+		writeJSON(w, http.StatusOK, health)
+	}
+}
+
+// maintenanceStatus is the maintenance mode of a host as written by maintenanceHandler
+type maintenanceStatus struct {
+	// Host is the host the maintenance mode applies to
+	Host string `json:"host"`
+	// Maintenance is true when the requests of the host are answered with the maintenance page
+	Maintenance bool `json:"maintenance"`
+}
+
+// maintenanceHandler writes whether a host is in maintenance as json. Hosts without a route get 404 Not Found
+// unless they were put in maintenance
+func maintenanceHandler(proxyServer *ProxyServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := normalizeHost(r.PathValue("host"))
+		maintenance, err := proxyServer.InMaintenance(host)
+		if errors.Is(err, store.ErrHostNotFound) {
+			http.Error(w, "host not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("failed to lookup host %s: %v", host, err)
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, maintenanceStatus{Host: host, Maintenance: maintenance})
+	}
+}
+
+// setMaintenanceHandler puts a host in maintenance, or takes it out of it if enabled is false, and writes its
+// new maintenance status as json. The change lasts until the proxy is restarted, see SetMaintenance
+func setMaintenanceHandler(proxyServer *ProxyServer, enabled bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := normalizeHost(r.PathValue("host"))
+		if host == "" {
+			http.Error(w, "invalid host", http.StatusBadRequest)
+			return
+		}
+		proxyServer.SetMaintenance(host, enabled)
+		writeJSON(w, http.StatusOK, maintenanceStatus{Host: host, Maintenance: enabled})
+	}
+}
+
+// maxRouteUpdateBytes is the largest body accepted by setRouteHandler
+const maxRouteUpdateBytes = 1 << 20
+
+// routeUpdate is the json body of a request configuring the route of a host through the admin api
+type routeUpdate struct {
+	// Target is the url of the upstream target. It may be combined with Targets
+	Target string `json:"target"`
+	// Targets contains the urls of several upstream targets to balance requests across
+	Targets []string `json:"targets"`
+}
+
+// setRouteHandler configures the route of a host or wildcard pattern to the targets of a json routeUpdate,
+// answering 201 Created for a new host and 200 OK for a replaced route, and removes the cached upstreams the
+// old route was resolved to. Stores whose routes cannot be changed get 501 Not Implemented. Routes of a
+// config file are replaced by those of the file when it is reloaded
+func setRouteHandler(proxyServer *ProxyServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writer, ok := proxyServer.Store.(store.RouteWriter)
+		if !ok {
+			http.Error(w, "store cannot change routes", http.StatusNotImplemented)
+			return
+		}
+		host := normalizeHost(r.PathValue("host"))
+		if !validRouteHost(host) {
+			http.Error(w, "invalid host", http.StatusBadRequest)
+			return
+		}
+		var update routeUpdate
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRouteUpdateBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("invalid route: %v", err), http.StatusBadRequest)
+			return
+		}
+		rawURLs := update.Targets
+		if update.Target != "" {
+			rawURLs = append([]string{update.Target}, rawURLs...)
+		}
+		if len(rawURLs) == 0 {
+			http.Error(w, "invalid route: missing target", http.StatusBadRequest)
+			return
+		}
+		route := &store.Route{}
+		status := routeStatus{Host: host}
+		for _, rawURL := range rawURLs {
+			target, err := store.ParseTarget(rawURL)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid target: %v", err), http.StatusBadRequest)
+				return
+			}
+			route.Targets = append(route.Targets, target)
+			status.Targets = append(status.Targets, target.String())
+		}
+
+		code := http.StatusOK
+		if lister, ok := proxyServer.Store.(store.RouteLister); ok {
+			if routes, err := lister.Routes(); err == nil && routes[host] == nil {
+				code = http.StatusCreated
+			}
+		}
+		writer.Set(host, route)
+		invalidateHost(proxyServer.Cache, host)
+		writeJSON(w, code, status)
+	}
+}
+
+// deleteRouteHandler removes the route of a host or wildcard pattern and the cached upstreams it was resolved
+// to, answering 404 Not Found if the host has no route of its own
+func deleteRouteHandler(proxyServer *ProxyServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writer, ok := proxyServer.Store.(store.RouteWriter)
+		if !ok {
+			http.Error(w, "store cannot change routes", http.StatusNotImplemented)
+			return
+		}
+		host := normalizeHost(r.PathValue("host"))
+		if !writer.Delete(host) {
+			http.Error(w, "host not configured", http.StatusNotFound)
+			return
+		}
+		invalidateHost(proxyServer.Cache, host)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// validRouteHost reports whether a route may be configured for the host, which must be a host name or a
+// wildcard pattern whose only "*" is its leading label, such as *.example.com
+func validRouteHost(host string) bool {
+	name := strings.TrimPrefix(host, "*.")
+	return name != "" && !strings.ContainsAny(name, "*/ ")
+}
+
+// drainStatus is the drain state of a host as written by drainHandler
+type drainStatus struct {
+	// Host is the host the drain state applies to
+	Host string `json:"host"`
+	// Draining is true when the new requests of the host are rejected
+	Draining bool `json:"draining"`
+	// InFlight is the number of requests proxied before the host started draining that are still in flight
+	InFlight int64 `json:"in_flight"`
+}
+
+// drainHandler writes whether a host is draining and how many of its requests are still in flight as json
+func drainHandler(proxyServer *ProxyServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := normalizeHost(r.PathValue("host"))
+		draining, inFlight := proxyServer.DrainStatus(host)
+		writeJSON(w, http.StatusOK, drainStatus{Host: host, Draining: draining, InFlight: inFlight})
+	}
+}
+
+// setDrainHandler starts draining a host, or stops if enabled is false, and writes its new drain status as
+// json. The change lasts until the proxy is restarted, see Drain
+func setDrainHandler(proxyServer *ProxyServer, enabled bool) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := normalizeHost(r.PathValue("host"))
+		if host == "" {
+			http.Error(w, "invalid host", http.StatusBadRequest)
+			return
+		}
+		if enabled {
+			proxyServer.Drain(host)
+		} else {
+			proxyServer.Undrain(host)
+		}
+		draining, inFlight := proxyServer.DrainStatus(host)
+		writeJSON(w, http.StatusOK, drainStatus{Host: host, Draining: draining, InFlight: inFlight})
+	}
+}
+
+// routeStatus is the state of a configured route as listed by routesHandler and set by setRouteHandler
+type routeStatus struct {
+	// Host is the host or wildcard pattern the route is configured for
+	Host string `json:"host"`
+	// Targets contains the target urls of the route
+	Targets []string `json:"targets"`
+	// Cached is true when the proxy of the host is currently cached
+	Cached bool `json:"cached"`
+	// TTLSeconds is how long the cached proxy remains valid, omitted when it is not cached or never expires
+	TTLSeconds float64 `json:"ttl_seconds,omitempty"`
+	// Health contains the health of the targets of the cached proxy when health checks are enabled
+	Health []balancer.TargetHealth `json:"health,omitempty"`
+}
+
+// routesHandler writes every route configured in the store with whether its host is cached, the remaining
+// ttl of its cache entry and, when health checks are enabled, the health of its targets. Routes are written
+// as json, or as a table with ?format=text. Stores that cannot list their routes get 501 Not Implemented
+func routesHandler(proxyServer *ProxyServer) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lister, ok := proxyServer.Store.(store.RouteLister)
+		if !ok {
+			http.Error(w, "store cannot list routes", http.StatusNotImplemented)
+			return
+		}
+		routes, err := lister.Routes()
+		if err != nil {
+			log.Printf("failed to list routes: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		statuses := make([]routeStatus, 0, len(routes))
+		for host, route := range routes {
+			status := routeStatus{
+				Host:    host,
+				Targets: make([]string, 0, len(route.Targets)),
+			}
+			for _, target := range route.Targets {
+				status.Targets = append(status.Targets, target.String())
+			}
+			if upstream, expiration, ok := proxyServer.Cache.GetWithExpiration(host); ok {
+				status.Cached = true
+				if !expiration.IsZero() {
+					status.TTLSeconds = time.Until(expiration).Seconds()
+				}
+				if proxyServer.HealthCheckInterval > 0 && upstream.Balancer != nil {
+					status.Health = upstream.Balancer.Health()
+				}
+			}
+			statuses = append(statuses, status)
+		}
+		sort.Slice(statuses, func(i, j int) bool {
+			return statuses[i].Host < statuses[j].Host
+		})
+		if r.URL.Query().Get("format") == "text" {
+			writeRoutesText(w, statuses)
+			return
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	}
+}
+
+// writeRoutesText writes the route statuses as a table with one route per line
+func writeRoutesText(w http.ResponseWriter, statuses []routeStatus) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tTARGETS\tCACHED\tTTL\tHEALTHY")
+	for _, status := range statuses {
+		ttl := "-"
+		if status.TTLSeconds > 0 {
+			ttl = (time.Duration(status.TTLSeconds * float64(time.Second))).Round(time.Second).String()
+		}
+		healthy := "-"
+		if len(status.Health) > 0 {
+			count := 0
+			for _, target := range status.Health {
+				if target.Healthy {
+					count++
+				}
+			}
+			healthy = fmt.Sprintf("%d/%d", count, len(status.Health))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", status.Host, strings.Join(status.Targets, ","), status.Cached, ttl, healthy)
+	}
+	if err := tw.Flush(); err != nil {
+		log.Printf("failed to write routes: %v", err)
+	}
+}
+
+// writeJSON writes v to the response as json with the specified status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write json response: %v", err)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/metrics"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// newTestUpstream creates an upstream that answers every request with 200 and the specified body
+func newTestUpstream(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestAdminCache(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	admin := AdminHandler(s)
+	serve(s, http.MethodGet, "example.com", "/")
+
+	rec := serve(admin, http.MethodGet, "admin", "/admin/cache")
+	var hosts []string
+	if err := json.NewDecoder(rec.Body).Decode(&hosts); err != nil {
+		t.Fatalf("failed to decode hosts: %v", err)
+	}
+	if len(hosts) != 1 || hosts[0] != "example.com" {
+		t.Errorf("cached hosts = %v, want [example.com]", hosts)
+	}
+
+	if rec := serve(admin, http.MethodDelete, "admin", "/admin/cache/example.com"); rec.Code != http.StatusNoContent {
+		t.Errorf("delete cached host: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if rec := serve(admin, http.MethodDelete, "admin", "/admin/cache/example.com"); rec.Code != http.StatusNotFound {
+		t.Errorf("delete uncached host: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminCacheStats(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	serve(s, http.MethodGet, "example.com", "/")
+	serve(s, http.MethodGet, "example.com", "/")
+
+	rec := serve(AdminHandler(s), http.MethodGet, "admin", "/admin/cache/stats")
+	var stats cache.Stats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Sets != 1 {
+		t.Errorf("stats = %+v, want 1 hit, 1 miss and 1 set", stats)
+	}
+}
+
+func TestAdminCacheDeletesPathUpstreams(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets: []*url.URL{mustParseURL(t, upstream.URL)},
+			Paths:   []*store.PathRule{{Prefix: "/api", Targets: []*url.URL{mustParseURL(t, upstream.URL)}}},
+		},
+	})
+	serve(s, http.MethodGet, "example.com", "/api")
+	if n := s.Cache.Len(); n != 2 {
+		t.Fatalf("cache has %d entries, want the host and its path", n)
+	}
+	if rec := serve(AdminHandler(s), http.MethodDelete, "admin", "/admin/cache/example.com"); rec.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if keys := s.Cache.Keys(); len(keys) != 0 {
+		t.Errorf("cache keys after delete = %v, want none", keys)
+	}
+}
+
+func TestAdminCacheDeletesSubdomains(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	route := &store.Route{
+		Targets: []*url.URL{mustParseURL(t, upstream.URL)},
+		Paths:   []*store.PathRule{{Prefix: "/api", Targets: []*url.URL{mustParseURL(t, upstream.URL)}}},
+	}
+	s := newTestServer(t, map[string]*store.Route{
+		"*.example.com": route,
+		"example.com":   route,
+	})
+	for _, host := range []string{"a.example.com", "b.example.com", "example.com"} {
+		serve(s, http.MethodGet, host, "/api")
+	}
+	admin := AdminHandler(s)
+	if rec := serve(admin, http.MethodDelete, "admin", "/admin/cache/*.example.com"); rec.Code != http.StatusNoContent {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	keys := s.Cache.Keys()
+	sort.Strings(keys)
+	if want := []string{"example.com", "example.com/api"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("cache keys after delete = %v, want %v", keys, want)
+	}
+	if rec := serve(admin, http.MethodDelete, "admin", "/admin/cache/*.example.com"); rec.Code != http.StatusNotFound {
+		t.Errorf("delete uncached subdomains: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	if rec := serve(AdminHandler(s), http.MethodGet, "admin", "/metrics"); rec.Code != http.StatusNotFound {
+		t.Errorf("metrics disabled: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	s.Metrics = metrics.New()
+	serve(s, http.MethodGet, "example.com", "/")
+	serve(s, http.MethodGet, "example.com", "/")
+	serve(s, http.MethodGet, "unknown.example.com", "/")
+	rec := serve(AdminHandler(s), http.MethodGet, "admin", "/metrics")
+	body := rec.Body.String()
+	for _, want := range []string{
+		`proxy_host_requests_total{code="2xx"} 2`,
+		`proxy_host_requests_total{code="4xx"} 1`,
+		"proxy_host_cache_hits_total 1",
+		"proxy_host_cache_misses_total 1",
+		"proxy_host_upstream_duration_seconds_count 2",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
+
+// lookupOnlyStore is a HostStore that cannot list its routes
+type lookupOnlyStore struct{}
+
+// Lookup reports every host as not found
+func (lookupOnlyStore) Lookup(host string) (*store.Route, error) {
+	return nil, store.ErrHostNotFound
+}
+
+func TestAdminRoutes(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com":   {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"*.example.com": {Targets: []*url.URL{mustParseURL(t, "http://*.internal")}},
+	})
+	s.HealthCheckInterval = time.Hour
+	serve(s, http.MethodGet, "example.com", "/")
+
+	rec := serve(AdminHandler(s), http.MethodGet, "admin", "/admin/routes")
+	var routes []routeStatus
+	if err := json.NewDecoder(rec.Body).Decode(&routes); err != nil {
+		t.Fatalf("failed to decode routes: %v", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2", len(routes))
+	}
+	wildcard, cached := routes[0], routes[1]
+	if wildcard.Host != "*.example.com" || wildcard.Cached || wildcard.TTLSeconds != 0 || len(wildcard.Health) != 0 {
+		t.Errorf("uncached route = %+v", wildcard)
+	}
+	if cached.Host != "example.com" || !cached.Cached || len(cached.Targets) != 1 || cached.Targets[0] != upstream.URL {
+		t.Errorf("cached route = %+v", cached)
+	}
+	if cached.TTLSeconds <= 0 || cached.TTLSeconds > time.Minute.Seconds() {
+		t.Errorf("cached route ttl = %v, want up to a minute", cached.TTLSeconds)
+	}
+	if len(cached.Health) != 1 || !cached.Health[0].Healthy {
+		t.Errorf("cached route health = %+v, want one healthy target", cached.Health)
+	}
+}
+
+func TestAdminRoutesWithoutHealthChecks(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.HealthCheckInterval = 0
+	serve(s, http.MethodGet, "example.com", "/")
+	rec := serve(AdminHandler(s), http.MethodGet, "admin", "/admin/routes")
+	if strings.Contains(rec.Body.String(), "health") {
+		t.Errorf("routes include health without health checks: %s", rec.Body.String())
+	}
+}
+
+func TestAdminRoutesText(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com":      {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"idle.example.com": {Targets: []*url.URL{mustParseURL(t, "http://10.0.0.1")}},
+	})
+	serve(s, http.MethodGet, "example.com", "/")
+	rec := serve(AdminHandler(s), http.MethodGet, "admin", "/admin/routes?format=text")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "HOST") {
+		t.Fatalf("text routes = %q, want a header and 2 routes", rec.Body.String())
+	}
+	if fields := strings.Fields(lines[1]); len(fields) != 5 || fields[0] != "example.com" || fields[2] != "true" || fields[3] != "1m0s" {
+		t.Errorf("cached route line = %q", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); len(fields) != 5 || fields[0] != "idle.example.com" || fields[2] != "false" || fields[3] != "-" {
+		t.Errorf("uncached route line = %q", lines[2])
+	}
+}
+
+func TestAdminRoutesUnsupportedStore(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.Store = lookupOnlyStore{}
+	if rec := serve(AdminHandler(s), http.MethodGet, "admin", "/admin/routes"); rec.Code != http.StatusNotImplemented {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+}
+
+// sendJSON sends a request with the json body through the handler and returns the recorded response
+func sendJSON(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminSetRoute(t *testing.T) {
+	first := newTestUpstream(t, "first")
+	second := newTestUpstream(t, "second")
+	s := newTestServer(t, nil)
+	admin := AdminHandler(s)
+
+	rec := sendJSON(admin, http.MethodPut, "/admin/routes/App.Example.com", fmt.Sprintf(`{"target": %q}`, first.URL))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var status routeStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode route: %v", err)
+	}
+	if status.Host != "app.example.com" || len(status.Targets) != 1 || status.Targets[0] != first.URL {
+		t.Errorf("created route = %+v", status)
+	}
+	if rec := serve(s, http.MethodGet, "app.example.com", "/"); rec.Body.String() != "first" {
+		t.Fatalf("proxied to %q, want the created route", rec.Body.String())
+	}
+
+	// replacing the route flushes the cached upstream of the old one
+	rec = sendJSON(admin, http.MethodPut, "/admin/routes/app.example.com", fmt.Sprintf(`{"targets": [%q]}`, second.URL))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("replace: status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := serve(s, http.MethodGet, "app.example.com", "/"); rec.Body.String() != "second" {
+		t.Errorf("proxied to %q after the route was replaced, want the new target", rec.Body.String())
+	}
+
+	if rec := serve(admin, http.MethodDelete, "admin", "/admin/routes/app.example.com"); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if _, found := s.Cache.Get("app.example.com"); found {
+		t.Error("the upstream of the deleted route is still cached")
+	}
+	if rec := serve(s, http.MethodGet, "app.example.com", "/"); rec.Code != http.StatusNotFound {
+		t.Errorf("status after delete = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := serve(admin, http.MethodDelete, "admin", "/admin/routes/app.example.com"); rec.Code != http.StatusNotFound {
+		t.Errorf("delete of a missing route: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestAdminSetWildcardRoute(t *testing.T) {
+	first := newTestUpstream(t, "first")
+	second := newTestUpstream(t, "second")
+	s := newTestServer(t, map[string]*store.Route{
+		"*.example.com": {Targets: []*url.URL{mustParseURL(t, first.URL)}},
+	})
+	serve(s, http.MethodGet, "a.example.com", "/")
+	rec := sendJSON(AdminHandler(s), http.MethodPut, "/admin/routes/*.example.com", fmt.Sprintf(`{"target": %q}`, second.URL))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := serve(s, http.MethodGet, "a.example.com", "/"); rec.Body.String() != "second" {
+		t.Errorf("subdomain proxied to %q after its wildcard route was replaced, want the new target", rec.Body.String())
+	}
+}
+
+func TestAdminSetRouteInvalid(t *testing.T) {
+	s := newTestServer(t, nil)
+	admin := AdminHandler(s)
+	tests := []struct {
+		path, body, want string
+	}{
+		{"/admin/routes/example.com", `{"target": "example.com"}`, "invalid target"},
+		{"/admin/routes/example.com", `{"target": "ftp://example.com"}`, "invalid target"},
+		{"/admin/routes/example.com", `{}`, "missing target"},
+		{"/admin/routes/example.com", `{"target": "http://10.0.0.1", "timeout": "5s"}`, "unknown field"},
+		{"/admin/routes/example.com", `not json`, "invalid route"},
+		{"/admin/routes/a.*.example.com", `{"target": "http://10.0.0.1"}`, "invalid host"},
+	}
+	for _, test := range tests {
+		rec := sendJSON(admin, http.MethodPut, test.path, test.body)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), test.want) {
+			t.Errorf("PUT %s %s: got %d %q, want 400 with %q", test.path, test.body, rec.Code, rec.Body.String(), test.want)
+		}
+	}
+	if routes, _ := s.Store.(store.RouteLister).Routes(); len(routes) != 0 {
+		t.Errorf("invalid requests configured routes %v", routes)
+	}
+}
+
+func TestAdminSetRouteUnsupportedStore(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.Store = lookupOnlyStore{}
+	admin := AdminHandler(s)
+	if rec := sendJSON(admin, http.MethodPut, "/admin/routes/example.com", `{"target": "http://10.0.0.1"}`); rec.Code != http.StatusNotImplemented {
+		t.Errorf("PUT status = %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+	if rec := serve(admin, http.MethodDelete, "admin", "/admin/routes/example.com"); rec.Code != http.StatusNotImplemented {
+		t.Errorf("DELETE status = %d, want %d", rec.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestAdminBearerToken(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.Metrics = metrics.New()
+	s.AdminToken = "secret"
+	admin := AdminHandler(s)
+	tests := []struct {
+		path, authorization string
+		want                int
+	}{
+		{"/admin/cache", "", http.StatusUnauthorized},
+		{"/admin/cache", "Bearer wrong", http.StatusUnauthorized},
+		{"/admin/cache", "Bearer secret-but-longer", http.StatusUnauthorized},
+		{"/admin/cache", "Basic secret", http.StatusUnauthorized},
+		{"/admin/cache", "secret", http.StatusUnauthorized},
+		{"/admin/cache", "Bearer secret", http.StatusOK},
+		{"/admin/cache", "bearer secret", http.StatusOK},
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer secret", http.StatusOK},
+		{"/admin/unknown", "", http.StatusUnauthorized},
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("GET %s with %q: status = %d, want %d", test.path, test.authorization, rec.Code, test.want)
+		}
+		if rec.Code == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("GET %s: WWW-Authenticate = %q, want a bearer challenge", test.path, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+	rec := sendJSON(admin, http.MethodPut, "/admin/routes/example.com", `{"target": "http://10.0.0.1"}`)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated route update: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if _, err := s.Store.Lookup("example.com"); err == nil {
+		t.Error("an unauthenticated request configured a route")
+	}
+}
+
+func TestAdminWithoutToken(t *testing.T) {
+	s := newTestServer(t, nil)
+	if rec := serve(AdminHandler(s), http.MethodGet, "admin", "/admin/cache"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d without a configured token", rec.Code, http.StatusOK)
+	}
+}
+
+// pingStore is a HostStore whose pings return err, counting them
+type pingStore struct {
+	lookupOnlyStore
+	// err is returned by every ping
+	err error
+	// pings counts the pings
+	pings int
+}
+
+// Ping returns the error of the store
+func (s *pingStore) Ping(ctx context.Context) error {
+	s.pings++
+	return s.err
+}
+
+func TestAdminLiveness(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.Store = nil
+	if rec := serve(AdminHandler(s), http.MethodGet, "admin", "/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAdminReadiness(t *testing.T) {
+	s := newTestServer(t, nil)
+	admin := AdminHandler(s)
+	if rec := serve(admin, http.MethodGet, "admin", "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("memory store: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	s.Store = nil
+	if rec := serve(admin, http.MethodGet, "admin", "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("no store: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestAdminReadinessProbesStore(t *testing.T) {
+	s := newTestServer(t, nil)
+	hostStore := &pingStore{err: fmt.Errorf("failed to reach redis: %w", store.ErrUnavailable)}
+	s.Store = hostStore
+	readiness := &readinessHandler{proxyServer: s}
+	if rec := serve(readiness, http.MethodGet, "admin", "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unreachable store: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	hostStore.err = nil
+	if rec := serve(readiness, http.MethodGet, "admin", "/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("probe within the ttl: status = %d, want the cached %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if hostStore.pings != 1 {
+		t.Errorf("store was pinged %d times within the ttl, want 1", hostStore.pings)
+	}
+	readiness.checkedAt = time.Now().Add(-readinessTTL)
+	if rec := serve(readiness, http.MethodGet, "admin", "/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("recovered store: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
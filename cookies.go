@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// rewriteCookies rewrites each Set-Cookie header of a target's response for the public host as configured
+func rewriteCookies(header http.Header, host string, cookies *store.Cookies) {
+	values := header["Set-Cookie"]
+	for i, value := range values {
+		values[i] = rewriteCookie(value, host, cookies)
+	}
+}
+
+// rewriteCookie rewrites the attributes of a Set-Cookie header value, keeping the others as they are. A Domain
+// is rewritten to the host, or dropped if the host is an IP address, which a cookie cannot be scoped to
+func rewriteCookie(value, host string, cookies *store.Cookies) string {
+	parts := strings.Split(value, ";")
+	attributes := parts[:1]
+	secure, sameSite := false, false
+	for _, attribute := range parts[1:] {
+		name, _, _ := strings.Cut(attribute, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			if cookies.RewriteDomain {
+				if _, err := netip.ParseAddr(host); err == nil {
+					continue
+				}
+				attribute = " Domain=" + host
+			}
+		case "secure":
+			secure = true
+		case "samesite":
+			if cookies.SameSite != "" {
+				attribute = " SameSite=" + cookies.SameSite
+			}
+			sameSite = true
+		}
+		attributes = append(attributes, attribute)
+	}
+	if !secure && (cookies.Secure || cookies.SameSite == "None") {
+		attributes = append(attributes, " Secure")
+	}
+	if !sameSite && cookies.SameSite != "" {
+		attributes = append(attributes, " SameSite="+cookies.SameSite)
+	}
+	return strings.Join(attributes, ";")
+}
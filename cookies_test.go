@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+func TestRewriteCookie(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		host    string
+		cookies *store.Cookies
+		want    string
+	}{
+		{
+			"domain",
+			"session=abc; Path=/; Domain=app.internal.svc; HttpOnly",
+			"example.com",
+			&store.Cookies{RewriteDomain: true},
+			"session=abc; Path=/; Domain=example.com; HttpOnly",
+		},
+		{
+			"domain attribute case",
+			"session=abc; domain=.internal.svc",
+			"www.example.com",
+			&store.Cookies{RewriteDomain: true},
+			"session=abc; Domain=www.example.com",
+		},
+		{
+			"host-only cookie",
+			"session=abc; Path=/",
+			"example.com",
+			&store.Cookies{RewriteDomain: true},
+			"session=abc; Path=/",
+		},
+		{
+			"ip host drops the domain",
+			"session=abc; Domain=app.internal.svc; Path=/",
+			"203.0.113.7",
+			&store.Cookies{RewriteDomain: true},
+			"session=abc; Path=/",
+		},
+		{
+			"domain left without rewrite",
+			"session=abc; Domain=app.internal.svc",
+			"example.com",
+			&store.Cookies{Secure: true},
+			"session=abc; Domain=app.internal.svc; Secure",
+		},
+		{
+			"secure already set",
+			"session=abc; Secure",
+			"example.com",
+			&store.Cookies{Secure: true},
+			"session=abc; Secure",
+		},
+		{
+			"same site added",
+			"session=abc",
+			"example.com",
+			&store.Cookies{SameSite: "Lax"},
+			"session=abc; SameSite=Lax",
+		},
+		{
+			"same site replaced",
+			"session=abc; SameSite=None; Secure",
+			"example.com",
+			&store.Cookies{SameSite: "Strict"},
+			"session=abc; SameSite=Strict; Secure",
+		},
+		{
+			"same site none implies secure",
+			"session=abc",
+			"example.com",
+			&store.Cookies{SameSite: "None"},
+			"session=abc; Secure; SameSite=None",
+		},
+		{
+			"value with an equals sign",
+			"token=a=b; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Domain=internal",
+			"example.com",
+			&store.Cookies{RewriteDomain: true},
+			"token=a=b; Expires=Wed, 21 Oct 2026 07:28:00 GMT; Domain=example.com",
+		},
+	}
+	for _, test := range tests {
+		if got := rewriteCookie(test.value, test.host, test.cookies); got != test.want {
+			t.Errorf("%s: rewriteCookie(%q) = %q, want %q", test.name, test.value, got, test.want)
+		}
+	}
+}
+
+func TestProxyServerRewritesCookies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=app.internal.svc; Path=/")
+		w.Header().Add("Set-Cookie", "theme=dark; Domain=.internal.svc")
+		w.Header().Add("Set-Cookie", "local=1")
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets: []*url.URL{mustParseURL(t, upstream.URL)},
+			Cookies: &store.Cookies{RewriteDomain: true, Secure: true},
+		},
+		"plain.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+
+	rec := serve(s, http.MethodGet, "Example.com:8443", "/")
+	want := []string{
+		"session=abc; Domain=example.com; Path=/; Secure",
+		"theme=dark; Domain=example.com; Secure",
+		"local=1; Secure",
+	}
+	if got := rec.Header().Values("Set-Cookie"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Set-Cookie = %q, want %q", got, want)
+	}
+	rec = serve(s, http.MethodGet, "plain.example.com", "/")
+	if got := rec.Header().Values("Set-Cookie"); len(got) != 3 || got[0] != "session=abc; Domain=app.internal.svc; Path=/" {
+		t.Errorf("Set-Cookie of a host without cookie rewriting = %q, want them unchanged", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// applyCORS applies the CORS policy of a host to a request. Preflight requests are answered with 204 No
+// Content, carrying the allowed methods and headers if the origin is allowed, and true is returned. Other
+// requests from an allowed origin get a response writer that adds the CORS headers to the response unless
+// the target set its own
+func applyCORS(w http.ResponseWriter, r *http.Request, cors *store.CORS) (http.ResponseWriter, bool) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return w, false
+	}
+	// the response depends on the origin, so shared caches must not serve it to other origins
+	w.Header().Add("Vary", "Origin")
+	allowed := cors.AllowsOrigin(origin)
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		if allowed {
+			header := w.Header()
+			setAllowOrigin(header, origin, cors)
+			header.Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+			if len(cors.AllowedHeaders) > 0 {
+				header.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			}
+			if cors.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return w, true
+	}
+	if !allowed {
+		return w, false
+	}
+	return &corsWriter{
+		ResponseWriter: w,
+		origin:         origin,
+		cors:           cors,
+	}, false
+}
+
+// setAllowOrigin allows the origin to read the response
+func setAllowOrigin(header http.Header, origin string, cors *store.CORS) {
+	header.Set("Access-Control-Allow-Origin", origin)
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// corsWriter is an http.ResponseWriter that adds the CORS headers for an allowed origin to the response when
+// its header is written, unless the response already carries Access-Control-Allow-Origin
+type corsWriter struct {
+	http.ResponseWriter
+	// origin is the allowed origin of the request
+	origin string
+	// cors is the policy of the host
+	cors *store.CORS
+	// wroteHeader is true once the header has been written
+	wroteHeader bool
+}
+
+// WriteHeader adds the CORS headers and writes the status code to the underlying response writer
+func (c *corsWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		if c.Header().Get("Access-Control-Allow-Origin") == "" {
+			setAllowOrigin(c.Header(), c.origin, c.cors)
+		}
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the header, if it was not written yet, and then the body to the underlying response writer
+func (c *corsWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying response writer, if it supports flushing
+func (c *corsWriter) Flush() {
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying response writer so that http.ResponseController can reach it
+func (c *corsWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
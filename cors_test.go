@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// newCORSTestServer creates a proxy server for example.com with a CORS policy allowing https://app.example.com,
+// proxying to an upstream that answers with the specified handler
+func newCORSTestServer(t *testing.T, handler http.HandlerFunc) *ProxyServer {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	return newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets: []*url.URL{mustParseURL(t, upstream.URL)},
+			CORS: &store.CORS{
+				AllowedOrigins:   []string{"https://app.example.com"},
+				AllowedMethods:   []string{"GET", "PUT"},
+				AllowedHeaders:   []string{"Content-Type", "X-Token"},
+				AllowCredentials: true,
+				MaxAge:           10 * time.Minute,
+			},
+		},
+	})
+}
+
+// serveOrigin sends a request from the origin through the handler and returns the recorded response
+func serveOrigin(handler http.Handler, method, origin string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/", nil)
+	req.Host = "example.com"
+	req.Header.Set("Origin", origin)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSPreflight(t *testing.T) {
+	reached := false
+	s := newCORSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})
+	rec := serveOrigin(s, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method":  "PUT",
+		"Access-Control-Request-Headers": "x-token",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if reached {
+		t.Error("preflight request was forwarded to the upstream")
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "Content-Type, X-Token",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+		"Vary":                             "Origin",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestCORSPreflightDisallowedOrigin(t *testing.T) {
+	s := newCORSTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	rec := serveOrigin(s, http.MethodOptions, "https://evil.example.com", map[string]string{
+		"Access-Control-Request-Method": "PUT",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Methods %q", got)
+	}
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	s := newCORSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	rec := serveOrigin(s, http.MethodGet, "https://app.example.com", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("response = %d %q, want the upstream response", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the reflected origin", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want true", got)
+	}
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	s := newCORSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	rec := serveOrigin(s, http.MethodGet, "https://evil.example.com", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Vary = %q, want Origin", got)
+	}
+}
+
+func TestCORSKeepsUpstreamHeaders(t *testing.T) {
+	s := newCORSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write([]byte("ok"))
+	})
+	rec := serveOrigin(s, http.MethodGet, "https://app.example.com", nil)
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the upstream's *", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q was added to the upstream's CORS headers", got)
+	}
+}
+
+func TestCORSOptionsWithoutPreflightIsForwarded(t *testing.T) {
+	reached := false
+	s := newCORSTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	})
+	serveOrigin(s, http.MethodOptions, "https://app.example.com", nil)
+	if !reached {
+		t.Error("OPTIONS request that is not a preflight was not forwarded")
+	}
+}
+
+func TestCORSPreflightBeforeBasicAuth(t *testing.T) {
+	s := newCORSTestServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	route, _ := s.Store.Lookup("example.com")
+	route.BasicAuth = &store.BasicAuth{Realm: "example.com", Users: map[string][]byte{}}
+	rec := serveOrigin(s, http.MethodOptions, "https://app.example.com", map[string]string{
+		"Access-Control-Request-Method": "GET",
+	})
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("preflight of an authenticated host: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+	rec = serveOrigin(s, http.MethodGet, "https://app.example.com", nil)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Errorf("unauthenticated request = %d with Access-Control-Allow-Origin %q, want 401 readable by the origin", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
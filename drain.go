@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// drainingHosts holds the hosts being drained: their new requests are rejected while the requests already
+// proxied with their upstreams finish
+type drainingHosts struct {
+	// mutex is used to synchronize access to hosts
+	mutex sync.RWMutex
+	// hosts maps each draining host to the upstreams that were cached for it when it started draining
+	hosts map[string][]*Upstream
+}
+
+// draining reports whether the host is being drained
+func (d *drainingHosts) draining(host string) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	_, found := d.hosts[host]
+	return found
+}
+
+// inFlight returns the number of requests still being proxied with the upstreams the host had when it
+// started draining, and whether it is draining at all
+func (d *drainingHosts) inFlight(host string) (int64, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	upstreams, found := d.hosts[host]
+	var count int64
+	for _, upstream := range upstreams {
+		count += upstream.active.Load()
+	}
+	return count, found
+}
+
+// Drain starts draining the host, as when its targets are being replaced: new requests are answered with
+// 503 Service Unavailable while those in flight finish. The cached upstreams of the host are removed, so
+// that the host gets new ones once it is undrained. See DrainStatus for the requests still in flight
+func (s *ProxyServer) Drain(host string) {
+	host = normalizeHost(host)
+	var upstreams []*Upstream
+	s.Cache.Range(func(key string, upstream *Upstream) bool {
+		if key == host || strings.HasPrefix(key, host+"/") {
+			upstreams = append(upstreams, upstream)
+		}
+		return true
+	})
+	s.draining.mutex.Lock()
+	if s.draining.hosts == nil {
+		s.draining.hosts = make(map[string][]*Upstream)
+	}
+	s.draining.hosts[host] = append(s.draining.hosts[host], upstreams...)
+	s.draining.mutex.Unlock()
+	// requests are rejected from now on, so the upstreams cached for the host are not used again
+	invalidateHost(s.Cache, host)
+}
+
+// Undrain stops draining the host, whose next request builds a new upstream from its current route. Any
+// upstream cached while the host was draining is removed
+func (s *ProxyServer) Undrain(host string) {
+	host = normalizeHost(host)
+	s.draining.mutex.Lock()
+	delete(s.draining.hosts, host)
+	s.draining.mutex.Unlock()
+	invalidateHost(s.Cache, host)
+}
+
+// DrainStatus reports whether the host is being drained and, if so, how many of the requests proxied before
+// it started draining are still in flight
+func (s *ProxyServer) DrainStatus(host string) (draining bool, inFlight int64) {
+	inFlight, draining = s.draining.inFlight(normalizeHost(host))
+	return draining, inFlight
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+func TestProxyServerDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	cached, found := s.Cache.Get("example.com")
+	if !found {
+		t.Fatal("expected the upstream to be cached")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx)
+		req.Host = "example.com"
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		slow <- rec
+	}()
+	select {
+	case <-started:
+	case <-ctx.Done():
+		t.Fatal("the slow request did not reach the upstream")
+	}
+
+	s.Drain("example.com")
+	if draining, inFlight := s.DrainStatus("example.com"); !draining || inFlight != 1 {
+		t.Errorf("DrainStatus = %t, %d, want true, 1", draining, inFlight)
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status while draining = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if _, found := s.Cache.Get("example.com"); found {
+		t.Error("expected the cached upstream to be removed once the host is draining")
+	}
+
+	close(release)
+	if rec := <-slow; rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("in-flight request = %d %q, want %d %q", rec.Code, rec.Body.String(), http.StatusOK, "ok")
+	}
+	if _, inFlight := s.DrainStatus("example.com"); inFlight != 0 {
+		t.Errorf("in flight after completion = %d, want 0", inFlight)
+	}
+
+	s.Undrain("example.com")
+	if draining, _ := s.DrainStatus("example.com"); draining {
+		t.Error("expected the host to stop draining")
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("status after undrain = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if upstream, _ := s.Cache.Get("example.com"); upstream == cached {
+		t.Error("expected a new upstream after undrain, the one cached before draining was reused")
+	}
+}
+
+func TestProxyServerDrainOtherHosts(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	target := mustParseURL(t, upstream.URL)
+	s := newTestServer(t, map[string]*store.Route{
+		"a.example.com": {Targets: []*url.URL{target}},
+		"b.example.com": {Targets: []*url.URL{target}},
+	})
+	s.Drain("A.example.com")
+	if rec := serve(s, http.MethodGet, "a.example.com", "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("drained host status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec := serve(s, http.MethodGet, "b.example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("other host status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	admin := AdminHandler(s)
+
+	decode := func(rec *httptest.ResponseRecorder) drainStatus {
+		t.Helper()
+		var status drainStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+
+	rec := serve(admin, http.MethodPut, "admin", "/admin/drain/example.com")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if status := decode(rec); status.Host != "example.com" || !status.Draining {
+		t.Errorf("PUT status = %+v, want example.com draining", status)
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("proxied status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	rec = serve(admin, http.MethodGet, "admin", "/admin/drain/example.com")
+	if status := decode(rec); !status.Draining || status.InFlight != 0 {
+		t.Errorf("GET status = %+v, want draining with nothing in flight", status)
+	}
+
+	rec = serve(admin, http.MethodDelete, "admin", "/admin/drain/example.com")
+	if status := decode(rec); status.Draining {
+		t.Errorf("DELETE status = %+v, want not draining", status)
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("proxied status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrorPageData is the data the error page templates of a proxy server are executed with
+type ErrorPageData struct {
+	// Host is the host the request was sent to
+	Host string
+	// Status is the status code of the response
+	Status int
+	// StatusText is the text of the status code, such as "Bad Gateway"
+	StatusText string
+	// Message is the plain text message the proxy would otherwise have responded with
+	Message string
+	// RequestID is the ID of the request, if request IDs are enabled
+	RequestID string
+}
+
+// LoadErrorPages parses the error page templates in the directory, whose files are named after the status
+// they are rendered for, such as 404.html. Other files are ignored
+func LoadErrorPages(dir string) (map[int]*template.Template, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read error pages: %w", err)
+	}
+	pages := make(map[int]*template.Template)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".html")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		status, err := strconv.Atoi(name)
+		if err != nil || status < 400 || status > 599 {
+			continue
+		}
+		page, err := template.ParseFiles(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("invalid error page %s: %w", entry.Name(), err)
+		}
+		pages[status] = page
+	}
+	return pages, nil
+}
+
+// serveError writes an error response generated by the proxy with the error page configured for the status,
+// or as plain text with the message if there is none
+func (s *ProxyServer) serveError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	page := s.ErrorPages[status]
+	if page == nil {
+		http.Error(w, message, status)
+		return
+	}
+	data := ErrorPageData{
+		Host:       normalizeHost(r.Host),
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+	}
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		data.Host = info.host
+		data.RequestID = info.requestID
+	}
+	// the page is rendered before anything is written, so that a failing template still gets a response
+	var body bytes.Buffer
+	if err := page.Execute(&body, data); err != nil {
+		s.logger().Error("failed to render error page", "status", status, "error", err)
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
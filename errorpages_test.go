@@ -0,0 +1,117 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// testErrorPage is rendered for every status in the error page tests
+var testErrorPage = template.Must(template.New("error").Parse(`<p>{{.Status}} {{.StatusText}} for {{.Host}}</p>`))
+
+// newErrorPagesTestServer creates a proxy server with the test error page for 404, 502 and 504, proxying
+// example.com to the upstream
+func newErrorPagesTestServer(t *testing.T, upstreamURL string) *ProxyServer {
+	t.Helper()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstreamURL)}},
+	})
+	s.ErrorPages = map[int]*template.Template{
+		http.StatusNotFound:       testErrorPage,
+		http.StatusBadGateway:     testErrorPage,
+		http.StatusGatewayTimeout: testErrorPage,
+	}
+	return s
+}
+
+func TestErrorPageUnknownHost(t *testing.T) {
+	s := newErrorPagesTestServer(t, "http://upstream.internal")
+	rec := serve(s, http.MethodGet, "unknown.example.com", "/")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if got, want := rec.Body.String(), "<p>404 Not Found for unknown.example.com</p>"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+		t.Errorf("Content-Type = %q, want html", got)
+	}
+}
+
+func TestErrorPageUnreachableUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	s := newErrorPagesTestServer(t, upstream.URL)
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if got, want := rec.Body.String(), "<p>502 Bad Gateway for example.com</p>"; rec.Code != http.StatusBadGateway || got != want {
+		t.Errorf("got %d %q, want %d %q", rec.Code, got, http.StatusBadGateway, want)
+	}
+}
+
+func TestErrorPageTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	s := newErrorPagesTestServer(t, upstream.URL)
+	s.RequestTimeout = 20 * time.Millisecond
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if got, want := rec.Body.String(), "<p>504 Gateway Timeout for example.com</p>"; rec.Code != http.StatusGatewayTimeout || got != want {
+		t.Errorf("got %d %q, want %d %q", rec.Code, got, http.StatusGatewayTimeout, want)
+	}
+}
+
+func TestErrorPageKeepsUpstreamErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such item", http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	s := newErrorPagesTestServer(t, upstream.URL)
+	rec := serve(s, http.MethodGet, "example.com", "/items/1")
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "no such item\n" {
+		t.Errorf("got %d %q, want the 404 of the upstream", rec.Code, rec.Body)
+	}
+}
+
+func TestErrorPageFallsBackToText(t *testing.T) {
+	s := newTestServer(t, nil)
+	rec := serve(s, http.MethodGet, "unknown.example.com", "/")
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "host not found\n" {
+		t.Errorf("got %d %q, want the plain text error", rec.Code, rec.Body)
+	}
+}
+
+func TestLoadErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"502.html":   "{{.Host}} is down",
+		"index.html": "ignored",
+		"200.html":   "ignored",
+		"README":     "ignored",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	pages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pages) != 1 || pages[http.StatusBadGateway] == nil {
+		t.Errorf("pages = %v, want only 502", pages)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "404.html"), []byte("{{.Host"), 0o644); err != nil {
+		t.Fatalf("failed to write 404.html: %v", err)
+	}
+	if _, err := LoadErrorPages(dir); err == nil {
+		t.Error("invalid template loaded without error")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/cbodonnell/proxy-host/pkg/config"
+)
+
+// storeFlags are the flags selecting the store of the host routes, of which only one may be set
+var storeFlags = []struct {
+	// name is the name of the flag
+	name string
+	// store is the store type the flag selects
+	store string
+	// usage describes the flag
+	usage string
+}{
+	{"config", config.StoreFile, "path to a yaml config file of host routes"},
+	{"db", config.StoreSQLite, "path to a SQLite database of host routes, created if it does not exist"},
+	{"redis", config.StoreRedis, "host:port address of a Redis server holding the host routes"},
+}
+
+// addrsFlag is a flag.Value setting a list of addresses from a comma-separated value
+type addrsFlag struct {
+	// addrs is the list the flag sets
+	addrs *[]string
+}
+
+// String returns the addresses separated by commas
+func (f addrsFlag) String() string {
+	if f.addrs == nil {
+		return ""
+	}
+	return strings.Join(*f.addrs, ",")
+}
+
+// Set replaces the addresses with those of the comma-separated value
+func (f addrsFlag) Set(value string) error {
+	*f.addrs = config.SplitAddrs(value)
+	return nil
+}
+
+// parseFlags parses the command line args with fs into the server config. Flags override the environment
+// variables read by config.FromEnv, which override the defaults. The flags of the other settings, such as
+// those bound to the fields of the proxy server, must be defined on fs beforehand so that they are parsed
+// and listed by -h too
+func parseFlags(fs *flag.FlagSet, args []string) (*config.Server, error) {
+	server, err := config.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	fs.Var(addrsFlag{&server.ListenAddrs}, "listen", "comma-separated addresses the proxy listens on")
+	fs.StringVar(&server.AdminAddr, "admin-listen", server.AdminAddr, "address the admin api, metrics and probes listen on")
+	fs.DurationVar(&server.CacheTTL, "cache-ttl", server.CacheTTL, "how long the upstream of a host is cached before its route is looked up again")
+	fs.DurationVar(&server.CleanupInterval, "cache-cleanup-interval", server.CleanupInterval, "how often expired upstreams are removed from the cache")
+	fs.DurationVar(&server.ReadHeaderTimeout, "read-header-timeout", server.ReadHeaderTimeout, "how long clients may take to send the headers of a request, 0 for no limit")
+	fs.DurationVar(&server.ReadTimeout, "read-timeout", server.ReadTimeout, "how long clients may take to send a whole request, 0 for no limit")
+	fs.DurationVar(&server.WriteTimeout, "write-timeout", server.WriteTimeout, "how long writing a response may take, 0 for no limit; server-sent event streams are exempt")
+	fs.DurationVar(&server.IdleTimeout, "idle-timeout", server.IdleTimeout, "how long keep-alive connections wait for their next request, 0 for no limit")
+	fs.TextVar(&server.LogLevel, "log-level", server.LogLevel, "minimum level of the logged messages: debug, info, warn or error")
+	locations := make([]string, len(storeFlags))
+	for i, storeFlag := range storeFlags {
+		if server.Store == storeFlag.store {
+			locations[i] = server.StoreLocation
+		}
+		fs.StringVar(&locations[i], storeFlag.name, locations[i], storeFlag.usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\n", fs.Name())
+		fmt.Fprintln(fs.Output(), "Proxies each request to the targets configured for its host. Flags override the PROXY_* environment")
+		fmt.Fprintln(fs.Output(), "variables, such as PROXY_LISTEN_ADDR and PROXY_CACHE_TTL, which override the defaults.")
+		fmt.Fprintln(fs.Output(), "The admin api requires PROXY_ADMIN_TOKEN as a bearer token when it listens beyond localhost.")
+		fmt.Fprintln(fs.Output(), "\nFlags:")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q, all settings are flags", fs.Args())
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	selected := ""
+	for i, storeFlag := range storeFlags {
+		if !set[storeFlag.name] || locations[i] == "" {
+			continue
+		}
+		if selected != "" {
+			return nil, fmt.Errorf("only one of -%s and -%s may be set", selected, storeFlag.name)
+		}
+		selected = storeFlag.name
+		server.Store = storeFlag.store
+		server.StoreLocation = locations[i]
+	}
+	if err := server.Validate(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/config"
+)
+
+// newTestFlagSet returns a flag set that returns its errors and writes its output to the returned buffer
+func newTestFlagSet() (*flag.FlagSet, *bytes.Buffer) {
+	output := new(bytes.Buffer)
+	fs := flag.NewFlagSet("proxy-host", flag.ContinueOnError)
+	fs.SetOutput(output)
+	return fs, output
+}
+
+func TestParseFlagsDefaults(t *testing.T) {
+	fs, _ := newTestFlagSet()
+	server, err := parseFlags(fs, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(server, config.DefaultServer()) {
+		t.Errorf("server = %+v, want the defaults %+v", server, config.DefaultServer())
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	fs, _ := newTestFlagSet()
+	server, err := parseFlags(fs, []string{
+		"-listen", ":8080, 127.0.0.1:8082",
+		"-admin-listen", "127.0.0.1:8081",
+		"-cache-ttl", "1m",
+		"-cache-cleanup-interval", "10s",
+		"-log-level", "warn",
+		"-config", "hosts.yaml",
+		"-write-timeout", "30s",
+		"-idle-timeout", "0",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := config.Server{
+		ListenAddrs:     []string{":8080", "127.0.0.1:8082"},
+		AdminAddr:       "127.0.0.1:8081",
+		CacheTTL:        time.Minute,
+		CleanupInterval: 10 * time.Second,
+		Store:           config.StoreFile,
+		StoreLocation:   "hosts.yaml",
+		LogLevel:        slog.LevelWarn,
+
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      30 * time.Second,
+	}
+	if !reflect.DeepEqual(*server, want) {
+		t.Errorf("server = %+v, want %+v", server, want)
+	}
+}
+
+func TestParseFlagsOverrideEnv(t *testing.T) {
+	t.Setenv("PROXY_LISTEN_ADDR", ":8080")
+	t.Setenv("PROXY_ADMIN_ADDR", "127.0.0.1:8081")
+	t.Setenv("PROXY_STORE", "sqlite")
+	t.Setenv("PROXY_STORE_LOCATION", "hosts.db")
+	fs, _ := newTestFlagSet()
+	server, err := parseFlags(fs, []string{"-listen", ":9090", "-redis", "localhost:6379"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(server.ListenAddrs, []string{":9090"}) {
+		t.Errorf("listen addresses = %q, want the flag over the environment", server.ListenAddrs)
+	}
+	if server.AdminAddr != "127.0.0.1:8081" {
+		t.Errorf("admin address = %q, want the environment over the default", server.AdminAddr)
+	}
+	if server.Store != config.StoreRedis || server.StoreLocation != "localhost:6379" {
+		t.Errorf("store = %s %q, want the redis flag over the environment", server.Store, server.StoreLocation)
+	}
+}
+
+func TestParseFlagsEnvStore(t *testing.T) {
+	t.Setenv("PROXY_STORE", "sqlite")
+	t.Setenv("PROXY_STORE_LOCATION", "hosts.db")
+	fs, _ := newTestFlagSet()
+	server, err := parseFlags(fs, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.Store != config.StoreSQLite || server.StoreLocation != "hosts.db" {
+		t.Errorf("store = %s %q, want the store of the environment", server.Store, server.StoreLocation)
+	}
+}
+
+func TestParseFlagsInvalid(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-listen-addr", ":8080"}, "flag provided but not defined: -listen-addr"},
+		{[]string{"-cache-ttl", "5"}, "invalid value \"5\" for flag -cache-ttl"},
+		{[]string{"-log-level", "verbose"}, "invalid value \"verbose\" for flag -log-level"},
+		{[]string{"-cache-ttl", "-1m"}, "cache ttl must not be negative"},
+		{[]string{"-config", "hosts.yaml", "-db", "hosts.db"}, "only one of -config and -db may be set"},
+		{[]string{"-listen", ":8080", "hosts.yaml"}, "unexpected arguments [\"hosts.yaml\"]"},
+		{[]string{"-admin-listen", ":9998"}, "requires PROXY_ADMIN_TOKEN"},
+	}
+	for _, test := range tests {
+		fs, _ := newTestFlagSet()
+		_, err := parseFlags(fs, test.args)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseFlags(%q) error = %v, want %q", test.args, err, test.want)
+		}
+	}
+}
+
+func TestParseFlagsHelp(t *testing.T) {
+	fs, output := newTestFlagSet()
+	fs.Bool("metrics", true, "serve prometheus metrics on the admin listener")
+	_, err := parseFlags(fs, []string{"-h"})
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("error = %v, want %v", err, flag.ErrHelp)
+	}
+	for _, want := range []string{"Usage: proxy-host [flags]", "PROXY_LISTEN_ADDR", "-listen string", "-log-level", "-metrics"} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("usage does not contain %q:\n%s", want, output.String())
+		}
+	}
+}
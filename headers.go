@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// rewriteResponseHeaders removes the headers of a target's response that are rewritten to an empty value and
+// replaces the value of the others. Headers the target did not send are left absent
+func rewriteResponseHeaders(header http.Header, rewrites map[string]string) {
+	for name, value := range rewrites {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; !ok {
+			continue
+		}
+		if value == "" {
+			header.Del(name)
+			continue
+		}
+		header.Set(name, value)
+	}
+}
+
+// rewriteLocation rewrites the Location of a redirect to the target, such as one to its internal host name
+// that clients cannot reach, to the public host of the request, over https if the client connected with TLS.
+// Relative locations and redirects to other hosts are left as they are
+func rewriteLocation(header http.Header, target *url.URL, publicHost string, secure bool) {
+	location, err := url.Parse(header.Get("Location"))
+	if err != nil || location.Host == "" || !sameHost(location, target) {
+		return
+	}
+	location.Scheme = "http"
+	if secure {
+		location.Scheme = "https"
+	}
+	location.Host = publicHost
+	header.Set("Location", location.String())
+}
+
+// sameHost reports whether the urls have the same host name and port, the port defaulting to that of their
+// scheme
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname()) && urlPort(a) == urlPort(b)
+}
+
+// urlPort returns the port of the url, or the default port of its scheme if it has none
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		return "443"
+	}
+	return "80"
+}
+
+// addResponseHeaders adds the headers to the response of a target that did not set them itself
+func addResponseHeaders(header http.Header, headers map[string]string) {
+	for name, value := range headers {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; !ok {
+			header.Set(name, value)
+		}
+	}
+}
+
+// responseHeaders returns the headers added to the responses of the targets of the route: those of the proxy
+// server overridden by those of the route, where an empty value drops a header of the proxy server
+func (s *ProxyServer) responseHeaders(route *store.Route) map[string]string {
+	if len(route.ResponseHeaders) == 0 {
+		return s.ResponseHeaders
+	}
+	headers := make(map[string]string, len(s.ResponseHeaders)+len(route.ResponseHeaders))
+	for name, value := range s.ResponseHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	for name, value := range route.ResponseHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if value == "" {
+			delete(headers, name)
+			continue
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// headerFlag is a flag.Value collecting the response headers of repeated "Name=value" flags
+type headerFlag map[string]string
+
+// String returns the collected headers
+func (f headerFlag) String() string {
+	entries := make([]string, 0, len(f))
+	for name, value := range f {
+		entries = append(entries, name+"="+value)
+	}
+	return strings.Join(entries, ",")
+}
+
+// Set adds the header of a "Name=value" flag
+func (f headerFlag) Set(entry string) error {
+	name, value, ok := strings.Cut(entry, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || value == "" {
+		return fmt.Errorf("header %q must be of the form Name=value", entry)
+	}
+	f[http.CanonicalHeaderKey(name)] = value
+	return nil
+}
+
+// parseHeaderRewrites parses a comma separated list of response header rewrites. An entry "Name" removes the
+// header and an entry "Name=value" replaces its value
+func parseHeaderRewrites(list string) map[string]string {
+	rewrites := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		name, value, _ := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		rewrites[http.CanonicalHeaderKey(name)] = strings.TrimSpace(value)
+	}
+	return rewrites
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// newHeadersTestServer creates a proxy server for example.com whose upstream responds with the specified
+// status and headers
+func newHeadersTestServer(t *testing.T, status int, header map[string]string) *ProxyServer {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range header {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(upstream.Close)
+	return newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+}
+
+func TestRewriteResponseHeadersRemoves(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError} {
+		s := newHeadersTestServer(t, status, map[string]string{
+			"Server":       "nginx/1.25.3",
+			"X-Powered-By": "PHP/8.3",
+			"X-Kept":       "yes",
+		})
+		s.RewriteResponseHeaders = parseHeaderRewrites("Server,x-powered-by")
+		rec := serve(s, http.MethodGet, "example.com", "/")
+		if rec.Code != status {
+			t.Fatalf("status = %d, want %d", rec.Code, status)
+		}
+		if got := rec.Header().Values("Server"); len(got) != 0 {
+			t.Errorf("status %d: Server = %q, want it removed", status, got)
+		}
+		if got := rec.Header().Values("X-Powered-By"); len(got) != 0 {
+			t.Errorf("status %d: X-Powered-By = %q, want it removed", status, got)
+		}
+		if got := rec.Header().Get("X-Kept"); got != "yes" {
+			t.Errorf("status %d: X-Kept = %q, want it kept", status, got)
+		}
+	}
+}
+
+func TestRewriteResponseHeadersReplaces(t *testing.T) {
+	s := newHeadersTestServer(t, http.StatusOK, map[string]string{"Server": "Apache/2.4.58 (Ubuntu)"})
+	s.RewriteResponseHeaders = parseHeaderRewrites("Server=proxy-host, X-Powered-By=nothing")
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if got := rec.Header().Get("Server"); got != "proxy-host" {
+		t.Errorf("Server = %q, want proxy-host", got)
+	}
+	if got := rec.Header().Values("X-Powered-By"); len(got) != 0 {
+		t.Errorf("X-Powered-By = %q, want it not added", got)
+	}
+}
+
+func TestParseHeaderRewrites(t *testing.T) {
+	got := parseHeaderRewrites(" server , x-powered-by=, X-Runtime=hidden,,")
+	want := map[string]string{"Server": "", "X-Powered-By": "", "X-Runtime": "hidden"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseHeaderRewrites() = %v, want %v", got, want)
+	}
+}
+
+// securityHeaders are the headers added to all hosts in the response header tests
+var securityHeaders = map[string]string{
+	"Strict-Transport-Security": "max-age=63072000",
+	"X-Content-Type-Options":    "nosniff",
+	"X-Frame-Options":           "DENY",
+}
+
+func TestResponseHeadersAdded(t *testing.T) {
+	s := newHeadersTestServer(t, http.StatusOK, map[string]string{"X-Frame-Options": "SAMEORIGIN"})
+	s.ResponseHeaders = securityHeaders
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if got := rec.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("X-Frame-Options = %q, want the value of the upstream", got)
+	}
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "max-age=63072000" {
+		t.Errorf("Strict-Transport-Security = %q, want it added", got)
+	}
+	if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want it added", got)
+	}
+}
+
+func TestResponseHeadersRouteOverride(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets: []*url.URL{mustParseURL(t, upstream.URL)},
+			ResponseHeaders: map[string]string{
+				"x-frame-options":           "SAMEORIGIN",
+				"Strict-Transport-Security": "",
+				"Referrer-Policy":           "no-referrer",
+			},
+		},
+		"other.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.ResponseHeaders = securityHeaders
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	want := map[string]string{
+		"X-Frame-Options":           "SAMEORIGIN",
+		"X-Content-Type-Options":    "nosniff",
+		"Referrer-Policy":           "no-referrer",
+		"Strict-Transport-Security": "",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if got := serve(s, http.MethodGet, "other.example.com", "/").Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options of another host = %q, want DENY", got)
+	}
+}
+
+func TestHeaderFlag(t *testing.T) {
+	headers := make(headerFlag)
+	for _, entry := range []string{"x-frame-options=DENY", "Strict-Transport-Security=max-age=63072000; includeSubDomains"} {
+		if err := headers.Set(entry); err != nil {
+			t.Fatalf("Set(%q): %v", entry, err)
+		}
+	}
+	want := headerFlag{"X-Frame-Options": "DENY", "Strict-Transport-Security": "max-age=63072000; includeSubDomains"}
+	if !reflect.DeepEqual(headers, want) {
+		t.Errorf("headers = %v, want %v", headers, want)
+	}
+	for _, entry := range []string{"X-Frame-Options", "=DENY", "X-Frame-Options="} {
+		if err := headers.Set(entry); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", entry)
+		}
+	}
+}
+
+// serveWithHeaders sends a request for example.com with the specified headers through the proxy server,
+// returning the headers its upstream received
+func serveWithHeaders(t *testing.T, s *ProxyServer, received *http.Header, header map[string]string) http.Header {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com"
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	return *received
+}
+
+// newRequestHeadersTestServer creates a proxy server for example.com whose upstream records the headers of
+// the requests it receives
+func newRequestHeadersTestServer(t *testing.T) (*ProxyServer, *http.Header) {
+	t.Helper()
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	return s, &received
+}
+
+func TestStripRequestHeadersSpoofedProxyHost(t *testing.T) {
+	s, received := newRequestHeadersTestServer(t)
+	header := serveWithHeaders(t, s, received, map[string]string{"X-Proxy-Host": "false"})
+	if got := header.Values("X-Proxy-Host"); len(got) != 1 || got[0] != "true" {
+		t.Errorf("X-Proxy-Host = %q, want only the proxy's", got)
+	}
+}
+
+func TestStripRequestHeaders(t *testing.T) {
+	s, received := newRequestHeadersTestServer(t)
+	s.StripRequestHeaders = append(s.StripRequestHeaders, "X-Forwarded-For", "x-internal-user")
+	header := serveWithHeaders(t, s, received, map[string]string{
+		"X-Forwarded-For": "10.0.0.1",
+		"X-Internal-User": "admin",
+		"X-Kept":          "yes",
+	})
+	if got := header.Get("X-Internal-User"); got != "" {
+		t.Errorf("X-Internal-User = %q, want it stripped", got)
+	}
+	// the proxy starts a fresh X-Forwarded-For with the address of the client
+	if got := header.Get("X-Forwarded-For"); got != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For = %q, want only the client address", got)
+	}
+	if got := header.Get("X-Kept"); got != "yes" {
+		t.Errorf("X-Kept = %q, want it forwarded", got)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	target := mustParseURL(t, "http://app.internal:8080")
+	tests := []struct {
+		name     string
+		location string
+		secure   bool
+		want     string
+	}{
+		{"internal host", "http://app.internal:8080/login?next=%2Fdocs", false, "http://example.com/login?next=%2Fdocs"},
+		{"internal host over tls", "http://app.internal:8080/login", true, "https://example.com/login"},
+		{"internal host case", "http://APP.internal:8080/", false, "http://example.com/"},
+		{"protocol-relative", "//app.internal:8080/login", false, "http://example.com/login"},
+		{"external host", "https://accounts.example.org/authorize?client=1", false, "https://accounts.example.org/authorize?client=1"},
+		{"internal host on another port", "http://app.internal:9090/", false, "http://app.internal:9090/"},
+		{"relative", "/login", false, "/login"},
+	}
+	for _, test := range tests {
+		header := http.Header{"Location": {test.location}}
+		rewriteLocation(header, target, "example.com", test.secure)
+		if got := header.Get("Location"); got != test.want {
+			t.Errorf("%s: Location = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	header := http.Header{"Location": {"https://app.internal/"}}
+	rewriteLocation(header, mustParseURL(t, "https://app.internal:443"), "example.com:8443", true)
+	if got := header.Get("Location"); got != "https://example.com:8443/" {
+		t.Errorf("Location with the default port = %q, want the public host with its port", got)
+	}
+}
+
+func TestProxyServerRewritesRedirectLocation(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal":
+			// r.Host is the host of the target, as the proxy rewrites it
+			w.Header().Set("Location", "http://"+r.Host+"/login")
+			w.WriteHeader(http.StatusFound)
+		case "/external":
+			w.Header().Set("Location", "https://accounts.example.org/authorize")
+			w.WriteHeader(http.StatusFound)
+		case "/created":
+			w.Header().Set("Location", "http://"+r.Host+"/items/1")
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+
+	tests := map[string]string{
+		"/internal": "http://example.com:8080/login",
+		"/external": "https://accounts.example.org/authorize",
+		"/created":  upstream.URL + "/items/1",
+	}
+	for path, want := range tests {
+		rec := serve(s, http.MethodGet, "example.com:8080", path)
+		if got := rec.Header().Get("Location"); got != want {
+			t.Errorf("%s: Location = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -1,52 +1,305 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/compress"
+	"github.com/cbodonnell/proxy-host/pkg/config"
+	"github.com/cbodonnell/proxy-host/pkg/metrics"
+	"github.com/cbodonnell/proxy-host/pkg/ratelimit"
+	"github.com/cbodonnell/proxy-host/pkg/responsecache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	redisstore "github.com/cbodonnell/proxy-host/pkg/store/redis"
+	"github.com/cbodonnell/proxy-host/pkg/store/sqlite"
 )
 
-// ProxyRequestHandler handles the http request using proxy
-func ProxyRequestHandler(proxyCache *cache.Cache) func(http.ResponseWriter, *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var proxy *httputil.ReverseProxy
-		cached := proxyCache.Get(r.Host)
-		if cached == nil {
-			// TODO: check the database for the host and get the target url
-			// if the host is not found in the database, return 404
-			// if the host is found, create a new proxy with the target url
-			// targetHost := "abcdefg.tunnel.farm"
-			targetHost := "520cf64.dev.local:7880"
-			url := &url.URL{
-				Scheme: "http",
-				Host:   targetHost,
-			}
-			newProxy := httputil.NewSingleHostReverseProxy(url)
-			director := newProxy.Director
-			newProxy.Director = func(r *http.Request) {
-				director(r)
-				r.Host = targetHost
-				r.Header.Set("X-Proxy-Host", "true")
-			}
-			proxyCache.Set(r.Host, newProxy, 0)
-			proxy = newProxy
-		} else {
-			// proxyCache.Extend(r.Host, 0) // wait until we can invalidate the cache
-			proxy = cached.(*httputil.ReverseProxy)
-		}
+// ProxyRequestHandler handles the http request using proxy. It is kept for compatibility, see ProxyServer
+func ProxyRequestHandler(proxyCache *cache.TypedCache[*Upstream], hostStore store.HostStore) func(http.ResponseWriter, *http.Request) {
+	return NewProxyServer(proxyCache, hostStore).ServeHTTP
+}
 
-		proxy.ServeHTTP(w, r)
+// openHostStore returns a memory store holding the routes of the config file if configPath is set, opens
+// the SQLite store at dbPath, creating the hosts table if needed, or connects to Redis if redisOptions has an
+// address. If none is set, a memory store with a single development route is returned instead
+func openHostStore(configPath, dbPath string, redisOptions redisstore.Options) (store.HostStore, error) {
+	configured := 0
+	for _, set := range []bool{configPath != "", dbPath != "", redisOptions.Addr != ""} {
+		if set {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return nil, fmt.Errorf("only one of a config file, a database and redis may be used")
+	}
+	if configPath != "" {
+		routes, err := loadRoutes(configPath)
+		if err != nil {
+			return nil, err
+		}
+		return store.NewMemoryStore(routes), nil
 	}
+	if redisOptions.Addr != "" {
+		return redisstore.Open(redisOptions)
+	}
+	if dbPath == "" {
+		return store.NewMemoryStore(map[string]*store.Route{
+			"abcdefg.tunnel.farm": {
+				Targets: []*url.URL{
+					{
+						Scheme: "http",
+						Host:   "520cf64.dev.local:7880",
+					},
+				},
+			},
+		}), nil
+	}
+	if err := sqlite.Migrate(dbPath); err != nil {
+		return nil, err
+	}
+	sqliteStore, err := sqlite.Open(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return sqliteStore, nil
 }
 
 func main() {
-	proxyCache := cache.NewCache(5*time.Minute, 30*time.Second)
-	defer proxyCache.StopCleanup()
+	// the cache and the store are created once the flags are parsed
+	proxyServer := NewProxyServer(nil, nil)
 
-	http.HandleFunc("/", ProxyRequestHandler(proxyCache))
-	log.Fatal(http.ListenAndServe(":9999", nil))
+	slidingCacheExpiration := flag.Bool("sliding-cache-expiration", false, "keep hosts in the cache for as long as they receive requests rather than re-resolving them once their ttl expires")
+	useAutocert := flag.Bool("autocert", false, "serve https on :443 with certificates from Let's Encrypt")
+	autocertCacheDir := flag.String("autocert-cache-dir", "certs", "directory to cache autocert certificates in")
+	flag.DurationVar(&proxyServer.RequestTimeout, "request-timeout", proxyServer.RequestTimeout, "how long a request to a target may take before 504 is returned, 0 disables the timeout")
+	flag.DurationVar(&proxyServer.FlushInterval, "flush-interval", proxyServer.FlushInterval, "how often response bodies are flushed to clients, negative flushes after every write, event streams and responses of unknown length such as gRPC are always flushed immediately")
+	flag.IntVar(&proxyServer.MaxRetries, "max-retries", proxyServer.MaxRetries, "how often an idempotent request is retried when the connection to its target fails")
+	flag.DurationVar(&proxyServer.RetryBackoff, "retry-backoff", proxyServer.RetryBackoff, "wait before the first retry, doubled for each further retry")
+	flag.IntVar(&proxyServer.CircuitBreakerThreshold, "circuit-breaker-threshold", proxyServer.CircuitBreakerThreshold, "consecutive failed requests that open the circuit of a target, 0 disables circuit breakers")
+	flag.DurationVar(&proxyServer.CircuitBreakerCooldown, "circuit-breaker-cooldown", proxyServer.CircuitBreakerCooldown, "how long an open circuit rejects requests before a probe is let through")
+	flag.DurationVar(&proxyServer.HealthCheckInterval, "health-check-interval", proxyServer.HealthCheckInterval, "how often to probe the targets of multi-target hosts, 0 disables health checks")
+	flag.StringVar(&proxyServer.HealthCheckPath, "health-check-path", proxyServer.HealthCheckPath, "path requested on each target to check its health")
+	flag.IntVar(&proxyServer.HealthCheckUnhealthyThreshold, "health-check-unhealthy-threshold", proxyServer.HealthCheckUnhealthyThreshold, "consecutive failed probes that mark a target unhealthy")
+	flag.IntVar(&proxyServer.HealthCheckHealthyThreshold, "health-check-healthy-threshold", proxyServer.HealthCheckHealthyThreshold, "consecutive successful probes that mark a target healthy again")
+	flag.BoolVar(&proxyServer.ForwardedHeaders, "forwarded-headers", proxyServer.ForwardedHeaders, "set X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host on proxied requests")
+	flag.IntVar(&proxyServer.TrustedProxyDepth, "trusted-proxy-depth", proxyServer.TrustedProxyDepth, "number of proxies in front of this one whose X-Forwarded-For entries are trusted for the client IP")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated CIDR ranges of the proxies in front of this one, whose X-Forwarded-For entries are skipped to find the client IP, overriding -trusted-proxy-depth")
+	allowedMethods := flag.String("allowed-methods", "", "comma separated request methods proxied to targets, such as GET,HEAD,POST, others are answered with 405, empty allows all methods")
+	flag.Int64Var(&proxyServer.MaxInFlight, "max-in-flight", proxyServer.MaxInFlight, "largest number of requests proxied at once across all hosts, beyond which 503 is returned, 0 disables the limit")
+	flag.Int64Var(&proxyServer.MaxRequestBodyBytes, "max-request-body-bytes", proxyServer.MaxRequestBodyBytes, "largest request body in bytes forwarded to a target, 0 disables the limit")
+	enableResponseCache := flag.Bool("response-cache", false, "cache responses to GET requests as allowed by their Cache-Control headers")
+	compressor := compress.New()
+	enableCompression := flag.Bool("compress", false, "compress responses with gzip or brotli when clients accept it")
+	flag.IntVar(&compressor.MinSize, "compress-min-size", compressor.MinSize, "size in bytes below which responses are not compressed")
+	compressTypes := flag.String("compress-types", strings.Join(compressor.ContentTypes, ","), "comma separated media types to compress, an entry such as text/* matches all subtypes")
+	enableMetrics := flag.Bool("metrics", true, "serve prometheus metrics on the admin listener")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "expect a PROXY protocol v1 or v2 header on every connection to the listen addresses, as sent by HAProxy or an AWS NLB, and take the client address from it")
+	enableH2C := flag.Bool("h2c", false, "serve cleartext HTTP/2 besides HTTP/1 on the listen address, HTTP/2 is always negotiated over TLS with -autocert")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "how long to wait for in-flight requests to finish on shutdown")
+	redisOptions := redisstore.DefaultOptions()
+	flag.StringVar(&redisOptions.Username, "redis-username", redisOptions.Username, "username to authenticate to Redis with")
+	flag.StringVar(&redisOptions.Password, "redis-password", redisOptions.Password, "password to authenticate to Redis with")
+	flag.IntVar(&redisOptions.DB, "redis-db", redisOptions.DB, "number of the Redis database holding the host routes")
+	flag.StringVar(&redisOptions.KeyPrefix, "redis-key-prefix", redisOptions.KeyPrefix, "prefix of the Redis keys of the sets of target urls of each host")
+	flag.DurationVar(&redisOptions.CacheTTL, "redis-cache-ttl", redisOptions.CacheTTL, "how long routes read from Redis are remembered locally, 0 disables the local cache")
+	flag.DurationVar(&redisOptions.Timeout, "redis-timeout", redisOptions.Timeout, "how long a command sent to Redis may take")
+	transportOptions := DefaultTransportOptions()
+	flag.DurationVar(&transportOptions.DialTimeout, "upstream-dial-timeout", transportOptions.DialTimeout, "how long connecting to a target may take")
+	flag.DurationVar(&transportOptions.KeepAlive, "upstream-keep-alive", transportOptions.KeepAlive, "interval between keep-alive probes of connections to targets, negative disables them")
+	flag.DurationVar(&transportOptions.TLSHandshakeTimeout, "upstream-tls-handshake-timeout", transportOptions.TLSHandshakeTimeout, "how long the TLS handshake with an https target may take")
+	flag.IntVar(&transportOptions.MaxIdleConns, "upstream-max-idle-conns", transportOptions.MaxIdleConns, "idle connections kept open across all targets, 0 means no limit")
+	flag.IntVar(&transportOptions.MaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", transportOptions.MaxIdleConnsPerHost, "idle connections kept open to each target")
+	flag.DurationVar(&transportOptions.IdleConnTimeout, "upstream-idle-conn-timeout", transportOptions.IdleConnTimeout, "how long an idle connection to a target is kept open, 0 means no limit")
+	clientTLS := &store.ClientTLS{}
+	flag.StringVar(&clientTLS.CertFile, "upstream-client-cert", "", "path to the PEM client certificate presented to https targets that require mutual TLS, hosts may override it")
+	flag.StringVar(&clientTLS.KeyFile, "upstream-client-key", "", "path to the PEM private key of -upstream-client-cert")
+	flag.StringVar(&clientTLS.CAFile, "upstream-ca", "", "path to a PEM bundle of the CAs the certificates of https targets are verified against when mutual TLS is configured, the system roots are used if empty")
+	flag.StringVar(&proxyServer.RequestIDHeader, "request-id-header", proxyServer.RequestIDHeader, "header carrying the ID of each request to targets, clients and the access log, empty disables request IDs")
+	flag.BoolVar(&proxyServer.DedicatedTransports, "dedicated-upstream-transports", proxyServer.DedicatedTransports, "give each host its own connection pool, closed when the host is evicted from the cache")
+	maintenancePagePath := flag.String("maintenance-page", "", "path to the html page served with 503 for hosts in maintenance, a generic page is used if empty")
+	flag.DurationVar(&proxyServer.MaintenanceRetryAfter, "maintenance-retry-after", proxyServer.MaintenanceRetryAfter, "Retry-After sent with the responses of hosts in maintenance, 0 omits the header")
+	errorPagesDir := flag.String("error-pages", "", "directory of html templates, such as 502.html, rendered for the errors the proxy generates with that status")
+	stripRequestHeaders := flag.String("strip-request-headers", strings.Join(proxyServer.StripRequestHeaders, ","), "comma separated headers of incoming requests removed before they are forwarded, so that clients cannot spoof them")
+	rewriteResponseHeaders := flag.String("rewrite-response-headers", "", "comma separated response headers of targets to remove, such as Server,X-Powered-By, or to replace with Name=value")
+	responseHeaders := make(headerFlag)
+	flag.Var(responseHeaders, "response-header", "Name=value header added to the responses of targets that do not set it, such as X-Frame-Options=DENY, may be repeated")
+	defaultTarget := flag.String("default-target", "", "url of the target the requests of hosts without a route are proxied to, they are answered with 404 if empty")
+	probeTargetsOnStart := flag.Bool("probe-targets", false, "dial the targets of all routes on startup and log a warning for each that is unreachable, without failing startup")
+	probeTimeout := flag.Duration("probe-timeout", 2*time.Second, "how long each startup probe of a target may take")
+	probeConcurrency := flag.Int("probe-concurrency", 16, "largest number of targets dialed at once by the startup probe")
+	validatePath := flag.String("validate", "", "path to a yaml config file of host routes to validate before exiting with 0 if it is valid and 1 otherwise")
+	serverConfig, err := parseFlags(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		// the flag package exits on its own after reporting an unknown or malformed flag
+		fmt.Fprintf(os.Stderr, "%v\nRun %s -h for usage.\n", err, flag.CommandLine.Name())
+		os.Exit(2)
+	}
+	slog.SetLogLoggerLevel(serverConfig.LogLevel)
+	proxyServer.AdminToken = serverConfig.AdminToken
+	if *defaultTarget != "" {
+		target, err := store.ParseTarget(*defaultTarget)
+		if err != nil {
+			log.Fatalf("invalid -default-target: %v", err)
+		}
+		proxyServer.DefaultTarget = target
+	}
+
+	if *validatePath != "" {
+		if !validateConfig(os.Stdout, *validatePath) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	proxyCache := cache.NewTypedCache[*Upstream](cache.NewCache(serverConfig.CacheTTL, serverConfig.CleanupInterval))
+	defer proxyCache.Cache().StopCleanup()
+	proxyServer.Cache = proxyCache
+	proxyServer.RateLimiter = ratelimit.New(10 * time.Minute)
+	defer proxyServer.RateLimiter.Stop()
+	proxyCache.OnEvicted(func(key string, upstream *Upstream) {
+		upstream.Close()
+		proxyServer.Metrics.ObserveCacheEviction()
+	})
+	proxyServer.Transport = NewTransport(transportOptions, false)
+	proxyServer.InsecureTransport = NewTransport(transportOptions, true)
+	if *clientTLS != (store.ClientTLS{}) {
+		// load the files once up front so that a typo fails at startup rather than every request
+		if _, err := newClientTLSConfig(clientTLS, false); err != nil {
+			log.Fatal(err)
+		}
+		proxyServer.ClientTLS = clientTLS
+	}
+
+	var configPath, dbPath string
+	switch serverConfig.Store {
+	case config.StoreFile:
+		configPath = serverConfig.StoreLocation
+	case config.StoreSQLite:
+		dbPath = serverConfig.StoreLocation
+	case config.StoreRedis:
+		redisOptions.Addr = serverConfig.StoreLocation
+	}
+	hostStore, err := openHostStore(configPath, dbPath, redisOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxyServer.Store = hostStore
+	proxyServer.StripRequestHeaders = nil
+	for _, name := range strings.Split(*stripRequestHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			proxyServer.StripRequestHeaders = append(proxyServer.StripRequestHeaders, name)
+		}
+	}
+	for _, method := range strings.Split(*allowedMethods, ",") {
+		if method = strings.TrimSpace(method); method != "" {
+			proxyServer.AllowedMethods = append(proxyServer.AllowedMethods, strings.ToUpper(method))
+		}
+	}
+	for _, entry := range strings.Split(*trustedProxies, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, err := store.ParsePrefix(entry)
+		if err != nil {
+			log.Fatalf("invalid -trusted-proxies: %v", err)
+		}
+		proxyServer.TrustedProxies = append(proxyServer.TrustedProxies, prefix)
+	}
+	if len(responseHeaders) > 0 {
+		proxyServer.ResponseHeaders = responseHeaders
+	}
+	if *rewriteResponseHeaders != "" {
+		proxyServer.RewriteResponseHeaders = parseHeaderRewrites(*rewriteResponseHeaders)
+	}
+	if *errorPagesDir != "" {
+		proxyServer.ErrorPages, err = LoadErrorPages(*errorPagesDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *maintenancePagePath != "" {
+		page, err := os.ReadFile(*maintenancePagePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proxyServer.MaintenancePage = string(page)
+	}
+	proxyCache.Cache().SetSlidingExpiration(*slidingCacheExpiration)
+	if *enableResponseCache {
+		proxyServer.ResponseCache = responsecache.New(time.Minute)
+		defer proxyServer.ResponseCache.Stop()
+	}
+	if *enableMetrics {
+		proxyServer.Metrics = metrics.New()
+		proxyServer.Metrics.WatchCacheSize(func() (int, int) {
+			stats := proxyCache.Stats()
+			return stats.Size, stats.Capacity
+		})
+	}
+
+	proxyServer.Use(proxyServer.Recover)
+	if *enableCompression {
+		compressor.ContentTypes = strings.Split(*compressTypes, ",")
+		proxyServer.Use(compressor.Handler)
+	}
+
+	adminServer := &http.Server{
+		Addr:    serverConfig.AdminAddr,
+		Handler: AdminHandler(proxyServer),
+	}
+	servers := []*http.Server{adminServer}
+	if *useAutocert {
+		servers = append(servers, newAutocertServers(newAutocertManager(hostStore, *autocertCacheDir), proxyServer)...)
+	} else {
+		var handler http.Handler = proxyServer
+		if *enableH2C {
+			handler = withH2C(handler)
+		}
+		for _, addr := range serverConfig.ListenAddrs {
+			servers = append(servers, &http.Server{
+				Addr:    addr,
+				Handler: handler,
+			})
+		}
+	}
+
+	applyTimeouts(serverConfig, servers...)
+	var listen ListenFunc
+	if *proxyProtocol {
+		listen = listenProxyProtocol(serverConfig.ReadHeaderTimeout, adminServer)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if memoryStore, ok := hostStore.(*store.MemoryStore); ok && configPath != "" {
+		reloads := make(chan os.Signal, 1)
+		signal.Notify(reloads, syscall.SIGHUP)
+		defer signal.Stop(reloads)
+		go watchReloads(ctx, reloads, configPath, memoryStore, proxyCache, proxyServer.logger())
+	}
+	if *probeTargetsOnStart {
+		if lister, ok := hostStore.(store.RouteLister); !ok {
+			proxyServer.logger().Warn("the store cannot list its routes, so their targets are not probed")
+		} else if routes, err := lister.Routes(); err != nil {
+			proxyServer.logger().Warn("failed to list the routes to probe", "error", err)
+		} else {
+			// the probe runs alongside the servers, so that it does not delay startup
+			go probeTargets(ctx, routes, *probeTimeout, *probeConcurrency, proxyServer.logger())
+		}
+	}
+	if err := Run(ctx, *drainTimeout, listen, servers...); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("shut down")
 }
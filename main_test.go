@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	redisstore "github.com/cbodonnell/proxy-host/pkg/store/redis"
+)
+
+func TestProxyRequestHandler(t *testing.T) {
+	proxyCache := cache.NewCache(time.Minute, time.Minute)
+	defer proxyCache.StopCleanup()
+	handler := ProxyRequestHandler(cache.NewTypedCache[*Upstream](proxyCache), store.NewMemoryStore(nil))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "unknown.example.com"
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestOpenHostStoreDefault(t *testing.T) {
+	hostStore, err := openHostStore("", "", redisstore.Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := hostStore.Lookup("abcdefg.tunnel.farm"); err != nil {
+		t.Errorf("development route missing: %v", err)
+	}
+}
+
+func TestOpenHostStoreConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n"), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	hostStore, err := openHostStore(path, "", redisstore.Options{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	route, err := hostStore.Lookup("a.example.com")
+	if err != nil || route.Targets[0].Host != "10.0.0.1" {
+		t.Errorf("Lookup = %+v, %v", route, err)
+	}
+	if _, err := openHostStore(path, "hosts.db", redisstore.Options{}); err == nil {
+		t.Error("expected an error when both a config file and a database are set")
+	}
+	if _, err := openHostStore(path, "", redisstore.Options{Addr: "localhost:6379"}); err == nil {
+		t.Error("expected an error when both a config file and redis are set")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultMaintenancePage is the body of the responses of hosts in maintenance when no MaintenancePage is
+// configured
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>This site is undergoing maintenance and will be back shortly.</p>
+</body>
+</html>
+`
+
+// errMaintenance is returned while building the upstream of a host whose route is in maintenance, so that
+// no upstream is cached for it
+var errMaintenance = errors.New("host in maintenance")
+
+// maintenanceOverrides holds the hosts whose maintenance mode was toggled at runtime, overriding the
+// Maintenance flag of their routes
+type maintenanceOverrides struct {
+	// mutex is used to synchronize access to hosts
+	mutex sync.RWMutex
+	// hosts maps each toggled host to whether it is in maintenance
+	hosts map[string]bool
+}
+
+// get returns whether the host was put in maintenance, and whether it was toggled at all
+func (m *maintenanceOverrides) get(host string) (enabled, overridden bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	enabled, overridden = m.hosts[host]
+	return enabled, overridden
+}
+
+// set toggles the maintenance mode of the host
+func (m *maintenanceOverrides) set(host string, enabled bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.hosts == nil {
+		m.hosts = make(map[string]bool)
+	}
+	m.hosts[host] = enabled
+}
+
+// SetMaintenance puts the host in maintenance or takes it out of it, overriding the Maintenance flag of its
+// route until the proxy server is restarted
+func (s *ProxyServer) SetMaintenance(host string, enabled bool) {
+	s.maintenance.set(normalizeHost(host), enabled)
+}
+
+// InMaintenance reports whether the requests of the host are answered with the maintenance page, as set by
+// SetMaintenance or otherwise by the route of the host. Errors of the store are returned as is
+func (s *ProxyServer) InMaintenance(host string) (bool, error) {
+	host = normalizeHost(host)
+	if enabled, overridden := s.maintenance.get(host); overridden {
+		return enabled, nil
+	}
+	route, err := s.Store.Lookup(host)
+	if err != nil {
+		return false, err
+	}
+	return route.Maintenance, nil
+}
+
+// serveMaintenance answers a request for a host in maintenance with 503 Service Unavailable and the
+// maintenance page
+func (s *ProxyServer) serveMaintenance(w http.ResponseWriter) {
+	page := s.MaintenancePage
+	if page == "" {
+		page = defaultMaintenancePage
+	}
+	if s.MaintenanceRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(s.MaintenanceRetryAfter/time.Second)))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(page))
+}
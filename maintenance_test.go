@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// newMaintenanceTestServer creates a proxy server for example.com whose route is in maintenance if
+// maintenance is true, returning the number of requests that reached its upstream
+func newMaintenanceTestServer(t *testing.T, maintenance bool) (*ProxyServer, *atomic.Int64) {
+	t.Helper()
+	var reached atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}, Maintenance: maintenance},
+	})
+	return s, &reached
+}
+
+func TestMaintenanceRoute(t *testing.T) {
+	s, reached := newMaintenanceTestServer(t, true)
+	s.MaintenancePage = "<h1>back soon</h1>"
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Body.String() != "<h1>back soon</h1>" || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("body = %q with type %q, want the maintenance page", rec.Body, rec.Header().Get("Content-Type"))
+	}
+	if got := rec.Header().Get("Retry-After"); got != "300" {
+		t.Errorf("Retry-After = %q, want 300", got)
+	}
+	if reached.Load() != 0 {
+		t.Error("request in maintenance reached the upstream")
+	}
+	if s.Cache.Len() != 0 {
+		t.Errorf("cache holds %v, want no entry for a host in maintenance", s.Cache.Keys())
+	}
+}
+
+func TestMaintenanceDefaultPage(t *testing.T) {
+	s, _ := newMaintenanceTestServer(t, true)
+	s.MaintenanceRetryAfter = 0
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if !strings.Contains(rec.Body.String(), "maintenance") {
+		t.Errorf("body = %q, want the default maintenance page", rec.Body)
+	}
+	if _, ok := rec.Header()["Retry-After"]; ok {
+		t.Error("Retry-After sent although disabled")
+	}
+}
+
+func TestSetMaintenance(t *testing.T) {
+	s, reached := newMaintenanceTestServer(t, false)
+	serve(s, http.MethodGet, "example.com", "/")
+	s.SetMaintenance("Example.com:443", true)
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d after enabling maintenance, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	s.SetMaintenance("example.com", false)
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d after disabling maintenance, want %d", rec.Code, http.StatusOK)
+	}
+	if n := reached.Load(); n != 2 {
+		t.Errorf("upstream was reached %d times, want 2", n)
+	}
+}
+
+func TestSetMaintenanceOverridesRoute(t *testing.T) {
+	s, _ := newMaintenanceTestServer(t, true)
+	s.SetMaintenance("example.com", false)
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	s, reached := newMaintenanceTestServer(t, false)
+	admin := AdminHandler(s)
+	status := func(method string) maintenanceStatus {
+		t.Helper()
+		rec := serve(admin, method, "localhost", "/admin/maintenance/example.com")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s status = %d, want %d", method, rec.Code, http.StatusOK)
+		}
+		var status maintenanceStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatalf("failed to decode %s response: %v", method, err)
+		}
+		return status
+	}
+	if got := status(http.MethodGet); got.Host != "example.com" || got.Maintenance {
+		t.Errorf("GET = %+v, want example.com not in maintenance", got)
+	}
+	if got := status(http.MethodPut); !got.Maintenance {
+		t.Errorf("PUT = %+v, want maintenance", got)
+	}
+	if got := status(http.MethodGet); !got.Maintenance {
+		t.Errorf("GET after PUT = %+v, want maintenance", got)
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusServiceUnavailable || reached.Load() != 0 {
+		t.Errorf("status = %d after PUT, want %d without reaching the upstream", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := status(http.MethodDelete); got.Maintenance {
+		t.Errorf("DELETE = %+v, want no maintenance", got)
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d after DELETE, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := serve(admin, http.MethodGet, "localhost", "/admin/maintenance/unknown.example.com"); rec.Code != http.StatusNotFound {
+		t.Errorf("status for an unknown host = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "net/http"
+
+// Middleware wraps a handler with behavior that runs before and after it, such as authentication or
+// logging. It may answer a request itself rather than calling the wrapped handler
+type Middleware func(http.Handler) http.Handler
+
+// Use adds middleware around the proxy. Middleware run outside-in in the order they are added, so after
+// Use(a, b) and Use(c) a request passes through a, then b, then c before it reaches the proxy, and the
+// response passes back through them in reverse order. Middleware run before the proxy resolves the host,
+// so requests answered by a middleware are not recorded in the access log. Use must not be called while
+// the server is serving requests
+func (s *ProxyServer) Use(mw ...Middleware) {
+	s.middleware = append(s.middleware, mw...)
+	var handler http.Handler = http.HandlerFunc(s.serve)
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+	s.handler = handler
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// recordingMiddleware returns middleware that appends its name to calls before and after the wrapped handler
+func recordingMiddleware(name string, calls *[]string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name+" in")
+			next.ServeHTTP(w, r)
+			*calls = append(*calls, name+" out")
+		})
+	}
+}
+
+func TestUseRunsOutsideIn(t *testing.T) {
+	var calls []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "proxy")
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.Use(recordingMiddleware("a", &calls), recordingMiddleware("b", &calls))
+	s.Use(recordingMiddleware("c", &calls))
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	want := "a in,b in,c in,proxy,c out,b out,a out"
+	if got := strings.Join(calls, ","); got != want {
+		t.Errorf("calls = %s, want %s", got, want)
+	}
+}
+
+func TestUseShortCircuit(t *testing.T) {
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, "http://127.0.0.1:1")}},
+	})
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "denied", http.StatusTeapot)
+		})
+	})
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusTeapot {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusTeapot)
+	}
+	if s.Cache.Len() != 0 {
+		t.Error("request answered by middleware reached the proxy")
+	}
+}
@@ -0,0 +1,198 @@
+// balance requests for a host across its upstream targets
+package balancer
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// Target is an upstream target that requests can be balanced across
+type Target struct {
+	// URL is the url of the upstream target
+	URL *url.URL
+	// Proxy forwards requests to the upstream target
+	Proxy *httputil.ReverseProxy
+	// Breaker stops requests to the target while it keeps failing. If nil, the target has no circuit breaker
+	Breaker *CircuitBreaker
+	// Weight is the share of requests the Weighted strategy sends to the target relative to the others. Zero
+	// counts as 1
+	Weight int
+	// active is the number of requests the balancer is forwarding to the target
+	active atomic.Int64
+	// unhealthy is true when health checks have removed the target from rotation
+	unhealthy bool
+	// failures is the number of consecutive failed health checks
+	failures int
+	// successes is the number of consecutive successful health checks
+	successes int
+	// mutex is used to synchronize access to the health state
+	mutex sync.RWMutex
+}
+
+// TargetHealth reports the health of a target
+type TargetHealth struct {
+	// URL is the url of the upstream target
+	URL string `json:"url"`
+	// Healthy is false when health checks have removed the target from rotation
+	Healthy bool `json:"healthy"`
+	// Circuit is the state of the circuit breaker of the target, if it has one
+	Circuit string `json:"circuit,omitempty"`
+}
+
+// Healthy returns false when health checks have removed the target from rotation
+func (t *Target) Healthy() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return !t.unhealthy
+}
+
+// Available returns true when the target is healthy and its circuit breaker, if any, may let a request through
+func (t *Target) Available() bool {
+	return t.Healthy() && (t.Breaker == nil || t.Breaker.Ready())
+}
+
+// ActiveRequests returns the number of requests in flight to the target
+func (t *Target) ActiveRequests() int64 {
+	return t.active.Load()
+}
+
+// weight returns the weight of the target, at least 1
+func (t *Target) weight() int {
+	if t.Weight < 1 {
+		return 1
+	}
+	return t.Weight
+}
+
+// recordProbe records the result of a health check, marking the target unhealthy after unhealthyThreshold
+// consecutive failures and healthy again after healthyThreshold consecutive successes
+func (t *Target) recordProbe(ok bool, unhealthyThreshold, healthyThreshold int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if ok {
+		t.failures = 0
+		t.successes++
+		if t.unhealthy && t.successes >= healthyThreshold {
+			t.unhealthy = false
+		}
+		return
+	}
+	t.successes = 0
+	t.failures++
+	if !t.unhealthy && t.failures >= unhealthyThreshold {
+		t.unhealthy = true
+	}
+}
+
+// Strategy selects the target that should serve a request
+type Strategy interface {
+	// Next returns the target that should serve the request, or nil if none of the targets can.
+	// Targets that are not available must not be returned
+	Next(r *http.Request, targets []*Target) *Target
+}
+
+// Balancer is an http.Handler that forwards each request to one of its targets, chosen by its strategy
+type Balancer struct {
+	// Error writes the response to a request that no target is available for, with the status and a plain
+	// text message. If nil, http.Error is used
+	Error func(w http.ResponseWriter, r *http.Request, status int, message string)
+	// targets contains the upstream targets requests are balanced across
+	targets []*Target
+	// strategy selects the target for each request
+	strategy Strategy
+	// healthChecker probes the targets, if health checks are enabled
+	healthChecker *HealthChecker
+}
+
+// New creates a new balancer across the specified targets. If strategy is nil, round-robin is used
+func New(targets []*Target, strategy Strategy) *Balancer {
+	if strategy == nil {
+		strategy = NewRoundRobin()
+	}
+	return &Balancer{
+		targets:  targets,
+		strategy: strategy,
+	}
+}
+
+// Targets returns the upstream targets requests are balanced across
+func (b *Balancer) Targets() []*Target {
+	return b.targets
+}
+
+// StartHealthChecks starts the health checker, which is stopped when the balancer is closed
+func (b *Balancer) StartHealthChecks(checker *HealthChecker) {
+	b.healthChecker = checker
+	checker.Start()
+}
+
+// Health returns the health of each target
+func (b *Balancer) Health() []TargetHealth {
+	health := make([]TargetHealth, 0, len(b.targets))
+	for _, target := range b.targets {
+		targetHealth := TargetHealth{
+			URL:     target.URL.String(),
+			Healthy: target.Healthy(),
+		}
+		if target.Breaker != nil {
+			targetHealth.Circuit = target.Breaker.State().String()
+		}
+		health = append(health, targetHealth)
+	}
+	return health
+}
+
+// Close stops the health checker, if any
+func (b *Balancer) Close() {
+	if b.healthChecker != nil {
+		b.healthChecker.Stop()
+	}
+}
+
+// ServeHTTP forwards the request to the target chosen by the strategy, binding the client to it if the strategy
+// is a SessionStrategy. If no target is available, 503 Service Unavailable is returned when circuit breakers
+// rejected the request and 502 Bad Gateway otherwise
+func (b *Balancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target := b.strategy.Next(r, b.targets)
+	if target == nil {
+		if b.circuitOpen() {
+			b.error(w, r, http.StatusServiceUnavailable, "circuit open")
+			return
+		}
+		b.error(w, r, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+		return
+	}
+	if target.Breaker != nil && !target.Breaker.Allow() {
+		b.error(w, r, http.StatusServiceUnavailable, "circuit open")
+		return
+	}
+	if session, ok := b.strategy.(SessionStrategy); ok {
+		session.Bind(w, r, target)
+	}
+	// the proxy returns once the response is copied or the error handler has run
+	target.active.Add(1)
+	defer target.active.Add(-1)
+	target.Proxy.ServeHTTP(w, r)
+}
+
+// error writes an error response with Error, or http.Error if it is nil
+func (b *Balancer) error(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if b.Error != nil {
+		b.Error(w, r, status, message)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// circuitOpen returns true when a healthy target is only unavailable because its circuit is open
+func (b *Balancer) circuitOpen() bool {
+	for _, target := range b.targets {
+		if target.Breaker != nil && target.Healthy() && !target.Breaker.Ready() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// newTestTargets creates targets for the specified urls without proxies
+func newTestTargets(t *testing.T, rawURLs ...string) []*Target {
+	t.Helper()
+	targets := make([]*Target, 0, len(rawURLs))
+	for _, rawURL := range rawURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("failed to parse url %s: %v", rawURL, err)
+		}
+		targets = append(targets, &Target{URL: u})
+	}
+	return targets
+}
+
+func TestRoundRobin(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b", "http://c")
+	strategy := NewRoundRobin()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 6; i++ {
+		if got, want := strategy.Next(req, targets), targets[i%3]; got != want {
+			t.Errorf("pick %d = %s, want %s", i, got.URL, want.URL)
+		}
+	}
+}
+
+func TestRoundRobinSkipsUnhealthy(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	targets[0].recordProbe(false, 1, 1)
+	strategy := NewRoundRobin()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 4; i++ {
+		if got := strategy.Next(req, targets); got != targets[1] {
+			t.Errorf("pick %d = %s, want http://b", i, got.URL)
+		}
+	}
+}
+
+func TestBalancerAllUnhealthy(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	for _, target := range targets {
+		target.recordProbe(false, 1, 1)
+	}
+	rec := httptest.NewRecorder()
+	New(targets, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestBalancerError(t *testing.T) {
+	targets := newTestTargets(t, "http://a")
+	targets[0].recordProbe(false, 1, 1)
+	b := New(targets, nil)
+	var status int
+	b.Error = func(w http.ResponseWriter, r *http.Request, code int, message string) {
+		status = code
+		w.WriteHeader(http.StatusTeapot)
+	}
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if status != http.StatusBadGateway || rec.Code != http.StatusTeapot {
+		t.Errorf("Error called with %d and responded %d, want %d and %d", status, rec.Code, http.StatusBadGateway, http.StatusTeapot)
+	}
+}
+
+func TestBalancerForwardsToTarget(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+	targets := newTestTargets(t, upstream.URL)
+	targets[0].Proxy = httputil.NewSingleHostReverseProxy(targets[0].URL)
+	rec := httptest.NewRecorder()
+	New(targets, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "upstream" {
+		t.Errorf("got %d %q, want 200 \"upstream\"", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,133 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of a circuit breaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through
+	CircuitClosed CircuitState = iota
+	// CircuitHalfOpen lets a single probe request through to test whether the target recovered
+	CircuitHalfOpen
+	// CircuitOpen rejects all requests until the cooldown has passed
+	CircuitOpen
+)
+
+// String returns the name of the state
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitHalfOpen:
+		return "half-open"
+	case CircuitOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops requests to a target after consecutive failures. Once FailureThreshold consecutive
+// requests failed the circuit opens and requests are rejected. After the cooldown the circuit half-opens
+// and lets a single probe through: if it succeeds the circuit closes again, if it fails it reopens
+type CircuitBreaker struct {
+	// failureThreshold is the number of consecutive failures that open the circuit
+	failureThreshold int
+	// cooldown is how long the circuit stays open before a probe is let through
+	cooldown time.Duration
+	// onStateChange is called with the new state on each transition, if set
+	onStateChange func(state CircuitState)
+	// state is the current state of the circuit
+	state CircuitState
+	// failures is the number of consecutive failures
+	failures int
+	// changed is when the circuit last opened or let a probe through
+	changed time.Time
+	// now returns the current time, it is replaced in tests
+	now func() time.Time
+	// mutex is used to synchronize access to the state
+	mutex sync.Mutex
+}
+
+// NewCircuitBreaker creates a new closed circuit breaker that opens after failureThreshold consecutive
+// failures and probes the target again after cooldown
+func NewCircuitBreaker(failureThreshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		now:              time.Now,
+	}
+}
+
+// OnStateChange sets a callback that is called with the new state each time the circuit changes state. It
+// is called while the breaker's lock is held, so it must not call the breaker
+func (b *CircuitBreaker) OnStateChange(f func(state CircuitState)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.onStateChange = f
+}
+
+// State returns the current state of the circuit
+func (b *CircuitBreaker) State() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state
+}
+
+// Ready reports whether Allow may let a request through, without letting one through
+func (b *CircuitBreaker) Ready() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state == CircuitClosed || b.now().Sub(b.changed) >= b.cooldown
+}
+
+// Allow reports whether a request may be sent to the target. When the cooldown of an open circuit has
+// passed, the circuit half-opens and the request is let through as the probe. A half-open circuit lets no
+// other request through until the result of the probe is recorded, or another cooldown passed without one
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == CircuitClosed {
+		return true
+	}
+	now := b.now()
+	if now.Sub(b.changed) < b.cooldown {
+		return false
+	}
+	b.changed = now
+	b.setState(CircuitHalfOpen)
+	return true
+}
+
+// RecordSuccess records a successful request, closing the circuit
+func (b *CircuitBreaker) RecordSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures = 0
+	b.setState(CircuitClosed)
+}
+
+// RecordFailure records a failed request, opening the circuit if the probe of a half-open circuit failed
+// or the failure threshold was reached
+func (b *CircuitBreaker) RecordFailure() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.failures >= b.failureThreshold) {
+		b.changed = b.now()
+		b.setState(CircuitOpen)
+	}
+}
+
+// setState changes the state, notifying the callback of a transition. The lock must be held
+func (b *CircuitBreaker) setState(state CircuitState) {
+	if b.state == state {
+		return
+	}
+	b.state = state
+	if b.onStateChange != nil {
+		b.onStateChange(state)
+	}
+}
@@ -0,0 +1,136 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestBreaker creates a circuit breaker whose clock only moves when the returned func is called, recording
+// each state change
+func newTestBreaker(threshold int, cooldown time.Duration) (*CircuitBreaker, func(time.Duration), *[]CircuitState) {
+	b := NewCircuitBreaker(threshold, cooldown)
+	now := time.Unix(0, 0)
+	b.now = func() time.Time { return now }
+	var changes []CircuitState
+	b.OnStateChange(func(state CircuitState) {
+		changes = append(changes, state)
+	})
+	return b, func(d time.Duration) { now = now.Add(d) }, &changes
+}
+
+// expectState fails the test if the breaker is not in the state
+func expectState(t *testing.T, b *CircuitBreaker, want CircuitState) {
+	t.Helper()
+	if got := b.State(); got != want {
+		t.Fatalf("state = %s, want %s", got, want)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	b, advance, changes := newTestBreaker(3, 10*time.Second)
+	for i := 0; i < 2; i++ {
+		b.RecordFailure()
+		if !b.Allow() {
+			t.Fatalf("request rejected after %d failures", i+1)
+		}
+	}
+	expectState(t, b, CircuitClosed)
+	b.RecordFailure()
+	expectState(t, b, CircuitOpen)
+	if b.Allow() || b.Ready() {
+		t.Fatal("open circuit let a request through")
+	}
+
+	advance(9 * time.Second)
+	if b.Allow() {
+		t.Fatal("circuit let a request through before the cooldown passed")
+	}
+	advance(time.Second)
+	if !b.Ready() || !b.Allow() {
+		t.Fatal("circuit did not let a probe through after the cooldown")
+	}
+	expectState(t, b, CircuitHalfOpen)
+	if b.Allow() {
+		t.Fatal("half-open circuit let a second request through while probing")
+	}
+	b.RecordSuccess()
+	expectState(t, b, CircuitClosed)
+	if !b.Allow() {
+		t.Fatal("closed circuit rejected a request")
+	}
+
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(*changes) != len(want) {
+		t.Fatalf("state changes = %v, want %v", *changes, want)
+	}
+	for i, state := range want {
+		if (*changes)[i] != state {
+			t.Errorf("state change %d = %s, want %s", i, (*changes)[i], state)
+		}
+	}
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	b, advance, _ := newTestBreaker(1, 10*time.Second)
+	b.RecordFailure()
+	advance(10 * time.Second)
+	b.Allow()
+	b.RecordFailure()
+	expectState(t, b, CircuitOpen)
+	advance(5 * time.Second)
+	if b.Allow() {
+		t.Error("reopened circuit let a request through before another cooldown passed")
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	b, _, _ := newTestBreaker(2, time.Second)
+	b.RecordFailure()
+	b.RecordSuccess()
+	b.RecordFailure()
+	expectState(t, b, CircuitClosed)
+}
+
+func TestCircuitBreakerLostProbe(t *testing.T) {
+	b, advance, _ := newTestBreaker(1, 10*time.Second)
+	b.RecordFailure()
+	advance(10 * time.Second)
+	b.Allow()
+	// the probe never reports back, so another one is let through after another cooldown
+	advance(10 * time.Second)
+	if !b.Allow() {
+		t.Error("half-open circuit did not replace a probe that never reported back")
+	}
+}
+
+func TestBalancerCircuitOpen(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	for _, target := range targets {
+		target.Breaker, _, _ = newTestBreaker(1, time.Minute)
+	}
+	a, b := targets[0], targets[1]
+	a.Breaker.RecordFailure()
+
+	// a single target with an open circuit is answered with 503
+	rec := httptest.NewRecorder()
+	New([]*Target{a}, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	// other targets keep serving while the circuit of one is open
+	strategy := NewRoundRobin()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 4; i++ {
+		if got := strategy.Next(req, []*Target{a, b}); got != b {
+			t.Errorf("pick %d = %s, want http://b", i, got.URL)
+		}
+	}
+
+	health := New([]*Target{a, b}, nil).Health()
+	if health[0].Circuit != "open" || health[1].Circuit != "closed" {
+		t.Errorf("health = %+v, want the circuit of a open and b closed", health)
+	}
+}
@@ -0,0 +1,102 @@
+package balancer
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthChecker periodically probes a set of targets and removes failing ones from rotation
+type HealthChecker struct {
+	// Path is the path requested on each target to check its health
+	Path string
+	// Timeout specifies how long a probe may take before it counts as a failure
+	Timeout time.Duration
+	// UnhealthyThreshold is the number of consecutive failures after which a target is marked unhealthy
+	UnhealthyThreshold int
+	// HealthyThreshold is the number of consecutive successes after which an unhealthy target is marked healthy
+	HealthyThreshold int
+	// Client is used to send the probes. It must not follow redirects, so that 3xx responses are seen
+	Client *http.Client
+	// targets contains the targets that are probed
+	targets []*Target
+	// interval specifies how often the targets are probed
+	interval time.Duration
+	// stop is closed to stop the background probes
+	stop chan struct{}
+	// stopOnce ensures stop is only closed once
+	stopOnce sync.Once
+}
+
+// NewHealthChecker creates a new health checker that probes the specified targets at the specified interval.
+// The probe settings may be adjusted before calling Start
+func NewHealthChecker(targets []*Target, interval time.Duration) *HealthChecker {
+	return &HealthChecker{
+		Path:               "/",
+		Timeout:            5 * time.Second,
+		UnhealthyThreshold: 3,
+		HealthyThreshold:   2,
+		Client: &http.Client{
+			// a redirect is a healthy response in its own right and must not be followed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		targets:  targets,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start starts probing the targets in the background
+func (h *HealthChecker) Start() {
+	ticker := time.NewTicker(h.interval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				h.checkTargets()
+			case <-h.stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops probing the targets. It is safe to call more than once
+func (h *HealthChecker) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+}
+
+// checkTargets probes all targets concurrently and updates their health
+func (h *HealthChecker) checkTargets() {
+	var wg sync.WaitGroup
+	for _, target := range h.targets {
+		wg.Add(1)
+		go func(target *Target) {
+			defer wg.Done()
+			target.recordProbe(h.probe(target), h.UnhealthyThreshold, h.HealthyThreshold)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// probe returns true if the target responds to the health check with a 2xx or 3xx status
+func (h *HealthChecker) probe(target *Target) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.URL.JoinPath(h.Path).String(), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 400
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerMarksUnhealthyAndRecovers(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			t.Errorf("probe path = %s, want /healthz", r.URL.Path)
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+	targets := newTestTargets(t, upstream.URL)
+	checker := NewHealthChecker(targets, time.Hour)
+	checker.Path = "/healthz"
+	checker.UnhealthyThreshold = 2
+	checker.HealthyThreshold = 2
+
+	status.Store(http.StatusInternalServerError)
+	checker.checkTargets()
+	if !targets[0].Healthy() {
+		t.Fatal("target marked unhealthy before reaching the threshold")
+	}
+	checker.checkTargets()
+	if targets[0].Healthy() {
+		t.Fatal("target still healthy after reaching the threshold")
+	}
+
+	status.Store(http.StatusOK)
+	checker.checkTargets()
+	if targets[0].Healthy() {
+		t.Fatal("target marked healthy before reaching the threshold")
+	}
+	checker.checkTargets()
+	if !targets[0].Healthy() {
+		t.Fatal("target still unhealthy after reaching the threshold")
+	}
+}
+
+func TestHealthCheckerRedirectIsHealthy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/broken", http.StatusFound)
+	}))
+	defer upstream.Close()
+	targets := newTestTargets(t, upstream.URL)
+	checker := NewHealthChecker(targets, time.Hour)
+	checker.UnhealthyThreshold = 1
+	checker.checkTargets()
+	if !targets[0].Healthy() {
+		t.Error("a 3xx probe response marked the target unhealthy")
+	}
+}
+
+func TestHealthCheckerUnreachableTarget(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	targets := newTestTargets(t, upstream.URL)
+	checker := NewHealthChecker(targets, time.Hour)
+	checker.UnhealthyThreshold = 1
+	checker.checkTargets()
+	if targets[0].Healthy() {
+		t.Error("an unreachable target is still healthy")
+	}
+}
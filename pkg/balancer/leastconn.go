@@ -0,0 +1,38 @@
+package balancer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// LeastConnections is a Strategy that sends each request to the available target with the fewest requests in
+// flight. Ties are broken round-robin, so idle targets share the requests evenly
+type LeastConnections struct {
+	// next is the index of the target the search for the least busy target starts at
+	next atomic.Uint64
+}
+
+// NewLeastConnections creates a new least-connections strategy
+func NewLeastConnections() *LeastConnections {
+	return &LeastConnections{}
+}
+
+// Next returns the available target with the fewest requests in flight
+func (s *LeastConnections) Next(r *http.Request, targets []*Target) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	n := s.next.Add(1) - 1
+	var best *Target
+	var bestActive int64
+	for i := 0; i < len(targets); i++ {
+		target := targets[(n+uint64(i))%uint64(len(targets))]
+		if !target.Available() {
+			continue
+		}
+		if active := target.ActiveRequests(); best == nil || active < bestActive {
+			best, bestActive = target, active
+		}
+	}
+	return best
+}
@@ -0,0 +1,109 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeastConnectionsPicksIdlest(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b", "http://c")
+	targets[0].active.Store(2)
+	targets[1].active.Store(1)
+	targets[2].active.Store(3)
+	strategy := NewLeastConnections()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 3; i++ {
+		if got := strategy.Next(req, targets); got != targets[1] {
+			t.Errorf("pick %d = %s, want http://b", i, got.URL)
+		}
+	}
+	targets[1].recordProbe(false, 1, 1)
+	if got := strategy.Next(req, targets); got != targets[0] {
+		t.Errorf("pick = %s, want http://a with http://b unhealthy", got.URL)
+	}
+}
+
+func TestLeastConnectionsBreaksTiesRoundRobin(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	strategy := NewLeastConnections()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if first, second := strategy.Next(req, targets), strategy.Next(req, targets); first == second {
+		t.Errorf("idle targets picked %s twice", first.URL)
+	}
+}
+
+func TestLeastConnectionsFavorsIdleTargets(t *testing.T) {
+	release := make(chan struct{})
+	var slowRequests, fastRequests atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowRequests.Add(1)
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastRequests.Add(1)
+	}))
+	defer fast.Close()
+	targets := newTestTargets(t, slow.URL, fast.URL)
+	for _, target := range targets {
+		target.Proxy = httputil.NewSingleHostReverseProxy(target.URL)
+	}
+	b := New(targets, NewLeastConnections())
+
+	var wg sync.WaitGroup
+	defer func() {
+		close(release)
+		wg.Wait()
+	}()
+	for i := 0; i < 10; i++ {
+		slowBefore := slowRequests.Load()
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+		// the request either completes at the fast target or stays in flight at the slow one
+		deadline := time.After(5 * time.Second)
+	wait:
+		for {
+			select {
+			case <-done:
+				break wait
+			case <-deadline:
+				t.Fatalf("request %d neither completed nor reached the slow target", i)
+			default:
+				if slowRequests.Load() > slowBefore {
+					break wait
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+	if slowRequests.Load() != 1 || fastRequests.Load() != 9 {
+		t.Errorf("slow target got %d requests and fast target %d, want 1 and 9", slowRequests.Load(), fastRequests.Load())
+	}
+}
+
+func TestBalancerCountsFailedRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+	targets := newTestTargets(t, upstream.URL)
+	targets[0].Proxy = httputil.NewSingleHostReverseProxy(targets[0].URL)
+	targets[0].Proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if n := targets[0].ActiveRequests(); n != 1 {
+			t.Errorf("active requests while failing = %d, want 1", n)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	New(targets, NewLeastConnections()).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if n := targets[0].ActiveRequests(); n != 0 {
+		t.Errorf("active requests after the failed request = %d, want 0", n)
+	}
+}
@@ -0,0 +1,32 @@
+package balancer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// RoundRobin is a Strategy that cycles through the available targets in order
+type RoundRobin struct {
+	// next is the index of the next target to use
+	next atomic.Uint64
+}
+
+// NewRoundRobin creates a new round-robin strategy
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+// Next returns the next available target in the rotation
+func (s *RoundRobin) Next(r *http.Request, targets []*Target) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	n := s.next.Add(1) - 1
+	for i := 0; i < len(targets); i++ {
+		target := targets[(n+uint64(i))%uint64(len(targets))]
+		if target.Available() {
+			return target
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SessionStrategy is implemented by Strategies that bind each client to the target chosen for it by
+// marking the responses of the target
+type SessionStrategy interface {
+	Strategy
+	// Bind marks the response to the request so that later requests of the client are sent to the target
+	Bind(w http.ResponseWriter, r *http.Request, target *Target)
+}
+
+// Sticky is a SessionStrategy that sends the requests of a client to the target named by a cookie. Clients
+// without the cookie, or whose target is not available, are given a target by a fallback strategy
+type Sticky struct {
+	// CookieName is the name of the cookie identifying the target of the client
+	CookieName string
+	// TTL is how long the client keeps the cookie. Zero makes it a session cookie
+	TTL time.Duration
+	// fallback picks the targets of clients that are not bound to an available target
+	fallback Strategy
+}
+
+// NewSticky creates a sticky strategy binding clients with the specified cookie, falling back to the
+// specified strategy for clients that are not bound. If fallback is nil, round-robin is used
+func NewSticky(cookieName string, ttl time.Duration, fallback Strategy) *Sticky {
+	if fallback == nil {
+		fallback = NewRoundRobin()
+	}
+	return &Sticky{
+		CookieName: cookieName,
+		TTL:        ttl,
+		fallback:   fallback,
+	}
+}
+
+// Next returns the target named by the cookie of the request if it is available, or the target picked by
+// the fallback strategy otherwise
+func (s *Sticky) Next(r *http.Request, targets []*Target) *Target {
+	if cookie, err := r.Cookie(s.CookieName); err == nil {
+		for _, target := range targets {
+			if targetID(target) == cookie.Value && target.Available() {
+				return target
+			}
+		}
+	}
+	return s.fallback.Next(r, targets)
+}
+
+// Bind sets the cookie naming the target, unless the request already carries it
+func (s *Sticky) Bind(w http.ResponseWriter, r *http.Request, target *Target) {
+	id := targetID(target)
+	if cookie, err := r.Cookie(s.CookieName); err == nil && cookie.Value == id {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     s.CookieName,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if s.TTL > 0 {
+		cookie.MaxAge = int(s.TTL / time.Second)
+	}
+	http.SetCookie(w, cookie)
+}
+
+// targetID returns the cookie value identifying the target, a hash of its url so that the addresses of the
+// targets are not disclosed to clients
+func targetID(target *Target) string {
+	h := fnv.New64a()
+	h.Write([]byte(target.URL.String()))
+	return strconv.FormatUint(h.Sum64(), 36)
+}
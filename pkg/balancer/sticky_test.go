@@ -0,0 +1,67 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stickyRequest returns a request carrying the cookie set by the response, if any
+func stickyRequest(rec *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestStickyBindsClient(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b", "http://c")
+	strategy := NewSticky("target", time.Hour, nil)
+	first := strategy.Next(httptest.NewRequest(http.MethodGet, "/", nil), targets)
+	rec := httptest.NewRecorder()
+	strategy.Bind(rec, httptest.NewRequest(http.MethodGet, "/", nil), first)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "target" || cookies[0].MaxAge != 3600 || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %v, want a single target cookie kept for an hour", cookies)
+	}
+	req := stickyRequest(rec)
+	for i := 0; i < 5; i++ {
+		if got := strategy.Next(req, targets); got != first {
+			t.Errorf("pick %d = %s, want %s", i, got.URL, first.URL)
+		}
+	}
+	rebound := httptest.NewRecorder()
+	strategy.Bind(rebound, req, first)
+	if len(rebound.Result().Cookies()) != 0 {
+		t.Error("cookie set again for a client already bound to the target")
+	}
+}
+
+func TestStickyFallsBackWhenUnhealthy(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	strategy := NewSticky("target", 0, nil)
+	rec := httptest.NewRecorder()
+	strategy.Bind(rec, httptest.NewRequest(http.MethodGet, "/", nil), targets[0])
+	if cookie := rec.Result().Cookies()[0]; cookie.MaxAge != 0 || cookie.Expires.After(time.Now()) {
+		t.Errorf("cookie = %v, want a session cookie", cookie)
+	}
+	targets[0].recordProbe(false, 1, 1)
+	req := stickyRequest(rec)
+	for i := 0; i < 3; i++ {
+		if got := strategy.Next(req, targets); got != targets[1] {
+			t.Errorf("pick %d = %s, want the healthy http://b", i, got.URL)
+		}
+	}
+}
+
+func TestStickyUnknownCookie(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	strategy := NewSticky("target", 0, nil)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "target", Value: "unknown"})
+	if got := strategy.Next(req, targets); got == nil {
+		t.Error("no target picked for a client bound to an unknown target")
+	}
+}
@@ -0,0 +1,47 @@
+package balancer
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Weighted is a Strategy that sends each available target a share of the requests proportional to its
+// weight. It uses smooth weighted round-robin, so the requests of a heavy target are interleaved with those
+// of the others rather than sent in bursts
+type Weighted struct {
+	// mutex is used to synchronize access to current
+	mutex sync.Mutex
+	// current contains the current weight of each target, which grows by the weight of the target on each
+	// pick and shrinks by the total weight when the target is picked
+	current map[*Target]int
+}
+
+// NewWeighted creates a new weighted round-robin strategy
+func NewWeighted() *Weighted {
+	return &Weighted{
+		current: make(map[*Target]int),
+	}
+}
+
+// Next returns the available target with the highest current weight
+func (s *Weighted) Next(r *http.Request, targets []*Target) *Target {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var best *Target
+	total := 0
+	for _, target := range targets {
+		if !target.Available() {
+			continue
+		}
+		weight := target.weight()
+		s.current[target] += weight
+		total += weight
+		if best == nil || s.current[target] > s.current[best] {
+			best = target
+		}
+	}
+	if best != nil {
+		s.current[best] -= total
+	}
+	return best
+}
@@ -0,0 +1,59 @@
+package balancer
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWeightedDistribution(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b", "http://c")
+	targets[0].Weight = 3
+	targets[1].Weight = 1
+	// a zero weight counts as 1
+	strategy := NewWeighted()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	counts := make(map[*Target]int)
+	const picks = 10000
+	for i := 0; i < picks; i++ {
+		counts[strategy.Next(req, targets)]++
+	}
+	for target, want := range map[*Target]float64{targets[0]: 0.6, targets[1]: 0.2, targets[2]: 0.2} {
+		if got := float64(counts[target]) / picks; math.Abs(got-want) > 0.01 {
+			t.Errorf("%s got %.3f of the requests, want %.3f", target.URL, got, want)
+		}
+	}
+}
+
+func TestWeightedIsSmooth(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	targets[0].Weight = 3
+	strategy := NewWeighted()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	var order string
+	for i := 0; i < 8; i++ {
+		order += strategy.Next(req, targets).URL.Host
+	}
+	// smooth weighted round-robin interleaves the light target instead of sending a burst of aaab
+	if order != "aabaaaba" {
+		t.Errorf("order = %s, want aabaaaba", order)
+	}
+}
+
+func TestWeightedSkipsUnavailable(t *testing.T) {
+	targets := newTestTargets(t, "http://a", "http://b")
+	targets[0].Weight = 5
+	targets[0].recordProbe(false, 1, 1)
+	strategy := NewWeighted()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 4; i++ {
+		if got := strategy.Next(req, targets); got != targets[1] {
+			t.Errorf("pick %d = %s, want http://b", i, got.URL)
+		}
+	}
+	targets[1].recordProbe(false, 1, 1)
+	if got := strategy.Next(req, targets); got != nil {
+		t.Errorf("pick = %s, want none without available targets", got.URL)
+	}
+}
@@ -2,22 +2,108 @@
 package cache
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Cache is a simple, thread-safe key-value cache
 type Cache struct {
+	// cacheState holds the items and settings of the cache. The background cleanup only references the state,
+	// so a Cache that is no longer referenced can be garbage collected, which stops its cleanup
+	*cacheState
+}
+
+// cacheState is the state of a Cache
+type cacheState struct {
 	// items contains all the items stored in the cache
 	items map[string]Item
 	// mutex is used to synchronize access to the cache
 	mutex sync.RWMutex
 	// defaultExpiration specifies the default expiration time of an item
 	defaultExpiration time.Duration
-	// cleanupInterval specifies how often the cache should be cleaned
+	// cleanupInterval specifies how often the cache should be cleaned. Zero or negative disables the cleanup
 	cleanupInterval time.Duration
-	// stopCleanup is used to stop the background cleanup process
+	// stopCleanup is closed to stop the background cleanup process
 	stopCleanup chan bool
+	// stopOnce ensures stopCleanup is only closed once
+	stopOnce sync.Once
+	// cleanupDone is closed once the background cleanup process has stopped
+	cleanupDone chan struct{}
+	// maxItems specifies the maximum number of items in the cache. Zero or negative means unlimited
+	maxItems int
+	// lru orders the keys from most to least recently used when maxItems is set
+	lru *list.List
+	// elements maps each key to its element in lru when maxItems is set
+	elements map[string]*list.Element
+	// onEvicted is called with the key and value of each item removed from the cache
+	onEvicted func(key string, value interface{})
+	// pending contains the in-flight builds started by GetOrSet
+	pending map[string]*pendingBuild
+	// pendingMutex is used to synchronize access to pending
+	pendingMutex sync.Mutex
+	// clock tells the current time, it is a real clock unless a test injected another one
+	clock Clock
+	// nowFunc returns the current time of clock and is used for all expiration checks
+	nowFunc func() time.Time
+	// jitter is the fraction of its duration by which the expiration of each item set is randomly moved
+	// earlier or later. Zero means items expire exactly after their duration
+	jitter float64
+	// sliding is true when every successful get resets the expiration of the item to its duration from now
+	sliding atomic.Bool
+	// hits counts the gets that found an item that had not expired
+	hits atomic.Uint64
+	// misses counts the gets for missing or expired items
+	misses atomic.Uint64
+	// sets counts the items stored
+	sets atomic.Uint64
+	// deletes counts the items removed by Delete or Flush
+	deletes atomic.Uint64
+	// evictions counts the items removed because they expired or the cache was full
+	evictions atomic.Uint64
+}
+
+// Stats holds the cumulative counters of a cache since it was created or its stats were last reset, along with
+// gauges of its current size. Rates, such as the eviction rate, are derived from the difference between two
+// readings of a counter divided by the time between them
+type Stats struct {
+	// Hits is the number of gets that found an item that had not expired
+	Hits uint64 `json:"hits"`
+	// Misses is the number of gets for missing or expired items
+	Misses uint64 `json:"misses"`
+	// Sets is the number of items stored by Set, Add, Replace, GetOrSet and Load
+	Sets uint64 `json:"sets"`
+	// Deletes is the number of items removed by Delete or Flush
+	Deletes uint64 `json:"deletes"`
+	// Evictions is the number of items removed because they expired or the cache was full
+	Evictions uint64 `json:"evictions"`
+	// Size is the number of items that have not expired, like Len. Expired items that have not been removed yet
+	// are not counted
+	Size int `json:"size"`
+	// Capacity is the maximum number of items of the cache, zero if it is unlimited
+	Capacity int `json:"capacity,omitempty"`
+	// Utilization is Size divided by Capacity, zero if the cache is unlimited
+	Utilization float64 `json:"utilization,omitempty"`
+}
+
+// Clock tells the current time to a cache
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+}
+
+// realClock is the Clock of the system time
+type realClock struct{}
+
+// Now returns the current system time
+func (realClock) Now() time.Time {
+	return time.Now()
 }
 
 // Item represents a cache item
@@ -26,62 +112,425 @@ type Item struct {
 	value interface{}
 	// expiration specifies how long the item is valid
 	expiration int64
+	// duration is the duration the item was set with, by which sliding expiration extends it. Zero means
+	// the item is not extended
+	duration time.Duration
+}
+
+// pendingBuild is an in-flight build of a missing item started by GetOrSet
+type pendingBuild struct {
+	// done is closed once the build has finished
+	done chan struct{}
+	// value is the value returned by the build
+	value interface{}
+	// err is the error returned by the build
+	err error
+}
+
+// evictedItem is an item that has been removed from the cache and is pending the eviction callback
+type evictedItem struct {
+	key   string
+	value interface{}
 }
 
-// NewCache creates a new cache with the specified default expiration and cleanup interval
+// NewCache creates a new cache with the specified default expiration and cleanup interval. A cleanup interval
+// of zero or less starts no background cleanup, so expired items are only skipped by reads and removed when
+// they are overwritten or deleted
 func NewCache(defaultExpiration, cleanupInterval time.Duration) *Cache {
+	return NewCacheWithMaxSize(defaultExpiration, cleanupInterval, 0)
+}
+
+// NewCacheWithMaxSize creates a new cache with the specified default expiration and cleanup interval
+// that holds at most maxItems items, evicting the least recently used item when it is exceeded.
+// Zero or negative maxItems means the cache is unlimited
+func NewCacheWithMaxSize(defaultExpiration, cleanupInterval time.Duration, maxItems int) *Cache {
+	return newCache(context.Background(), defaultExpiration, cleanupInterval, maxItems, realClock{})
+}
+
+// NewCacheWithContext creates a new cache like NewCache whose background cleanup process stops when ctx is
+// done, or when StopCleanup is called, whichever happens first
+func NewCacheWithContext(ctx context.Context, defaultExpiration, cleanupInterval time.Duration) *Cache {
+	return newCache(ctx, defaultExpiration, cleanupInterval, 0, realClock{})
+}
+
+// newCache creates a new cache like NewCacheWithMaxSize that tells the time with the specified clock and
+// stops its cleanup process when ctx is done
+func newCache(ctx context.Context, defaultExpiration, cleanupInterval time.Duration, maxItems int, clock Clock) *Cache {
 	items := make(map[string]Item)
-	cache := Cache{
+	cache := Cache{&cacheState{
 		items:             items,
 		defaultExpiration: defaultExpiration,
 		cleanupInterval:   cleanupInterval,
 		stopCleanup:       make(chan bool),
+		cleanupDone:       make(chan struct{}),
+		maxItems:          maxItems,
+		pending:           make(map[string]*pendingBuild),
+		clock:             clock,
+		nowFunc:           clock.Now,
+	}}
+	if maxItems > 0 {
+		cache.lru = list.New()
+		cache.elements = make(map[string]*list.Element)
+	}
+	cache.startCleanupTimer(ctx)
+	if cache.cleanupInterval > 0 {
+		// a safety net for caches that are dropped without calling StopCleanup, which should still be called
+		// as the finalizer only runs at some point after the cache is collected, if at all
+		runtime.SetFinalizer(&cache, (*Cache).StopCleanup)
 	}
-	cache.startCleanupTimer()
 	return &cache
 }
 
+// ErrItemExists is returned by Add when an item that has not expired already exists for the key
+var ErrItemExists = errors.New("item already exists")
+
+// ErrItemNotFound is returned by Replace when no item that has not expired exists for the key
+var ErrItemNotFound = errors.New("item not found")
+
 // Set adds a new item to the cache. If the item already exists, it will be overwritten
 func (c *Cache) Set(key string, value interface{}, duration time.Duration) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	evicted := c.set(key, value, duration)
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+}
+
+// Add adds a new item to the cache only if no item that has not expired exists for the key. Otherwise an
+// error wrapping ErrItemExists is returned and the existing item is left unchanged
+func (c *Cache) Add(key string, value interface{}, duration time.Duration) error {
+	c.mutex.Lock()
+	if item, found := c.items[key]; found && !c.expired(item) {
+		c.mutex.Unlock()
+		return fmt.Errorf("add %s: %w", key, ErrItemExists)
+	}
+	evicted := c.set(key, value, duration)
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+	return nil
+}
+
+// SetIfAbsent stores the value like Add only if no item that has not expired exists for the key. It returns
+// the value now in the cache and whether this call stored it, so that callers racing to store a value for the
+// same key all end up using the one that won. It is a lighter alternative to GetOrSet when building the value
+// is cheap enough that losing the race may waste it. Like Add, it does not count as a lookup in the stats
+func (c *Cache) SetIfAbsent(key string, value interface{}, duration time.Duration) (actual interface{}, stored bool) {
+	c.mutex.Lock()
+	if item, found := c.items[key]; found && !c.expired(item) {
+		c.mutex.Unlock()
+		return item.value, false
+	}
+	evicted := c.set(key, value, duration)
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+	return value, true
+}
+
+// Replace overwrites the item with the specified key only if it exists and has not expired. Otherwise an
+// error wrapping ErrItemNotFound is returned and nothing is stored
+func (c *Cache) Replace(key string, value interface{}, duration time.Duration) error {
+	c.mutex.Lock()
+	if item, found := c.items[key]; !found || c.expired(item) {
+		c.mutex.Unlock()
+		return fmt.Errorf("replace %s: %w", key, ErrItemNotFound)
+	}
+	evicted := c.set(key, value, duration)
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+	return nil
+}
+
+// set stores an item like Set and returns the items it evicted. The caller must hold the write lock and
+// notify the eviction callback after releasing it
+func (c *Cache) set(key string, value interface{}, duration time.Duration) []evictedItem {
 	var expiration int64
 	if duration == 0 {
 		duration = c.defaultExpiration
 	}
 	if duration > 0 {
-		expiration = time.Now().Add(duration).UnixNano()
+		expiration = c.nowFunc().Add(duration).UnixNano()
+		if c.jitter > 0 {
+			// spread by up to ±jitter so that items set together do not all expire together
+			expiration += int64(float64(duration) * c.jitter * (2*rand.Float64() - 1))
+		}
+	} else {
+		duration = 0
 	}
-	c.items[key] = Item{
+	return c.store(key, Item{
 		value:      value,
 		expiration: expiration,
+		duration:   duration,
+	})
+}
+
+// store stores the item under the specified key and returns the items it evicted. The caller must hold the
+// write lock and notify the eviction callback after releasing it
+func (c *Cache) store(key string, item Item) []evictedItem {
+	var evicted []evictedItem
+	// an expired item that has not been cleaned up yet is evicted rather than silently overwritten
+	if existing, found := c.items[key]; found && c.expired(existing) {
+		evicted = append(evicted, evictedItem{
+			key:   key,
+			value: existing.value,
+		})
+	}
+	c.items[key] = item
+	c.sets.Add(1)
+	if c.maxItems > 0 {
+		c.touch(key)
+		for len(c.items) > c.maxItems {
+			evicted = append(evicted, c.removeItem(c.lru.Back().Value.(string)))
+		}
 	}
+	c.evictions.Add(uint64(len(evicted)))
+	return evicted
+}
+
+// expired reports whether the item has expired. The caller must hold the lock
+func (c *Cache) expired(item Item) bool {
+	return item.expiration > 0 && c.nowFunc().UnixNano() > item.expiration
 }
 
 // Get returns the value of the item with the specified key. If the item does not exist or is expired,
 // nil will be returned instead
 func (c *Cache) Get(key string) interface{} {
+	// recording recency modifies the lru list and sliding expiration modifies the item, which requires the
+	// write lock
+	sliding := c.sliding.Load()
+	if c.maxItems > 0 || sliding {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	} else {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+	}
+	item, found := c.items[key]
+	if !found || c.expired(item) {
+		c.misses.Add(1)
+		return nil
+	}
+	return c.hit(key, item, sliding).value
+}
+
+// GetWithExpiration returns the value of the item with the specified key, the time it expires at and true if
+// it was found. The expiration is the zero time for items that never expire. If the item does not exist or
+// is expired, nil, the zero time and false will be returned instead
+func (c *Cache) GetWithExpiration(key string) (interface{}, time.Time, bool) {
+	// recording recency modifies the lru list and sliding expiration modifies the item, which requires the
+	// write lock
+	sliding := c.sliding.Load()
+	if c.maxItems > 0 || sliding {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	} else {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+	}
+	item, found := c.items[key]
+	if !found || c.expired(item) {
+		c.misses.Add(1)
+		return nil, time.Time{}, false
+	}
+	item = c.hit(key, item, sliding)
+	var expiration time.Time
+	if item.expiration > 0 {
+		expiration = time.Unix(0, item.expiration)
+	}
+	return item.value, expiration, true
+}
+
+// hit records a successful get of the item with the specified key, marking it as recently used and, if
+// sliding, extending its expiration. It returns the updated item. The caller must hold the write lock if
+// the cache has a maximum size or sliding is true, and the read lock otherwise
+func (c *Cache) hit(key string, item Item, sliding bool) Item {
+	c.hits.Add(1)
+	if c.maxItems > 0 {
+		c.touch(key)
+	}
+	if sliding && item.duration > 0 {
+		item.expiration = c.nowFunc().Add(item.duration).UnixNano()
+		c.items[key] = item
+	}
+	return item
+}
+
+// peek returns the value of the item with the specified key like Get, but without marking it as used or
+// counting the lookup in the stats
+func (c *Cache) peek(key string) interface{} {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 	item, found := c.items[key]
-	if !found {
+	if !found || c.expired(item) {
 		return nil
 	}
-	if item.expiration > 0 {
-		if time.Now().UnixNano() > item.expiration {
-			return nil
+	return item.value
+}
+
+// GetOrSet returns the value of the item with the specified key. If the item does not exist or is expired,
+// build is called to create the value, which is then stored with the specified duration. Concurrent calls
+// for the same missing key wait for a single call to build and share its result. If build returns an error,
+// nothing is stored and the error is returned to every waiting caller. If build panics, the waiting callers
+// receive an error and the panic is propagated to the caller that ran build
+func (c *Cache) GetOrSet(key string, duration time.Duration, build func() (interface{}, error)) (interface{}, error) {
+	if value := c.Get(key); value != nil {
+		return value, nil
+	}
+	c.pendingMutex.Lock()
+	if pb, found := c.pending[key]; found {
+		c.pendingMutex.Unlock()
+		<-pb.done
+		return pb.value, pb.err
+	}
+	// another caller may have finished building the item since the first check. The first check has
+	// already been counted in the stats, so this one looks the item up without counting it
+	if value := c.peek(key); value != nil {
+		c.pendingMutex.Unlock()
+		return value, nil
+	}
+	pb := &pendingBuild{
+		done: make(chan struct{}),
+	}
+	c.pending[key] = pb
+	c.pendingMutex.Unlock()
+
+	defer func() {
+		// waiters must never see a nil value with a nil error, so a panicking build is reported to them
+		// as an error before the panic continues
+		recovered := recover()
+		if recovered != nil {
+			pb.value, pb.err = nil, fmt.Errorf("build for %s panicked: %v", key, recovered)
 		}
+		c.pendingMutex.Lock()
+		delete(c.pending, key)
+		c.pendingMutex.Unlock()
+		close(pb.done)
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+	pb.value, pb.err = build()
+	if pb.err == nil {
+		c.Set(key, pb.value, duration)
 	}
-	return item.value
+	return pb.value, pb.err
 }
 
-// Delete removes the item with the specified key from the cache
-func (c *Cache) Delete(key string) {
+// Delete removes the item with the specified key from the cache. It returns true if the item existed
+// and had not expired before it was removed
+func (c *Cache) Delete(key string) bool {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	delete(c.items, key)
+	item, found := c.items[key]
+	if !found {
+		c.mutex.Unlock()
+		return false
+	}
+	live := !c.expired(item)
+	evicted := c.removeItem(key)
+	c.deletes.Add(1)
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, []evictedItem{evicted})
+	return live
 }
 
+// DeleteMatching removes the items whose keys satisfy match, whether they have expired or not, and returns the
+// number of items removed. match is called under the write lock, so it must not use the cache. The eviction
+// callback, if any, is called for each removed item after the lock has been released
+func (c *Cache) DeleteMatching(match func(key string) bool) int {
+	c.mutex.Lock()
+	var evicted []evictedItem
+	for key := range c.items {
+		if match(key) {
+			evicted = append(evicted, c.removeItem(key))
+		}
+	}
+	c.deletes.Add(uint64(len(evicted)))
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+	return len(evicted)
+}
+
+// Increment atomically adds delta to the int64 value of the item with the specified key and returns the new
+// value. The expiration of the item is preserved. If the item does not exist or is expired, it is created
+// with the value delta and the default expiration. If the value is not an int64, an error wrapping
+// ErrUnexpectedType is returned and the item is left unchanged
+func (c *Cache) Increment(key string, delta int64) (int64, error) {
+	c.mutex.Lock()
+	item, found := c.items[key]
+	var evicted []evictedItem
+	if found && item.expiration > 0 && c.nowFunc().UnixNano() > item.expiration {
+		// an expired item that has not been cleaned up yet is evicted rather than incremented
+		evicted = append(evicted, evictedItem{
+			key:   key,
+			value: item.value,
+		})
+		found = false
+	}
+	var value int64
+	if found {
+		current, ok := item.value.(int64)
+		if !ok {
+			c.mutex.Unlock()
+			return 0, fmt.Errorf("item %s has type %T: %w", key, item.value, ErrUnexpectedType)
+		}
+		value = current + delta
+		item.value = value
+	} else {
+		value = delta
+		item = Item{value: value}
+		if c.defaultExpiration > 0 {
+			item.expiration = c.nowFunc().Add(c.defaultExpiration).UnixNano()
+			item.duration = c.defaultExpiration
+		}
+	}
+	c.items[key] = item
+	if c.maxItems > 0 {
+		c.touch(key)
+		for len(c.items) > c.maxItems {
+			evicted = append(evicted, c.removeItem(c.lru.Back().Value.(string)))
+		}
+	}
+	c.evictions.Add(uint64(len(evicted)))
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+	return value, nil
+}
+
+// Decrement atomically subtracts delta from the int64 value of the item with the specified key and returns
+// the new value, following the same rules as Increment
+func (c *Cache) Decrement(key string, delta int64) (int64, error) {
+	return c.Increment(key, -delta)
+}
+
+// Flush removes all items from the cache at once. The eviction callback, if any, is called for each removed
+// item after the lock has been released
+func (c *Cache) Flush() {
+	c.mutex.Lock()
+	evicted := make([]evictedItem, 0, len(c.items))
+	for key, item := range c.items {
+		evicted = append(evicted, evictedItem{
+			key:   key,
+			value: item.value,
+		})
+	}
+	c.items = make(map[string]Item)
+	c.deletes.Add(uint64(len(evicted)))
+	if c.maxItems > 0 {
+		c.lru.Init()
+		c.elements = make(map[string]*list.Element)
+	}
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+}
+
+// Extend resets the expiration of the item with the specified key to duration from now, or the default
+// expiration if duration is zero. It does nothing if the key is missing, see Touch to find out
 func (c *Cache) Extend(key string, duration time.Duration) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -89,44 +538,228 @@ func (c *Cache) Extend(key string, duration time.Duration) {
 	if !found {
 		return
 	}
+	c.items[key] = c.extended(item, duration)
+}
+
+// Touch resets the expiration of the item with the specified key like Extend, and reports whether an item that
+// had not expired was found and extended. An expired item is left to expire, so that callers repopulate it
+func (c *Cache) Touch(key string, duration time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	item, found := c.items[key]
+	if !found || c.expired(item) {
+		return false
+	}
+	c.items[key] = c.extended(item, duration)
+	return true
+}
+
+// extended returns the item with its expiration reset to duration from now, or the default expiration if
+// duration is zero. A negative duration leaves the expiration unchanged
+func (c *Cache) extended(item Item, duration time.Duration) Item {
 	if duration == 0 {
 		duration = c.defaultExpiration
 	}
 	if duration > 0 {
-		item.expiration = time.Now().Add(duration).UnixNano()
+		item.expiration = c.nowFunc().Add(duration).UnixNano()
+		item.duration = duration
+	}
+	return item
+}
+
+// OnEvicted sets a callback that is called with the key and value of each item removed from the cache,
+// whether by Delete, expiration or lru eviction. It is not called when Set overwrites an item that has
+// not expired. The callback is invoked after the item has been removed, without holding the lock, on the
+// goroutine that removed it; items evicted together by a single operation are passed in the order they
+// were removed
+func (c *Cache) OnEvicted(f func(key string, value interface{})) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.onEvicted = f
+}
+
+// SetSlidingExpiration enables or disables sliding expiration. When enabled, every get that finds an item
+// resets its expiration to the duration it was set with from now, so that items in use stay in the cache
+// while idle ones expire. Items that never expire are unaffected. It is disabled by default, in which case
+// items expire after their duration however often they are used
+func (c *Cache) SetSlidingExpiration(enabled bool) {
+	c.sliding.Store(enabled)
+}
+
+// SetExpirationJitter sets the fraction of its duration by which the expiration of each item set afterwards
+// is randomly moved earlier or later, so that 0.1 spreads the expiration of items set with a duration of 10
+// minutes between 9 and 11 minutes. The fraction is clamped to between 0, the default that disables jitter,
+// and 1
+func (c *Cache) SetExpirationJitter(jitter float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.jitter = min(max(jitter, 0), 1)
+}
+
+// Stats returns the counters and size of the cache. Each counter is read atomically, but they are not read
+// together, so operations running concurrently may be counted in some of them and not yet in others. The size
+// is counted like Len, so reading it walks the cache
+func (c *Cache) Stats() Stats {
+	size := c.Len()
+	stats := Stats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Sets:      c.sets.Load(),
+		Deletes:   c.deletes.Load(),
+		Evictions: c.evictions.Load(),
+		Size:      size,
+	}
+	if c.maxItems > 0 {
+		stats.Capacity = c.maxItems
+		stats.Utilization = float64(size) / float64(c.maxItems)
+	}
+	return stats
+}
+
+// ResetStats resets all counters of the cache to zero, the size is left as it is
+func (c *Cache) ResetStats() {
+	c.hits.Store(0)
+	c.misses.Store(0)
+	c.sets.Store(0)
+	c.deletes.Store(0)
+	c.evictions.Store(0)
+}
+
+// Len returns the number of items in the cache that have not expired
+func (c *Cache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	now := c.nowFunc().UnixNano()
+	count := 0
+	for _, item := range c.items {
+		if item.expiration > 0 && now > item.expiration {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// Keys returns a snapshot of the keys of all items in the cache that have not expired, in no
+// particular order
+func (c *Cache) Keys() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	now := c.nowFunc().UnixNano()
+	keys := make([]string, 0, len(c.items))
+	for key, item := range c.items {
+		if item.expiration > 0 && now > item.expiration {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Range calls f with the key and value of each item in the cache that has not expired, in no particular
+// order, until f returns false. It does not mark the items as recently used. f is called while the read lock
+// is held, so it must not call back into the cache or it may deadlock
+func (c *Cache) Range(f func(key string, value interface{}) bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	now := c.nowFunc().UnixNano()
+	for key, item := range c.items {
+		if item.expiration > 0 && now > item.expiration {
+			continue
+		}
+		if !f(key, item.value) {
+			return
+		}
 	}
-	c.items[key] = item
 }
 
 // startCleanupTimer starts a background goroutine that cleans up the cache at the specified
-// cleanup interval
-func (c *Cache) startCleanupTimer() {
+// cleanup interval until StopCleanup is called or ctx is done. No goroutine is started if the
+// interval is zero or negative
+func (c *Cache) startCleanupTimer(ctx context.Context) {
+	if c.cleanupInterval <= 0 {
+		close(c.cleanupDone)
+		return
+	}
 	ticker := time.NewTicker(c.cleanupInterval)
+	// the goroutine must not reference c, or the cache would never be collected and its finalizer never run
+	state := c.cacheState
 	go func() {
+		defer close(state.cleanupDone)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				c.deleteExpiredItems()
-			case <-c.stopCleanup:
-				ticker.Stop()
+				(&Cache{state}).DeleteExpired()
+			case <-state.stopCleanup:
+				return
+			case <-ctx.Done():
 				return
 			}
 		}
 	}()
 }
 
-// deleteExpiredItems deletes all expired items from the cache
-func (c *Cache) deleteExpiredItems() {
+// DeleteExpired removes all expired items from the cache, calling the eviction callback for each, and returns
+// the number of items removed. It is what the background cleanup runs at every interval, and lets caches
+// without one be cleaned up on demand
+func (c *Cache) DeleteExpired() int {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	var evicted []evictedItem
+	now := c.nowFunc().UnixNano()
 	for key, item := range c.items {
-		if item.expiration > 0 && time.Now().UnixNano() > item.expiration {
-			delete(c.items, key)
+		if item.expiration > 0 && now > item.expiration {
+			evicted = append(evicted, c.removeItem(key))
 		}
 	}
+	c.evictions.Add(uint64(len(evicted)))
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+	return len(evicted)
+}
+
+// touch marks the item with the specified key as the most recently used. The caller must hold the write lock
+func (c *Cache) touch(key string) {
+	if element, found := c.elements[key]; found {
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.elements[key] = c.lru.PushFront(key)
+}
+
+// removeItem removes the item with the specified key from the cache and the lru list, returning it so
+// that the eviction callback can be invoked. The caller must hold the write lock
+func (c *Cache) removeItem(key string) evictedItem {
+	item := c.items[key]
+	delete(c.items, key)
+	if c.maxItems > 0 {
+		if element, found := c.elements[key]; found {
+			c.lru.Remove(element)
+			delete(c.elements, key)
+		}
+	}
+	return evictedItem{
+		key:   key,
+		value: item.value,
+	}
+}
+
+// notifyEvicted invokes the eviction callback for each evicted item. It must be called without holding the lock
+func notifyEvicted(onEvicted func(key string, value interface{}), evicted []evictedItem) {
+	if onEvicted == nil {
+		return
+	}
+	for _, item := range evicted {
+		onEvicted(item.key, item.value)
+	}
 }
 
-// StopCleanup stops the background cleanup process
+// StopCleanup stops the background cleanup process. It is safe to call more than once. A cache that is no
+// longer referenced stops its cleanup once it is garbage collected, but that may take a while, so caches that
+// are done with should still be stopped explicitly
 func (c *Cache) StopCleanup() {
-	c.stopCleanup <- true
+	c.stopOnce.Do(func() {
+		close(c.stopCleanup)
+	})
 }
@@ -0,0 +1,1078 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCache creates a cache that is stopped when the test finishes
+func newTestCache(t *testing.T, defaultExpiration time.Duration) *Cache {
+	t.Helper()
+	c := NewCache(defaultExpiration, time.Hour)
+	t.Cleanup(c.StopCleanup)
+	return c
+}
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	// now is the current time of the clock
+	now time.Time
+	// mutex is used to synchronize access to now
+	mutex sync.Mutex
+}
+
+// Now returns the current time of the clock
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// newFakeClockCache creates a cache telling the time with a fake clock and no background cleanup, so that
+// expired items stay until DeleteExpired is called
+func newFakeClockCache(t *testing.T, defaultExpiration time.Duration, maxItems int) (*Cache, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := newCache(context.Background(), defaultExpiration, 0, maxItems, clock)
+	return c, clock
+}
+
+func TestFakeClockExpiration(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("default", 1, 0)
+	c.Set("short", 2, time.Second)
+	c.Set("permanent", 3, -1)
+
+	clock.Advance(time.Second)
+	if c.Get("short") == nil {
+		t.Error("item expired at its expiration time rather than after it")
+	}
+	clock.Advance(time.Nanosecond)
+	if c.Get("short") != nil {
+		t.Error("item did not expire after its duration")
+	}
+	c.Extend("default", 2*time.Minute)
+	clock.Advance(time.Minute)
+	if c.Get("default") == nil {
+		t.Error("extended item expired at its original expiration")
+	}
+	clock.Advance(time.Minute + time.Second)
+	if c.Get("default") != nil {
+		t.Error("extended item did not expire after its extended duration")
+	}
+	if c.Get("permanent") == nil {
+		t.Error("item without expiration expired")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("a", 1, time.Second)
+	if !c.Touch("a", time.Minute) {
+		t.Error("Touch of an item that has not expired = false, want true")
+	}
+	clock.Advance(30 * time.Second)
+	if c.Get("a") == nil {
+		t.Error("touched item expired at its original expiration")
+	}
+	if c.Touch("missing", time.Minute) {
+		t.Error("Touch of a missing key = true, want false")
+	}
+	if _, found := c.items["missing"]; found {
+		t.Error("Touch of a missing key stored an item")
+	}
+
+	c.Set("b", 2, time.Second)
+	clock.Advance(2 * time.Second)
+	if c.Touch("b", time.Minute) {
+		t.Error("Touch of an expired item = true, want false")
+	}
+	if c.Get("b") != nil {
+		t.Error("Touch revived an expired item")
+	}
+}
+
+func TestNoCleanup(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		c := newCache(context.Background(), time.Minute, interval, 0, clock)
+		select {
+		case <-c.cleanupDone:
+		default:
+			t.Fatalf("interval %v: a background cleanup was started", interval)
+		}
+		c.Set("a", 1, time.Second)
+		if c.Get("a") != 1 {
+			t.Errorf("interval %v: item missing before it expired", interval)
+		}
+		clock.Advance(time.Minute)
+		if c.Get("a") != nil {
+			t.Errorf("interval %v: expired item returned by Get", interval)
+		}
+		if _, _, found := c.GetWithExpiration("a"); found {
+			t.Errorf("interval %v: expired item returned by GetWithExpiration", interval)
+		}
+		// StopCleanup is still safe to call
+		c.StopCleanup()
+	}
+}
+
+func TestFakeClockDeleteExpired(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	var evicted []string
+	c.OnEvicted(func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	c.Set("a", 1, time.Second)
+	c.Set("b", 2, time.Hour)
+	clock.Advance(time.Minute)
+	if removed := c.DeleteExpired(); removed != 1 {
+		t.Errorf("DeleteExpired removed %d items, want 1", removed)
+	}
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("evicted = %v, want [a]", evicted)
+	}
+	if len(c.items) != 1 {
+		t.Errorf("cache holds %d items after cleanup, want 1", len(c.items))
+	}
+	if removed := c.DeleteExpired(); removed != 0 {
+		t.Errorf("second DeleteExpired removed %d items, want 0", removed)
+	}
+	c.Set("permanent", 3, -1)
+	clock.Advance(2 * time.Hour)
+	if removed := c.DeleteExpired(); removed != 1 || c.Get("permanent") != 3 {
+		t.Errorf("DeleteExpired removed %d items, want only the expired b", removed)
+	}
+	if got := c.Stats().Evictions; got != 2 {
+		t.Errorf("evictions = %d, want 2", got)
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 3)
+	var evicted []string
+	c.OnEvicted(func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	c.Set("api.example.com", 1, 0)
+	c.Set("api.example.org", 2, 0)
+	c.Set("expired.example.com", 3, time.Second)
+	clock.Advance(time.Second + time.Nanosecond)
+
+	removed := c.DeleteMatching(func(key string) bool {
+		return strings.HasSuffix(key, ".example.com")
+	})
+	if removed != 2 {
+		t.Errorf("DeleteMatching removed %d items, want 2", removed)
+	}
+	sort.Strings(evicted)
+	if want := []string{"api.example.com", "expired.example.com"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted = %v, want %v", evicted, want)
+	}
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != "api.example.org" {
+		t.Errorf("keys after DeleteMatching = %v, want [api.example.org]", keys)
+	}
+	// the removed keys no longer count against the size limit
+	c.Set("a.example.net", 4, 0)
+	c.Set("b.example.net", 5, 0)
+	if c.Get("api.example.org") != 2 {
+		t.Error("the remaining item was evicted for the space of removed items")
+	}
+	if removed := c.DeleteMatching(func(string) bool { return false }); removed != 0 {
+		t.Errorf("DeleteMatching without matches removed %d items", removed)
+	}
+}
+
+func TestGetWithExpiration(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("permanent", 1, -1)
+	c.Set("default", 2, 0)
+	c.Set("expiring", 3, time.Second)
+
+	value, expiration, found := c.GetWithExpiration("permanent")
+	if !found || value != 1 || !expiration.IsZero() {
+		t.Errorf("permanent = %v, %v, %v, want 1, zero time, true", value, expiration, found)
+	}
+	value, expiration, found = c.GetWithExpiration("default")
+	if want := time.Unix(0, 0).Add(time.Minute); !found || value != 2 || !expiration.Equal(want) {
+		t.Errorf("default = %v, %v, %v, want 2, %v, true", value, expiration, found, want)
+	}
+	value, expiration, found = c.GetWithExpiration("expiring")
+	if want := time.Unix(0, 0).Add(time.Second); !found || value != 3 || !expiration.Equal(want) {
+		t.Errorf("expiring = %v, %v, %v, want 3, %v, true", value, expiration, found, want)
+	}
+	if value, expiration, found := c.GetWithExpiration("missing"); found || value != nil || !expiration.IsZero() {
+		t.Errorf("missing = %v, %v, %v, want nil, zero time, false", value, expiration, found)
+	}
+	clock.Advance(2 * time.Second)
+	if value, expiration, found := c.GetWithExpiration("expiring"); found || value != nil || !expiration.IsZero() {
+		t.Errorf("expired = %v, %v, %v, want nil, zero time, false", value, expiration, found)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 2)
+	evicted := make(map[string]int)
+	c.OnEvicted(func(key string, value interface{}) {
+		// the lock is released before callbacks run, so the cache may be used from them
+		c.Len()
+		evicted[key]++
+	})
+	c.Set("a", 1, 0)
+	c.Set("b", 2, time.Second)
+	clock.Advance(time.Minute)
+	c.Flush()
+	if n := c.Len(); n != 0 {
+		t.Errorf("Len() = %d after Flush, want 0", n)
+	}
+	if len(evicted) != 2 || evicted["a"] != 1 || evicted["b"] != 1 {
+		t.Errorf("evicted = %v, want a and b once each", evicted)
+	}
+	// the lru list is reset along with the items
+	c.Set("c", 3, 0)
+	c.Set("d", 4, 0)
+	c.Set("e", 5, 0)
+	if c.Get("c") != nil || c.Get("d") == nil || c.Get("e") == nil {
+		t.Errorf("lru eviction after Flush kept %v", c.Keys())
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	if value, err := c.Increment("missing", 5); err != nil || value != 5 {
+		t.Errorf("Increment of a missing key = %d, %v, want 5", value, err)
+	}
+	if _, expiration, _ := c.GetWithExpiration("missing"); !expiration.Equal(time.Unix(0, 0).Add(time.Minute)) {
+		t.Errorf("missing key created with expiration %v, want the default", expiration)
+	}
+	c.Set("a", int64(10), time.Hour)
+	if value, err := c.Increment("a", 2); err != nil || value != 12 {
+		t.Errorf("Increment = %d, %v, want 12", value, err)
+	}
+	if value, err := c.Decrement("a", 5); err != nil || value != 7 {
+		t.Errorf("Decrement = %d, %v, want 7", value, err)
+	}
+	if _, expiration, _ := c.GetWithExpiration("a"); !expiration.Equal(time.Unix(0, 0).Add(time.Hour)) {
+		t.Errorf("expiration after Increment = %v, want the original", expiration)
+	}
+	c.Set("string", "value", 0)
+	if _, err := c.Increment("string", 1); !errors.Is(err, ErrUnexpectedType) {
+		t.Errorf("Increment of a string: err = %v, want ErrUnexpectedType", err)
+	}
+	if c.Get("string") != "value" {
+		t.Error("failed Increment modified the item")
+	}
+	c.Set("expiring", int64(100), time.Second)
+	clock.Advance(2 * time.Second)
+	if value, err := c.Increment("expiring", 1); err != nil || value != 1 {
+		t.Errorf("Increment of an expired key = %d, %v, want 1", value, err)
+	}
+}
+
+func TestIncrementConcurrent(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := c.Increment("counter", 2); err != nil {
+					t.Error(err)
+				}
+				if _, err := c.Decrement("counter", 1); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if value := c.Get("counter"); value != int64(5000) {
+		t.Errorf("counter = %v, want 5000", value)
+	}
+}
+
+func TestExpirationJitter(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.SetExpirationJitter(0.1)
+	expirations := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		c.Set(key, i, 10*time.Minute)
+		_, expiration, _ := c.GetWithExpiration(key)
+		if low, high := clock.Now().Add(9*time.Minute), clock.Now().Add(11*time.Minute); expiration.Before(low) || expiration.After(high) {
+			t.Errorf("item %s expires at %v, want between %v and %v", key, expiration, low, high)
+		}
+		expirations[expiration] = true
+	}
+	if len(expirations) < 90 {
+		t.Errorf("100 items set together share only %d distinct expirations", len(expirations))
+	}
+	c.Set("permanent", 1, -1)
+	if _, expiration, _ := c.GetWithExpiration("permanent"); !expiration.IsZero() {
+		t.Error("jitter gave an expiration to an item that never expires")
+	}
+}
+
+func TestExpirationJitterDisabledByDefault(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	for i := 0; i < 10; i++ {
+		key := strconv.Itoa(i)
+		c.Set(key, i, 0)
+		if _, expiration, _ := c.GetWithExpiration(key); !expiration.Equal(clock.Now().Add(time.Minute)) {
+			t.Errorf("item %s expires at %v without jitter, want exactly its duration", key, expiration)
+		}
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.SetSlidingExpiration(true)
+	c.Set("used", 1, 0)
+	c.Set("idle", 2, 0)
+	c.Set("permanent", 3, -1)
+	for i := 0; i < 5; i++ {
+		clock.Advance(30 * time.Second)
+		if c.Get("used") == nil {
+			t.Fatalf("item in use expired after %v", time.Duration(i+1)*30*time.Second)
+		}
+	}
+	if c.Get("idle") != nil {
+		t.Error("idle item did not expire after its duration")
+	}
+	if _, expiration, _ := c.GetWithExpiration("used"); !expiration.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("GetWithExpiration returned %v, want the extended expiration %v", expiration, clock.Now().Add(time.Minute))
+	}
+	if _, expiration, _ := c.GetWithExpiration("permanent"); !expiration.IsZero() {
+		t.Error("sliding expiration gave an expiration to an item that never expires")
+	}
+	clock.Advance(2 * time.Minute)
+	if c.Get("used") != nil {
+		t.Error("item did not expire once it stopped being used")
+	}
+}
+
+func TestSlidingExpirationDisabledByDefault(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("a", 1, 0)
+	clock.Advance(30 * time.Second)
+	c.Get("a")
+	clock.Advance(31 * time.Second)
+	if c.Get("a") != nil {
+		t.Error("get extended an item without sliding expiration")
+	}
+}
+
+func TestStats(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 2)
+	c.Set("a", 1, 0)
+	c.Set("b", 2, time.Second)
+	c.Get("a")
+	c.Get("missing")
+	clock.Advance(2 * time.Second)
+	c.Get("b")
+	c.Set("c", 3, 0)
+	c.Set("d", 4, 0)
+	c.Delete("c")
+	want := Stats{Hits: 1, Misses: 2, Sets: 4, Deletes: 1, Evictions: 2, Size: 1, Capacity: 2, Utilization: 0.5}
+	if stats := c.Stats(); stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+	c.ResetStats()
+	if stats := c.Stats(); stats != (Stats{Size: 1, Capacity: 2, Utilization: 0.5}) {
+		t.Errorf("Stats after ResetStats = %+v, want zero counters and the size unchanged", stats)
+	}
+	c.Flush()
+	if stats := c.Stats(); stats.Deletes != 1 {
+		t.Errorf("Deletes after Flush = %d, want 1", stats.Deletes)
+	}
+}
+
+func TestStatsSize(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("a", 1, 0)
+	c.Set("b", 2, time.Second)
+	c.Add("c", 3, 0)
+	if stats := c.Stats(); stats.Size != 3 || stats.Capacity != 0 || stats.Utilization != 0 {
+		t.Errorf("Stats = %+v, want size 3 and no capacity", stats)
+	}
+	c.Set("a", 4, 0)
+	c.Delete("c")
+	if size := c.Stats().Size; size != 2 {
+		t.Errorf("Size after overwrite and delete = %d, want 2", size)
+	}
+	clock.Advance(2 * time.Second)
+	if stats := c.Stats(); stats.Size != 1 {
+		t.Errorf("Size with an expired item = %d, want 1 before it is removed", stats.Size)
+	}
+	c.DeleteExpired()
+	if size := c.Stats().Size; size != 1 {
+		t.Errorf("Size after DeleteExpired = %d, want 1", size)
+	}
+	c.Flush()
+	if size := c.Stats().Size; size != 0 {
+		t.Errorf("Size after Flush = %d, want 0", size)
+	}
+}
+
+func TestStatsUtilization(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 4)
+	for i, want := range []float64{0.25, 0.5, 0.75, 1, 1} {
+		c.Set(strconv.Itoa(i), i, 0)
+		if stats := c.Stats(); stats.Capacity != 4 || stats.Utilization != want {
+			t.Errorf("after %d sets: capacity %d, utilization %v, want 4, %v", i+1, stats.Capacity, stats.Utilization, want)
+		}
+	}
+	if evictions := c.Stats().Evictions; evictions != 1 {
+		t.Errorf("Evictions = %d, want 1", evictions)
+	}
+	c.Set("expiring", 5, time.Second)
+	clock.Advance(2 * time.Second)
+	if utilization := c.Stats().Utilization; utilization != 0.75 {
+		t.Errorf("utilization with an expired item = %v, want 0.75", utilization)
+	}
+}
+
+func TestStatsGetOrSet(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	build := func() (interface{}, error) {
+		return 1, nil
+	}
+	c.GetOrSet("a", 0, build)
+	c.GetOrSet("a", 0, build)
+	if stats := c.Stats(); stats.Hits != 1 || stats.Misses != 1 || stats.Sets != 1 {
+		t.Errorf("Stats = %+v, want 1 hit, 1 miss and 1 set", stats)
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(i*100 + j)
+				c.Set(key, j, 0)
+				c.Get(key)
+				c.Get(key + "-missing")
+				c.Delete(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	want := Stats{Hits: 2000, Misses: 2000, Sets: 2000, Deletes: 2000}
+	if stats := c.Stats(); stats != want {
+		t.Errorf("Stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	if err := c.Add("a", 1, 0); err != nil {
+		t.Fatalf("Add of a missing key: %v", err)
+	}
+	if err := c.Add("a", 2, 0); !errors.Is(err, ErrItemExists) {
+		t.Errorf("Add of an existing key: err = %v, want ErrItemExists", err)
+	}
+	if c.Get("a") != 1 {
+		t.Error("failed Add modified the existing item")
+	}
+	c.Set("expiring", 1, time.Second)
+	clock.Advance(2 * time.Second)
+	if err := c.Add("expiring", 2, time.Hour); err != nil {
+		t.Errorf("Add of an expired key: %v", err)
+	}
+	if _, expiration, _ := c.GetWithExpiration("expiring"); !expiration.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("added item expires at %v, want %v", expiration, clock.Now().Add(time.Hour))
+	}
+}
+
+func TestReplace(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	if err := c.Replace("missing", 1, 0); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("Replace of a missing key: err = %v, want ErrItemNotFound", err)
+	}
+	if c.Get("missing") != nil {
+		t.Error("failed Replace stored the item")
+	}
+	c.Set("a", 1, time.Second)
+	if err := c.Replace("a", 2, time.Hour); err != nil {
+		t.Fatalf("Replace of an existing key: %v", err)
+	}
+	clock.Advance(time.Minute)
+	if c.Get("a") != 2 {
+		t.Error("replaced item did not get the new value and expiration")
+	}
+	clock.Advance(time.Hour)
+	if err := c.Replace("a", 3, 0); !errors.Is(err, ErrItemNotFound) {
+		t.Errorf("Replace of an expired key: err = %v, want ErrItemNotFound", err)
+	}
+}
+
+func TestAddConcurrent(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if c.Add("key", i, 0) == nil {
+				added.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if added.Load() != 1 {
+		t.Errorf("%d concurrent Adds succeeded, want 1", added.Load())
+	}
+}
+
+func TestSetIfAbsent(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	if actual, stored := c.SetIfAbsent("a", 1, 0); !stored || actual != 1 {
+		t.Errorf("SetIfAbsent of a missing key = %v, %v, want 1, true", actual, stored)
+	}
+	if actual, stored := c.SetIfAbsent("a", 2, 0); stored || actual != 1 {
+		t.Errorf("SetIfAbsent of an existing key = %v, %v, want 1, false", actual, stored)
+	}
+	if c.Get("a") != 1 {
+		t.Error("SetIfAbsent of an existing key modified the item")
+	}
+	c.Set("expiring", 1, time.Second)
+	clock.Advance(2 * time.Second)
+	if actual, stored := c.SetIfAbsent("expiring", 2, time.Hour); !stored || actual != 2 {
+		t.Errorf("SetIfAbsent of an expired key = %v, %v, want 2, true", actual, stored)
+	}
+	if _, expiration, _ := c.GetWithExpiration("expiring"); !expiration.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("stored item expires at %v, want %v", expiration, clock.Now().Add(time.Hour))
+	}
+}
+
+func TestSetIfAbsentConcurrent(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	actuals := make([]interface{}, 50)
+	var stored atomic.Int32
+	var wg sync.WaitGroup
+	for i := range actuals {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			actual, ok := c.SetIfAbsent("key", i, 0)
+			if ok {
+				stored.Add(1)
+			}
+			actuals[i] = actual
+		}(i)
+	}
+	wg.Wait()
+	if stored.Load() != 1 {
+		t.Errorf("%d concurrent SetIfAbsents stored their value, want 1", stored.Load())
+	}
+	winner := c.Get("key")
+	for i, actual := range actuals {
+		if actual != winner {
+			t.Errorf("SetIfAbsent %d returned %v, want the stored value %v", i, actual, winner)
+		}
+	}
+}
+
+func TestDeletePresent(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	c.Set("a", 1, 0)
+	if !c.Delete("a") {
+		t.Error("Delete of a present key returned false")
+	}
+	if c.Get("a") != nil {
+		t.Error("key still present after Delete")
+	}
+}
+
+func TestDeleteMissing(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	if c.Delete("missing") {
+		t.Error("Delete of a missing key returned true")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("a", 1, time.Nanosecond)
+	clock.Advance(time.Millisecond)
+	if c.Delete("a") {
+		t.Error("Delete of an expired key returned true")
+	}
+}
+
+func TestStopCleanupTwice(t *testing.T) {
+	c := NewCache(time.Minute, time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		c.StopCleanup()
+		c.StopCleanup()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("StopCleanup did not return promptly when called twice")
+	}
+}
+
+// waitCleanupStopped fails the test unless the cleanup process of c stops promptly
+func waitCleanupStopped(t *testing.T, c *Cache) {
+	t.Helper()
+	select {
+	case <-c.cleanupDone:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup process did not stop")
+	}
+}
+
+func TestCleanupStopsWhenCollected(t *testing.T) {
+	before := runtime.NumGoroutine()
+	done := make([]chan struct{}, 50)
+	for i := range done {
+		c := NewCache(time.Minute, time.Millisecond)
+		c.Set("a", i, 0)
+		done[i] = c.cleanupDone
+	}
+	if started := runtime.NumGoroutine() - before; started < len(done) {
+		t.Fatalf("%d cleanup goroutines started, want %d", started, len(done))
+	}
+	for i, cleanupDone := range done {
+		deadline := time.After(5 * time.Second)
+	wait:
+		for {
+			runtime.GC()
+			select {
+			case <-cleanupDone:
+				break wait
+			case <-deadline:
+				t.Fatalf("the cleanup of unreferenced cache %d did not stop", i)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if leaked := runtime.NumGoroutine() - before; leaked > 0 {
+		t.Errorf("%d goroutines leaked after the caches were collected", leaked)
+	}
+}
+
+func TestNewCacheWithContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewCacheWithContext(ctx, time.Millisecond, time.Millisecond)
+	c.Set("a", 1, 0)
+	cancel()
+	waitCleanupStopped(t, c)
+	// stopping the cleanup after the context ended must not panic
+	c.StopCleanup()
+	c.StopCleanup()
+}
+
+func TestNewCacheWithContextStopCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCacheWithContext(ctx, time.Minute, time.Millisecond)
+	c.StopCleanup()
+	waitCleanupStopped(t, c)
+	cancel()
+	c.StopCleanup()
+}
+
+func TestNewCacheWithContextCleansUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewCacheWithContext(ctx, time.Millisecond, time.Millisecond)
+	c.Set("a", 1, 0)
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mutex.RLock()
+		n := len(c.items)
+		c.mutex.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expired item was not cleaned up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLen(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("permanent", 1, -1)
+	c.Set("live", 2, 0)
+	c.Set("expired", 3, time.Nanosecond)
+	clock.Advance(time.Millisecond)
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	c.Set("expired", 3, time.Nanosecond)
+	clock.Advance(time.Millisecond)
+	keys := c.Keys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("Keys() = %v, want [a b]", keys)
+	}
+	keys[0] = "mutated"
+	if c.Get("a") == nil {
+		t.Error("mutating the returned keys affected the cache")
+	}
+}
+
+func TestRange(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	c.Set("expired", 3, time.Second)
+	clock.Advance(2 * time.Second)
+	seen := make(map[string]interface{})
+	c.Range(func(key string, value interface{}) bool {
+		seen[key] = value
+		return true
+	})
+	if len(seen) != 2 || seen["a"] != 1 || seen["b"] != 2 {
+		t.Errorf("Range visited %v, want a and b only", seen)
+	}
+}
+
+func TestRangeStopsEarly(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	for i := 0; i < 10; i++ {
+		c.Set(strconv.Itoa(i), i, 0)
+	}
+	calls := 0
+	c.Range(func(key string, value interface{}) bool {
+		calls++
+		return calls < 3
+	})
+	if calls != 3 {
+		t.Errorf("Range called f %d times after it returned false, want 3", calls)
+	}
+}
+
+func TestMaxSizeEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewCacheWithMaxSize(time.Minute, time.Hour, 2)
+	defer c.StopCleanup()
+	c.Set("a", 1, 0)
+	c.Set("b", 2, 0)
+	// reading a makes b the least recently used
+	c.Get("a")
+	c.Set("c", 3, 0)
+	if c.Get("b") != nil {
+		t.Error("expected b to be evicted")
+	}
+	if c.Get("a") == nil || c.Get("c") == nil {
+		t.Error("expected a and c to remain")
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+}
+
+func TestMaxSizeEvictionOrder(t *testing.T) {
+	c := NewCacheWithMaxSize(time.Minute, time.Hour, 2)
+	defer c.StopCleanup()
+	var evicted []string
+	c.OnEvicted(func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	})
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Set(key, key, 0)
+	}
+	if len(evicted) != 2 || evicted[0] != "a" || evicted[1] != "b" {
+		t.Errorf("evicted = %v, want [a b]", evicted)
+	}
+}
+
+func TestMaxSizeUnlimited(t *testing.T) {
+	for _, maxItems := range []int{0, -1} {
+		c := NewCacheWithMaxSize(time.Minute, time.Hour, maxItems)
+		for i := 0; i < 100; i++ {
+			c.Set(strconv.Itoa(i), i, 0)
+		}
+		if n := c.Len(); n != 100 {
+			t.Errorf("maxItems %d: Len() = %d, want 100", maxItems, n)
+		}
+		c.StopCleanup()
+	}
+}
+
+func TestOnEvictedDelete(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	var gotKey string
+	var gotValue interface{}
+	c.OnEvicted(func(key string, value interface{}) {
+		gotKey, gotValue = key, value
+		// the callback runs without the lock, so calling back into the cache must not deadlock
+		c.Len()
+	})
+	c.Set("a", 42, 0)
+	c.Delete("a")
+	if gotKey != "a" || gotValue != 42 {
+		t.Errorf("callback saw %q=%v, want a=42", gotKey, gotValue)
+	}
+}
+
+func TestOnEvictedExpiration(t *testing.T) {
+	c := NewCache(time.Minute, time.Millisecond)
+	defer c.StopCleanup()
+	evicted := make(chan interface{}, 1)
+	c.OnEvicted(func(key string, value interface{}) {
+		evicted <- value
+	})
+	c.Set("a", "value", time.Millisecond)
+	select {
+	case value := <-evicted:
+		if value != "value" {
+			t.Errorf("callback saw %v, want value", value)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback was not called for an expired item")
+	}
+}
+
+func TestOnEvictedNotCalledOnOverwrite(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	calls := 0
+	c.OnEvicted(func(key string, value interface{}) {
+		calls++
+	})
+	c.Set("a", 1, 0)
+	c.Set("a", 2, 0)
+	if calls != 0 {
+		t.Errorf("callback called %d times on overwrite, want 0", calls)
+	}
+}
+
+func TestGetOrSetBuildsOnce(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	var builds atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.GetOrSet("a", 0, func() (interface{}, error) {
+				builds.Add(1)
+				time.Sleep(10 * time.Millisecond)
+				return 42, nil
+			})
+			if err != nil || value != 42 {
+				t.Errorf("GetOrSet = %v, %v, want 42, nil", value, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := builds.Load(); n != 1 {
+		t.Errorf("build ran %d times, want 1", n)
+	}
+}
+
+func TestGetOrSetError(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	buildErr := errors.New("build failed")
+	if _, err := c.GetOrSet("a", 0, func() (interface{}, error) {
+		return nil, buildErr
+	}); !errors.Is(err, buildErr) {
+		t.Errorf("err = %v, want %v", err, buildErr)
+	}
+	if c.Get("a") != nil {
+		t.Error("a failed build stored a value")
+	}
+}
+
+func TestGetOrSetPanic(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		c.GetOrSet("a", 0, func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+	type result struct {
+		value interface{}
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		value, err := c.GetOrSet("a", 0, func() (interface{}, error) {
+			return 1, nil
+		})
+		results <- result{value, err}
+	}()
+	// give the waiter time to block on the pending build before it panics
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if got := <-results; got.err == nil || got.value != nil {
+		t.Errorf("waiter got %v, %v, want nil and an error", got.value, got.err)
+	}
+}
+
+// benchmarkSizes are the item counts the benchmarks are run with
+var benchmarkSizes = []int{100, 10_000, 100_000}
+
+// benchmarkGoroutines are the goroutine counts the concurrent benchmarks are run with
+var benchmarkGoroutines = []int{1, 4, 16, 64}
+
+// benchmarkKeys returns count distinct keys shaped like the hosts the proxy caches
+func benchmarkKeys(count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = "host-" + strconv.Itoa(i) + ".example.com"
+	}
+	return keys
+}
+
+// newBenchmarkCache returns a cache without background cleanup holding an item for each key
+func newBenchmarkCache(b *testing.B, keys []string, maxItems int) *Cache {
+	b.Helper()
+	c := NewCacheWithMaxSize(time.Hour, 0, maxItems)
+	for i, key := range keys {
+		c.Set(key, i, 0)
+	}
+	return c
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		keys := benchmarkKeys(size)
+		missing := make([]string, len(keys))
+		for i, key := range keys {
+			missing[i] = "missing-" + key
+		}
+		c := newBenchmarkCache(b, keys, 0)
+		b.Run(fmt.Sprintf("hit/items=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.Get(keys[i%len(keys)])
+			}
+		})
+		b.Run(fmt.Sprintf("miss/items=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.Get(missing[i%len(missing)])
+			}
+		})
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		keys := benchmarkKeys(size)
+		for _, lru := range []bool{false, true} {
+			maxItems := 0
+			if lru {
+				// only half the keys fit, so cycling through them evicts the least recently used item on every set
+				maxItems = size / 2
+			}
+			b.Run(fmt.Sprintf("items=%d/lru=%t", size, lru), func(b *testing.B) {
+				c := newBenchmarkCache(b, keys, maxItems)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					c.Set(keys[i%len(keys)], i, 0)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMixed(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		keys := benchmarkKeys(size)
+		for _, goroutines := range benchmarkGoroutines {
+			b.Run(fmt.Sprintf("items=%d/goroutines=%d", size, goroutines), func(b *testing.B) {
+				c := newBenchmarkCache(b, keys, 0)
+				b.ReportAllocs()
+				b.ResetTimer()
+				// the goroutines share b.N operations, one Set and one Delete for every eight Gets
+				var wg sync.WaitGroup
+				for g := 0; g < goroutines; g++ {
+					wg.Add(1)
+					go func(g int) {
+						defer wg.Done()
+						for i := g; i < b.N; i += goroutines {
+							key := keys[i%len(keys)]
+							switch i % 10 {
+							case 0:
+								c.Set(key, i, 0)
+							case 1:
+								c.Delete(key)
+							default:
+								c.Get(key)
+							}
+						}
+					}(g)
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+func BenchmarkDeleteExpired(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		keys := benchmarkKeys(size)
+		// the pass the cleanup runs at every interval when nothing has expired yet
+		b.Run(fmt.Sprintf("none-expired/items=%d", size), func(b *testing.B) {
+			c := newBenchmarkCache(b, keys, 0)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.DeleteExpired()
+			}
+		})
+		b.Run(fmt.Sprintf("all-expired/items=%d", size), func(b *testing.B) {
+			clock := &fakeClock{now: time.Unix(0, 0)}
+			c := newCache(context.Background(), time.Minute, 0, 0, clock)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j, key := range keys {
+					c.Set(key, j, 0)
+				}
+				clock.Advance(2 * time.Minute)
+				b.StartTimer()
+				c.DeleteExpired()
+			}
+		})
+	}
+}
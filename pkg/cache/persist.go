@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedItem is an item as it is encoded by Save
+type persistedItem struct {
+	// Value is the value of the item, which must be of a type gob can encode
+	Value interface{}
+	// Expiration is the expiration of the item in Unix nanoseconds, zero if it never expires
+	Expiration int64
+	// Duration is the duration the item was set with, used by sliding expiration
+	Duration time.Duration
+}
+
+// Save writes the items in the cache that have not expired to w with gob encoding. Values must be of types
+// gob can encode, such as strings and numbers; types other than the basic ones must be registered with
+// gob.Register
+func (c *Cache) Save(w io.Writer) error {
+	c.mutex.RLock()
+	now := c.nowFunc().UnixNano()
+	items := make(map[string]persistedItem, len(c.items))
+	for key, item := range c.items {
+		if item.expiration > 0 && now > item.expiration {
+			continue
+		}
+		items[key] = persistedItem{
+			Value:      item.value,
+			Expiration: item.expiration,
+			Duration:   item.duration,
+		}
+	}
+	c.mutex.RUnlock()
+	if err := gob.NewEncoder(w).Encode(items); err != nil {
+		return fmt.Errorf("error encoding cache: %w", err)
+	}
+	return nil
+}
+
+// SaveFile writes the items in the cache that have not expired to the file at path, see Save. The file is
+// replaced atomically so that a failed save leaves the previous one intact
+func (c *Cache) SaveFile(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating cache file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if err := c.Save(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing cache file: %w", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("error replacing cache file: %w", err)
+	}
+	return nil
+}
+
+// Load reads items written by Save from r and adds them to the cache with their original expiration,
+// overwriting existing items with the same key. Items that have expired by the time they are loaded are
+// discarded
+func (c *Cache) Load(r io.Reader) error {
+	var items map[string]persistedItem
+	if err := gob.NewDecoder(r).Decode(&items); err != nil {
+		return fmt.Errorf("error decoding cache: %w", err)
+	}
+	c.mutex.Lock()
+	var evicted []evictedItem
+	now := c.nowFunc().UnixNano()
+	for key, item := range items {
+		if item.Expiration > 0 && now > item.Expiration {
+			continue
+		}
+		evicted = append(evicted, c.store(key, Item{
+			value:      item.Value,
+			expiration: item.Expiration,
+			duration:   item.Duration,
+		})...)
+	}
+	onEvicted := c.onEvicted
+	c.mutex.Unlock()
+	notifyEvicted(onEvicted, evicted)
+	return nil
+}
+
+// LoadFile reads items written by SaveFile from the file at path and adds them to the cache, see Load
+func (c *Cache) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening cache file: %w", err)
+	}
+	defer file.Close()
+	return c.Load(file)
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveFileLoadFile(t *testing.T) {
+	c, clock := newFakeClockCache(t, time.Minute, 0)
+	c.Set("permanent", "value", -1)
+	c.Set("expiring", int64(42), time.Hour)
+	c.Set("float", 1.5, 0)
+	c.Set("expired", "gone", time.Second)
+	clock.Advance(2 * time.Second)
+
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	if err := c.SaveFile(path); err != nil {
+		t.Fatalf("SaveFile: %v", err)
+	}
+	loaded, loadedClock := newFakeClockCache(t, time.Minute, 0)
+	loadedClock.Advance(2 * time.Second)
+	if err := loaded.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: %v", err)
+	}
+	if loaded.Len() != 3 {
+		t.Errorf("loaded %d items, want 3", loaded.Len())
+	}
+	if value, expiration, _ := loaded.GetWithExpiration("permanent"); value != "value" || !expiration.IsZero() {
+		t.Errorf("permanent = %v, %v, want value, zero time", value, expiration)
+	}
+	if value, expiration, _ := loaded.GetWithExpiration("expiring"); value != int64(42) || !expiration.Equal(time.Unix(0, 0).Add(time.Hour)) {
+		t.Errorf("expiring = %v, %v, want 42 with its original expiration", value, expiration)
+	}
+	if value := loaded.Get("float"); value != 1.5 {
+		t.Errorf("float = %v, want 1.5", value)
+	}
+	if loaded.Get("expired") != nil {
+		t.Error("item expired at save time was loaded")
+	}
+}
+
+func TestLoadDiscardsItemsExpiredSinceSave(t *testing.T) {
+	c, _ := newFakeClockCache(t, time.Minute, 0)
+	c.Set("short", 1, time.Second)
+	c.Set("long", 2, time.Hour)
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, clock := newFakeClockCache(t, time.Minute, 0)
+	clock.Advance(time.Minute)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.Get("short") != nil {
+		t.Error("item expired before load was restored")
+	}
+	if loaded.Get("long") != 2 {
+		t.Error("item still live at load was not restored")
+	}
+}
+
+func TestLoadRespectsMaxSize(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, key, 0)
+	}
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, _ := newFakeClockCache(t, time.Minute, 2)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.Len() != 2 {
+		t.Errorf("loaded %d items into a cache of at most 2", loaded.Len())
+	}
+}
+
+func TestSaveUnencodableValue(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	c.Set("func", func() {}, 0)
+	path := filepath.Join(t.TempDir(), "cache.gob")
+	if err := c.SaveFile(path); err == nil {
+		t.Fatal("saving a func value succeeded")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("failed save left a file behind: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 0 {
+		t.Errorf("failed save left %d temporary files behind", len(entries))
+	}
+}
+
+func TestLoadFileMissing(t *testing.T) {
+	c := newTestCache(t, time.Minute)
+	if err := c.LoadFile(filepath.Join(t.TempDir(), "missing.gob")); err == nil {
+		t.Error("loading a missing file succeeded")
+	}
+}
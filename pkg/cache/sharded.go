@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"time"
+)
+
+const (
+	// fnvOffset32 is the offset basis of the 32-bit FNV-1a hash
+	fnvOffset32 = 2166136261
+	// fnvPrime32 is the prime of the 32-bit FNV-1a hash
+	fnvPrime32 = 16777619
+)
+
+// ShardedCache is a thread-safe key-value cache that spreads its items over independent Cache shards by
+// the hash of their key, so that concurrent writes to different keys rarely contend for the same lock
+type ShardedCache struct {
+	// shards contains the caches the items are stored in
+	shards []*Cache
+}
+
+// NewShardedCache creates a new sharded cache of the specified number of shards, each with the specified
+// default expiration and its own cleanup process running at the specified interval. Zero or negative
+// shards means a single shard
+func NewShardedCache(shards int, defaultExpiration, cleanupInterval time.Duration) *ShardedCache {
+	if shards < 1 {
+		shards = 1
+	}
+	cache := ShardedCache{
+		shards: make([]*Cache, shards),
+	}
+	for i := range cache.shards {
+		cache.shards[i] = NewCache(defaultExpiration, cleanupInterval)
+	}
+	return &cache
+}
+
+// shard returns the shard the item with the specified key is stored in. The key is hashed with FNV-1a inline
+// rather than with hash/fnv, which would allocate on every call
+func (c *ShardedCache) shard(key string) *Cache {
+	hash := uint32(fnvOffset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= fnvPrime32
+	}
+	return c.shards[hash%uint32(len(c.shards))]
+}
+
+// Set adds a new item to the cache. If the item already exists, it will be overwritten
+func (c *ShardedCache) Set(key string, value interface{}, duration time.Duration) {
+	c.shard(key).Set(key, value, duration)
+}
+
+// Get returns the value of the item with the specified key. If the item does not exist or is expired,
+// nil will be returned instead
+func (c *ShardedCache) Get(key string) interface{} {
+	return c.shard(key).Get(key)
+}
+
+// Delete removes the item with the specified key from the cache. It returns true if the item existed
+// and had not expired before it was removed
+func (c *ShardedCache) Delete(key string) bool {
+	return c.shard(key).Delete(key)
+}
+
+// Extend resets the expiration of the item with the specified key
+func (c *ShardedCache) Extend(key string, duration time.Duration) {
+	c.shard(key).Extend(key, duration)
+}
+
+// Touch resets the expiration of the item with the specified key and reports whether it was found. See
+// Cache.Touch
+func (c *ShardedCache) Touch(key string, duration time.Duration) bool {
+	return c.shard(key).Touch(key, duration)
+}
+
+// DeleteMatching removes the items of every shard whose keys satisfy match and returns the number removed
+func (c *ShardedCache) DeleteMatching(match func(key string) bool) int {
+	count := 0
+	for _, shard := range c.shards {
+		count += shard.DeleteMatching(match)
+	}
+	return count
+}
+
+// DeleteExpired removes the expired items of every shard and returns the number removed
+func (c *ShardedCache) DeleteExpired() int {
+	count := 0
+	for _, shard := range c.shards {
+		count += shard.DeleteExpired()
+	}
+	return count
+}
+
+// Len returns the number of items in the cache that have not expired
+func (c *ShardedCache) Len() int {
+	count := 0
+	for _, shard := range c.shards {
+		count += shard.Len()
+	}
+	return count
+}
+
+// StopCleanup stops the background cleanup process of every shard. It is safe to call more than once
+func (c *ShardedCache) StopCleanup() {
+	for _, shard := range c.shards {
+		shard.StopCleanup()
+	}
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestShardedCache creates a sharded cache that is stopped when the test or benchmark finishes
+func newTestShardedCache(tb testing.TB, shards int, defaultExpiration time.Duration) *ShardedCache {
+	tb.Helper()
+	c := NewShardedCache(shards, defaultExpiration, time.Hour)
+	tb.Cleanup(c.StopCleanup)
+	return c
+}
+
+func TestShardedCache(t *testing.T) {
+	c := newTestShardedCache(t, 8, time.Minute)
+	for i := 0; i < 100; i++ {
+		c.Set(strconv.Itoa(i), i, 0)
+	}
+	if c.Len() != 100 {
+		t.Errorf("Len = %d, want 100", c.Len())
+	}
+	for i := 0; i < 100; i++ {
+		if value := c.Get(strconv.Itoa(i)); value != i {
+			t.Fatalf("Get(%d) = %v, want %d", i, value, i)
+		}
+	}
+	if !c.Delete("1") || c.Get("1") != nil {
+		t.Error("Delete did not remove the item")
+	}
+	c.Set("short", 1, time.Millisecond)
+	c.Extend("short", time.Hour)
+	time.Sleep(5 * time.Millisecond)
+	if c.Get("short") == nil {
+		t.Error("extended item expired")
+	}
+	if !c.Touch("short", time.Hour) || c.Touch("missing", time.Hour) {
+		t.Error("expected Touch to report only the item that was found")
+	}
+}
+
+func TestShardedCacheSpreadsKeys(t *testing.T) {
+	c := newTestShardedCache(t, 4, time.Minute)
+	for i := 0; i < 1000; i++ {
+		c.Set(strconv.Itoa(i), i, 0)
+	}
+	for i, shard := range c.shards {
+		if shard.Len() == 0 {
+			t.Errorf("shard %d holds no items", i)
+		}
+	}
+}
+
+func TestShardedCacheHashMatchesFNV(t *testing.T) {
+	c := newTestShardedCache(t, 7, time.Minute)
+	for _, key := range []string{"", "a", "example.com", "api.example.com/v1"} {
+		hash := fnv.New32a()
+		hash.Write([]byte(key))
+		if want := c.shards[hash.Sum32()%7]; c.shard(key) != want {
+			t.Errorf("key %q was not assigned the shard of its FNV-1a hash", key)
+		}
+	}
+}
+
+func TestShardedCacheSingleShard(t *testing.T) {
+	c := newTestShardedCache(t, 0, time.Minute)
+	if len(c.shards) != 1 {
+		t.Errorf("cache has %d shards, want 1", len(c.shards))
+	}
+}
+
+func TestShardedCacheConcurrent(t *testing.T) {
+	c := newTestShardedCache(t, 16, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa(i*100 + j)
+				c.Set(key, j, 0)
+				c.Get(key)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if c.Len() != 2000 {
+		t.Errorf("Len = %d, want 2000", c.Len())
+	}
+}
+
+// benchmarkParallel measures a mix of one Set for every three Gets over many distinct keys from parallel
+// goroutines
+func benchmarkParallel(b *testing.B, set func(key string, value interface{}), get func(key string) interface{}) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "host-" + strconv.Itoa(i) + ".example.com"
+		set(keys[i], i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%4 == 0 {
+				set(key, i)
+			} else {
+				get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	c := NewCache(time.Minute, time.Hour)
+	b.Cleanup(c.StopCleanup)
+	benchmarkParallel(b, func(key string, value interface{}) {
+		c.Set(key, value, 0)
+	}, c.Get)
+}
+
+func BenchmarkShardedCacheParallel(b *testing.B) {
+	c := newTestShardedCache(b, 32, time.Minute)
+	benchmarkParallel(b, func(key string, value interface{}) {
+		c.Set(key, value, 0)
+	}, c.Get)
+}
+
+func TestShardedCacheDeleteExpired(t *testing.T) {
+	c := newTestShardedCache(t, 4, time.Minute)
+	for i := 0; i < 20; i++ {
+		duration := time.Hour
+		if i%2 == 0 {
+			duration = time.Millisecond
+		}
+		c.Set(strconv.Itoa(i), i, duration)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if removed := c.DeleteExpired(); removed != 10 {
+		t.Errorf("DeleteExpired removed %d items, want 10", removed)
+	}
+	if c.Len() != 10 {
+		t.Errorf("Len = %d after DeleteExpired, want 10", c.Len())
+	}
+}
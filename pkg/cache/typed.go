@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnexpectedType is returned by a TypedCache, or by Increment and Decrement, when a stored value is not of
+// the expected type
+var ErrUnexpectedType = errors.New("unexpected type")
+
+// TypedCache is a type-safe wrapper around a Cache that only stores values of type V
+type TypedCache[V any] struct {
+	// cache is the underlying cache storing the values
+	cache *Cache
+}
+
+// NewTypedCache creates a new typed cache that stores its values in the specified cache
+func NewTypedCache[V any](cache *Cache) *TypedCache[V] {
+	return &TypedCache[V]{
+		cache: cache,
+	}
+}
+
+// Set adds a new item to the cache. If the item already exists, it will be overwritten
+func (c *TypedCache[V]) Set(key string, value V, duration time.Duration) {
+	c.cache.Set(key, value, duration)
+}
+
+// Add adds a new item to the cache only if no item that has not expired exists for the key. See Cache.Add
+func (c *TypedCache[V]) Add(key string, value V, duration time.Duration) error {
+	return c.cache.Add(key, value, duration)
+}
+
+// SetIfAbsent stores the value only if no item that has not expired exists for the key, returning the value
+// now in the cache and whether this call stored it. If the existing value is not of type V, the zero value of
+// V and false are returned. See Cache.SetIfAbsent
+func (c *TypedCache[V]) SetIfAbsent(key string, value V, duration time.Duration) (actual V, stored bool) {
+	existing, stored := c.cache.SetIfAbsent(key, value, duration)
+	actual, _ = existing.(V)
+	return actual, stored
+}
+
+// Replace overwrites the item with the specified key only if it exists and has not expired. See Cache.Replace
+func (c *TypedCache[V]) Replace(key string, value V, duration time.Duration) error {
+	return c.cache.Replace(key, value, duration)
+}
+
+// Get returns the value of the item with the specified key and true if it was found. If the item does
+// not exist, is expired or is not of type V, the zero value of V and false will be returned instead
+func (c *TypedCache[V]) Get(key string) (V, bool) {
+	value, ok := c.cache.Get(key).(V)
+	return value, ok
+}
+
+// GetWithExpiration returns the value of the item with the specified key, the time it expires at and true if
+// it was found. The expiration is the zero time for items that never expire. If the item does not exist, is
+// expired or is not of type V, the zero value of V, the zero time and false will be returned instead
+func (c *TypedCache[V]) GetWithExpiration(key string) (V, time.Time, bool) {
+	value, expiration, found := c.cache.GetWithExpiration(key)
+	typed, ok := value.(V)
+	if !found || !ok {
+		return typed, time.Time{}, false
+	}
+	return typed, expiration, true
+}
+
+// GetOrSet returns the value of the item with the specified key. If the item does not exist or is expired,
+// build is called once across concurrent callers to create and store the value. If the stored value is not
+// of type V, an error wrapping ErrUnexpectedType is returned
+func (c *TypedCache[V]) GetOrSet(key string, duration time.Duration, build func() (V, error)) (V, error) {
+	value, err := c.cache.GetOrSet(key, duration, func() (interface{}, error) {
+		return build()
+	})
+	if err != nil {
+		var zero V
+		return zero, err
+	}
+	typed, ok := value.(V)
+	if !ok {
+		return typed, fmt.Errorf("item %s has type %T: %w", key, value, ErrUnexpectedType)
+	}
+	return typed, nil
+}
+
+// Flush removes all items from the cache at once
+func (c *TypedCache[V]) Flush() {
+	c.cache.Flush()
+}
+
+// Delete removes the item with the specified key from the cache. It returns true if the item existed
+// before it was removed
+func (c *TypedCache[V]) Delete(key string) bool {
+	return c.cache.Delete(key)
+}
+
+// DeleteMatching removes the items whose keys satisfy match and returns the number removed. See
+// Cache.DeleteMatching
+func (c *TypedCache[V]) DeleteMatching(match func(key string) bool) int {
+	return c.cache.DeleteMatching(match)
+}
+
+// DeleteExpired removes all expired items from the cache and returns the number removed. See
+// Cache.DeleteExpired
+func (c *TypedCache[V]) DeleteExpired() int {
+	return c.cache.DeleteExpired()
+}
+
+// Extend resets the expiration of the item with the specified key
+func (c *TypedCache[V]) Extend(key string, duration time.Duration) {
+	c.cache.Extend(key, duration)
+}
+
+// Touch resets the expiration of the item with the specified key and reports whether it was found. See
+// Cache.Touch
+func (c *TypedCache[V]) Touch(key string, duration time.Duration) bool {
+	return c.cache.Touch(key, duration)
+}
+
+// OnEvicted sets a callback that is called with the key and value of each item of type V removed from
+// the cache. See Cache.OnEvicted
+func (c *TypedCache[V]) OnEvicted(f func(key string, value V)) {
+	c.cache.OnEvicted(func(key string, value interface{}) {
+		if typed, ok := value.(V); ok {
+			f(key, typed)
+		}
+	})
+}
+
+// Len returns the number of items in the cache that have not expired
+func (c *TypedCache[V]) Len() int {
+	return c.cache.Len()
+}
+
+// Keys returns a snapshot of the keys of all items in the cache that have not expired, in no
+// particular order
+func (c *TypedCache[V]) Keys() []string {
+	return c.cache.Keys()
+}
+
+// Range calls f with the key and value of each item of type V in the cache that has not expired until f
+// returns false. See Cache.Range
+func (c *TypedCache[V]) Range(f func(key string, value V) bool) {
+	c.cache.Range(func(key string, value interface{}) bool {
+		if typed, ok := value.(V); ok {
+			return f(key, typed)
+		}
+		return true
+	})
+}
+
+// Stats returns the counters of the underlying cache. See Cache.Stats
+func (c *TypedCache[V]) Stats() Stats {
+	return c.cache.Stats()
+}
+
+// Cache returns the underlying cache
+func (c *TypedCache[V]) Cache() *Cache {
+	return c.cache
+}
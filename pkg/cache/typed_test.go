@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTypedCacheGet(t *testing.T) {
+	c := NewTypedCache[int](newTestCache(t, time.Minute))
+	c.Set("a", 1, 0)
+	if value, ok := c.Get("a"); !ok || value != 1 {
+		t.Errorf("Get(a) = %v, %v, want 1, true", value, ok)
+	}
+	if _, ok := c.Get("missing"); ok {
+		t.Error("Get of a missing key returned true")
+	}
+	c.Cache().Set("wrong", "string", 0)
+	if _, ok := c.Get("wrong"); ok {
+		t.Error("Get of a value of the wrong type returned true")
+	}
+}
+
+func TestTypedCacheGetWithExpiration(t *testing.T) {
+	c := NewTypedCache[int](newTestCache(t, time.Minute))
+	c.Set("a", 1, -1)
+	if value, expiration, ok := c.GetWithExpiration("a"); !ok || value != 1 || !expiration.IsZero() {
+		t.Errorf("GetWithExpiration(a) = %v, %v, %v, want 1, zero time, true", value, expiration, ok)
+	}
+	c.Cache().Set("wrong", "string", 0)
+	if _, expiration, ok := c.GetWithExpiration("wrong"); ok || !expiration.IsZero() {
+		t.Error("GetWithExpiration of a value of the wrong type returned true")
+	}
+}
+
+func TestTypedCacheGetOrSetUnexpectedType(t *testing.T) {
+	c := NewTypedCache[int](newTestCache(t, time.Minute))
+	c.Cache().Set("wrong", "string", 0)
+	_, err := c.GetOrSet("wrong", 0, func() (int, error) {
+		return 1, nil
+	})
+	if !errors.Is(err, ErrUnexpectedType) {
+		t.Errorf("err = %v, want ErrUnexpectedType", err)
+	}
+}
+
+func TestTypedCacheSetIfAbsent(t *testing.T) {
+	c := NewTypedCache[int](newTestCache(t, time.Minute))
+	c.SetIfAbsent("a", 1, 0)
+	if actual, stored := c.SetIfAbsent("a", 2, 0); stored || actual != 1 {
+		t.Errorf("SetIfAbsent of an existing key = %d, %v, want 1, false", actual, stored)
+	}
+	c.Cache().Set("wrong", "string", 0)
+	if actual, stored := c.SetIfAbsent("wrong", 2, 0); stored || actual != 0 {
+		t.Errorf("SetIfAbsent of a key of another type = %d, %v, want 0, false", actual, stored)
+	}
+}
+
+func TestTypedCacheOnEvicted(t *testing.T) {
+	c := NewTypedCache[int](newTestCache(t, time.Minute))
+	var got []int
+	c.OnEvicted(func(key string, value int) {
+		got = append(got, value)
+	})
+	c.Set("a", 1, 0)
+	c.Cache().Set("wrong", "string", 0)
+	c.Delete("a")
+	c.Delete("wrong")
+	if len(got) != 1 || got[0] != 1 {
+		t.Errorf("callback saw %v, want [1]", got)
+	}
+}
+
+func TestTypedCacheRange(t *testing.T) {
+	c := NewTypedCache[int](newTestCache(t, time.Minute))
+	c.Set("a", 1, 0)
+	c.Cache().Set("wrong", "string", 0)
+	var keys []string
+	c.Range(func(key string, value int) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("Range visited %v, want [a]", keys)
+	}
+}
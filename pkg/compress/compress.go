@@ -0,0 +1,245 @@
+// compress responses with gzip or brotli when the client accepts it
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DefaultMinSize is the default size below which responses are not compressed
+const DefaultMinSize = 1024
+
+// DefaultContentTypes contains the media types compressed by default
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// encodings contains the supported content encodings in order of preference
+var encodings = []string{"br", "gzip"}
+
+// Compressor compresses the responses of a handler with the best encoding the client accepts
+type Compressor struct {
+	// MinSize is the size below which responses are sent uncompressed
+	MinSize int
+	// ContentTypes contains the media types that are compressed. An entry such as "text/*" matches all
+	// subtypes
+	ContentTypes []string
+}
+
+// New creates a new compressor with the default minimum size and content types
+func New() *Compressor {
+	return &Compressor{
+		MinSize:      DefaultMinSize,
+		ContentTypes: DefaultContentTypes,
+	}
+}
+
+// Handler returns a handler that compresses the responses of next. Responses that already have a
+// Content-Encoding, are smaller than MinSize or whose content type is not listed are sent as they are
+func (c *Compressor) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			compressor:     c,
+			encoding:       negotiate(r.Header.Values("Accept-Encoding")),
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressible reports whether responses of the content type should be compressed
+func (c *Compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range c.ContentTypes {
+		if prefix, found := strings.CutSuffix(allowed, "/*"); found {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate returns the preferred supported encoding of the Accept-Encoding header values, or "" if the
+// client accepts none of them
+func negotiate(acceptEncoding []string) string {
+	qualities := make(map[string]float64)
+	for _, value := range acceptEncoding {
+		for _, entry := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(entry), ";")
+			quality := 1.0
+			if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+				parsed, err := strconv.ParseFloat(q, 64)
+				if err != nil {
+					continue
+				}
+				quality = parsed
+			}
+			qualities[strings.ToLower(strings.TrimSpace(name))] = quality
+		}
+	}
+	best, bestQuality := "", 0.0
+	for _, encoding := range encodings {
+		quality, found := qualities[encoding]
+		if !found {
+			quality, found = qualities["*"]
+		}
+		if found && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// encoder is a compressing writer that can flush the data compressed so far
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newEncoder creates an encoder of the encoding writing to w
+func newEncoder(encoding string, w io.Writer) encoder {
+	if encoding == "br" {
+		return brotli.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// compressWriter is an http.ResponseWriter that buffers the start of the body until it can decide whether
+// to compress the response
+type compressWriter struct {
+	http.ResponseWriter
+	// compressor holds the compression settings
+	compressor *Compressor
+	// encoding is the encoding negotiated with the client, or "" if it accepts none
+	encoding string
+	// status is the status code of the response, or zero if none was written yet
+	status int
+	// decided is true once the headers were written and the response is either compressed or not
+	decided bool
+	// buffer holds the start of the body until the decision is made
+	buffer []byte
+	// encoder compresses the body, or is nil if the response is not compressed
+	encoder encoder
+}
+
+// WriteHeader records the status code. Informational responses are written immediately
+func (w *compressWriter) WriteHeader(status int) {
+	if status < http.StatusOK {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		w.decide()
+	}
+}
+
+// Write buffers the body until MinSize bytes were written, then compresses it if it should be compressed
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.buffer = append(w.buffer, b...)
+		if len(w.buffer) >= w.compressor.MinSize {
+			if err := w.decide(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush decides how to send the response if that was not done yet and flushes the body written so far
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.decided {
+		w.decide()
+	}
+	if w.encoder != nil {
+		w.encoder.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying response writer so that http.ResponseController can reach it
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close sends a response that is still buffered and finishes the compressed body
+func (w *compressWriter) Close() error {
+	if w.status == 0 {
+		return nil
+	}
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	return nil
+}
+
+// decide writes the headers, compressing the response if the client accepts an encoding, the response is
+// not encoded yet, its content type is compressible and the buffered body reached MinSize. It then writes
+// the buffered body
+func (w *compressWriter) decide() error {
+	w.decided = true
+	header := w.Header()
+	if header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified &&
+		w.compressor.compressible(header.Get("Content-Type")) {
+		header.Add("Vary", "Accept-Encoding")
+		if w.encoding != "" && len(w.buffer) >= w.compressor.MinSize {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", w.encoding)
+			w.encoder = newEncoder(w.encoding, w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	buffer := w.buffer
+	w.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(buffer)
+	} else {
+		_, err = w.ResponseWriter.Write(buffer)
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// serve sends a GET request with the Accept-Encoding header through the compressor to a handler answering
+// with the headers and body
+func serve(c *Compressor, acceptEncoding string, header http.Header, body string) *httptest.ResponseRecorder {
+	handler := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		io.WriteString(w, body)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decode decompresses the body of the response according to its Content-Encoding
+func decode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var r io.Reader = rec.Body
+	switch rec.Header().Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("invalid gzip body: %v", err)
+		}
+		r = gz
+	case "br":
+		r = brotli.NewReader(rec.Body)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	return string(body)
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"gzip":                   "gzip",
+		"gzip, deflate, br":      "br",
+		"br;q=0.5, gzip":         "gzip",
+		"br;q=0, gzip;q=0":       "",
+		"*":                      "br",
+		"*;q=0.1, gzip;q=0.5":    "gzip",
+		"identity":               "",
+		"GZIP":                   "gzip",
+		"br;q=bad, gzip;q=0.001": "gzip",
+	}
+	for acceptEncoding, want := range tests {
+		if got := negotiate([]string{acceptEncoding}); got != want {
+			t.Errorf("negotiate(%q) = %q, want %q", acceptEncoding, got, want)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("compressible ", 200)
+	header := http.Header{"Content-Type": {"text/html; charset=utf-8"}, "Content-Length": {"2600"}}
+	for _, encoding := range []string{"gzip", "br"} {
+		rec := serve(New(), encoding, header, body)
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+		}
+		if rec.Header().Get("Content-Length") != "" {
+			t.Error("Content-Length of the uncompressed body was kept")
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Vary = %q, want Accept-Encoding", got)
+		}
+		if rec.Body.Len() >= len(body) {
+			t.Errorf("%s body is %d bytes, larger than the original %d", encoding, rec.Body.Len(), len(body))
+		}
+		if got := decode(t, rec); got != body {
+			t.Errorf("%s body does not decode to the original", encoding)
+		}
+	}
+}
+
+func TestCompressSkips(t *testing.T) {
+	large := strings.Repeat("a", 2048)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		header         http.Header
+		body           string
+		vary           bool
+	}{
+		{name: "not accepted", header: http.Header{"Content-Type": {"text/plain"}}, body: large, vary: true},
+		{name: "tiny body", acceptEncoding: "gzip", header: http.Header{"Content-Type": {"text/plain"}}, body: "tiny", vary: true},
+		{name: "image", acceptEncoding: "gzip", header: http.Header{"Content-Type": {"image/png"}}, body: large},
+		{name: "no content type", acceptEncoding: "gzip", body: large},
+		{name: "already encoded", acceptEncoding: "gzip", header: http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}}, body: large},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serve(New(), test.acceptEncoding, test.header, test.body)
+			if rec.Body.String() != test.body {
+				t.Errorf("body was modified")
+			}
+			if got, want := rec.Header().Get("Content-Encoding"), test.header.Get("Content-Encoding"); got != want {
+				t.Errorf("Content-Encoding = %q, want %q", got, want)
+			}
+			if got := rec.Header().Get("Vary") != ""; got != test.vary {
+				t.Errorf("Vary set = %v, want %v", got, test.vary)
+			}
+		})
+	}
+}
+
+func TestCompressSettings(t *testing.T) {
+	c := &Compressor{MinSize: 4, ContentTypes: []string{"application/x-custom"}}
+	rec := serve(c, "gzip", http.Header{"Content-Type": {"application/x-custom"}}, "small but enough")
+	if rec.Header().Get("Content-Encoding") != "gzip" || decode(t, rec) != "small but enough" {
+		t.Errorf("custom content type above the custom minimum size was not compressed")
+	}
+	rec = serve(c, "gzip", http.Header{"Content-Type": {"text/plain"}}, strings.Repeat("a", 2048))
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("content type missing from the custom list was compressed")
+	}
+}
+
+func TestCompressFlush(t *testing.T) {
+	handler := New().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(bytes.Repeat([]byte("a"), 2048))
+		w.(http.Flusher).Flush()
+		w.Write(bytes.Repeat([]byte("b"), 10))
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if !rec.Flushed {
+		t.Error("Flush did not reach the underlying writer")
+	}
+	if got := decode(t, rec); got != strings.Repeat("a", 2048)+strings.Repeat("b", 10) {
+		t.Errorf("flushed body does not decode to the original")
+	}
+}
+
+func TestCompressNoContent(t *testing.T) {
+	handler := New().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Content-Encoding") != "" || rec.Body.Len() != 0 {
+		t.Errorf("got %d with Content-Encoding %q and %d bytes", rec.Code, rec.Header().Get("Content-Encoding"), rec.Body.Len())
+	}
+}
@@ -0,0 +1,626 @@
+// load static host routes from a yaml config file
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the contents of a route config file
+type Config struct {
+	// Hosts contains the route of each host
+	Hosts []Host `yaml:"hosts"`
+}
+
+// Host is the route config of a single host
+type Host struct {
+	// Host is the public host the route applies to, or a wildcard pattern such as "*.example.com"
+	Host string `yaml:"host"`
+	// Target is the url of the upstream target. It may be combined with Targets
+	Target string `yaml:"target"`
+	// Targets contains the urls of several upstream targets to balance requests across
+	Targets []string `yaml:"targets"`
+	// Strategy is the load balancing strategy across the targets: round-robin, the default, weighted or
+	// least-connections
+	Strategy string `yaml:"strategy"`
+	// Weights contains the weight of each target, in the order of Target followed by Targets. Setting them
+	// implies the weighted strategy
+	Weights []int `yaml:"weights"`
+	// Timeout bounds how long a request to a target may take
+	Timeout time.Duration `yaml:"timeout"`
+	// InsecureSkipVerify disables verification of the certificates presented by https targets
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// PreserveHostHeader forwards requests with the Host header the client sent rather than the host of the
+	// target
+	PreserveHostHeader bool `yaml:"preserve_host_header"`
+	// ClientTLS presents a client certificate to https targets that require mutual TLS
+	ClientTLS *ClientTLS `yaml:"client_tls"`
+	// MaxRequestBodyBytes overrides the limit on request bodies, a negative value disables it
+	MaxRequestBodyBytes int64 `yaml:"max_request_body_bytes"`
+	// AllowedMethods contains the request methods proxied for the host, such as GET, HEAD and POST, overriding
+	// the methods the proxy allows for all hosts
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// RateLimit limits the rate of requests for the host
+	RateLimit *RateLimit `yaml:"rate_limit"`
+	// Allow contains the CIDR ranges the host may only be reached from
+	Allow []string `yaml:"allow"`
+	// Deny contains the CIDR ranges the host may not be reached from
+	Deny []string `yaml:"deny"`
+	// BasicAuth requires clients to authenticate with HTTP basic authentication
+	BasicAuth *BasicAuth `yaml:"basic_auth"`
+	// CORS adds cross-origin resource sharing headers to the responses of the host
+	CORS *CORS `yaml:"cors"`
+	// StickySessions sends the requests of each client to the same target
+	StickySessions *StickySessions `yaml:"sticky_sessions"`
+	// Paths routes path prefixes of the host to targets of their own. A host with paths may omit its own
+	// targets, in which case requests matching no path are answered with 404 Not Found
+	Paths []Path `yaml:"paths"`
+	// ResponseHeaders contains headers added to responses that do not set them, such as
+	// Strict-Transport-Security. An empty value stops the proxy from adding a header it adds to all hosts
+	ResponseHeaders map[string]string `yaml:"response_headers"`
+	// Cookies rewrites the cookies set by the targets for the public host
+	Cookies *Cookies `yaml:"cookies"`
+	// Maintenance answers the requests of the host with a maintenance page instead of proxying them
+	Maintenance bool `yaml:"maintenance"`
+	// Redirect answers the requests of the host with a redirect instead of proxying them. A host that
+	// redirects has no targets or paths
+	Redirect *Redirect `yaml:"redirect"`
+	// line is the line of the entry in the config file, or zero if it was not parsed from one
+	line int
+}
+
+// UnmarshalYAML decodes the entry of a host, remembering its line for the problems reported by Validate
+func (h *Host) UnmarshalYAML(node *yaml.Node) error {
+	// the alias has the fields of Host without this method, so decoding it does not recurse
+	type host Host
+	if err := node.Decode((*host)(h)); err != nil {
+		return err
+	}
+	h.line = node.Line
+	return nil
+}
+
+// entry names the entry of the host at index i of the config, with its line if it is known
+func (h *Host) entry(i int) string {
+	if h.line > 0 {
+		return fmt.Sprintf("hosts[%d] (line %d)", i, h.line)
+	}
+	return fmt.Sprintf("hosts[%d]", i)
+}
+
+// BasicAuth is the basic authentication config of a host
+type BasicAuth struct {
+	// Realm is the realm sent to unauthenticated clients. It defaults to the host
+	Realm string `yaml:"realm"`
+	// Users maps each username to the bcrypt hash of its password, as generated by htpasswd -B
+	Users map[string]string `yaml:"users"`
+}
+
+// StickySessions is the sticky session config of a host
+type StickySessions struct {
+	// Cookie is the name of the cookie identifying the target of a client. It defaults to proxy_host_target
+	Cookie string `yaml:"cookie"`
+	// TTL is how long clients keep the cookie. It defaults to the end of the browser session
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// Cookies is the config of the rewriting of the cookies set by the targets of a host
+type Cookies struct {
+	// RewriteDomain replaces the Domain attribute of cookies with the public host
+	RewriteDomain bool `yaml:"rewrite_domain"`
+	// Secure adds the Secure attribute to cookies
+	Secure bool `yaml:"secure"`
+	// SameSite sets the SameSite attribute of cookies: lax, strict or none
+	SameSite string `yaml:"same_site"`
+}
+
+// Redirect is the redirect config of a host
+type Redirect struct {
+	// URL is the absolute http or https url requests are redirected to
+	URL string `yaml:"url"`
+	// Status is the status code of the redirect: 301, the default, 302, 307 or 308
+	Status int `yaml:"status"`
+	// PreservePath appends the path of each request to the url and keeps its query
+	PreservePath bool `yaml:"preserve_path"`
+}
+
+// ClientTLS is the mutual TLS config of the connections to the targets of a host
+type ClientTLS struct {
+	// Cert is the path of the PEM encoded client certificate
+	Cert string `yaml:"cert"`
+	// Key is the path of the PEM encoded private key of the client certificate
+	Key string `yaml:"key"`
+	// CA is the path of a PEM bundle of the CAs the certificates of the targets are verified against. It
+	// defaults to the system roots
+	CA string `yaml:"ca"`
+}
+
+// CORS is the cross-origin resource sharing config of a host
+type CORS struct {
+	// AllowedOrigins contains the origins that may make cross-origin requests, "*" allowing any origin
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	// AllowedMethods contains the methods preflight requests may ask for. It defaults to GET, HEAD and POST
+	AllowedMethods []string `yaml:"allowed_methods"`
+	// AllowedHeaders contains the request headers preflight requests may ask for
+	AllowedHeaders []string `yaml:"allowed_headers"`
+	// AllowCredentials lets cross-origin requests carry cookies and authorization
+	AllowCredentials bool `yaml:"allow_credentials"`
+	// MaxAge is how long a browser may cache the result of a preflight request
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// Path is the config of a path prefix rule of a host
+type Path struct {
+	// Prefix is the path prefix the rule applies to, see store.PathRule
+	Prefix string `yaml:"prefix"`
+	// Target is the url of the upstream target. It may be combined with Targets
+	Target string `yaml:"target"`
+	// Targets contains the urls of several upstream targets to balance requests across
+	Targets []string `yaml:"targets"`
+	// StripPrefix removes the prefix from the path before the request is forwarded
+	StripPrefix bool `yaml:"strip_prefix"`
+	// RewritePrefix replaces the prefix with the specified path before the request is forwarded
+	RewritePrefix string `yaml:"rewrite_prefix"`
+}
+
+// RateLimit is the token bucket config of a host
+type RateLimit struct {
+	// RequestsPerSecond is the sustained rate of requests allowed
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is the number of requests allowed at once. It defaults to one second of requests
+	Burst int `yaml:"burst"`
+	// PerClient applies the limit to each client IP separately
+	PerClient bool `yaml:"per_client"`
+}
+
+// LoadFile reads and validates the config file at the specified path
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %s: %w", path, err)
+	}
+	config, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// Parse parses and validates a yaml config
+func Parse(data []byte) (*Config, error) {
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	if problems := config.Validate(); len(problems) > 0 {
+		return nil, errors.Join(problems...)
+	}
+	return &config, nil
+}
+
+// Validate returns every problem of the config, such as an entry with an invalid target or a host listed
+// more than once, or nil if the config is valid
+func (c *Config) Validate() []error {
+	var problems []error
+	entries := make(map[string]int, len(c.Hosts))
+	for i, host := range c.Hosts {
+		if host.Host == "" {
+			problems = append(problems, fmt.Errorf("hosts[%d]: missing host", i))
+			continue
+		}
+		if err := validateHostPattern(host.Host); err != nil {
+			problems = append(problems, fmt.Errorf("host %s: %w", host.Host, err))
+		}
+		// hosts are matched case-insensitively, so entries differing only in case would shadow each other
+		normalized := normalizeHost(host.Host)
+		if first, ok := entries[normalized]; ok {
+			problems = append(problems, fmt.Errorf("%s: host %s is already configured by %s as %s", host.entry(i), host.Host, c.Hosts[first].entry(first), c.Hosts[first].Host))
+		} else {
+			entries[normalized] = i
+		}
+		if _, err := host.Route(); err != nil {
+			problems = append(problems, fmt.Errorf("host %s: %w", host.Host, err))
+		}
+	}
+	return problems
+}
+
+// normalizeHost returns the host in the form requests are matched with: lower case and without trailing dots
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimRight(host, "."))
+}
+
+// validateHostPattern checks that a host is a plain host or a wildcard pattern whose first label is "*",
+// the only wildcard matched by Resolve
+func validateHostPattern(host string) error {
+	rest, wildcard := strings.CutPrefix(host, "*.")
+	if strings.Contains(rest, "*") || (wildcard && rest == "") {
+		return fmt.Errorf("wildcard pattern never matches, only a leading label such as *.example.com is supported")
+	}
+	return nil
+}
+
+// Routes returns the route of each host in the config. An error naming the offending host is returned
+// if an entry is invalid
+func (c *Config) Routes() (map[string]*store.Route, error) {
+	routes := make(map[string]*store.Route, len(c.Hosts))
+	for i, host := range c.Hosts {
+		if host.Host == "" {
+			return nil, fmt.Errorf("hosts[%d]: missing host", i)
+		}
+		route, err := host.Route()
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %w", host.Host, err)
+		}
+		routes[normalizeHost(host.Host)] = route
+	}
+	return routes, nil
+}
+
+// Route returns the route described by the host config
+func (h *Host) Route() (*store.Route, error) {
+	targets, err := parseTargets(h.Target, h.Targets)
+	if err != nil {
+		return nil, err
+	}
+	if h.Redirect != nil && (len(targets) > 0 || len(h.Paths) > 0) {
+		return nil, fmt.Errorf("a host that redirects cannot have targets or paths")
+	}
+	if len(targets) == 0 && len(h.Paths) == 0 && h.Redirect == nil {
+		return nil, fmt.Errorf("missing target")
+	}
+	route := &store.Route{
+		Targets:             targets,
+		Timeout:             h.Timeout,
+		InsecureSkipVerify:  h.InsecureSkipVerify,
+		PreserveHostHeader:  h.PreserveHostHeader,
+		MaxRequestBodyBytes: h.MaxRequestBodyBytes,
+		Maintenance:         h.Maintenance,
+	}
+	for _, method := range h.AllowedMethods {
+		if method == "" || strings.ContainsAny(method, " \t\r\n,") {
+			return nil, fmt.Errorf("invalid allowed method %q", method)
+		}
+		route.AllowedMethods = append(route.AllowedMethods, strings.ToUpper(method))
+	}
+	if h.Redirect != nil {
+		redirect, err := h.Redirect.redirect()
+		if err != nil {
+			return nil, err
+		}
+		route.Redirect = redirect
+	}
+	if err := h.balancing(route); err != nil {
+		return nil, err
+	}
+	if h.RateLimit != nil {
+		rateLimit, err := h.RateLimit.rateLimit()
+		if err != nil {
+			return nil, err
+		}
+		route.RateLimit = rateLimit
+	}
+	if len(h.Allow) > 0 || len(h.Deny) > 0 {
+		ipFilter, err := h.ipFilter()
+		if err != nil {
+			return nil, err
+		}
+		route.IPFilter = ipFilter
+	}
+	if h.BasicAuth != nil {
+		basicAuth, err := h.BasicAuth.basicAuth(h.Host)
+		if err != nil {
+			return nil, err
+		}
+		route.BasicAuth = basicAuth
+	}
+	if h.CORS != nil {
+		cors, err := h.CORS.cors()
+		if err != nil {
+			return nil, err
+		}
+		route.CORS = cors
+	}
+	if h.ClientTLS != nil {
+		clientTLS, err := h.ClientTLS.clientTLS()
+		if err != nil {
+			return nil, err
+		}
+		route.ClientTLS = clientTLS
+	}
+	if h.Cookies != nil {
+		cookies, err := h.Cookies.cookies()
+		if err != nil {
+			return nil, err
+		}
+		route.Cookies = cookies
+	}
+	if h.StickySessions != nil {
+		stickySessions, err := h.StickySessions.stickySessions()
+		if err != nil {
+			return nil, err
+		}
+		route.StickySessions = stickySessions
+	}
+	for name, value := range h.ResponseHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid response header %q", name)
+		}
+		if route.ResponseHeaders == nil {
+			route.ResponseHeaders = make(map[string]string, len(h.ResponseHeaders))
+		}
+		route.ResponseHeaders[http.CanonicalHeaderKey(name)] = value
+	}
+	prefixes := make(map[string]bool, len(h.Paths))
+	for i, path := range h.Paths {
+		rule, err := path.rule()
+		if err != nil {
+			return nil, fmt.Errorf("paths[%d]: %w", i, err)
+		}
+		if prefixes[rule.Prefix] {
+			return nil, fmt.Errorf("paths[%d]: duplicate prefix %s", i, rule.Prefix)
+		}
+		prefixes[rule.Prefix] = true
+		route.Paths = append(route.Paths, rule)
+	}
+	return route, nil
+}
+
+// balancing validates the load balancing strategy and target weights of the config and sets them on the route
+func (h *Host) balancing(route *store.Route) error {
+	strategy := h.Strategy
+	if strategy == "" && len(h.Weights) > 0 {
+		strategy = store.StrategyWeighted
+	}
+	switch strategy {
+	case "", store.StrategyRoundRobin:
+	case store.StrategyWeighted, store.StrategyLeastConnections:
+	default:
+		return fmt.Errorf("unknown strategy %q", h.Strategy)
+	}
+	if len(h.Weights) > 0 {
+		if strategy != store.StrategyWeighted {
+			return fmt.Errorf("weights require the %s strategy", store.StrategyWeighted)
+		}
+		if len(h.Weights) != len(route.Targets) {
+			return fmt.Errorf("%d weights given for %d targets", len(h.Weights), len(route.Targets))
+		}
+		for i, weight := range h.Weights {
+			if weight < 1 {
+				return fmt.Errorf("weights[%d]: weight must be at least 1", i)
+			}
+		}
+	}
+	route.Strategy = strategy
+	route.Weights = h.Weights
+	return nil
+}
+
+// redirect returns the validated redirect described by the config
+func (r *Redirect) redirect() (*store.Redirect, error) {
+	target, err := url.Parse(r.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("redirect url %q must be an absolute http or https url", r.URL)
+	}
+	status := r.Status
+	switch status {
+	case 0:
+		status = http.StatusMovedPermanently
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("redirect status %d must be 301, 302, 307 or 308", r.Status)
+	}
+	return &store.Redirect{
+		URL:          target,
+		Status:       status,
+		PreservePath: r.PreservePath,
+	}, nil
+}
+
+// clientTLS returns the validated client TLS config described by the config. The files are read when the
+// upstream of the host is created, so that renewed certificates are picked up
+func (c *ClientTLS) clientTLS() (*store.ClientTLS, error) {
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, fmt.Errorf("client_tls requires both cert and key")
+	}
+	if c.Cert == "" && c.CA == "" {
+		return nil, fmt.Errorf("client_tls requires a cert and key or a ca")
+	}
+	return &store.ClientTLS{
+		CertFile: c.Cert,
+		KeyFile:  c.Key,
+		CAFile:   c.CA,
+	}, nil
+}
+
+// stickySessions returns the validated sticky sessions described by the config
+func (s *StickySessions) stickySessions() (*store.StickySessions, error) {
+	cookie := s.Cookie
+	if cookie == "" {
+		cookie = "proxy_host_target"
+	}
+	if strings.ContainsAny(cookie, " \t\r\n;,=\"") {
+		return nil, fmt.Errorf("invalid sticky session cookie name %q", cookie)
+	}
+	if s.TTL < 0 {
+		return nil, fmt.Errorf("sticky session ttl must not be negative")
+	}
+	return &store.StickySessions{
+		CookieName: cookie,
+		TTL:        s.TTL,
+	}, nil
+}
+
+// cookies returns the validated cookie rewriting described by the config
+func (c *Cookies) cookies() (*store.Cookies, error) {
+	var sameSite string
+	switch strings.ToLower(c.SameSite) {
+	case "":
+	case "lax":
+		sameSite = "Lax"
+	case "strict":
+		sameSite = "Strict"
+	case "none":
+		sameSite = "None"
+	default:
+		return nil, fmt.Errorf("cookie same_site %q must be lax, strict or none", c.SameSite)
+	}
+	return &store.Cookies{
+		RewriteDomain: c.RewriteDomain,
+		Secure:        c.Secure,
+		SameSite:      sameSite,
+	}, nil
+}
+
+// rule returns the validated path rule described by the config
+func (p *Path) rule() (*store.PathRule, error) {
+	if !strings.HasPrefix(p.Prefix, "/") {
+		return nil, fmt.Errorf("prefix %q must start with /", p.Prefix)
+	}
+	if p.StripPrefix && p.RewritePrefix != "" {
+		return nil, fmt.Errorf("only one of strip_prefix and rewrite_prefix may be set")
+	}
+	if p.RewritePrefix != "" && !strings.HasPrefix(p.RewritePrefix, "/") {
+		return nil, fmt.Errorf("rewrite_prefix %q must start with /", p.RewritePrefix)
+	}
+	targets, err := parseTargets(p.Target, p.Targets)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("missing target")
+	}
+	return &store.PathRule{
+		Prefix:        p.Prefix,
+		Targets:       targets,
+		StripPrefix:   p.StripPrefix,
+		RewritePrefix: p.RewritePrefix,
+	}, nil
+}
+
+// parseTargets parses the target urls of a config entry that has both a target and targets field
+func parseTargets(target string, targets []string) ([]*url.URL, error) {
+	rawURLs := targets
+	if target != "" {
+		rawURLs = append([]string{target}, rawURLs...)
+	}
+	var parsed []*url.URL
+	for _, rawURL := range rawURLs {
+		parsedTarget, err := store.ParseTarget(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target: %w", err)
+		}
+		parsed = append(parsed, parsedTarget)
+	}
+	return parsed, nil
+}
+
+// ipFilter parses the allowed and denied CIDR ranges of the host config
+func (h *Host) ipFilter() (*store.IPFilter, error) {
+	ipFilter := &store.IPFilter{}
+	for _, s := range h.Allow {
+		prefix, err := store.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("allow: %w", err)
+		}
+		ipFilter.Allow = append(ipFilter.Allow, prefix)
+	}
+	for _, s := range h.Deny {
+		prefix, err := store.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("deny: %w", err)
+		}
+		ipFilter.Deny = append(ipFilter.Deny, prefix)
+	}
+	return ipFilter, nil
+}
+
+// basicAuth returns the validated store basic authentication described by the config
+func (b *BasicAuth) basicAuth(host string) (*store.BasicAuth, error) {
+	if len(b.Users) == 0 {
+		return nil, fmt.Errorf("basic auth requires at least one user")
+	}
+	basicAuth := &store.BasicAuth{
+		Realm: b.Realm,
+		Users: make(map[string][]byte, len(b.Users)),
+	}
+	if basicAuth.Realm == "" {
+		basicAuth.Realm = host
+	}
+	for username, hash := range b.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("basic auth user %s: password must be a bcrypt hash: %w", username, err)
+		}
+		basicAuth.Users[username] = []byte(hash)
+	}
+	return basicAuth, nil
+}
+
+// cors returns the validated store CORS policy described by the config
+func (c *CORS) cors() (*store.CORS, error) {
+	if len(c.AllowedOrigins) == 0 {
+		return nil, fmt.Errorf("cors requires at least one allowed origin")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				return nil, fmt.Errorf("cors may not allow credentials from any origin")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("cors origin %q must be a scheme and host such as https://app.example.com", origin)
+		}
+	}
+	if c.MaxAge < 0 {
+		return nil, fmt.Errorf("cors max age must not be negative")
+	}
+	cors := &store.CORS{
+		AllowedOrigins:   make([]string, 0, len(c.AllowedOrigins)),
+		AllowedMethods:   make([]string, 0, len(c.AllowedMethods)),
+		AllowedHeaders:   c.AllowedHeaders,
+		AllowCredentials: c.AllowCredentials,
+		MaxAge:           c.MaxAge,
+	}
+	for _, origin := range c.AllowedOrigins {
+		// browsers send the origin without a trailing slash
+		cors.AllowedOrigins = append(cors.AllowedOrigins, strings.TrimSuffix(origin, "/"))
+	}
+	for _, method := range c.AllowedMethods {
+		cors.AllowedMethods = append(cors.AllowedMethods, strings.ToUpper(method))
+	}
+	if len(cors.AllowedMethods) == 0 {
+		cors.AllowedMethods = []string{"GET", "HEAD", "POST"}
+	}
+	return cors, nil
+}
+
+// rateLimit returns the validated store rate limit described by the config
+func (r *RateLimit) rateLimit() (*store.RateLimit, error) {
+	if r.RequestsPerSecond <= 0 {
+		return nil, fmt.Errorf("rate limit must allow a positive number of requests per second")
+	}
+	if r.Burst < 0 {
+		return nil, fmt.Errorf("rate limit burst must not be negative")
+	}
+	burst := r.Burst
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(r.RequestsPerSecond)))
+	}
+	return &store.RateLimit{
+		RequestsPerSecond: r.RequestsPerSecond,
+		Burst:             burst,
+		PerClient:         r.PerClient,
+	}, nil
+}
@@ -0,0 +1,489 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := `hosts:
+  - host: a.example.com
+    target: http://10.0.0.1:8080
+    timeout: 5s
+  - host: b.example.com
+    targets:
+      - https://10.0.0.2
+      - https://10.0.0.3
+    insecure_skip_verify: true
+    max_request_body_bytes: 1048576
+    preserve_host_header: true
+`
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, err := config.Routes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := routes["a.example.com"]
+	if a == nil || len(a.Targets) != 1 || a.Targets[0].String() != "http://10.0.0.1:8080" || a.Timeout != 5*time.Second || a.PreserveHostHeader {
+		t.Errorf("a.example.com route = %+v", a)
+	}
+	b := routes["b.example.com"]
+	if b == nil || len(b.Targets) != 2 || !b.InsecureSkipVerify || b.MaxRequestBodyBytes != 1<<20 || !b.PreserveHostHeader {
+		t.Errorf("b.example.com route = %+v", b)
+	}
+}
+
+func TestLoadFileMissing(t *testing.T) {
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := map[string]string{
+		"bad.example.com":     "hosts:\n  - host: bad.example.com\n    target: example.com\n",
+		"none.example.com":    "hosts:\n  - host: none.example.com\n",
+		"ftp.example.com":     "hosts:\n  - host: ftp.example.com\n    targets: [ftp://example.com]\n",
+		"hosts[0]: missing":   "hosts:\n  - target: http://example.com\n",
+		"zero.example.com":    "hosts:\n  - host: zero.example.com\n    target: http://10.0.0.1\n    rate_limit: {requests_per_second: 0}\n",
+		"cidr.example.com":    "hosts:\n  - host: cidr.example.com\n    target: http://10.0.0.1\n    allow: [10.0.0.0/33]\n",
+		"paths[0]: prefix":    "hosts:\n  - host: p.example.com\n    paths:\n      - prefix: api\n        target: http://10.0.0.1\n",
+		"paths[1]: duplicate": "hosts:\n  - host: p.example.com\n    paths:\n      - {prefix: /api, target: http://10.0.0.1}\n      - {prefix: /api, target: http://10.0.0.2}\n",
+		"paths[0]: only one":  "hosts:\n  - host: p.example.com\n    paths:\n      - {prefix: /api, target: http://10.0.0.1, strip_prefix: true, rewrite_prefix: /v2}\n",
+		"paths[0]: missing":   "hosts:\n  - host: p.example.com\n    paths:\n      - {prefix: /api}\n",
+		"user alice":          "hosts:\n  - host: auth.example.com\n    target: http://10.0.0.1\n    basic_auth: {users: {alice: plaintext}}\n",
+		"at least one user":   "hosts:\n  - host: auth.example.com\n    target: http://10.0.0.1\n    basic_auth: {realm: private}\n",
+		"neg.example.com":     "hosts:\n  - host: neg.example.com\n    target: http://10.0.0.1\n    rate_limit: {requests_per_second: 1, burst: -1}\n",
+		"allowed origin":      "hosts:\n  - host: cors.example.com\n    target: http://10.0.0.1\n    cors: {allowed_methods: [GET]}\n",
+		"cors origin":         "hosts:\n  - host: cors.example.com\n    target: http://10.0.0.1\n    cors: {allowed_origins: [app.example.com]}\n",
+		"credentials":         "hosts:\n  - host: cors.example.com\n    target: http://10.0.0.1\n    cors: {allowed_origins: ['*'], allow_credentials: true}\n",
+	}
+	for want, data := range tests {
+		_, err := Parse([]byte(data))
+		if err == nil {
+			t.Errorf("%s: expected an error", want)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not name %s", err, want)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	data := `hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    rate_limit:
+      requests_per_second: 2.5
+  - host: b.example.com
+    target: http://10.0.0.2
+    rate_limit:
+      requests_per_second: 10
+      burst: 20
+      per_client: true
+`
+	config, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	if limit := routes["a.example.com"].RateLimit; limit == nil || limit.RequestsPerSecond != 2.5 || limit.Burst != 3 || limit.PerClient {
+		t.Errorf("a.example.com rate limit = %+v, want 2.5/s with the default burst of 3", limit)
+	}
+	if limit := routes["b.example.com"].RateLimit; limit == nil || limit.RequestsPerSecond != 10 || limit.Burst != 20 || !limit.PerClient {
+		t.Errorf("b.example.com rate limit = %+v", limit)
+	}
+}
+
+func TestParseIPFilter(t *testing.T) {
+	data := `hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    allow: [10.0.0.0/8, "2001:db8::/32"]
+    deny: [10.0.0.5]
+  - host: b.example.com
+    target: http://10.0.0.2
+`
+	config, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	ipFilter := routes["a.example.com"].IPFilter
+	if ipFilter == nil || len(ipFilter.Allow) != 2 || len(ipFilter.Deny) != 1 || ipFilter.Deny[0].String() != "10.0.0.5/32" {
+		t.Errorf("a.example.com ip filter = %+v", ipFilter)
+	}
+	if ipFilter := routes["b.example.com"].IPFilter; ipFilter != nil {
+		t.Errorf("b.example.com ip filter = %+v, want nil", ipFilter)
+	}
+}
+
+func TestParsePaths(t *testing.T) {
+	data := `hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    paths:
+      - prefix: /api
+        targets: [http://10.0.0.2, http://10.0.0.3]
+        strip_prefix: true
+      - prefix: /app
+        target: http://10.0.0.4
+        rewrite_prefix: /v2
+  - host: b.example.com
+    paths:
+      - prefix: /
+        target: http://10.0.0.5
+`
+	config, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	a := routes["a.example.com"]
+	if len(a.Paths) != 2 || len(a.Paths[0].Targets) != 2 || !a.Paths[0].StripPrefix || a.Paths[1].RewritePrefix != "/v2" {
+		t.Errorf("a.example.com paths = %+v", a.Paths)
+	}
+	b := routes["b.example.com"]
+	if len(b.Targets) != 0 || len(b.Paths) != 1 {
+		t.Errorf("b.example.com route = %+v", b)
+	}
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	data := fmt.Sprintf(`hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    basic_auth:
+      users:
+        alice: %q
+  - host: b.example.com
+    target: http://10.0.0.2
+    basic_auth:
+      realm: staff only
+      users:
+        bob: %q
+`, hash, hash)
+	config, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	a := routes["a.example.com"].BasicAuth
+	if a == nil || a.Realm != "a.example.com" || !a.Authenticate("alice", "secret") {
+		t.Errorf("a.example.com basic auth = %+v", a)
+	}
+	if b := routes["b.example.com"].BasicAuth; b == nil || b.Realm != "staff only" || !b.Authenticate("bob", "secret") {
+		t.Errorf("b.example.com basic auth = %+v", b)
+	}
+}
+
+func TestParseCORS(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    cors:
+      allowed_origins: [https://app.example.com/]
+      allowed_methods: [get, put]
+      allowed_headers: [Content-Type]
+      allow_credentials: true
+      max_age: 10m
+  - host: b.example.com
+    target: http://10.0.0.2
+    cors:
+      allowed_origins: ["*"]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	a := routes["a.example.com"].CORS
+	if a == nil || !a.AllowsOrigin("https://app.example.com") || a.AllowsOrigin("https://evil.example.com") {
+		t.Fatalf("a.example.com cors = %+v", a)
+	}
+	if strings.Join(a.AllowedMethods, ",") != "GET,PUT" || !a.AllowCredentials || a.MaxAge != 10*time.Minute {
+		t.Errorf("a.example.com cors = %+v", a)
+	}
+	b := routes["b.example.com"].CORS
+	if b == nil || !b.AllowsOrigin("https://anything.example.com") || strings.Join(b.AllowedMethods, ",") != "GET,HEAD,POST" {
+		t.Errorf("b.example.com cors = %+v", b)
+	}
+}
+
+func TestParseMaintenance(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    maintenance: true
+  - host: b.example.com
+    target: http://10.0.0.2
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	if !routes["a.example.com"].Maintenance || routes["b.example.com"].Maintenance {
+		t.Errorf("maintenance = %t, %t, want true, false", routes["a.example.com"].Maintenance, routes["b.example.com"].Maintenance)
+	}
+}
+
+func TestParseResponseHeaders(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    response_headers:
+      x-frame-options: SAMEORIGIN
+      Strict-Transport-Security: ""
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	headers := routes["a.example.com"].ResponseHeaders
+	if len(headers) != 2 || headers["X-Frame-Options"] != "SAMEORIGIN" || headers["Strict-Transport-Security"] != "" {
+		t.Errorf("response headers = %v", headers)
+	}
+	if _, err := Parse([]byte("hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n    response_headers:\n      \"X Frame\": DENY\n")); err == nil {
+		t.Error("invalid header name parsed without error")
+	}
+}
+
+func TestParseStickySessions(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    targets: [http://10.0.0.1, http://10.0.0.2]
+    sticky_sessions:
+      cookie: backend
+      ttl: 1h
+  - host: b.example.com
+    targets: [http://10.0.0.1, http://10.0.0.2]
+    sticky_sessions: {}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	if a := routes["a.example.com"].StickySessions; a == nil || a.CookieName != "backend" || a.TTL != time.Hour {
+		t.Errorf("a.example.com sticky sessions = %+v", a)
+	}
+	if b := routes["b.example.com"].StickySessions; b == nil || b.CookieName != "proxy_host_target" || b.TTL != 0 {
+		t.Errorf("b.example.com sticky sessions = %+v", b)
+	}
+	if _, err := Parse([]byte("hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n    sticky_sessions:\n      cookie: \"a;b\"\n")); err == nil {
+		t.Error("invalid cookie name parsed without error")
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: www.example.com
+    redirect:
+      url: https://example.com
+      preserve_path: true
+  - host: old.example.com
+    redirect: {url: https://example.com/new, status: 307}
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	if www := routes["www.example.com"].Redirect; www == nil || www.URL.String() != "https://example.com" || www.Status != 301 || !www.PreservePath {
+		t.Errorf("www.example.com redirect = %+v", www)
+	}
+	if old := routes["old.example.com"].Redirect; old == nil || old.Status != 307 || old.PreservePath {
+		t.Errorf("old.example.com redirect = %+v", old)
+	}
+	tests := map[string]string{
+		"redirect: {url: example.com}":                                        "must be an absolute http or https url",
+		"redirect: {url: 'ftp://example.com'}":                                "must be an absolute http or https url",
+		"redirect: {url: 'https://example.com', status: 200}":                 "redirect status 200",
+		"target: http://10.0.0.1\n    redirect: {url: 'https://example.com'}": "cannot have targets",
+	}
+	for entry, want := range tests {
+		data := "hosts:\n  - host: a.example.com\n    " + entry + "\n"
+		if _, err := Parse([]byte(data)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error = %v, want %q", entry, err, want)
+		}
+	}
+}
+
+func TestParseCookies(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    cookies:
+      rewrite_domain: true
+      secure: true
+      same_site: LAX
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	want := store.Cookies{RewriteDomain: true, Secure: true, SameSite: "Lax"}
+	if cookies := routes["a.example.com"].Cookies; cookies == nil || *cookies != want {
+		t.Errorf("cookies = %+v, want %+v", cookies, want)
+	}
+	data := "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n    cookies: {same_site: loose}\n"
+	if _, err := Parse([]byte(data)); err == nil || !strings.Contains(err.Error(), "must be lax, strict or none") {
+		t.Errorf("error = %v, want an invalid same_site", err)
+	}
+}
+
+func TestParseAllowedMethods(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    allowed_methods: [get, HEAD, Post]
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	if methods := strings.Join(routes["a.example.com"].AllowedMethods, ","); methods != "GET,HEAD,POST" {
+		t.Errorf("allowed methods = %s, want GET,HEAD,POST", methods)
+	}
+	data := "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n    allowed_methods: [\"GET, POST\"]\n"
+	if _, err := Parse([]byte(data)); err == nil || !strings.Contains(err.Error(), "invalid allowed method") {
+		t.Errorf("error = %v, want an invalid allowed method", err)
+	}
+}
+
+func TestParseClientTLS(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    target: https://10.0.0.1
+    client_tls:
+      cert: /etc/proxy-host/client.pem
+      key: /etc/proxy-host/client-key.pem
+      ca: /etc/proxy-host/ca.pem
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	want := store.ClientTLS{
+		CertFile: "/etc/proxy-host/client.pem",
+		KeyFile:  "/etc/proxy-host/client-key.pem",
+		CAFile:   "/etc/proxy-host/ca.pem",
+	}
+	if got := routes["a.example.com"].ClientTLS; got == nil || *got != want {
+		t.Errorf("client tls = %+v, want %+v", got, want)
+	}
+	for _, clientTLS := range []string{"{cert: client.pem}", "{key: client-key.pem, ca: ca.pem}", "{}"} {
+		data := "hosts:\n  - host: a.example.com\n    target: https://10.0.0.1\n    client_tls: " + clientTLS + "\n"
+		if _, err := Parse([]byte(data)); err == nil || !strings.Contains(err.Error(), "client_tls requires") {
+			t.Errorf("client_tls %s: error = %v", clientTLS, err)
+		}
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	config, err := Parse([]byte(`hosts:
+  - host: a.example.com
+    target: http://10.0.0.1
+    targets: [http://10.0.0.2]
+    weights: [3, 1]
+  - host: b.example.com
+    targets: [http://10.0.0.1, http://10.0.0.2]
+    strategy: round-robin
+  - host: c.example.com
+    targets: [http://10.0.0.1, http://10.0.0.2]
+    strategy: least-connections
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	if c := routes["c.example.com"]; c.Strategy != store.StrategyLeastConnections {
+		t.Errorf("c.example.com strategy = %q", c.Strategy)
+	}
+	if a := routes["a.example.com"]; a.Strategy != store.StrategyWeighted || len(a.Weights) != 2 || a.Weights[0] != 3 {
+		t.Errorf("a.example.com strategy = %q with weights %v", a.Strategy, a.Weights)
+	}
+	if b := routes["b.example.com"]; b.Strategy != store.StrategyRoundRobin || b.Weights != nil {
+		t.Errorf("b.example.com strategy = %q with weights %v", b.Strategy, b.Weights)
+	}
+	for name, data := range map[string]string{
+		"unknown strategy":  "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n    strategy: random\n",
+		"weight count":      "hosts:\n  - host: a.example.com\n    targets: [http://10.0.0.1, http://10.0.0.2]\n    weights: [1]\n",
+		"zero weight":       "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n    weights: [0]\n",
+		"weighted strategy": "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n    strategy: round-robin\n    weights: [2]\n",
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	config := &Config{Hosts: []Host{
+		{Host: "a.example.com", Target: "http://10.0.0.1"},
+		{Host: "b.example.com", Target: "ftp://10.0.0.2"},
+		{Host: "a.example.com", Target: "http://10.0.0.3"},
+		{Host: "a.*.example.com", Target: "http://10.0.0.4"},
+		{Host: "*.example.com", Target: "http://10.0.0.5"},
+		{Target: "http://10.0.0.6"},
+	}}
+	problems := config.Validate()
+	want := []string{
+		"host b.example.com: invalid target: unsupported scheme",
+		"hosts[2]: host a.example.com is already configured by hosts[0]",
+		"host a.*.example.com: wildcard pattern never matches",
+		"hosts[5]: missing host",
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("problems = %v, want %d", problems, len(want))
+	}
+	for i, problem := range problems {
+		if !strings.Contains(problem.Error(), want[i]) {
+			t.Errorf("problem %d = %q, want %q", i, problem, want[i])
+		}
+	}
+	if problems := (&Config{Hosts: []Host{{Host: "*.example.com", Target: "http://10.0.0.1"}}}).Validate(); problems != nil {
+		t.Errorf("valid config has problems %v", problems)
+	}
+}
+
+func TestParseDuplicateHosts(t *testing.T) {
+	tests := map[string]string{
+		"hosts[1] (line 4): host a.example.com is already configured by hosts[0] (line 2) as a.example.com":  "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n  - host: a.example.com\n    target: http://10.0.0.2\n",
+		"hosts[2] (line 6): host A.example.com. is already configured by hosts[0] (line 2) as a.example.com": "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n  - host: b.example.com\n    target: http://10.0.0.2\n  - host: A.example.com.\n    target: http://10.0.0.3\n",
+		"hosts[1] (line 4): host *.Example.com is already configured by hosts[0] (line 2) as *.example.com":  "hosts:\n  - host: '*.example.com'\n    target: http://10.0.0.1\n  - host: '*.Example.com'\n    target: http://10.0.0.2\n",
+	}
+	for want, data := range tests {
+		_, err := Parse([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %v, want %q", err, want)
+		}
+	}
+}
+
+func TestRoutesNormalizesHosts(t *testing.T) {
+	config, err := Parse([]byte("hosts:\n  - host: App.Example.com.\n    target: http://10.0.0.1\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	routes, _ := config.Routes()
+	if _, ok := routes["app.example.com"]; !ok || len(routes) != 1 {
+		t.Errorf("routes = %v, want the normalized host", routes)
+	}
+}
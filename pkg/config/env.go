@@ -0,0 +1,203 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Store types of a Server
+const (
+	// StoreMemory serves a single development route from memory
+	StoreMemory = "memory"
+	// StoreFile serves the routes of a yaml config file
+	StoreFile = "file"
+	// StoreSQLite serves the routes of a SQLite database
+	StoreSQLite = "sqlite"
+	// StoreRedis serves the routes of a Redis server
+	StoreRedis = "redis"
+)
+
+// Server is the config of the proxy server itself, as opposed to the routes of its hosts
+type Server struct {
+	// ListenAddrs are the addresses the proxy listens on, each served by a server of its own
+	ListenAddrs []string
+	// AdminAddr is the address the admin api listens on
+	AdminAddr string
+	// AdminToken is the bearer token the requests of the admin api must carry. Without one, the admin api may
+	// only listen on a loopback address
+	AdminToken string
+	// CacheTTL is how long the upstream of a host is cached before its route is looked up again
+	CacheTTL time.Duration
+	// CleanupInterval is how often expired upstreams are removed from the cache
+	CleanupInterval time.Duration
+	// Store is the type of the store of the host routes, one of the Store constants
+	Store string
+	// StoreLocation is the path of the config file or database, or the host:port address of the Redis
+	// server, the routes are read from. It is unused by StoreMemory
+	StoreLocation string
+	// LogLevel is the minimum level of the messages that are logged
+	LogLevel slog.Level
+	// ReadHeaderTimeout bounds how long a client may take to send the headers of a request, so that slow
+	// clients cannot hold connections open. Zero means no timeout
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds how long a client may take to send a whole request, body included. Zero means no
+	// timeout
+	ReadTimeout time.Duration
+	// WriteTimeout bounds how long writing a response may take from the end of the request headers. Zero
+	// means no timeout, leaving proxied requests to the request timeout. Server-sent event streams are never
+	// bound by it
+	WriteTimeout time.Duration
+	// IdleTimeout bounds how long a keep-alive connection waits for its next request. Zero means no timeout
+	IdleTimeout time.Duration
+}
+
+// DefaultServer returns the config of a proxy server listening on :9999 with its admin api on localhost:9998,
+// caching upstreams for 5 minutes and serving the development route from memory. Clients get 10 seconds to
+// send the headers of a request and a minute to send all of it, and idle connections are closed after 2
+// minutes. Responses have no write timeout, so that long downloads and streams are not cut off
+func DefaultServer() *Server {
+	return &Server{
+		ListenAddrs:       []string{":9999"},
+		AdminAddr:         "localhost:9998",
+		CacheTTL:          5 * time.Minute,
+		CleanupInterval:   30 * time.Second,
+		Store:             StoreMemory,
+		LogLevel:          slog.LevelInfo,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// FromEnv returns the default server config overridden by the environment variables PROXY_LISTEN_ADDR,
+// PROXY_ADMIN_ADDR, PROXY_ADMIN_TOKEN, PROXY_CACHE_TTL, PROXY_CLEANUP_INTERVAL, PROXY_STORE,
+// PROXY_STORE_LOCATION, PROXY_LOG_LEVEL, PROXY_READ_HEADER_TIMEOUT, PROXY_READ_TIMEOUT, PROXY_WRITE_TIMEOUT
+// and PROXY_IDLE_TIMEOUT. PROXY_LISTEN_ADDR may hold several comma-separated addresses. Durations are parsed
+// with time.ParseDuration and log levels with slog.Level.UnmarshalText. An error naming the variable is
+// returned if one is invalid
+func FromEnv() (*Server, error) {
+	server := DefaultServer()
+	if value, ok := os.LookupEnv("PROXY_LISTEN_ADDR"); ok {
+		server.ListenAddrs = SplitAddrs(value)
+	}
+	if value, ok := os.LookupEnv("PROXY_ADMIN_ADDR"); ok {
+		server.AdminAddr = value
+	}
+	if value, ok := os.LookupEnv("PROXY_ADMIN_TOKEN"); ok {
+		server.AdminToken = value
+	}
+	if err := durationFromEnv("PROXY_CACHE_TTL", &server.CacheTTL); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("PROXY_CLEANUP_INTERVAL", &server.CleanupInterval); err != nil {
+		return nil, err
+	}
+	if value, ok := os.LookupEnv("PROXY_STORE"); ok {
+		server.Store = value
+	}
+	if value, ok := os.LookupEnv("PROXY_STORE_LOCATION"); ok {
+		server.StoreLocation = value
+	}
+	if value, ok := os.LookupEnv("PROXY_LOG_LEVEL"); ok {
+		if err := server.LogLevel.UnmarshalText([]byte(value)); err != nil {
+			return nil, fmt.Errorf("PROXY_LOG_LEVEL: invalid log level %q, want debug, info, warn or error", value)
+		}
+	}
+	if err := durationFromEnv("PROXY_READ_HEADER_TIMEOUT", &server.ReadHeaderTimeout); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("PROXY_READ_TIMEOUT", &server.ReadTimeout); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("PROXY_WRITE_TIMEOUT", &server.WriteTimeout); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("PROXY_IDLE_TIMEOUT", &server.IdleTimeout); err != nil {
+		return nil, err
+	}
+	if err := server.Validate(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
+
+// Validate checks that the server config has listen addresses without repeats, an admin address that is a
+// loopback address unless there is an admin token, a known store type with a location, a cache ttl and server
+// timeouts that are not negative and a positive cleanup interval
+func (s *Server) Validate() error {
+	if len(s.ListenAddrs) == 0 {
+		return fmt.Errorf("missing listen address")
+	}
+	for i, addr := range s.ListenAddrs {
+		if slices.Contains(s.ListenAddrs[:i], addr) {
+			return fmt.Errorf("listen address %q is repeated", addr)
+		}
+	}
+	if s.AdminToken == "" && !isLoopback(s.AdminAddr) {
+		return fmt.Errorf("admin address %q is reachable beyond localhost, which requires PROXY_ADMIN_TOKEN", s.AdminAddr)
+	}
+	if s.CacheTTL < 0 {
+		return fmt.Errorf("cache ttl must not be negative")
+	}
+	if s.CleanupInterval <= 0 {
+		return fmt.Errorf("cleanup interval must be positive")
+	}
+	if s.ReadHeaderTimeout < 0 || s.ReadTimeout < 0 || s.WriteTimeout < 0 || s.IdleTimeout < 0 {
+		return fmt.Errorf("server timeouts must not be negative")
+	}
+	switch s.Store {
+	case StoreMemory:
+	case StoreFile, StoreSQLite, StoreRedis:
+		if s.StoreLocation == "" {
+			return fmt.Errorf("store %s requires a location", s.Store)
+		}
+	default:
+		return fmt.Errorf("unknown store %q, want one of %s, %s, %s or %s", s.Store, StoreMemory, StoreFile, StoreSQLite, StoreRedis)
+	}
+	return nil
+}
+
+// SplitAddrs splits a comma-separated list of addresses, dropping the spaces around each and empty entries
+func SplitAddrs(value string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// isLoopback reports whether the host of the address is localhost or a loopback IP. An address without a host
+// listens on all interfaces
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// durationFromEnv sets duration to the value of the environment variable if it is set
+func durationFromEnv(name string, duration *time.Duration) error {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s: invalid duration %q, want a value such as 30s or 5m", name, value)
+	}
+	*duration = parsed
+	return nil
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFromEnvDefaults(t *testing.T) {
+	server, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(server, DefaultServer()) {
+		t.Errorf("server = %+v, want the defaults %+v", server, DefaultServer())
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("PROXY_LISTEN_ADDR", ":8080,[::]:8080")
+	t.Setenv("PROXY_ADMIN_ADDR", "127.0.0.1:8081")
+	t.Setenv("PROXY_CACHE_TTL", "1m30s")
+	t.Setenv("PROXY_CLEANUP_INTERVAL", "10s")
+	t.Setenv("PROXY_STORE", "sqlite")
+	t.Setenv("PROXY_STORE_LOCATION", "/var/lib/proxy-host/hosts.db")
+	t.Setenv("PROXY_LOG_LEVEL", "debug")
+	t.Setenv("PROXY_READ_HEADER_TIMEOUT", "5s")
+	t.Setenv("PROXY_READ_TIMEOUT", "30s")
+	t.Setenv("PROXY_WRITE_TIMEOUT", "2m")
+	t.Setenv("PROXY_IDLE_TIMEOUT", "0s")
+	server, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Server{
+		ListenAddrs:     []string{":8080", "[::]:8080"},
+		AdminAddr:       "127.0.0.1:8081",
+		CacheTTL:        90 * time.Second,
+		CleanupInterval: 10 * time.Second,
+		Store:           StoreSQLite,
+		StoreLocation:   "/var/lib/proxy-host/hosts.db",
+		LogLevel:        slog.LevelDebug,
+
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      2 * time.Minute,
+	}
+	if !reflect.DeepEqual(*server, want) {
+		t.Errorf("server = %+v, want %+v", server, want)
+	}
+}
+
+func TestFromEnvAdminToken(t *testing.T) {
+	t.Setenv("PROXY_ADMIN_ADDR", ":9998")
+	t.Setenv("PROXY_ADMIN_TOKEN", "secret")
+	server, err := FromEnv()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if server.AdminAddr != ":9998" || server.AdminToken != "secret" {
+		t.Errorf("admin = %q with token %q, want :9998 with the token", server.AdminAddr, server.AdminToken)
+	}
+	for _, addr := range []string{"localhost:9998", "127.0.0.1:9998", "[::1]:9998"} {
+		server := DefaultServer()
+		server.AdminAddr = addr
+		if err := server.Validate(); err != nil {
+			t.Errorf("%s without a token: %v", addr, err)
+		}
+	}
+}
+
+func TestFromEnvInvalid(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"PROXY_CACHE_TTL", "5", "PROXY_CACHE_TTL: invalid duration \"5\""},
+		{"PROXY_CACHE_TTL", "five minutes", "PROXY_CACHE_TTL: invalid duration"},
+		{"PROXY_CACHE_TTL", "-1m", "cache ttl must not be negative"},
+		{"PROXY_CLEANUP_INTERVAL", "soon", "PROXY_CLEANUP_INTERVAL: invalid duration"},
+		{"PROXY_CLEANUP_INTERVAL", "0s", "cleanup interval must be positive"},
+		{"PROXY_STORE", "etcd", "unknown store \"etcd\""},
+		{"PROXY_STORE", "redis", "store redis requires a location"},
+		{"PROXY_LISTEN_ADDR", "", "missing listen address"},
+		{"PROXY_LISTEN_ADDR", " , ", "missing listen address"},
+		{"PROXY_LISTEN_ADDR", ":80,:8080,:80", "listen address \":80\" is repeated"},
+		{"PROXY_ADMIN_ADDR", ":9998", "admin address \":9998\" is reachable beyond localhost"},
+		{"PROXY_ADMIN_ADDR", "0.0.0.0:9998", "requires PROXY_ADMIN_TOKEN"},
+		{"PROXY_ADMIN_ADDR", "localhost", "reachable beyond localhost"},
+		{"PROXY_LOG_LEVEL", "verbose", "PROXY_LOG_LEVEL: invalid log level \"verbose\""},
+		{"PROXY_READ_HEADER_TIMEOUT", "10", "PROXY_READ_HEADER_TIMEOUT: invalid duration"},
+		{"PROXY_WRITE_TIMEOUT", "-1s", "server timeouts must not be negative"},
+		{"PROXY_IDLE_TIMEOUT", "-2m", "server timeouts must not be negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name+"="+test.value, func(t *testing.T) {
+			t.Setenv(test.name, test.value)
+			_, err := FromEnv()
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+// expose prometheus metrics about proxied requests and the proxy cache
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the prometheus collectors updated by the proxy. All methods are safe to call on a nil
+// *Metrics, which records nothing, so metrics can be disabled by leaving them unset
+type Metrics struct {
+	// registry holds the collectors below and backs Handler
+	registry *prometheus.Registry
+	// requests counts the requests served, by status class
+	requests *prometheus.CounterVec
+	// cacheHits counts the requests whose upstream was already cached
+	cacheHits prometheus.Counter
+	// cacheMisses counts the requests whose upstream had to be resolved
+	cacheMisses prometheus.Counter
+	// cacheEvictions counts the upstreams removed from the cache
+	cacheEvictions prometheus.Counter
+	// upstreamLatency observes how long requests forwarded to a target took
+	upstreamLatency prometheus.Histogram
+	// circuitState holds the state of the circuit breaker of each target
+	circuitState *prometheus.GaugeVec
+}
+
+// New creates a new set of metrics registered with their own registry
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_host_requests_total",
+			Help: "Total number of requests served, by status class.",
+		}, []string{"code"}),
+		cacheHits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_host_cache_hits_total",
+			Help: "Total number of requests whose upstream was already cached.",
+		}),
+		cacheMisses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_host_cache_misses_total",
+			Help: "Total number of requests whose upstream had to be resolved.",
+		}),
+		cacheEvictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "proxy_host_cache_evictions_total",
+			Help: "Total number of upstreams removed from the cache.",
+		}),
+		upstreamLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "proxy_host_upstream_duration_seconds",
+			Help:    "Duration of requests forwarded to upstream targets.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		circuitState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "proxy_host_circuit_state",
+			Help: "State of the circuit breaker of each target: 0 closed, 1 half-open, 2 open.",
+		}, []string{"target"}),
+	}
+	m.registry.MustRegister(m.requests, m.cacheHits, m.cacheMisses, m.cacheEvictions, m.upstreamLatency, m.circuitState)
+	return m
+}
+
+// Handler returns the http.Handler serving the metrics in the prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest records a served request with the specified status code
+func (m *Metrics) ObserveRequest(status int) {
+	if m == nil {
+		return
+	}
+	m.requests.WithLabelValues(statusClass(status)).Inc()
+}
+
+// ObserveCacheLookup records a cache hit or miss
+func (m *Metrics) ObserveCacheLookup(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheHits.Inc()
+		return
+	}
+	m.cacheMisses.Inc()
+}
+
+// ObserveCacheEviction records an upstream removed from the cache
+func (m *Metrics) ObserveCacheEviction() {
+	if m == nil {
+		return
+	}
+	m.cacheEvictions.Inc()
+}
+
+// WatchCacheSize exposes the number of upstreams in the cache and its capacity, zero if it is unlimited, as
+// gauges read from size on every scrape. It must be called at most once
+func (m *Metrics) WatchCacheSize(size func() (items, capacity int)) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "proxy_host_cache_size",
+			Help: "Number of upstreams in the cache.",
+		}, func() float64 {
+			items, _ := size()
+			return float64(items)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "proxy_host_cache_capacity",
+			Help: "Maximum number of upstreams in the cache, 0 if it is unlimited.",
+		}, func() float64 {
+			_, capacity := size()
+			return float64(capacity)
+		}),
+	)
+}
+
+// ObserveUpstreamLatency records how long a request forwarded to a target took
+func (m *Metrics) ObserveUpstreamLatency(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.upstreamLatency.Observe(duration.Seconds())
+}
+
+// ObserveCircuitState records the state of the circuit breaker of a target, 0 for closed, 1 for half-open and
+// 2 for open
+func (m *Metrics) ObserveCircuitState(target string, state int) {
+	if m == nil {
+		return
+	}
+	m.circuitState.WithLabelValues(target).Set(float64(state))
+}
+
+// statusClass returns the class of a status code, such as 2xx
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	m := New()
+	m.ObserveRequest(http.StatusOK)
+	m.ObserveRequest(http.StatusNotFound)
+	m.ObserveRequest(http.StatusNotFound)
+	m.ObserveCacheLookup(true)
+	m.ObserveCacheLookup(false)
+	m.ObserveCacheEviction()
+	m.ObserveUpstreamLatency(20 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`proxy_host_requests_total{code="2xx"} 1`,
+		`proxy_host_requests_total{code="4xx"} 2`,
+		"proxy_host_cache_hits_total 1",
+		"proxy_host_cache_misses_total 1",
+		"proxy_host_cache_evictions_total 1",
+		"proxy_host_upstream_duration_seconds_count 1",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
+
+func TestWatchCacheSize(t *testing.T) {
+	m := New()
+	items := 3
+	m.WatchCacheSize(func() (int, int) {
+		return items, 10
+	})
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	body := scrape()
+	for _, want := range []string{"proxy_host_cache_size 3", "proxy_host_cache_capacity 10"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+	items = 7
+	if body := scrape(); !strings.Contains(body, "proxy_host_cache_size 7") {
+		t.Error("expected the cache size to be read again on every scrape")
+	}
+}
+
+func TestWatchCacheSizeSkipsExpired(t *testing.T) {
+	// without background cleanup, the expired item stays stored until it is looked up
+	c := cache.NewCacheWithMaxSize(time.Minute, 0, 10)
+	c.Set("live", 1, 0)
+	c.Set("expired", 2, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	m := New()
+	m.WatchCacheSize(func() (int, int) {
+		stats := c.Stats()
+		return stats.Size, stats.Capacity
+	})
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{"proxy_host_cache_size 1", "proxy_host_cache_capacity 10"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics output is missing %q", want)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.ObserveRequest(http.StatusOK)
+	m.ObserveCacheLookup(true)
+	m.ObserveCacheEviction()
+	m.ObserveUpstreamLatency(time.Second)
+	m.WatchCacheSize(func() (int, int) { return 0, 0 })
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{200: "2xx", 301: "3xx", 404: "4xx", 504: "5xx", 0: "unknown"}
+	for status, want := range tests {
+		if got := statusClass(status); got != want {
+			t.Errorf("statusClass(%d) = %q, want %q", status, got, want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// parse the PROXY protocol header that load balancers prepend to the connections they forward
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// signature starts every version 2 header
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the longest version 1 header, its line ending included
+const maxV1Length = 107
+
+// ErrNoHeader is returned by the reads of a connection that did not start with a PROXY protocol header
+var ErrNoHeader = errors.New("missing PROXY protocol header")
+
+// Listener accepts connections that start with a version 1 or 2 PROXY protocol header, such as those forwarded
+// by HAProxy or an AWS Network Load Balancer. The RemoteAddr of each connection is the client address the
+// header carries. Every connection must start with a header, so it may only be used where all clients connect
+// through such load balancers: a client connecting directly could otherwise claim any address
+type Listener struct {
+	// Listener accepts the connections of the load balancers
+	net.Listener
+	// HeaderTimeout bounds how long a connection may take to send its header. Zero means no timeout
+	HeaderTimeout time.Duration
+}
+
+// NewListener wraps the listener to parse the PROXY protocol header of its connections, which must be sent
+// within the header timeout
+func NewListener(listener net.Listener, headerTimeout time.Duration) *Listener {
+	return &Listener{Listener: listener, HeaderTimeout: headerTimeout}
+}
+
+// Accept waits for the next connection. Its header is read by its first Read or RemoteAddr call, so that a
+// slow client does not hold up the others being accepted
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), headerTimeout: l.HeaderTimeout}, nil
+}
+
+// Conn is a connection accepted by a Listener
+type Conn struct {
+	// Conn is the connection from the load balancer
+	net.Conn
+	// reader buffers the bytes that follow the header
+	reader *bufio.Reader
+	// headerTimeout bounds how long reading the header may take
+	headerTimeout time.Duration
+	// once ensures the header is only read once
+	once sync.Once
+	// remoteAddr is the client address of the header, nil if it carried none
+	remoteAddr net.Addr
+	// err is the error reading the header, returned by every Read
+	err error
+}
+
+// Read reads the data that follows the header. It fails if the header is missing or invalid
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address of the header. It is the address of the load balancer if the header
+// did not carry one, as for health checks, or could not be read
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the header, setting the remote address it carries or the error reading it
+func (c *Conn) readHeader() {
+	if c.headerTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.remoteAddr, c.err = readHeader(c.reader)
+	if c.err != nil {
+		c.err = fmt.Errorf("proxy protocol: %w", c.err)
+	}
+}
+
+// readHeader reads a version 1 or 2 header from the reader and returns the source address it carries, nil for
+// headers without one such as those of the health checks of the load balancer
+func readHeader(reader *bufio.Reader) (net.Addr, error) {
+	start, err := reader.Peek(len(signature))
+	if err != nil && len(start) == 0 {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, signature):
+		return readV2(reader)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readV1(reader)
+	default:
+		return nil, ErrNoHeader
+	}
+}
+
+// readV1 reads a human-readable version 1 header, such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxV1Length {
+			return nil, fmt.Errorf("v1 header longer than %d bytes", maxV1Length)
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read v1 header: %w", err)
+		}
+		line = append(line, b)
+	}
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readV2 reads a binary version 2 header, skipping the type-length-value fields that follow its addresses
+func readV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read v2 header: %w", err)
+	}
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 header version %d", versionCommand>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("failed to read v2 addresses: %w", err)
+	}
+	switch versionCommand & 0xf {
+	case 0:
+		// a LOCAL connection of the load balancer itself, such as a health check
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", versionCommand&0xf)
+	}
+	var ipLength int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLength = 4
+	case 0x21: // TCP over IPv6
+		ipLength = 16
+	default:
+		// UDP and unix socket sources are not clients of an http server
+		return nil, nil
+	}
+	if len(payload) < 2*ipLength+4 {
+		return nil, fmt.Errorf("v2 addresses of %d bytes are too short", len(payload))
+	}
+	ip, _ := netip.AddrFromSlice(payload[:ipLength])
+	port := binary.BigEndian.Uint16(payload[2*ipLength:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)), nil
+}
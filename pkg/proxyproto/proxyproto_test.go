@@ -0,0 +1,121 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// accept sends the data over a new connection to a Listener with the header timeout and returns the
+// connection it accepted
+func accept(t *testing.T, headerTimeout time.Duration, data []byte) net.Conn {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := NewListener(inner, headerTimeout)
+	t.Cleanup(func() { listener.Close() })
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// v2Header builds a version 2 header of the command and address family followed by the payload
+func v2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestConnHeaders(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}
+	// a type-length-value field after the addresses is skipped
+	withTLV := append(append([]byte{}, ipv4...), 0x04, 0x00, 0x02, 'o', 'k')
+	ipv6 := append(net.ParseIP("2001:db8::7").To16(), net.ParseIP("2001:db8::1").To16()...)
+	ipv6 = append(ipv6, 0x1f, 0x90, 0x01, 0xbb)
+
+	tests := []struct {
+		name       string
+		header     []byte
+		wantRemote string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "203.0.113.7:56324"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 8080 443\r\n"), "[2001:db8::7]:8080"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", v2Header(1, 0x11, ipv4), "203.0.113.7:56324"},
+		{"v2 tcp4 with tlv", v2Header(1, 0x11, withTLV), "203.0.113.7:56324"},
+		{"v2 tcp6", v2Header(1, 0x21, ipv6), "[2001:db8::7]:8080"},
+		{"v2 local", v2Header(0, 0x00, nil), ""},
+	}
+	for _, test := range tests {
+		conn := accept(t, time.Second, append(test.header, "GET / HTTP/1.1\r\n"...))
+		remote := conn.RemoteAddr().String()
+		if test.wantRemote == "" {
+			if !strings.HasPrefix(remote, "127.0.0.1:") {
+				t.Errorf("%s: RemoteAddr = %s, want the address of the load balancer", test.name, remote)
+			}
+		} else if remote != test.wantRemote {
+			t.Errorf("%s: RemoteAddr = %s, want %s", test.name, remote, test.wantRemote)
+		}
+		data := make([]byte, len("GET / HTTP/1.1\r\n"))
+		if _, err := io.ReadFull(conn, data); err != nil || string(data) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("%s: read %q, %v after the header, want the request", test.name, data, err)
+		}
+	}
+}
+
+func TestConnInvalidHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"missing", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "missing PROXY protocol header"},
+		{"v1 bad address", []byte("PROXY TCP4 example.com 10.0.0.1 1 2\r\n"), "invalid v1 source address"},
+		{"v1 family mismatch", []byte("PROXY TCP4 2001:db8::7 10.0.0.1 1 2\r\n"), "invalid v1 source address"},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 http 443\r\n"), "invalid v1 source port"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", maxV1Length) + "\r\n"), "longer than"},
+		{"v2 version", append(append([]byte{}, signature...), 0x11, 0x11, 0, 0), "unsupported v2 header version 1"},
+		{"v2 short addresses", v2Header(1, 0x11, []byte{203, 0, 113}), "too short"},
+	}
+	for _, test := range tests {
+		conn := accept(t, time.Second, test.header)
+		if _, err := conn.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.want)
+		}
+	}
+	conn := accept(t, time.Second, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("error = %v, want ErrNoHeader", err)
+	}
+}
+
+func TestConnHeaderTimeout(t *testing.T) {
+	conn := accept(t, 50*time.Millisecond, []byte("PROXY TCP4 203.0.113.7"))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("reading the incomplete header took %v, want it bound by the header timeout", elapsed)
+	}
+}
@@ -0,0 +1,75 @@
+// limit the rate of requests with token buckets kept per key
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+)
+
+// RateLimiter keeps a token bucket for each key it is consulted with, such as a host or a host and client IP.
+// Buckets that have not been used for the idle timeout are dropped, so memory does not grow with the number of
+// keys ever seen
+type RateLimiter struct {
+	// buckets holds the bucket of each key, expiring idle buckets
+	buckets *cache.TypedCache[*bucket]
+	// now returns the current time, it is replaced in tests
+	now func() time.Time
+}
+
+// bucket is the token bucket of a single key
+type bucket struct {
+	// tokens is the number of requests that may be made right now
+	tokens float64
+	// last is when tokens was last refilled
+	last time.Time
+	// mutex is used to synchronize access to the bucket
+	mutex sync.Mutex
+}
+
+// New creates a new rate limiter that drops the bucket of a key once it has been idle for idleTimeout
+func New(idleTimeout time.Duration) *RateLimiter {
+	return &RateLimiter{
+		buckets: cache.NewTypedCache[*bucket](cache.NewCache(idleTimeout, idleTimeout)),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the key, which is refilled at rate tokens per second and holds at
+// most burst tokens. If the bucket is empty, false is returned with how long to wait until the next token
+func (l *RateLimiter) Allow(key string, rate float64, burst int) (bool, time.Duration) {
+	b, _ := l.buckets.GetOrSet(key, 0, func() (*bucket, error) {
+		return &bucket{
+			tokens: float64(burst),
+			last:   l.now(),
+		}, nil
+	})
+	l.buckets.Extend(key, 0)
+	return b.take(l.now(), rate, float64(burst))
+}
+
+// Stop stops the removal of idle buckets
+func (l *RateLimiter) Stop() {
+	l.buckets.Cache().StopCleanup()
+}
+
+// take refills the bucket for the time elapsed since it was last refilled and takes a token from it
+func (b *bucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	return false, wait
+}
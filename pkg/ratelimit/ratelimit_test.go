@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter creates a rate limiter whose clock only moves when the returned func is called
+func newTestRateLimiter(t *testing.T, idleTimeout time.Duration) (*RateLimiter, func(time.Duration)) {
+	t.Helper()
+	l := New(idleTimeout)
+	t.Cleanup(l.Stop)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	return l, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestAllowBurst(t *testing.T) {
+	l, _ := newTestRateLimiter(t, time.Minute)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.Allow("a", 1, 3); !allowed {
+			t.Fatalf("request %d of the burst was limited", i)
+		}
+	}
+	allowed, retryAfter := l.Allow("a", 1, 3)
+	if allowed {
+		t.Fatal("request over the burst was allowed")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("retry after = %v, want 1s", retryAfter)
+	}
+}
+
+func TestAllowRefill(t *testing.T) {
+	l, advance := newTestRateLimiter(t, time.Minute)
+	l.Allow("a", 2, 1)
+	if allowed, retryAfter := l.Allow("a", 2, 1); allowed || retryAfter != 500*time.Millisecond {
+		t.Fatalf("Allow = %v, %v, want false, 500ms", allowed, retryAfter)
+	}
+	advance(500 * time.Millisecond)
+	if allowed, _ := l.Allow("a", 2, 1); !allowed {
+		t.Error("request limited after the bucket was refilled")
+	}
+	// tokens never exceed the burst, however long the bucket was idle
+	advance(10 * time.Second)
+	l.Allow("a", 2, 1)
+	if allowed, _ := l.Allow("a", 2, 1); allowed {
+		t.Error("bucket refilled beyond its burst")
+	}
+}
+
+func TestAllowKeysAreIndependent(t *testing.T) {
+	l, _ := newTestRateLimiter(t, time.Minute)
+	l.Allow("a", 1, 1)
+	if allowed, _ := l.Allow("b", 1, 1); !allowed {
+		t.Error("limit of one key applied to another")
+	}
+}
+
+func TestIdleBucketsExpire(t *testing.T) {
+	l, _ := newTestRateLimiter(t, 10*time.Millisecond)
+	l.Allow("a", 1, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for l.buckets.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle bucket was not dropped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,206 @@
+// cache upstream responses to GET requests for as long as their Cache-Control headers allow
+package responsecache
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+)
+
+// DefaultMaxBodyBytes is the default limit on the size of the bodies of cached responses
+const DefaultMaxBodyBytes = 1 << 20
+
+// ResponseCache caches responses to GET requests. A response is cached only if it has status 200 OK, sets no
+// cookies, does not vary and has a Cache-Control header with a positive max-age (or s-maxage) and none of
+// no-store, no-cache or private. It is cached for that many seconds. Responses to requests with an
+// Authorization header are meant for one user, so they are only cached, and only served from the cache to
+// such requests, if they allow it with public, s-maxage or must-revalidate as in RFC 9111 section 3.5.
+// Responses served from the cache carry X-Cache: HIT, all others X-Cache: MISS
+type ResponseCache struct {
+	// entries holds the cached response of each key
+	entries *cache.TypedCache[*entry]
+	// MaxBodyBytes is the size above which responses are not cached
+	MaxBodyBytes int64
+}
+
+// entry is a cached response
+type entry struct {
+	// status is the status code of the response
+	status int
+	// header contains the headers of the response
+	header http.Header
+	// body is the body of the response
+	body []byte
+	// stored is when the response was cached, for its Age header
+	stored time.Time
+	// shared is true if the response may be served to requests with an Authorization header
+	shared bool
+}
+
+// New creates a new response cache that removes expired responses every cleanupInterval
+func New(cleanupInterval time.Duration) *ResponseCache {
+	return &ResponseCache{
+		entries:      cache.NewTypedCache[*entry](cache.NewCache(0, cleanupInterval)),
+		MaxBodyBytes: DefaultMaxBodyBytes,
+	}
+}
+
+// Stop stops the removal of expired responses
+func (c *ResponseCache) Stop() {
+	c.entries.Cache().StopCleanup()
+}
+
+// Len returns the number of cached responses
+func (c *ResponseCache) Len() int {
+	return c.entries.Len()
+}
+
+// ServeHTTP answers the request from the cached response of the key, which should identify the host, path and
+// query of the request. If no response is cached, the request is served by next and its response is cached
+// if it may be
+func (c *ResponseCache) ServeHTTP(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	if r.Method != http.MethodGet || hasDirective(r.Header, "no-store") {
+		next.ServeHTTP(w, r)
+		return
+	}
+	authorized := r.Header.Get("Authorization") != ""
+	if cached, found := c.entries.Get(key); found && (!authorized || cached.shared) {
+		header := w.Header()
+		for name, values := range cached.header {
+			// headers set for this request before it reached the cache, such as its request ID, are its own
+			if _, set := header[name]; !set {
+				header[name] = values
+			}
+		}
+		header.Set("X-Cache", "HIT")
+		header.Set("Age", strconv.Itoa(int(time.Since(cached.stored).Seconds())))
+		w.WriteHeader(cached.status)
+		w.Write(cached.body)
+		return
+	}
+	rec := &recorder{ResponseWriter: w, limit: c.MaxBodyBytes}
+	next.ServeHTTP(rec, r)
+	if ttl := rec.ttl(); ttl > 0 && !rec.overLimit {
+		shared := sharedWithAuthorization(rec.header)
+		if authorized && !shared {
+			return
+		}
+		c.entries.Set(key, &entry{
+			status: rec.status,
+			header: rec.header,
+			body:   rec.body.Bytes(),
+			stored: time.Now(),
+			shared: shared,
+		}, ttl)
+	}
+}
+
+// sharedWithAuthorization reports whether the Cache-Control header of a response lets it be cached for and
+// served to requests with an Authorization header
+func sharedWithAuthorization(header http.Header) bool {
+	for _, directive := range []string{"public", "s-maxage", "must-revalidate"} {
+		if hasDirective(header, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// recorder is an http.ResponseWriter that writes through to the client while keeping a copy of the response
+type recorder struct {
+	http.ResponseWriter
+	// status is the status code written, or zero if none was written yet
+	status int
+	// header is a copy of the headers as they were when the status was written
+	header http.Header
+	// body holds the body written so far, up to limit bytes
+	body bytes.Buffer
+	// limit is the size above which the body is no longer kept
+	limit int64
+	// overLimit is true once the body exceeded limit
+	overLimit bool
+}
+
+// WriteHeader marks the response as a cache miss, copies its headers and writes the status
+func (r *recorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+		r.ResponseWriter.Header().Set("X-Cache", "MISS")
+		r.header = r.ResponseWriter.Header().Clone()
+		r.header.Del("X-Cache")
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write keeps a copy of the body and writes it to the client
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.overLimit {
+		if int64(r.body.Len()+len(b)) > r.limit {
+			r.overLimit = true
+			r.body.Reset()
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush flushes the underlying response writer, if it supports flushing
+func (r *recorder) Flush() {
+	http.NewResponseController(r.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying response writer so that http.ResponseController can reach it
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// ttl returns how long the recorded response may be cached, or zero if it may not be cached
+func (r *recorder) ttl() time.Duration {
+	if r.status != http.StatusOK || r.header.Get("Set-Cookie") != "" || r.header.Get("Vary") != "" {
+		return 0
+	}
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if hasDirective(r.header, directive) {
+			return 0
+		}
+	}
+	maxAge, found := directiveValue(r.header, "s-maxage")
+	if !found {
+		maxAge, found = directiveValue(r.header, "max-age")
+	}
+	if !found {
+		return 0
+	}
+	seconds, err := strconv.Atoi(maxAge)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// hasDirective reports whether the Cache-Control header contains the directive
+func hasDirective(header http.Header, name string) bool {
+	_, found := directiveValue(header, name)
+	return found
+}
+
+// directiveValue returns the value of the directive of the Cache-Control header, which may be empty
+func directiveValue(header http.Header, name string) (string, bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directiveName, directiveValue, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if strings.EqualFold(directiveName, name) {
+				return strings.Trim(directiveValue, `"`), true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,195 @@
+package responsecache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingHandler answers every request with the headers and body, counting the requests it served
+type countingHandler struct {
+	header http.Header
+	status int
+	body   string
+	calls  int
+}
+
+// ServeHTTP writes the configured response
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.calls++
+	for name, values := range h.header {
+		w.Header()[name] = values
+	}
+	if h.status != 0 {
+		w.WriteHeader(h.status)
+	}
+	w.Write([]byte(h.body))
+}
+
+// newTestResponseCache creates a response cache that is stopped when the test ends
+func newTestResponseCache(t *testing.T) *ResponseCache {
+	t.Helper()
+	c := New(10 * time.Millisecond)
+	t.Cleanup(c.Stop)
+	return c
+}
+
+// get sends a GET request through the response cache and returns the recorded response
+func get(c *ResponseCache, key string, next http.Handler) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil), key, next)
+	return rec
+}
+
+func TestResponseCacheHit(t *testing.T) {
+	c := newTestResponseCache(t)
+	next := &countingHandler{
+		header: http.Header{"Cache-Control": {"public, max-age=60"}, "Content-Type": {"text/plain"}},
+		body:   "cached",
+	}
+	if rec := get(c, "example.com/a", next); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "cached" {
+		t.Fatalf("first response: X-Cache = %q, body = %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	rec := get(c, "example.com/a", next)
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "cached" || rec.Code != http.StatusOK {
+		t.Errorf("second response: %d, X-Cache = %q, body = %q", rec.Code, rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "text/plain" || rec.Header().Get("Age") != "0" {
+		t.Errorf("cached headers = %v", rec.Header())
+	}
+	if next.calls != 1 {
+		t.Errorf("upstream served %d requests, want 1", next.calls)
+	}
+	get(c, "example.com/a?page=2", next)
+	if next.calls != 2 {
+		t.Errorf("a different key was served from the cache")
+	}
+}
+
+func TestResponseCacheSkipsUncacheable(t *testing.T) {
+	tests := map[string]*countingHandler{
+		"no max-age":  {header: http.Header{"Cache-Control": {"public"}}},
+		"zero":        {header: http.Header{"Cache-Control": {"max-age=0"}}},
+		"no-store":    {header: http.Header{"Cache-Control": {"max-age=60, no-store"}}},
+		"no-cache":    {header: http.Header{"Cache-Control": {"no-cache, max-age=60"}}},
+		"private":     {header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		"set-cookie":  {header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}},
+		"vary":        {header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}},
+		"not found":   {header: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusNotFound},
+		"redirect":    {header: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusFound},
+		"bad max-age": {header: http.Header{"Cache-Control": {"max-age=soon"}}},
+	}
+	for name, next := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := newTestResponseCache(t)
+			get(c, "key", next)
+			if rec := get(c, "key", next); rec.Header().Get("X-Cache") != "MISS" {
+				t.Errorf("X-Cache = %q, want MISS", rec.Header().Get("X-Cache"))
+			}
+			if next.calls != 2 {
+				t.Errorf("upstream served %d requests, want 2", next.calls)
+			}
+		})
+	}
+}
+
+func TestResponseCacheSharedMaxAge(t *testing.T) {
+	c := newTestResponseCache(t)
+	next := &countingHandler{header: http.Header{"Cache-Control": {"max-age=0, s-maxage=60"}}}
+	get(c, "key", next)
+	if rec := get(c, "key", next); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("s-maxage did not take precedence over max-age")
+	}
+}
+
+func TestResponseCacheSkipsRequests(t *testing.T) {
+	c := newTestResponseCache(t)
+	next := &countingHandler{header: http.Header{"Cache-Control": {"max-age=60"}}}
+	for i := 0; i < 2; i++ {
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil), "key", next)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Cache-Control", "no-store")
+	c.ServeHTTP(httptest.NewRecorder(), req, "key", next)
+	if next.calls != 3 || c.Len() != 0 {
+		t.Errorf("upstream served %d requests with %d cached, want 3 with none cached", next.calls, c.Len())
+	}
+}
+
+func TestResponseCacheAuthorization(t *testing.T) {
+	// authorizedHandler answers with a body naming the credentials of the request
+	authorizedHandler := func(cacheControl string, calls *int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls++
+			w.Header().Set("Cache-Control", cacheControl)
+			w.Write([]byte("secret for " + r.Header.Get("Authorization")))
+		})
+	}
+	send := func(c *ResponseCache, next http.Handler, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req, "key", next)
+		return rec
+	}
+
+	for _, cacheControl := range []string{"max-age=60", "private, max-age=60"} {
+		c := newTestResponseCache(t)
+		var calls int
+		next := authorizedHandler(cacheControl, &calls)
+		send(c, next, "Bearer alice")
+		rec := send(c, next, "")
+		if rec.Header().Get("X-Cache") != "MISS" || strings.Contains(rec.Body.String(), "alice") {
+			t.Errorf("%s: anonymous request got X-Cache = %q, body = %q, want a miss", cacheControl, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+		// the response to the anonymous request is cached, but not for requests with other credentials
+		if rec := send(c, next, "Bearer bob"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "secret for Bearer bob" {
+			t.Errorf("%s: request of another user got X-Cache = %q, body = %q, want a miss", cacheControl, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+		if calls != 3 {
+			t.Errorf("%s: upstream served %d requests, want 3", cacheControl, calls)
+		}
+	}
+
+	for _, cacheControl := range []string{"public, max-age=60", "s-maxage=60", "max-age=60, must-revalidate"} {
+		c := newTestResponseCache(t)
+		var calls int
+		next := authorizedHandler(cacheControl, &calls)
+		send(c, next, "Bearer alice")
+		if rec := send(c, next, "Bearer bob"); rec.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("%s: X-Cache = %q, want the shared response to be a hit", cacheControl, rec.Header().Get("X-Cache"))
+		}
+	}
+}
+
+func TestResponseCacheMaxBodyBytes(t *testing.T) {
+	c := newTestResponseCache(t)
+	c.MaxBodyBytes = 4
+	next := &countingHandler{header: http.Header{"Cache-Control": {"max-age=60"}}, body: "too large"}
+	if rec := get(c, "key", next); rec.Body.String() != "too large" {
+		t.Errorf("body = %q, want it written through", rec.Body.String())
+	}
+	if c.Len() != 0 {
+		t.Error("response over the size limit was cached")
+	}
+}
+
+func TestResponseCacheExpires(t *testing.T) {
+	c := newTestResponseCache(t)
+	next := &countingHandler{header: http.Header{"Cache-Control": {"max-age=1"}}, body: strings.Repeat("a", 10)}
+	get(c, "key", next)
+	if rec := get(c, "key", next); rec.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("X-Cache = %q before the max-age passed, want HIT", rec.Header().Get("X-Cache"))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if c.Len() != 0 {
+		t.Errorf("expired response is still cached")
+	}
+	if rec := get(c, "key", next); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("X-Cache = %q after the max-age passed, want MISS", rec.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"reflect"
+	"sync"
+)
+
+// MemoryStore is a simple, thread-safe HostStore backed by a map
+type MemoryStore struct {
+	// routes maps each host to its route
+	routes map[string]*Route
+	// mutex is used to synchronize access to the store
+	mutex sync.RWMutex
+}
+
+// NewMemoryStore creates a new memory store populated with the specified host to route mappings
+func NewMemoryStore(routes map[string]*Route) *MemoryStore {
+	store := MemoryStore{
+		routes: make(map[string]*Route, len(routes)),
+	}
+	for host, route := range routes {
+		store.routes[host] = route
+	}
+	return &store
+}
+
+// Lookup returns the route for the specified host, matching wildcard hosts as described by Resolve. If the
+// host is not configured, ErrHostNotFound will be returned
+func (s *MemoryStore) Lookup(host string) (*Route, error) {
+	return Resolve(host, s.lookup)
+}
+
+// lookup returns the route configured for exactly the specified host or pattern
+func (s *MemoryStore) lookup(host string) (*Route, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	route, found := s.routes[host]
+	if !found {
+		return nil, ErrHostNotFound
+	}
+	return route, nil
+}
+
+// Routes returns a snapshot of the routes of the store keyed by the host or wildcard pattern they are
+// configured for
+func (s *MemoryStore) Routes() (map[string]*Route, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	routes := make(map[string]*Route, len(s.routes))
+	for host, route := range s.routes {
+		routes[host] = route
+	}
+	return routes, nil
+}
+
+// Set adds a new host to route mapping to the store. If the host already exists, it will be overwritten
+func (s *MemoryStore) Set(host string, route *Route) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.routes[host] = route
+}
+
+// Delete removes the mapping for the specified host from the store. It returns true if the host was configured
+func (s *MemoryStore) Delete(host string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, found := s.routes[host]
+	delete(s.routes, host)
+	return found
+}
+
+// Replace atomically replaces all routes of the store with the specified routes. It returns the number of
+// hosts whose route was added, removed or changed
+func (s *MemoryStore) Replace(routes map[string]*Route) int {
+	replacement := make(map[string]*Route, len(routes))
+	for host, route := range routes {
+		replacement[host] = route
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changed := 0
+	for host, route := range replacement {
+		if existing, found := s.routes[host]; !found || !reflect.DeepEqual(existing, route) {
+			changed++
+		}
+	}
+	for host := range s.routes {
+		if _, found := replacement[host]; !found {
+			changed++
+		}
+	}
+	s.routes = replacement
+	return changed
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+// newTestRoute creates a route to the specified target urls
+func newTestRoute(t *testing.T, rawURLs ...string) *Route {
+	t.Helper()
+	route := &Route{}
+	for _, rawURL := range rawURLs {
+		target, err := ParseTarget(rawURL)
+		if err != nil {
+			t.Fatalf("failed to parse target %s: %v", rawURL, err)
+		}
+		route.Targets = append(route.Targets, target)
+	}
+	return route
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(map[string]*Route{
+		"a.example.com": newTestRoute(t, "http://10.0.0.1"),
+	})
+	if _, err := s.Lookup("a.example.com"); err != nil {
+		t.Errorf("Lookup of a configured host: %v", err)
+	}
+	if _, err := s.Lookup("b.example.com"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("Lookup of a missing host: err = %v, want ErrHostNotFound", err)
+	}
+	s.Set("b.example.com", newTestRoute(t, "http://10.0.0.2"))
+	if _, err := s.Lookup("b.example.com"); err != nil {
+		t.Errorf("Lookup after Set: %v", err)
+	}
+	if !s.Delete("a.example.com") {
+		t.Error("Delete of a configured host returned false")
+	}
+	if _, err := s.Lookup("a.example.com"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("Lookup after Delete: err = %v, want ErrHostNotFound", err)
+	}
+	if s.Delete("a.example.com") {
+		t.Error("Delete of a missing host returned true")
+	}
+}
+
+func TestMemoryStoreRoutes(t *testing.T) {
+	s := NewMemoryStore(map[string]*Route{
+		"a.example.com": newTestRoute(t, "http://10.0.0.1"),
+		"*.example.com": newTestRoute(t, "http://*.internal"),
+	})
+	routes, err := s.Routes()
+	if err != nil {
+		t.Fatalf("Routes: %v", err)
+	}
+	if len(routes) != 2 || routes["a.example.com"] == nil || routes["*.example.com"] == nil {
+		t.Errorf("Routes = %v, want both configured hosts", routes)
+	}
+	delete(routes, "a.example.com")
+	if _, err := s.Lookup("a.example.com"); err != nil {
+		t.Error("modifying the snapshot modified the store")
+	}
+}
+
+func TestMemoryStoreReplace(t *testing.T) {
+	s := NewMemoryStore(map[string]*Route{
+		"same.example.com":    newTestRoute(t, "http://10.0.0.1"),
+		"changed.example.com": newTestRoute(t, "http://10.0.0.2"),
+		"removed.example.com": newTestRoute(t, "http://10.0.0.3"),
+	})
+	changed := s.Replace(map[string]*Route{
+		"same.example.com":    newTestRoute(t, "http://10.0.0.1"),
+		"changed.example.com": newTestRoute(t, "http://10.0.0.20"),
+		"added.example.com":   newTestRoute(t, "http://10.0.0.4"),
+	})
+	if changed != 3 {
+		t.Errorf("Replace reported %d changes, want 3", changed)
+	}
+	if _, err := s.Lookup("removed.example.com"); !errors.Is(err, ErrHostNotFound) {
+		t.Errorf("removed host still resolves: %v", err)
+	}
+	route, err := s.Lookup("changed.example.com")
+	if err != nil || route.Targets[0].String() != "http://10.0.0.20" {
+		t.Errorf("changed host resolves to %+v, %v", route, err)
+	}
+}
+
+func TestMemoryStoreWildcard(t *testing.T) {
+	s := NewMemoryStore(map[string]*Route{
+		"*.tunnel.farm":        newTestRoute(t, "http://*.internal:7880"),
+		"exact.tunnel.farm":    newTestRoute(t, "http://10.0.0.1"),
+		"*.deep.tunnel.farm":   newTestRoute(t, "http://10.0.0.2"),
+		"shared.example.com":   newTestRoute(t, "http://10.0.0.3"),
+		"*.shared.example.com": newTestRoute(t, "http://*-shared.internal"),
+	})
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "abc.tunnel.farm", want: "abc.internal:7880"},
+		{host: "xyz.tunnel.farm", want: "xyz.internal:7880"},
+		// an exact match takes precedence over the wildcard
+		{host: "exact.tunnel.farm", want: "10.0.0.1"},
+		// the most specific wildcard is the only one considered
+		{host: "a.deep.tunnel.farm", want: "10.0.0.2"},
+		{host: "shared.example.com", want: "10.0.0.3"},
+		{host: "a.shared.example.com", want: "a-shared.internal"},
+	}
+	for _, test := range tests {
+		route, err := s.Lookup(test.host)
+		if err != nil {
+			t.Errorf("Lookup(%q): %v", test.host, err)
+			continue
+		}
+		if got := route.Targets[0].Host; got != test.want {
+			t.Errorf("Lookup(%q) target = %q, want %q", test.host, got, test.want)
+		}
+	}
+	// a wildcard matches exactly one label
+	for _, host := range []string{"tunnel.farm", "a.b.tunnel.farm", "*.tunnel.farm", ".tunnel.farm"} {
+		if _, err := s.Lookup(host); !errors.Is(err, ErrHostNotFound) {
+			t.Errorf("Lookup(%q): err = %v, want ErrHostNotFound", host, err)
+		}
+	}
+	// expanding a wildcard route leaves the configured route untouched
+	if route, _ := s.lookup("*.tunnel.farm"); route.Targets[0].Host != "*.internal:7880" {
+		t.Errorf("wildcard route was modified: %s", route.Targets[0])
+	}
+}
@@ -0,0 +1,196 @@
+// implement a HostStore backed by Redis, shared by several proxy instances
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// Options configures the connection of a Store to Redis
+type Options struct {
+	// Addr is the host:port address of the Redis server
+	Addr string
+	// Username authenticates the connection with Redis ACLs, if set
+	Username string
+	// Password authenticates the connection, if set
+	Password string
+	// DB is the number of the database to select
+	DB int
+	// KeyPrefix is prepended to a host to form the key of the set holding its target urls
+	KeyPrefix string
+	// CacheTTL is how long a route read from Redis, or the absence of one, is remembered locally before
+	// Redis is asked again. Zero or negative disables the local cache
+	CacheTTL time.Duration
+	// Timeout bounds each command sent to Redis
+	Timeout time.Duration
+}
+
+// DefaultOptions returns options with the default key prefix, a local cache of 5 seconds and a timeout of 1
+// second. The address of the server must still be set
+func DefaultOptions() Options {
+	return Options{
+		KeyPrefix: "proxy-host:route:",
+		CacheTTL:  5 * time.Second,
+		Timeout:   time.Second,
+	}
+}
+
+// Store is a HostStore that reads host to target url mappings from Redis. The targets of a host are the
+// members of the set at the key of the host, so "SADD proxy-host:route:a.example.com http://10.0.0.1:8080"
+// routes a.example.com to http://10.0.0.1:8080
+type Store struct {
+	// client is the connection pool to Redis
+	client *goredis.Client
+	// keyPrefix is prepended to a host to form its key
+	keyPrefix string
+	// timeout bounds each command sent to Redis
+	timeout time.Duration
+	// routes caches the routes read from Redis, a nil route meaning the host is not configured. It is nil
+	// when the local cache is disabled
+	routes *cache.TypedCache[*store.Route]
+}
+
+// Open connects to the Redis server described by the options and checks that it is reachable
+func Open(opts Options) (*Store, error) {
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     opts.Addr,
+		Username: opts.Username,
+		Password: opts.Password,
+		DB:       opts.DB,
+	})
+	s := &Store{
+		client:    client,
+		keyPrefix: opts.KeyPrefix,
+		timeout:   opts.Timeout,
+	}
+	if opts.CacheTTL > 0 {
+		s.routes = cache.NewTypedCache[*store.Route](cache.NewCache(opts.CacheTTL, opts.CacheTTL))
+	}
+	if err := s.Ping(context.Background()); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Ping checks that Redis is reachable. If it is not, an error wrapping store.ErrUnavailable is returned
+func (s *Store) Ping(ctx context.Context) error {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to reach redis: %w: %w", store.ErrUnavailable, err)
+	}
+	return nil
+}
+
+// Lookup returns the route for the specified host, with one target per member of its set. Wildcard hosts
+// are matched as described by store.Resolve. If the host is not configured, store.ErrHostNotFound will be
+// returned, and if Redis cannot be reached, an error wrapping store.ErrUnavailable
+func (s *Store) Lookup(host string) (*store.Route, error) {
+	return store.Resolve(host, s.lookupHost)
+}
+
+// lookupHost returns the route configured for exactly the specified host or pattern, from the local cache
+// if it holds it
+func (s *Store) lookupHost(host string) (*store.Route, error) {
+	if s.routes == nil {
+		return s.fetch(host)
+	}
+	route, err := s.routes.GetOrSet(host, 0, func() (*store.Route, error) {
+		route, err := s.fetch(host)
+		if errors.Is(err, store.ErrHostNotFound) {
+			// remember the absence of the host too, so that requests for unknown hosts do not reach Redis
+			return nil, nil
+		}
+		return route, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if route == nil {
+		return nil, store.ErrHostNotFound
+	}
+	return route, nil
+}
+
+// fetch reads the route configured for exactly the specified host or pattern from Redis
+func (s *Store) fetch(host string) (*store.Route, error) {
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+	rawURLs, err := s.client.SMembers(ctx, s.keyPrefix+host).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup host %s: %w: %w", host, store.ErrUnavailable, err)
+	}
+	if len(rawURLs) == 0 {
+		return nil, store.ErrHostNotFound
+	}
+	return parseRoute(host, rawURLs)
+}
+
+// Routes returns the routes of all hosts in Redis, keyed by the host or wildcard pattern they are
+// configured for. The local cache is bypassed
+func (s *Store) Routes() (map[string]*store.Route, error) {
+	ctx, cancel := s.withTimeout(context.Background())
+	defer cancel()
+	routes := make(map[string]*store.Route)
+	iter := s.client.Scan(ctx, 0, s.keyPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		host := strings.TrimPrefix(iter.Val(), s.keyPrefix)
+		rawURLs, err := s.client.SMembers(ctx, iter.Val()).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list hosts: %w: %w", store.ErrUnavailable, err)
+		}
+		if len(rawURLs) == 0 {
+			continue
+		}
+		route, err := parseRoute(host, rawURLs)
+		if err != nil {
+			return nil, err
+		}
+		routes[host] = route
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list hosts: %w: %w", store.ErrUnavailable, err)
+	}
+	return routes, nil
+}
+
+// Close stops the local cache and closes the connections to Redis
+func (s *Store) Close() error {
+	if s.routes != nil {
+		s.routes.Cache().StopCleanup()
+	}
+	return s.client.Close()
+}
+
+// withTimeout returns a context bounded by the timeout of the store, if any
+func (s *Store) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// parseRoute returns the route of the host to the target urls, in sorted order since set members are
+// returned in no particular order
+func parseRoute(host string, rawURLs []string) (*store.Route, error) {
+	sort.Strings(rawURLs)
+	route := &store.Route{}
+	for _, rawURL := range rawURLs {
+		target, err := store.ParseTarget(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target url for host %s: %w", host, err)
+		}
+		route.Targets = append(route.Targets, target)
+	}
+	return route, nil
+}
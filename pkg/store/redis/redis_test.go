@@ -0,0 +1,143 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// openTestStore starts an in-memory Redis server and opens a store on it with the specified local cache ttl
+func openTestStore(t *testing.T, cacheTTL time.Duration) (*Store, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	opts := DefaultOptions()
+	opts.Addr = server.Addr()
+	opts.CacheTTL = cacheTTL
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, server
+}
+
+func TestLookup(t *testing.T) {
+	s, server := openTestStore(t, 0)
+	server.SAdd("proxy-host:route:a.example.com", "https://10.0.0.2", "http://10.0.0.1:8080")
+	route, err := s.Lookup("a.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(route.Targets) != 2 {
+		t.Fatalf("got %d targets, want 2", len(route.Targets))
+	}
+	if got := route.Targets[0].String(); got != "http://10.0.0.1:8080" {
+		t.Errorf("first target = %s", got)
+	}
+}
+
+func TestLookupNotFound(t *testing.T) {
+	s, _ := openTestStore(t, time.Minute)
+	for i := 0; i < 2; i++ {
+		if _, err := s.Lookup("missing.example.com"); !errors.Is(err, store.ErrHostNotFound) {
+			t.Errorf("err = %v, want ErrHostNotFound", err)
+		}
+	}
+}
+
+func TestLookupInvalidTarget(t *testing.T) {
+	s, server := openTestStore(t, 0)
+	server.SAdd("proxy-host:route:a.example.com", "ftp://10.0.0.1")
+	if _, err := s.Lookup("a.example.com"); err == nil || errors.Is(err, store.ErrHostNotFound) {
+		t.Errorf("err = %v, want an invalid target error", err)
+	}
+}
+
+func TestLookupWildcard(t *testing.T) {
+	s, server := openTestStore(t, time.Minute)
+	server.SAdd("proxy-host:route:*.example.com", "http://*.internal:7880")
+	route, err := s.Lookup("a.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := route.Targets[0].String(); got != "http://a.internal:7880" {
+		t.Errorf("target = %s, want http://a.internal:7880", got)
+	}
+}
+
+func TestLookupCachesLocally(t *testing.T) {
+	s, server := openTestStore(t, 50*time.Millisecond)
+	server.SAdd("proxy-host:route:a.example.com", "http://10.0.0.1")
+	if _, err := s.Lookup("a.example.com"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server.Del("proxy-host:route:a.example.com")
+	server.SAdd("proxy-host:route:a.example.com", "http://10.0.0.2")
+	route, err := s.Lookup("a.example.com")
+	if err != nil || route.Targets[0].Host != "10.0.0.1" {
+		t.Errorf("Lookup within the cache ttl = %+v, %v, want the cached route", route, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	route, err = s.Lookup("a.example.com")
+	if err != nil || route.Targets[0].Host != "10.0.0.2" {
+		t.Errorf("Lookup after the cache ttl = %+v, %v, want the new route", route, err)
+	}
+}
+
+func TestLookupUnavailable(t *testing.T) {
+	s, server := openTestStore(t, time.Minute)
+	server.Close()
+	_, err := s.Lookup("a.example.com")
+	if !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("err = %v, want ErrUnavailable", err)
+	}
+	if errors.Is(err, store.ErrHostNotFound) {
+		t.Error("unavailable redis reported the host as not found")
+	}
+	if err := s.Ping(context.Background()); !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("Ping err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestLookupUnavailableNotCached(t *testing.T) {
+	s, server := openTestStore(t, time.Minute)
+	server.SetError("LOADING")
+	if _, err := s.Lookup("a.example.com"); !errors.Is(err, store.ErrUnavailable) {
+		t.Fatalf("err = %v, want ErrUnavailable", err)
+	}
+	server.SetError("")
+	server.SAdd("proxy-host:route:a.example.com", "http://10.0.0.1")
+	if _, err := s.Lookup("a.example.com"); err != nil {
+		t.Errorf("Lookup after redis recovered: %v", err)
+	}
+}
+
+func TestOpenUnreachable(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Addr = "127.0.0.1:1"
+	if _, err := Open(opts); !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	s, server := openTestStore(t, 0)
+	server.SAdd("proxy-host:route:a.example.com", "http://10.0.0.1", "http://10.0.0.2")
+	server.SAdd("proxy-host:route:*.example.com", "http://*.internal")
+	server.Set("other:key", "ignored")
+	routes, err := s.Routes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2", len(routes))
+	}
+	if n := len(routes["a.example.com"].Targets); n != 2 {
+		t.Errorf("a.example.com has %d targets, want 2", n)
+	}
+}
@@ -0,0 +1,138 @@
+// implement a HostStore backed by a SQLite database
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+
+	_ "modernc.org/sqlite"
+)
+
+// schema creates the hosts table if it does not already exist. A host may have several rows, one per target
+const schema = `CREATE TABLE IF NOT EXISTS hosts (
+	host TEXT NOT NULL,
+	target_url TEXT NOT NULL,
+	PRIMARY KEY (host, target_url)
+)`
+
+// Store is a HostStore that reads host to target url mappings from a SQLite database
+type Store struct {
+	// db is the underlying database connection
+	db *sql.DB
+	// lookup is the prepared statement used to resolve a host
+	lookup *sql.Stmt
+}
+
+// Open opens the SQLite database at the specified path and prepares the lookup statement.
+// The hosts table must already exist, see Migrate
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+	lookup, err := db.Prepare("SELECT target_url FROM hosts WHERE host = ? ORDER BY target_url")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to prepare lookup statement: %w", err)
+	}
+	return &Store{
+		db:     db,
+		lookup: lookup,
+	}, nil
+}
+
+// Migrate creates the hosts table in the SQLite database at the specified path if it does not exist
+func Migrate(path string) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("failed to create hosts table: %w", err)
+	}
+	return nil
+}
+
+// Lookup returns the route for the specified host, with one target per row. Wildcard hosts are matched as
+// described by store.Resolve. If the host is not configured, store.ErrHostNotFound will be returned
+func (s *Store) Lookup(host string) (*store.Route, error) {
+	return store.Resolve(host, s.lookupHost)
+}
+
+// lookupHost returns the route configured for exactly the specified host or pattern
+func (s *Store) lookupHost(host string) (*store.Route, error) {
+	rows, err := s.lookup.Query(host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup host %s: %w", host, err)
+	}
+	defer rows.Close()
+	route := &store.Route{}
+	for rows.Next() {
+		var rawURL string
+		if err := rows.Scan(&rawURL); err != nil {
+			return nil, fmt.Errorf("failed to lookup host %s: %w", host, err)
+		}
+		target, err := store.ParseTarget(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target url for host %s: %w", host, err)
+		}
+		route.Targets = append(route.Targets, target)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to lookup host %s: %w", host, err)
+	}
+	if len(route.Targets) == 0 {
+		return nil, store.ErrHostNotFound
+	}
+	return route, nil
+}
+
+// Routes returns the routes of all hosts in the database, with one target per row, keyed by the host or
+// wildcard pattern they are configured for
+func (s *Store) Routes() (map[string]*store.Route, error) {
+	rows, err := s.db.Query("SELECT host, target_url FROM hosts ORDER BY host, target_url")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hosts: %w", err)
+	}
+	defer rows.Close()
+	routes := make(map[string]*store.Route)
+	for rows.Next() {
+		var host, rawURL string
+		if err := rows.Scan(&host, &rawURL); err != nil {
+			return nil, fmt.Errorf("failed to list hosts: %w", err)
+		}
+		target, err := store.ParseTarget(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target url for host %s: %w", host, err)
+		}
+		route, found := routes[host]
+		if !found {
+			route = &store.Route{}
+			routes[host] = route
+		}
+		route.Targets = append(route.Targets, target)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list hosts: %w", err)
+	}
+	return routes, nil
+}
+
+// Ping checks that the database is reachable. If it is not, an error wrapping store.ErrUnavailable is
+// returned
+func (s *Store) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to reach database: %w: %w", store.ErrUnavailable, err)
+	}
+	return nil
+}
+
+// Close closes the lookup statement and the underlying database connection
+func (s *Store) Close() error {
+	s.lookup.Close()
+	return s.db.Close()
+}
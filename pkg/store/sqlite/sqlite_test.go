@@ -0,0 +1,126 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// openTestStore creates a migrated database holding the specified host to target url rows and opens it
+func openTestStore(t *testing.T, rows [][2]string) *Store {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hosts.db")
+	if err := Migrate(path); err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	for _, row := range rows {
+		if _, err := db.Exec("INSERT INTO hosts (host, target_url) VALUES (?, ?)", row[0], row[1]); err != nil {
+			t.Fatalf("failed to insert row: %v", err)
+		}
+	}
+	db.Close()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestLookup(t *testing.T) {
+	s := openTestStore(t, [][2]string{
+		{"a.example.com", "http://10.0.0.1:8080"},
+		{"a.example.com", "https://10.0.0.2"},
+	})
+	route, err := s.Lookup("a.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(route.Targets) != 2 {
+		t.Fatalf("got %d targets, want 2", len(route.Targets))
+	}
+	if got := route.Targets[0].String(); got != "http://10.0.0.1:8080" {
+		t.Errorf("first target = %s", got)
+	}
+}
+
+func TestLookupNotFound(t *testing.T) {
+	s := openTestStore(t, nil)
+	if _, err := s.Lookup("missing.example.com"); !errors.Is(err, store.ErrHostNotFound) {
+		t.Errorf("err = %v, want ErrHostNotFound", err)
+	}
+}
+
+func TestLookupInvalidTarget(t *testing.T) {
+	for _, target := range []string{"://bad", "example.com", "ftp://example.com", "http://"} {
+		s := openTestStore(t, [][2]string{{"bad.example.com", target}})
+		_, err := s.Lookup("bad.example.com")
+		if err == nil || errors.Is(err, store.ErrHostNotFound) {
+			t.Errorf("target %q: err = %v, want invalid target error", target, err)
+		}
+	}
+}
+
+func TestLookupWildcard(t *testing.T) {
+	s := openTestStore(t, [][2]string{
+		{"*.tunnel.farm", "http://*.internal:7880"},
+		{"exact.tunnel.farm", "http://10.0.0.1"},
+	})
+	route, err := s.Lookup("abc.tunnel.farm")
+	if err != nil || route.Targets[0].Host != "abc.internal:7880" {
+		t.Errorf("Lookup(abc.tunnel.farm) = %+v, %v", route, err)
+	}
+	route, err = s.Lookup("exact.tunnel.farm")
+	if err != nil || route.Targets[0].Host != "10.0.0.1" {
+		t.Errorf("Lookup(exact.tunnel.farm) = %+v, %v", route, err)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	s := openTestStore(t, [][2]string{
+		{"a.example.com", "http://10.0.0.1:8080"},
+		{"a.example.com", "https://10.0.0.2"},
+		{"*.example.com", "http://*.internal"},
+	})
+	routes, err := s.Routes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("got %d routes, want 2", len(routes))
+	}
+	if n := len(routes["a.example.com"].Targets); n != 2 {
+		t.Errorf("a.example.com has %d targets, want 2", n)
+	}
+	if got := routes["*.example.com"].Targets[0].String(); got != "http://*.internal" {
+		t.Errorf("wildcard target = %s", got)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := openTestStore(t, nil)
+	if err := s.Ping(context.Background()); err != nil {
+		t.Errorf("Ping of an open store: %v", err)
+	}
+	s.Close()
+	if err := s.Ping(context.Background()); !errors.Is(err, store.ErrUnavailable) {
+		t.Errorf("Ping of a closed store: err = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.db")
+	for i := 0; i < 2; i++ {
+		if err := Migrate(path); err != nil {
+			t.Fatalf("migrate %d: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+// resolve incoming hosts to the upstream targets they should be proxied to
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrHostNotFound is returned by a HostStore when no route is configured for a host
+var ErrHostNotFound = errors.New("host not found")
+
+// ErrUnavailable is returned by a HostStore when its backend cannot be reached, so whether a host is
+// configured is unknown rather than known to be false
+var ErrUnavailable = errors.New("store unavailable")
+
+// Load balancing strategies of routes
+const (
+	// StrategyRoundRobin cycles through the targets in order
+	StrategyRoundRobin = "round-robin"
+	// StrategyWeighted sends each target a share of the requests proportional to its weight
+	StrategyWeighted = "weighted"
+	// StrategyLeastConnections sends each request to the target with the fewest requests in flight
+	StrategyLeastConnections = "least-connections"
+)
+
+// Route describes how requests for a host should be proxied. Routes configured for a wildcard pattern
+// such as "*.example.com" are matched as described by Resolve
+type Route struct {
+	// Targets contains the upstream target urls that requests are balanced across. The scheme of each
+	// url determines whether the target is reached over http or https
+	Targets []*url.URL
+	// Strategy is the load balancing strategy across the targets, one of the Strategy constants. Empty means
+	// StrategyRoundRobin
+	Strategy string
+	// Weights contains the weight of the target at the same index of Targets for StrategyWeighted. If nil,
+	// all targets weigh 1
+	Weights []int
+	// Timeout bounds how long a request to a target may take. Zero uses the proxy's default
+	Timeout time.Duration
+	// InsecureSkipVerify disables verification of the certificates presented by https targets
+	InsecureSkipVerify bool
+	// PreserveHostHeader forwards requests with the Host header the client sent, for targets that serve
+	// several virtual hosts. If false, the Host header is set to the host of the target
+	PreserveHostHeader bool
+	// ClientTLS configures the client certificate presented to https targets that require mutual TLS,
+	// overriding the proxy's. If nil, the proxy's client TLS config is used
+	ClientTLS *ClientTLS
+	// MaxRequestBodyBytes overrides the proxy's limit on request bodies. Zero uses the proxy's default and
+	// a negative value disables the limit
+	MaxRequestBodyBytes int64
+	// AllowedMethods contains the request methods proxied for the host, overriding the proxy's. If nil, the
+	// proxy's allowed methods apply
+	AllowedMethods []string
+	// RateLimit limits the rate of requests proxied for the host. If nil, requests are not limited
+	RateLimit *RateLimit
+	// IPFilter restricts the client IPs the host may be reached from. If nil, all clients are permitted
+	IPFilter *IPFilter
+	// BasicAuth requires clients to authenticate with one of its users. If nil, no authentication is required
+	BasicAuth *BasicAuth
+	// CORS adds cross-origin resource sharing headers to the responses of the host and answers preflight
+	// requests. If nil, CORS headers are left to the targets
+	CORS *CORS
+	// StickySessions sends the requests of each client to the same target for as long as it is available.
+	// If nil, requests are balanced round-robin
+	StickySessions *StickySessions
+	// Paths routes requests whose path matches a prefix to targets of their own, see MatchPath. Requests
+	// matching no rule are proxied to Targets
+	Paths []*PathRule
+	// ResponseHeaders contains headers added to the responses of the targets that do not set them, overriding
+	// the headers the proxy adds to all hosts. An empty value stops the proxy from adding that header
+	ResponseHeaders map[string]string
+	// Cookies rewrites the cookies set by the targets for the public host. If nil, cookies are left as the
+	// targets set them
+	Cookies *Cookies
+	// Maintenance answers the requests of the host with a maintenance page instead of proxying them
+	Maintenance bool
+	// Redirect answers the requests of the host with a redirect instead of proxying them, in which case the
+	// route has no targets. If nil, requests are proxied
+	Redirect *Redirect
+}
+
+// Redirect redirects the requests of a host to another url
+type Redirect struct {
+	// URL is the absolute url requests are redirected to
+	URL *url.URL
+	// Status is the status code of the redirect: 301, 302, 307 or 308
+	Status int
+	// PreservePath appends the path of each request to the path of URL and keeps its query
+	PreservePath bool
+}
+
+// ClientTLS configures the TLS connections to the https targets of a route that require mutual TLS
+type ClientTLS struct {
+	// CertFile is the path of the PEM encoded client certificate presented to the targets
+	CertFile string
+	// KeyFile is the path of the PEM encoded private key of the client certificate
+	KeyFile string
+	// CAFile is the path of a PEM bundle of the CAs the certificates of the targets are verified against. If
+	// empty, the system roots are used
+	CAFile string
+}
+
+// PathRule routes the requests of a host under a path prefix to its own targets
+type PathRule struct {
+	// Prefix is the path prefix the rule applies to. A prefix ending in "/" matches any path starting with
+	// it, otherwise it matches the path itself and the paths below it, so "/api" matches "/api" and
+	// "/api/users" but not "/apis"
+	Prefix string
+	// Targets contains the upstream target urls that requests matching the rule are balanced across
+	Targets []*url.URL
+	// StripPrefix removes the prefix from the path before the request is forwarded
+	StripPrefix bool
+	// RewritePrefix replaces the prefix with the specified path before the request is forwarded
+	RewritePrefix string
+}
+
+// MatchPath returns the path rule of the route that applies to the path. If several rules match, the one with
+// the longest prefix wins. If no rule matches, nil is returned
+func (r *Route) MatchPath(path string) *PathRule {
+	var match *PathRule
+	for _, rule := range r.Paths {
+		if rule.matches(path) && (match == nil || len(rule.Prefix) > len(match.Prefix)) {
+			match = rule
+		}
+	}
+	return match
+}
+
+// ForPath returns a copy of the route that proxies to the targets of the path rule
+func (r *Route) ForPath(rule *PathRule) *Route {
+	pathRoute := *r
+	pathRoute.Targets = rule.Targets
+	pathRoute.Weights = nil
+	pathRoute.Paths = nil
+	return &pathRoute
+}
+
+// matches reports whether the rule applies to the path
+func (p *PathRule) matches(path string) bool {
+	if strings.HasSuffix(p.Prefix, "/") {
+		return strings.HasPrefix(path, p.Prefix)
+	}
+	return path == p.Prefix || strings.HasPrefix(path, p.Prefix+"/")
+}
+
+// RewritePath returns the path a request for the specified path matching the rule is forwarded with
+func (p *PathRule) RewritePath(path string) string {
+	if !p.StripPrefix && p.RewritePrefix == "" {
+		return path
+	}
+	rest := strings.TrimPrefix(path, strings.TrimSuffix(p.Prefix, "/"))
+	rewritten := strings.TrimSuffix(p.RewritePrefix, "/") + rest
+	if !strings.HasPrefix(rewritten, "/") {
+		rewritten = "/" + rewritten
+	}
+	return rewritten
+}
+
+// BasicAuth holds the users allowed to reach a host with HTTP basic authentication
+type BasicAuth struct {
+	// Realm is the realm sent in the challenge to unauthenticated clients
+	Realm string
+	// Users maps each username to the bcrypt hash of its password
+	Users map[string][]byte
+}
+
+// dummyHash is compared against when a username is unknown, so that unknown and known users take as long
+// to reject
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// Authenticate reports whether the password is the password of the user
+func (a *BasicAuth) Authenticate(username, password string) bool {
+	hash, found := a.Users[username]
+	if !found {
+		hash = dummyHash
+	}
+	// the comparison of the hashes is constant time
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && found
+}
+
+// Cookies rewrites the Set-Cookie headers of the responses of the targets of a host
+type Cookies struct {
+	// RewriteDomain replaces the Domain attribute of cookies with the public host of the request, for targets
+	// that set cookies for their internal host name. Cookies without a Domain are left host-only
+	RewriteDomain bool
+	// Secure adds the Secure attribute to cookies that lack it
+	Secure bool
+	// SameSite replaces the SameSite attribute of cookies with Lax, Strict or None. Empty leaves it as set.
+	// None implies Secure, as browsers reject it otherwise
+	SameSite string
+}
+
+// StickySessions binds the clients of a host to a target with a cookie
+type StickySessions struct {
+	// CookieName is the name of the cookie identifying the target of the client
+	CookieName string
+	// TTL is how long clients keep the cookie. Zero makes it a session cookie
+	TTL time.Duration
+}
+
+// CORS is the cross-origin resource sharing policy of a host
+type CORS struct {
+	// AllowedOrigins contains the origins, such as "https://app.example.com", that may make cross-origin
+	// requests. The entry "*" allows any origin
+	AllowedOrigins []string
+	// AllowedMethods contains the methods preflight requests may ask for
+	AllowedMethods []string
+	// AllowedHeaders contains the request headers preflight requests may ask for
+	AllowedHeaders []string
+	// AllowCredentials lets cross-origin requests carry cookies and authorization
+	AllowCredentials bool
+	// MaxAge is how long a browser may cache the result of a preflight request. Zero leaves it to the browser
+	MaxAge time.Duration
+}
+
+// AllowsOrigin reports whether requests from the origin are allowed
+func (c *CORS) AllowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFilter permits or denies client IPs by CIDR range
+type IPFilter struct {
+	// Allow contains the ranges clients must be in. If empty, clients not denied are permitted
+	Allow []netip.Prefix
+	// Deny contains the ranges clients must not be in. Deny takes precedence over Allow
+	Deny []netip.Prefix
+}
+
+// Permits reports whether a client with the specified IP may reach the host. IPv4-mapped IPv6 addresses
+// are matched as IPv4 addresses
+func (f *IPFilter) Permits(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range f.Deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePrefix parses a CIDR range such as "10.0.0.0/8" or "2001:db8::/32". A single IP address is parsed as
+// the range holding only that address
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR range %q", s)
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// RateLimit is a token bucket limit on the requests of a host
+type RateLimit struct {
+	// RequestsPerSecond is the sustained rate of requests allowed
+	RequestsPerSecond float64
+	// Burst is the number of requests allowed at once before the rate applies
+	Burst int
+	// PerClient applies the limit to each client IP separately rather than to the host as a whole
+	PerClient bool
+}
+
+// HostStore resolves a host to the route it should be proxied with
+type HostStore interface {
+	// Lookup returns the route for the specified host. If the host is not configured,
+	// ErrHostNotFound will be returned
+	Lookup(host string) (route *Route, err error)
+}
+
+// Pinger is implemented by HostStores whose backend may become unreachable
+type Pinger interface {
+	// Ping checks that the backend of the store is reachable. If it is not, an error wrapping
+	// ErrUnavailable is returned
+	Ping(ctx context.Context) error
+}
+
+// RouteLister is implemented by HostStores that can list all of their configured routes
+type RouteLister interface {
+	// Routes returns a snapshot of the routes of the store keyed by the host or wildcard pattern they are
+	// configured for
+	Routes() (map[string]*Route, error)
+}
+
+// RouteWriter is implemented by HostStores whose routes can be changed while the proxy is running
+type RouteWriter interface {
+	// Set configures the route of the host or wildcard pattern, replacing any route it already had
+	Set(host string, route *Route)
+	// Delete removes the route of the host or wildcard pattern. It returns true if the host was configured
+	Delete(host string) bool
+}
+
+// ParseTarget parses a target url, which must be an absolute http or https url, or a unix url such as
+// "unix:///var/run/app.sock" whose path is that of the Unix domain socket the target listens on
+func ParseTarget(rawURL string) (*url.URL, error) {
+	target, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme == "unix" {
+		if target.Host != "" || target.Path == "" {
+			return nil, fmt.Errorf("unix target %s must be of the form unix:///path/to/socket", rawURL)
+		}
+		return target, nil
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q in %s", target.Scheme, rawURL)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("missing host in %s", rawURL)
+	}
+	return target, nil
+}
+
+// Resolve returns the route for the specified host, using lookup to find the route configured for a single host
+// or wildcard pattern. HostStores use it to support wildcard routes with the following precedence:
+//   - a route configured for the host itself always takes precedence over a wildcard
+//   - otherwise the wildcard "*.example.com" matches a host with exactly one more label, so it matches
+//     "a.example.com" but neither "example.com" nor "a.b.example.com"
+//
+// A "*" in the host of a wildcard route's targets is replaced with the matched label, so the route for
+// "*.example.com" with the target "http://*.internal:7880" proxies "a.example.com" to "http://a.internal:7880"
+func Resolve(host string, lookup func(host string) (*Route, error)) (*Route, error) {
+	if strings.Contains(host, "*") {
+		return nil, ErrHostNotFound
+	}
+	route, err := lookup(host)
+	if !errors.Is(err, ErrHostNotFound) {
+		return route, err
+	}
+	label, parent, found := strings.Cut(host, ".")
+	if !found || label == "" || parent == "" {
+		return nil, ErrHostNotFound
+	}
+	route, err = lookup("*." + parent)
+	if err != nil {
+		return nil, err
+	}
+	return route.expand(label), nil
+}
+
+// expand returns a copy of the route with each "*" in the hosts of its targets and the targets of its path
+// rules replaced with label
+func (r *Route) expand(label string) *Route {
+	expanded := *r
+	expanded.Targets = expandTargets(r.Targets, label)
+	expanded.Paths = make([]*PathRule, len(r.Paths))
+	for i, rule := range r.Paths {
+		expandedRule := *rule
+		expandedRule.Targets = expandTargets(rule.Targets, label)
+		expanded.Paths[i] = &expandedRule
+	}
+	return &expanded
+}
+
+// expandTargets returns copies of the targets with each "*" in their hosts replaced with label
+func expandTargets(targets []*url.URL, label string) []*url.URL {
+	expanded := make([]*url.URL, len(targets))
+	for i, target := range targets {
+		expandedTarget := *target
+		expandedTarget.Host = strings.ReplaceAll(target.Host, "*", label)
+		expanded[i] = &expandedTarget
+	}
+	return expanded
+}
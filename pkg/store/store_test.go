@@ -0,0 +1,163 @@
+package store
+
+import (
+	"net/netip"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseTarget(t *testing.T) {
+	valid := []string{"http://example.com", "https://10.0.0.1:8443/base", "unix:///var/run/app.sock"}
+	for _, rawURL := range valid {
+		if _, err := ParseTarget(rawURL); err != nil {
+			t.Errorf("ParseTarget(%q): %v", rawURL, err)
+		}
+	}
+	invalid := []string{"example.com", "ftp://example.com", "http://", "://bad", "unix://", "unix://host/app.sock"}
+	for _, rawURL := range invalid {
+		if _, err := ParseTarget(rawURL); err == nil {
+			t.Errorf("ParseTarget(%q) succeeded, want an error", rawURL)
+		}
+	}
+}
+
+// mustParsePrefixes parses the CIDR ranges or fails the test
+func mustParsePrefixes(t *testing.T, ranges ...string) []netip.Prefix {
+	t.Helper()
+	var prefixes []netip.Prefix
+	for _, s := range ranges {
+		prefix, err := ParsePrefix(s)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", s, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+func TestIPFilterPermits(t *testing.T) {
+	allowOnly := &IPFilter{Allow: mustParsePrefixes(t, "10.0.0.0/8", "2001:db8::/32")}
+	denyOnly := &IPFilter{Deny: mustParsePrefixes(t, "192.0.2.0/24", "2001:db8:bad::/48")}
+	both := &IPFilter{Allow: mustParsePrefixes(t, "10.0.0.0/8"), Deny: mustParsePrefixes(t, "10.0.0.5")}
+	tests := []struct {
+		filter *IPFilter
+		ip     string
+		want   bool
+	}{
+		{filter: allowOnly, ip: "10.1.2.3", want: true},
+		{filter: allowOnly, ip: "::ffff:10.1.2.3", want: true},
+		{filter: allowOnly, ip: "2001:db8::1", want: true},
+		{filter: allowOnly, ip: "192.0.2.1", want: false},
+		{filter: allowOnly, ip: "2001:db9::1", want: false},
+		{filter: denyOnly, ip: "192.0.2.1", want: false},
+		{filter: denyOnly, ip: "2001:db8:bad::1", want: false},
+		{filter: denyOnly, ip: "2001:db8:900d::1", want: true},
+		{filter: denyOnly, ip: "10.1.2.3", want: true},
+		{filter: both, ip: "10.0.0.4", want: true},
+		{filter: both, ip: "10.0.0.5", want: false},
+		{filter: both, ip: "192.0.2.1", want: false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Permits(netip.MustParseAddr(test.ip)); got != test.want {
+			t.Errorf("Permits(%s) with %+v = %v, want %v", test.ip, test.filter, got, test.want)
+		}
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.0/8":    "10.0.0.0/8",
+		"10.1.2.3/8":    "10.0.0.0/8",
+		"10.0.0.5":      "10.0.0.5/32",
+		"2001:db8::/32": "2001:db8::/32",
+		"2001:db8::1":   "2001:db8::1/128",
+	}
+	for input, want := range tests {
+		prefix, err := ParsePrefix(input)
+		if err != nil || prefix.String() != want {
+			t.Errorf("ParsePrefix(%q) = %s, %v, want %s", input, prefix, err, want)
+		}
+	}
+	for _, input := range []string{"", "10.0.0.0/33", "example.com"} {
+		if _, err := ParsePrefix(input); err == nil {
+			t.Errorf("ParsePrefix(%q) succeeded, want an error", input)
+		}
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	route := &Route{
+		Paths: []*PathRule{
+			{Prefix: "/api"},
+			{Prefix: "/api/v2"},
+			{Prefix: "/static/"},
+			{Prefix: "/"},
+		},
+	}
+	tests := map[string]string{
+		"/api":          "/api",
+		"/api/users":    "/api",
+		"/api/v2":       "/api/v2",
+		"/api/v2/users": "/api/v2",
+		"/api/v20":      "/api",
+		"/apis":         "/",
+		"/static/a.css": "/static/",
+		"/static":       "/",
+		"/":             "/",
+	}
+	for path, want := range tests {
+		rule := route.MatchPath(path)
+		if rule == nil || rule.Prefix != want {
+			t.Errorf("MatchPath(%q) = %+v, want prefix %s", path, rule, want)
+		}
+	}
+	if rule := (&Route{Paths: []*PathRule{{Prefix: "/api"}}}).MatchPath("/app"); rule != nil {
+		t.Errorf("MatchPath(/app) = %+v, want nil", rule)
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		rule *PathRule
+		path string
+		want string
+	}{
+		{rule: &PathRule{Prefix: "/api"}, path: "/api/users", want: "/api/users"},
+		{rule: &PathRule{Prefix: "/api", StripPrefix: true}, path: "/api/users", want: "/users"},
+		{rule: &PathRule{Prefix: "/api", StripPrefix: true}, path: "/api", want: "/"},
+		{rule: &PathRule{Prefix: "/api/", StripPrefix: true}, path: "/api/users", want: "/users"},
+		{rule: &PathRule{Prefix: "/api", RewritePrefix: "/v2"}, path: "/api/users", want: "/v2/users"},
+		{rule: &PathRule{Prefix: "/api", RewritePrefix: "/v2/"}, path: "/api", want: "/v2"},
+		{rule: &PathRule{Prefix: "/", StripPrefix: true}, path: "/index.html", want: "/index.html"},
+	}
+	for _, test := range tests {
+		if got := test.rule.RewritePath(test.path); got != test.want {
+			t.Errorf("RewritePath(%q) with %+v = %q, want %q", test.path, test.rule, got, test.want)
+		}
+	}
+}
+
+func TestBasicAuthAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	basicAuth := &BasicAuth{Users: map[string][]byte{"alice": hash}}
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{username: "alice", password: "secret", want: true},
+		{username: "alice", password: "wrong", want: false},
+		{username: "alice", password: "", want: false},
+		{username: "bob", password: "secret", want: false},
+		{username: "bob", password: "dummy password", want: false},
+	}
+	for _, test := range tests {
+		if got := basicAuth.Authenticate(test.username, test.password); got != test.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", test.username, test.password, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// probedTarget is a target dialed by probeTargets, with the host it is configured for
+type probedTarget struct {
+	// target is the url of the target
+	target *url.URL
+	// host is the host or wildcard pattern of a route the target belongs to
+	host string
+}
+
+// probeTargets dials each target of the routes, those of their paths included, and logs a warning for each that
+// cannot be reached within the timeout. At most concurrency targets are dialed at once, so that a large config
+// neither takes long nor opens too many connections. It is diagnostic only: targets may come up after the
+// proxy, so nothing is changed for the unreachable ones. It returns the number of unreachable targets
+func probeTargets(ctx context.Context, routes map[string]*store.Route, timeout time.Duration, concurrency int, logger *slog.Logger) int {
+	targets := uniqueTargets(routes)
+	jobs := make(chan probedTarget)
+	var unreachable int
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < max(1, min(concurrency, len(targets))); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := dialTarget(ctx, job.target, timeout); err != nil {
+					logger.Warn("target unreachable", "host", job.host, "target", job.target.String(), "error", err)
+					mutex.Lock()
+					unreachable++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, target := range targets {
+		jobs <- target
+	}
+	close(jobs)
+	wg.Wait()
+	logger.Info("probed targets", "targets", len(targets), "unreachable", unreachable)
+	return unreachable
+}
+
+// uniqueTargets returns the targets of the routes and their paths, each once with the first host it is
+// configured for in sorted order
+func uniqueTargets(routes map[string]*store.Route) []probedTarget {
+	hosts := make([]string, 0, len(routes))
+	for host := range routes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var targets []probedTarget
+	seen := make(map[string]bool)
+	add := func(host string, urls []*url.URL) {
+		for _, target := range urls {
+			if !seen[target.String()] {
+				seen[target.String()] = true
+				targets = append(targets, probedTarget{target: target, host: host})
+			}
+		}
+	}
+	for _, host := range hosts {
+		add(host, routes[host].Targets)
+		for _, rule := range routes[host].Paths {
+			add(host, rule.Targets)
+		}
+	}
+	return targets
+}
+
+// dialTarget opens and closes a connection to the target, its Unix domain socket for unix targets and the
+// default port of its scheme if it has no port
+func dialTarget(ctx context.Context, target *url.URL, timeout time.Duration) error {
+	network, address := "tcp", target.Host
+	switch {
+	case target.Scheme == "unix":
+		network, address = "unix", target.Path
+	case target.Port() == "" && target.Scheme == "https":
+		address = net.JoinHostPort(target.Hostname(), "443")
+	case target.Port() == "":
+		address = net.JoinHostPort(target.Hostname(), "80")
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
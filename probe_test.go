@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// listen accepts and closes connections on the network address until the test ends
+func listen(t *testing.T, network, address string) net.Listener {
+	t.Helper()
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestProbeTargets(t *testing.T) {
+	reachable := listen(t, "tcp", "127.0.0.1:0")
+	socket := listen(t, "unix", filepath.Join(t.TempDir(), "app.sock"))
+	unreachable := freeAddr(t)
+	routes := map[string]*store.Route{
+		"a.example.com": {Targets: []*url.URL{
+			mustParseURL(t, "http://"+reachable.Addr().String()),
+			mustParseURL(t, "http://"+unreachable),
+		}},
+		"b.example.com": {
+			Targets: []*url.URL{mustParseURL(t, "unix://"+socket.Addr().String())},
+			Paths: []*store.PathRule{
+				{Prefix: "/api", Targets: []*url.URL{mustParseURL(t, "http://"+unreachable+"/api")}},
+			},
+		},
+		// the target shared with a.example.com is only probed once
+		"c.example.com":        {Targets: []*url.URL{mustParseURL(t, "http://"+unreachable)}},
+		"redirect.example.com": {Redirect: &store.Redirect{URL: mustParseURL(t, "https://example.com")}},
+	}
+	for _, concurrency := range []int{1, 16} {
+		var logs bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&logs, nil))
+		if got := probeTargets(context.Background(), routes, time.Second, concurrency, logger); got != 2 {
+			t.Errorf("concurrency %d: %d unreachable targets, want 2\n%s", concurrency, got, logs.String())
+		}
+		if warnings := strings.Count(logs.String(), "target unreachable"); warnings != 2 {
+			t.Errorf("concurrency %d: %d warnings, want 2\n%s", concurrency, warnings, logs.String())
+		}
+		if !strings.Contains(logs.String(), "host=a.example.com target=http://"+unreachable) {
+			t.Errorf("concurrency %d: logs = %s, want a warning naming the host and target", concurrency, logs.String())
+		}
+		if !strings.Contains(logs.String(), "targets=4 unreachable=2") {
+			t.Errorf("concurrency %d: logs = %s, want a summary of the probe", concurrency, logs.String())
+		}
+	}
+}
+
+func TestDialTargetDefaultPort(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// the canceled context fails the dial, whose error names the address it was for
+	for rawURL, want := range map[string]string{
+		"http://192.0.2.1":       "192.0.2.1:80",
+		"https://192.0.2.1":      "192.0.2.1:443",
+		"https://[2001:db8::1]":  "[2001:db8::1]:443",
+		"http://192.0.2.1:8080/": "192.0.2.1:8080",
+	} {
+		err := dialTarget(ctx, mustParseURL(t, rawURL), time.Second)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error = %v, want a dial of %s", rawURL, err, want)
+		}
+	}
+}
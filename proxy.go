@@ -0,0 +1,838 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/balancer"
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/metrics"
+	"github.com/cbodonnell/proxy-host/pkg/ratelimit"
+	"github.com/cbodonnell/proxy-host/pkg/responsecache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultUpstreamKey is the cache key of the upstream of the default target. Hosts cannot contain spaces, so
+// it does not collide with any of them
+const defaultUpstreamKey = " default"
+
+// insecureTransport is shared by the proxies to https targets that skip certificate verification when no
+// InsecureTransport is configured
+var insecureTransport = NewTransport(DefaultTransportOptions(), true)
+
+// Upstream is the cached state of a host: its route and the balancer across its targets
+type Upstream struct {
+	// Route is the route the host resolved to
+	Route *store.Route
+	// Balancer balances requests across the targets of the route. It is nil for a route that redirects
+	Balancer *balancer.Balancer
+	// transport is the transport dedicated to the proxies of the upstream. It is nil when they use a
+	// transport shared with other upstreams, which must not be closed with it
+	transport *http.Transport
+	// sockets sends the requests of the proxies to the targets that listen on a Unix domain socket. It is
+	// nil when none of the targets do
+	sockets *socketTransport
+	// active counts the requests being proxied with the upstream, which a draining host waits for
+	active atomic.Int64
+}
+
+// Close releases the resources held by the upstream, such as its health checker and the idle connections
+// of its dedicated transports
+func (u *Upstream) Close() {
+	if u.Balancer != nil {
+		u.Balancer.Close()
+	}
+	if u.transport != nil {
+		u.transport.CloseIdleConnections()
+	}
+	if u.sockets != nil {
+		u.sockets.CloseIdleConnections()
+	}
+}
+
+// ProxyServer is an http.Handler that proxies each request to the targets configured for its host
+type ProxyServer struct {
+	// Cache holds the upstream built for each host
+	Cache *cache.TypedCache[*Upstream]
+	// Store resolves hosts to the routes they should be proxied with
+	Store store.HostStore
+	// Logger receives the access log and errors encountered while proxying. If nil, slog.Default is used
+	Logger *slog.Logger
+	// Metrics records request and cache metrics. If nil, no metrics are recorded
+	Metrics *metrics.Metrics
+	// DefaultTarget is the target that the requests of hosts without a route are proxied to, such as a
+	// catch-all site. If nil, such requests are answered with 404 Not Found
+	DefaultTarget *url.URL
+	// Transport is shared by the proxies to reach their targets, see NewTransport. If nil,
+	// http.DefaultTransport is used. Routes that skip certificate verification use InsecureTransport instead
+	Transport http.RoundTripper
+	// InsecureTransport is shared by the proxies of routes that skip certificate verification. If nil, a
+	// transport with the default options that does not verify certificates is used
+	InsecureTransport http.RoundTripper
+	// ClientTLS configures the client certificate presented to https targets that require mutual TLS. Routes
+	// may override it. The upstream of each host using it gets a dedicated clone of the transport, or of
+	// http.DefaultTransport if the transport is not an *http.Transport. If nil, no certificate is presented
+	ClientTLS *store.ClientTLS
+	// RequestIDHeader is the header carrying the ID of each request, which is passed on to the target and
+	// the client and written to the access log. A request ID sent by the client is kept, otherwise a random
+	// one is generated. If empty, requests are not given IDs
+	RequestIDHeader string
+	// TracerProvider creates the tracer that wraps each request in an OpenTelemetry span, whose context is
+	// passed on to the target. If nil, requests are not traced
+	TracerProvider trace.TracerProvider
+	// Propagator extracts the trace context sent by clients and injects it into requests to targets. If nil,
+	// W3C trace context and baggage are propagated
+	Propagator propagation.TextMapPropagator
+	// DedicatedTransports gives the upstream of each host its own clone of the transport, so that its idle
+	// connections are closed when it is evicted from the cache rather than lingering to targets that may
+	// have moved. It trades the connection reuse across hosts of a shared transport for that, and only
+	// applies to transports that are an *http.Transport
+	DedicatedTransports bool
+	// RequestTimeout bounds how long a request to a target may take before 504 Gateway Timeout is returned.
+	// Routes may override it. Requests for server-sent events are not bound by it. Zero means no timeout
+	RequestTimeout time.Duration
+	// FlushInterval is how often the body of a response is flushed to the client while it is copied from the
+	// target, a negative value flushing after every write. Server-sent events and responses of unknown length,
+	// such as gRPC streams, are always flushed after every write so that their messages are not held back.
+	// Zero flushes only when the buffer of the response writer is full
+	FlushInterval time.Duration
+	// MaxRetries is the number of times an idempotent request without a body is retried against its target
+	// when the connection to the target fails. Zero disables retries
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubled for each further retry
+	RetryBackoff time.Duration
+	// CircuitBreakerThreshold is the number of consecutive failed requests to a target that open its circuit,
+	// rejecting requests with 503 Service Unavailable. Zero disables circuit breakers
+	CircuitBreakerThreshold int
+	// CircuitBreakerCooldown is how long a circuit stays open before a probe request is let through
+	CircuitBreakerCooldown time.Duration
+	// HealthCheckInterval specifies how often the targets of hosts with more than one target are probed.
+	// Zero disables health checks
+	HealthCheckInterval time.Duration
+	// HealthCheckPath is the path requested on each target to check its health
+	HealthCheckPath string
+	// HealthCheckUnhealthyThreshold is the number of consecutive failures that mark a target unhealthy
+	HealthCheckUnhealthyThreshold int
+	// HealthCheckHealthyThreshold is the number of consecutive successes that mark a target healthy again
+	HealthCheckHealthyThreshold int
+	// MaxRequestBodyBytes is the largest request body forwarded to a target. Larger requests are answered
+	// with 413 Request Entity Too Large. Routes may override it. Zero means no limit
+	MaxRequestBodyBytes int64
+	// MaxInFlight bounds the number of requests proxied at once across all hosts, so that a flood of slow
+	// requests cannot exhaust memory. Requests beyond it are answered with 503 Service Unavailable and a
+	// Retry-After of one second. Zero means no limit
+	MaxInFlight int64
+	// AllowedMethods contains the request methods proxied to targets, such as GET, HEAD and POST. Requests with
+	// other methods are answered with 405 Method Not Allowed and an Allow header listing them. Hosts that
+	// answer CORS preflight requests need OPTIONS. Routes may override it. If nil, all methods are proxied
+	AllowedMethods []string
+	// ResponseCache caches the responses of targets to GET requests. If nil, responses are not cached
+	ResponseCache *responsecache.ResponseCache
+	// TrustedProxyDepth is the number of proxies in front of this one that append to X-Forwarded-For. The
+	// client IP used by IP filters and rate limits is taken that many entries from the end of the header.
+	// Zero uses the address of the connection
+	TrustedProxyDepth int
+	// TrustedProxies are the CIDR ranges of the proxies in front of this one. If set, X-Forwarded-For is only
+	// consulted for requests whose connection comes from a trusted proxy, and the client IP is its rightmost
+	// entry outside the ranges, so that clients cannot spoof it by sending the header themselves. It takes
+	// precedence over TrustedProxyDepth
+	TrustedProxies []netip.Prefix
+	// RateLimiter enforces the rate limits of routes. If nil, routes are not rate limited
+	RateLimiter *ratelimit.RateLimiter
+	// ForwardedHeaders appends the client IP to X-Forwarded-For and sets X-Forwarded-Proto and
+	// X-Forwarded-Host on proxied requests. If false, none of the headers are sent to targets
+	ForwardedHeaders bool
+	// StripRequestHeaders contains headers of incoming requests that are removed before they are forwarded,
+	// so that clients cannot spoof them, such as X-Forwarded-For when the proxy is not behind trusted proxies.
+	// Headers the proxy sets itself, such as X-Proxy-Host, are set after the removal
+	StripRequestHeaders []string
+	// RewriteResponseHeaders maps headers of the responses of targets, such as Server and X-Powered-By, to
+	// the value they are replaced with before the responses reach clients. An empty value removes the header.
+	// Headers a target did not send are not added
+	RewriteResponseHeaders map[string]string
+	// ResponseHeaders contains headers added to the responses of targets that do not set them, such as
+	// Strict-Transport-Security, X-Content-Type-Options and X-Frame-Options. Routes may override them
+	ResponseHeaders map[string]string
+	// ErrorPages contains the html templates of the error responses generated by the proxy itself, such as
+	// 404 Not Found for unknown hosts or 502 Bad Gateway for unreachable targets, keyed by status. They are
+	// executed with an ErrorPageData. Responses of targets are never replaced, and statuses without a
+	// template are answered in plain text
+	ErrorPages map[int]*template.Template
+	// AdminToken is the bearer token the requests of the admin api must carry in their Authorization header,
+	// see AdminHandler. If empty, the admin api is not authenticated
+	AdminToken string
+	// MaintenancePage is the html body of the 503 Service Unavailable responses of hosts in maintenance, see
+	// SetMaintenance. If empty, a generic page is used
+	MaintenancePage string
+	// MaintenanceRetryAfter is sent in the Retry-After header of the responses of hosts in maintenance. Zero
+	// omits the header
+	MaintenanceRetryAfter time.Duration
+	// maintenance holds the hosts put in or taken out of maintenance with SetMaintenance
+	maintenance maintenanceOverrides
+	// draining holds the hosts being drained with Drain
+	draining drainingHosts
+	// inFlight is the number of requests being proxied, bounded by MaxInFlight
+	inFlight atomic.Int64
+	// middleware contains the middleware added by Use, outermost first
+	middleware []Middleware
+	// handler is the proxy wrapped in its middleware. If nil, no middleware was added
+	handler http.Handler
+}
+
+// NewProxyServer creates a new proxy server with the specified cache and store and default settings
+func NewProxyServer(proxyCache *cache.TypedCache[*Upstream], hostStore store.HostStore) *ProxyServer {
+	return &ProxyServer{
+		Cache:                         proxyCache,
+		Store:                         hostStore,
+		RetryBackoff:                  100 * time.Millisecond,
+		CircuitBreakerCooldown:        30 * time.Second,
+		HealthCheckInterval:           10 * time.Second,
+		HealthCheckPath:               "/",
+		HealthCheckUnhealthyThreshold: 3,
+		HealthCheckHealthyThreshold:   2,
+		ForwardedHeaders:              true,
+		RequestIDHeader:               "X-Request-ID",
+		MaintenanceRetryAfter:         5 * time.Minute,
+		StripRequestHeaders:           []string{"X-Proxy-Host"},
+	}
+}
+
+// ServeHTTP passes the request through the middleware added by Use to the proxy, see serve
+func (s *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.handler != nil {
+		s.handler.ServeHTTP(w, r)
+		return
+	}
+	s.serve(w, r)
+}
+
+// serve proxies the request to a target of its host. Unknown hosts are answered with 404 Not Found
+func (s *ProxyServer) serve(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	host := normalizeHost(r.Host)
+	info := &requestInfo{
+		host:       host,
+		publicHost: r.Host,
+		cacheHit:   true,
+	}
+	if s.RequestIDHeader != "" {
+		info.requestID = requestID(r.Header.Get(s.RequestIDHeader))
+		w.Header().Set(s.RequestIDHeader, info.requestID)
+	}
+	rec := &responseRecorder{ResponseWriter: w}
+	w = rec
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoContextKey{}, info))
+	defer s.logRequest(r, info, rec, start)
+	if s.TracerProvider != nil {
+		var span trace.Span
+		r, span = s.startSpan(r, host)
+		defer func() {
+			endSpan(span, info, rec.written())
+		}()
+	}
+
+	if host == "" {
+		s.serveError(w, r, http.StatusNotFound, "host not found")
+		return
+	}
+
+	maintenance, overridden := s.maintenance.get(host)
+	if maintenance {
+		s.serveMaintenance(w)
+		return
+	}
+	if s.draining.draining(host) {
+		s.serveError(w, r, http.StatusServiceUnavailable, "host is draining")
+		return
+	}
+	if s.MaxInFlight > 0 {
+		// deferred so that the slot is freed even if proxying panics
+		defer s.inFlight.Add(-1)
+		if s.inFlight.Add(1) > s.MaxInFlight {
+			w.Header().Set("Retry-After", "1")
+			s.serveError(w, r, http.StatusServiceUnavailable, "too many requests in flight")
+			return
+		}
+	}
+	upstream, err := s.Cache.GetOrSet(host, 0, func() (*Upstream, error) {
+		info.cacheHit = false
+		route, err := s.Store.Lookup(host)
+		if err != nil {
+			return nil, err
+		}
+		if route.Maintenance && !overridden {
+			return nil, errMaintenance
+		}
+		return s.newUpstream(route)
+	})
+	if errors.Is(err, store.ErrHostNotFound) && s.DefaultTarget != nil {
+		upstream, err = s.defaultUpstream()
+	}
+	if err != nil {
+		if errors.Is(err, errMaintenance) {
+			s.serveMaintenance(w)
+			return
+		}
+		if errors.Is(err, store.ErrHostNotFound) {
+			s.serveError(w, r, http.StatusNotFound, "host not found")
+			return
+		}
+		s.logger().Error("failed to lookup host", "host", host, "error", err)
+		if errors.Is(err, store.ErrUnavailable) {
+			s.serveError(w, r, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		s.serveError(w, r, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+		return
+	}
+	s.Metrics.ObserveCacheLookup(info.cacheHit)
+	if methods := s.allowedMethods(upstream.Route); methods != nil && !slices.Contains(methods, r.Method) {
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		s.serveError(w, r, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	if upstream.Route.Redirect != nil {
+		serveRedirect(w, r, upstream.Route.Redirect)
+		return
+	}
+
+	responseKey := host + r.URL.RequestURI()
+	if rule := upstream.Route.MatchPath(r.URL.Path); rule != nil {
+		upstream, err = s.pathUpstream(host, upstream.Route, rule)
+		if err != nil {
+			s.logger().Error("failed to build upstream for path", "host", host, "prefix", rule.Prefix, "error", err)
+			s.serveError(w, r, http.StatusBadGateway, http.StatusText(http.StatusBadGateway))
+			return
+		}
+		r = rewritePath(r, rule)
+	} else if len(upstream.Route.Targets) == 0 {
+		s.serveError(w, r, http.StatusNotFound, "path not found")
+		return
+	}
+
+	if upstream.Route.IPFilter != nil && !s.permitted(upstream.Route.IPFilter, r) {
+		s.serveError(w, r, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+	if allowed, retryAfter := s.allow(host, upstream.Route, r); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		s.serveError(w, r, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+		return
+	}
+	if upstream.Route.CORS != nil {
+		var answered bool
+		// preflight requests carry no credentials, so they are answered before authentication
+		if w, answered = applyCORS(w, r, upstream.Route.CORS); answered {
+			return
+		}
+	}
+	if upstream.Route.BasicAuth != nil {
+		if !authenticated(upstream.Route.BasicAuth, r) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", upstream.Route.BasicAuth.Realm))
+			s.serveError(w, r, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+			return
+		}
+		// the credentials are meant for the proxy, not the target
+		r.Header.Del("Authorization")
+	}
+
+	if limit := s.maxRequestBodyBytes(upstream.Route); limit > 0 {
+		if r.ContentLength > limit {
+			s.serveError(w, r, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+	}
+	if acceptsEventStream(r) {
+		// the stream lasts as long as the client stays connected, so it outlives the server timeouts. This
+		// fails only where the connection does not support deadlines, and then there are none to lift
+		controller := http.NewResponseController(w)
+		controller.SetReadDeadline(time.Time{})
+		controller.SetWriteDeadline(time.Time{})
+	} else if timeout := s.requestTimeout(upstream.Route); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	upstream.active.Add(1)
+	defer upstream.active.Add(-1)
+	upstreamStart := time.Now()
+	if s.ResponseCache != nil {
+		s.ResponseCache.ServeHTTP(w, r, responseKey, upstream.Balancer)
+	} else {
+		upstream.Balancer.ServeHTTP(w, r)
+	}
+	s.Metrics.ObserveUpstreamLatency(time.Since(upstreamStart))
+}
+
+// defaultUpstream returns the upstream of the default target. It is cached once for all unknown hosts, under
+// a key no host can have
+func (s *ProxyServer) defaultUpstream() (*Upstream, error) {
+	return s.Cache.GetOrSet(defaultUpstreamKey, 0, func() (*Upstream, error) {
+		return s.newUpstream(&store.Route{
+			Targets: []*url.URL{s.DefaultTarget},
+		})
+	})
+}
+
+// pathUpstream returns the upstream of a path rule of the host's route. It is cached separately from the
+// upstream of the host, under the host followed by the prefix of the rule
+func (s *ProxyServer) pathUpstream(host string, route *store.Route, rule *store.PathRule) (*Upstream, error) {
+	return s.Cache.GetOrSet(host+rule.Prefix, 0, func() (*Upstream, error) {
+		return s.newUpstream(route.ForPath(rule))
+	})
+}
+
+// rewritePath returns a shallow copy of the request with its path rewritten as configured by the path rule
+func rewritePath(r *http.Request, rule *store.PathRule) *http.Request {
+	path := rule.RewritePath(r.URL.Path)
+	if path == r.URL.Path {
+		return r
+	}
+	rewritten := r.WithContext(r.Context())
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	rewritten.URL = &u
+	return rewritten
+}
+
+// allow consults the rate limiter for the request if its route is rate limited. If the request is over the
+// limit, false is returned with how long the client should wait before retrying
+func (s *ProxyServer) allow(host string, route *store.Route, r *http.Request) (bool, time.Duration) {
+	if s.RateLimiter == nil || route.RateLimit == nil {
+		return true, 0
+	}
+	key := host
+	if route.RateLimit.PerClient {
+		key += "|" + s.clientIP(r)
+	}
+	return s.RateLimiter.Allow(key, route.RateLimit.RequestsPerSecond, route.RateLimit.Burst)
+}
+
+// authenticated reports whether the request carries the basic authentication credentials of a user
+func authenticated(basicAuth *store.BasicAuth, r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	return ok && basicAuth.Authenticate(username, password)
+}
+
+// requestTimeout returns the timeout for requests of the route, falling back to the server default
+func (s *ProxyServer) requestTimeout(route *store.Route) time.Duration {
+	if route.Timeout > 0 {
+		return route.Timeout
+	}
+	return s.RequestTimeout
+}
+
+// acceptsEventStream reports whether the request asks for server-sent events, as EventSource clients do. Such
+// a response streams events for as long as the client stays connected, so it is not bound by the request
+// timeout nor by the read and write timeouts of the server. The reverse proxy flushes each event to the client
+// as soon as it is written
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(mediaRange, ";")
+			if strings.EqualFold(strings.TrimSpace(mediaType), "text/event-stream") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allowedMethods returns the request methods the route accepts, falling back to the server default. Nil means
+// all methods
+func (s *ProxyServer) allowedMethods(route *store.Route) []string {
+	if route.AllowedMethods != nil {
+		return route.AllowedMethods
+	}
+	return s.AllowedMethods
+}
+
+// maxRequestBodyBytes returns the request body limit of the route, falling back to the server default. Zero
+// means no limit
+func (s *ProxyServer) maxRequestBodyBytes(route *store.Route) int64 {
+	if route.MaxRequestBodyBytes < 0 {
+		return 0
+	}
+	if route.MaxRequestBodyBytes > 0 {
+		return route.MaxRequestBodyBytes
+	}
+	return s.MaxRequestBodyBytes
+}
+
+// logger returns the configured logger or the default logger
+func (s *ProxyServer) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// newBalancer creates a balancer across the targets of the route, starting health checks if enabled
+func (s *ProxyServer) newBalancer(route *store.Route, transport http.RoundTripper) *balancer.Balancer {
+	targets := make([]*balancer.Target, 0, len(route.Targets))
+	for i, target := range route.Targets {
+		breaker := s.newCircuitBreaker(target)
+		balancerTarget := &balancer.Target{
+			URL:     target,
+			Proxy:   s.newReverseProxy(route, target, transport, breaker),
+			Breaker: breaker,
+		}
+		if i < len(route.Weights) {
+			balancerTarget.Weight = route.Weights[i]
+		}
+		targets = append(targets, balancerTarget)
+	}
+	var strategy balancer.Strategy = balancer.NewRoundRobin()
+	switch route.Strategy {
+	case store.StrategyWeighted:
+		strategy = balancer.NewWeighted()
+	case store.StrategyLeastConnections:
+		strategy = balancer.NewLeastConnections()
+	}
+	if route.StickySessions != nil {
+		strategy = balancer.NewSticky(route.StickySessions.CookieName, route.StickySessions.TTL, strategy)
+	}
+	b := balancer.New(targets, strategy)
+	b.Error = s.serveError
+	if len(targets) > 1 && s.HealthCheckInterval > 0 {
+		b.StartHealthChecks(s.newHealthChecker(targets, transport))
+	}
+	return b
+}
+
+// newUpstream creates the upstream of a route, with a dedicated transport if they are enabled or the route
+// uses a client certificate, and a transport dialing the sockets of the targets that listen on a Unix domain
+// socket
+func (s *ProxyServer) newUpstream(route *store.Route) (*Upstream, error) {
+	upstream := &Upstream{
+		Route: route,
+	}
+	if route.Redirect != nil {
+		// the requests of the host are redirected, so there is nothing to proxy to
+		return upstream, nil
+	}
+	transport := s.transport(route)
+	clientTLS := route.ClientTLS
+	if clientTLS == nil {
+		clientTLS = s.ClientTLS
+	}
+	if clientTLS != nil {
+		tlsConfig, err := newClientTLSConfig(clientTLS, route.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		shared, ok := transport.(*http.Transport)
+		if !ok {
+			shared = http.DefaultTransport.(*http.Transport)
+		}
+		upstream.transport = shared.Clone()
+		if upstream.transport.TLSClientConfig != nil {
+			// keep the protocols negotiated by the transport, such as h2
+			tlsConfig.NextProtos = upstream.transport.TLSClientConfig.NextProtos
+		}
+		upstream.transport.TLSClientConfig = tlsConfig
+		transport = upstream.transport
+	} else if shared, ok := transport.(*http.Transport); ok && s.DedicatedTransports {
+		upstream.transport = shared.Clone()
+		transport = upstream.transport
+	}
+	if upstream.sockets = newSocketTransport(transport, route.Targets); upstream.sockets != nil {
+		transport = upstream.sockets
+	}
+	upstream.Balancer = s.newBalancer(route, transport)
+	return upstream, nil
+}
+
+// newCircuitBreaker creates the circuit breaker of a target, reporting its state in the metrics. If circuit
+// breakers are disabled, nil is returned
+func (s *ProxyServer) newCircuitBreaker(target *url.URL) *balancer.CircuitBreaker {
+	if s.CircuitBreakerThreshold <= 0 {
+		return nil
+	}
+	breaker := balancer.NewCircuitBreaker(s.CircuitBreakerThreshold, s.CircuitBreakerCooldown)
+	targetURL := target.String()
+	s.Metrics.ObserveCircuitState(targetURL, int(balancer.CircuitClosed))
+	breaker.OnStateChange(func(state balancer.CircuitState) {
+		s.Metrics.ObserveCircuitState(targetURL, int(state))
+	})
+	return breaker
+}
+
+// transport returns the transport the proxies of the route should use
+func (s *ProxyServer) transport(route *store.Route) http.RoundTripper {
+	if route.InsecureSkipVerify {
+		if s.InsecureTransport != nil {
+			return s.InsecureTransport
+		}
+		return insecureTransport
+	}
+	if s.Transport != nil {
+		return s.Transport
+	}
+	return http.DefaultTransport
+}
+
+// newHealthChecker creates a health checker for the specified targets using the configured probe settings.
+// Probes use the same transport as the targets' proxies
+func (s *ProxyServer) newHealthChecker(targets []*balancer.Target, transport http.RoundTripper) *balancer.HealthChecker {
+	checker := balancer.NewHealthChecker(targets, s.HealthCheckInterval)
+	checker.Client.Transport = transport
+	checker.Path = s.HealthCheckPath
+	checker.UnhealthyThreshold = s.HealthCheckUnhealthyThreshold
+	checker.HealthyThreshold = s.HealthCheckHealthyThreshold
+	return checker
+}
+
+// newReverseProxy creates a reverse proxy to the specified target that rewrites the Host header to the target
+// host, unless the route preserves the Host of the incoming request. Protocol upgrades such as WebSockets and
+// other long-lived streaming connections are supported: the reverse proxy strips the hop-by-hop headers of
+// the incoming request and restores Connection and Upgrade for upgrades after the director has run, so the
+// director must not set them itself. If the target has a circuit breaker, the outcome of each request is
+// recorded in it. The response headers of the route are added to its responses and their cookies are
+// rewritten for the public host as the route configures. Redirects to the target are rewritten to the public
+// host
+func (s *ProxyServer) newReverseProxy(route *store.Route, target *url.URL, transport http.RoundTripper, breaker *balancer.CircuitBreaker) *httputil.ReverseProxy {
+	responseHeaders := s.responseHeaders(route)
+	targetHost := target.Host
+	if target.Scheme == "unix" {
+		targetHost = socketHost
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	proxy.FlushInterval = s.FlushInterval
+	if s.MaxRetries > 0 {
+		proxy.Transport = &retryTransport{
+			next:       proxy.Transport,
+			maxRetries: s.MaxRetries,
+			backoff:    s.RetryBackoff,
+		}
+	}
+	director := proxy.Director
+	targetURL := target.String()
+	proxy.Director = func(r *http.Request) {
+		info := requestInfoFromContext(r.Context())
+		if info != nil {
+			info.target = targetURL
+		}
+		director(r)
+		for _, name := range s.StripRequestHeaders {
+			r.Header.Del(name)
+		}
+		if info != nil && info.requestID != "" {
+			r.Header.Set(s.RequestIDHeader, info.requestID)
+		}
+		if s.TracerProvider != nil {
+			s.injectTraceContext(r)
+		}
+		s.setForwardedHeaders(r)
+		if !route.PreserveHostHeader {
+			r.Host = targetHost
+		}
+		r.Header.Set("X-Proxy-Host", "true")
+	}
+	proxy.ErrorHandler = s.handleProxyError
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if breaker != nil {
+			breaker.RecordSuccess()
+		}
+		if s.RequestIDHeader != "" {
+			// the response already carries the request ID set by the proxy, which a target echoing it
+			// would duplicate
+			resp.Header.Del(s.RequestIDHeader)
+		}
+		rewriteResponseHeaders(resp.Header, s.RewriteResponseHeaders)
+		addResponseHeaders(resp.Header, responseHeaders)
+		if info := requestInfoFromContext(resp.Request.Context()); info != nil {
+			if resp.StatusCode >= 300 && resp.StatusCode < 400 && target.Scheme != "unix" {
+				rewriteLocation(resp.Header, target, info.publicHost, resp.Request.TLS != nil)
+			}
+			if route.Cookies != nil {
+				rewriteCookies(resp.Header, info.host, route.Cookies)
+			}
+		}
+		return nil
+	}
+	if breaker != nil {
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if targetFailed(err) {
+				breaker.RecordFailure()
+			}
+			s.handleProxyError(w, r, err)
+		}
+	}
+	return proxy
+}
+
+// targetFailed reports whether a proxy error is the fault of the target rather than of the client, which
+// canceled the request or sent a body over the limit
+func targetFailed(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return !errors.Is(err, context.Canceled) && !errors.As(err, &maxBytesErr)
+}
+
+// setForwardedHeaders sets X-Forwarded-Proto and X-Forwarded-Host on the outgoing request from the incoming
+// request it was cloned from. The reverse proxy itself appends the client IP to any X-Forwarded-For of the
+// incoming request after the director has run, unless the header is present with a nil value
+func (s *ProxyServer) setForwardedHeaders(r *http.Request) {
+	if !s.ForwardedHeaders {
+		r.Header["X-Forwarded-For"] = nil
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+		return
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", r.Host)
+}
+
+// handleProxyError answers a request whose proxying failed with 413 Request Entity Too Large if its body
+// exceeded the limit, 504 Gateway Timeout if its deadline was exceeded and 502 Bad Gateway otherwise, naming
+// the host in a short body
+func (s *ProxyServer) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	host := normalizeHost(r.Host)
+	if info := requestInfoFromContext(r.Context()); info != nil {
+		host = info.host
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		s.serveError(w, r, http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge))
+		return
+	}
+	s.logger().Error("failed to proxy request", "host", host, "kind", proxyErrorKind(err), "error", err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.serveError(w, r, http.StatusGatewayTimeout, fmt.Sprintf("upstream for %s timed out", host))
+		return
+	}
+	s.serveError(w, r, http.StatusBadGateway, fmt.Sprintf("upstream for %s is unreachable", host))
+}
+
+// proxyErrorKind classifies an error returned while proxying so that failures can be told apart in logs
+func proxyErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &dnsErr):
+		return "dns lookup failed"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	default:
+		return "upstream error"
+	}
+}
+
+// permitted reports whether the client IP of the request passes the filter. Requests without a valid client
+// IP are denied
+func (s *ProxyServer) permitted(ipFilter *store.IPFilter, r *http.Request) bool {
+	ip, err := netip.ParseAddr(s.clientIP(r))
+	if err != nil {
+		return false
+	}
+	return ipFilter.Permits(ip)
+}
+
+// clientIP returns the IP address of the client that sent the request. If proxies are trusted by their
+// ranges and the connection comes from one, it is the rightmost entry of X-Forwarded-For that is not a
+// trusted proxy, or the first entry if all of them are. If proxies are trusted by depth, it is the entry
+// appended by the outermost trusted proxy, or the first entry if the header is shorter than expected
+func (s *ProxyServer) clientIP(r *http.Request) string {
+	remoteIP := r.RemoteAddr
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remoteIP = ip
+	}
+	if len(s.TrustedProxies) > 0 {
+		if !s.trustedProxy(remoteIP) {
+			return remoteIP
+		}
+		forwardedFor := forwardedFor(r)
+		for i := len(forwardedFor) - 1; i >= 0; i-- {
+			if !s.trustedProxy(forwardedFor[i]) {
+				return forwardedFor[i]
+			}
+		}
+		if len(forwardedFor) > 0 {
+			return forwardedFor[0]
+		}
+		return remoteIP
+	}
+	if s.TrustedProxyDepth > 0 {
+		if forwardedFor := forwardedFor(r); len(forwardedFor) > 0 {
+			return forwardedFor[max(0, len(forwardedFor)-s.TrustedProxyDepth)]
+		}
+	}
+	return remoteIP
+}
+
+// trustedProxy reports whether the IP address is in one of the ranges of TrustedProxies. Invalid addresses
+// are not trusted
+func (s *ProxyServer) trustedProxy(address string) bool {
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range s.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the entries of the X-Forwarded-For headers of the request, leftmost first
+func forwardedFor(r *http.Request) []string {
+	var entries []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	return entries
+}
+
+// normalizeHost returns the form of host used as the cache and store key. It is lowercased and stripped of
+// its port, the brackets around an IPv6 literal and the trailing dot of a fully qualified name, so that
+// "Example.com:443" and "example.com." share one route. Routes are configured per host rather than per port,
+// so any port is stripped, not only the default ports. Stripping is repeated until nothing is left to strip, so
+// that a normalized host normalizes to itself even when a malformed host such as "[[::1]]" or "example.com.."
+// needs more than one pass
+func normalizeHost(host string) string {
+	for {
+		stripped := host
+		if h, _, err := net.SplitHostPort(stripped); err == nil {
+			stripped = h
+		}
+		stripped = strings.TrimSuffix(strings.TrimPrefix(stripped, "["), "]")
+		stripped = strings.TrimRight(stripped, ".")
+		if stripped == host {
+			return strings.ToLower(host)
+		}
+		host = stripped
+	}
+}
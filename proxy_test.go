@@ -0,0 +1,1217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/balancer"
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/compress"
+	"github.com/cbodonnell/proxy-host/pkg/metrics"
+	"github.com/cbodonnell/proxy-host/pkg/ratelimit"
+	"github.com/cbodonnell/proxy-host/pkg/responsecache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestServer creates a proxy server with a fresh cache and a memory store holding the specified routes
+func newTestServer(t *testing.T, routes map[string]*store.Route) *ProxyServer {
+	t.Helper()
+	proxyCache := cache.NewCache(time.Minute, time.Minute)
+	t.Cleanup(proxyCache.StopCleanup)
+	s := NewProxyServer(cache.NewTypedCache[*Upstream](proxyCache), store.NewMemoryStore(routes))
+	s.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return s
+}
+
+// serve sends a request for the specified host and path through the handler and returns the recorded response
+func serve(handler http.Handler, method, host, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Host = host
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// mustParseURL parses the url or fails the test
+func mustParseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("failed to parse url %s: %v", rawURL, err)
+	}
+	return u
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"":                  "",
+		"example.com":       "example.com",
+		"example.com:8080":  "example.com",
+		"Example.com:443":   "example.com",
+		"example.com:80":    "example.com",
+		"Example.COM":       "example.com",
+		"example.com.":      "example.com",
+		"Example.COM.:443":  "example.com",
+		"a.b.example.com.":  "a.b.example.com",
+		"example.com:":      "example.com",
+		"10.0.0.1:9999":     "10.0.0.1",
+		"[::1]":             "::1",
+		"[::1]:443":         "::1",
+		"[FE80::1]":         "fe80::1",
+		"[FE80::1%eth0]:80": "fe80::1%eth0",
+		"example.com..":     "example.com",
+		"[[::1]]":           "::1",
+		".":                 "",
+	}
+	for input, want := range tests {
+		if got := normalizeHost(input); got != want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func FuzzNormalizeHost(f *testing.F) {
+	for _, seed := range []string{
+		"", "example.com", "Example.COM.:443", "a.b.example.com.", "example.com:", "example.com..", ".",
+		"[::1]", "[::1]:443", "::1", "[FE80::1%eth0]:80", "[::ffff:10.0.0.1]:8080", "[[::1]]", "[::1",
+		"10.0.0.1:9999", "*.example.com", "a.example.com:99999", "xn--bcher-kva.example", "ÖL.example.com",
+		"a..example.com", " example.com ", "example.com:80:80",
+	} {
+		f.Add(seed)
+	}
+	wildcardTarget := &url.URL{Scheme: "http", Host: "*.internal:7880"}
+	hostStore := store.NewMemoryStore(map[string]*store.Route{
+		"example.com":   {Targets: []*url.URL{{Scheme: "http", Host: "10.0.0.1:7880"}}},
+		"*.example.com": {Targets: []*url.URL{wildcardTarget}},
+		"::1":           {Targets: []*url.URL{{Scheme: "http", Host: "127.0.0.1:7880"}}},
+	})
+	f.Fuzz(func(t *testing.T, host string) {
+		normalized := normalizeHost(host)
+		if again := normalizeHost(normalized); again != normalized {
+			t.Fatalf("normalizeHost(%q) = %q, but normalizing it again gives %q", host, normalized, again)
+		}
+		route, err := hostStore.Lookup(normalized)
+		if err != nil {
+			if !errors.Is(err, store.ErrHostNotFound) {
+				t.Fatalf("Lookup(%q) failed: %v", normalized, err)
+			}
+			return
+		}
+		if len(route.Targets) != 1 || route.Targets[0] == nil {
+			t.Fatalf("Lookup(%q) returned a route without its target", normalized)
+		}
+		if wildcardTarget.Host != "*.internal:7880" {
+			t.Fatalf("Lookup(%q) modified the target of the wildcard route", normalized)
+		}
+	})
+}
+
+func TestProxyServerNormalizesHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	for _, host := range []string{"example.com", "Example.com:443", "example.com.", "EXAMPLE.COM.:9999"} {
+		if rec := serve(s, http.MethodGet, host, "/"); rec.Code != http.StatusOK {
+			t.Errorf("host %q: status = %d, want %d", host, rec.Code, http.StatusOK)
+		}
+	}
+	if keys := s.Cache.Keys(); len(keys) != 1 || keys[0] != "example.com" {
+		t.Errorf("cache keys = %v, want [example.com]", keys)
+	}
+}
+
+func TestProxyServerUnknownHost(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, host := range []string{"", "unknown.example.com", "unknown.example.com:8080"} {
+		rec := serve(s, http.MethodGet, host, "/")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("host %q: status = %d, want %d", host, rec.Code, http.StatusNotFound)
+		}
+	}
+	if n := s.Cache.Len(); n != 0 {
+		t.Errorf("cache has %d entries after unknown hosts, want 0", n)
+	}
+}
+
+func TestProxyServerDefaultTarget(t *testing.T) {
+	known := newTestUpstream(t, "known")
+	fallback := newTestUpstream(t, "default")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, known.URL)}},
+	})
+	s.DefaultTarget = mustParseURL(t, fallback.URL)
+
+	for _, host := range []string{"unknown.example.com", "other.example.org:8080"} {
+		rec := serve(s, http.MethodGet, host, "/")
+		if rec.Code != http.StatusOK || rec.Body.String() != "default" {
+			t.Errorf("host %q: got %d %q, want the default target", host, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Body.String() != "known" {
+		t.Errorf("configured host proxied to %q, want its own target", rec.Body.String())
+	}
+	keys := s.Cache.Keys()
+	sort.Strings(keys)
+	if want := []string{defaultUpstreamKey, "example.com"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("cache keys = %q, want the default upstream cached once besides the configured host", keys)
+	}
+	// a host whose route is added later gets its own upstream rather than the default one
+	s.Store.(*store.MemoryStore).Set("new.example.com", &store.Route{Targets: []*url.URL{mustParseURL(t, known.URL)}})
+	if rec := serve(s, http.MethodGet, "new.example.com", "/"); rec.Body.String() != "known" {
+		t.Errorf("newly configured host proxied to %q, want its own target", rec.Body.String())
+	}
+}
+
+func TestProxyServerKnownHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+
+	rec := serve(s, http.MethodGet, "Example.com:9999", "/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("got %d %q, want 200 \"ok\"", rec.Code, rec.Body.String())
+	}
+	if _, found := s.Cache.Get("example.com"); !found {
+		t.Error("expected a cached proxy for example.com")
+	}
+}
+
+func TestProxyServerHTTPSUpstream(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer upstream.Close()
+	target := mustParseURL(t, upstream.URL)
+
+	tests := []struct {
+		name               string
+		insecureSkipVerify bool
+		wantStatus         int
+	}{
+		{"verify", false, http.StatusBadGateway},
+		{"skip verify", true, http.StatusOK},
+	}
+	for _, test := range tests {
+		s := newTestServer(t, map[string]*store.Route{
+			"secure.example.com": {
+				Targets:            []*url.URL{target},
+				InsecureSkipVerify: test.insecureSkipVerify,
+			},
+		})
+		rec := serve(s, http.MethodGet, "secure.example.com", "/")
+		if rec.Code != test.wantStatus {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.wantStatus)
+		}
+	}
+}
+
+func TestHealthCheckerSkipsVerification(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	route := &store.Route{
+		Targets:            []*url.URL{mustParseURL(t, upstream.URL)},
+		InsecureSkipVerify: true,
+	}
+	s := newTestServer(t, nil)
+	s.HealthCheckInterval = time.Millisecond
+	targets := []*balancer.Target{{URL: route.Targets[0]}}
+	checker := s.newHealthChecker(targets, s.transport(route))
+	checker.UnhealthyThreshold = 1
+	b := balancer.New(targets, nil)
+	b.StartHealthChecks(checker)
+	defer b.Close()
+	time.Sleep(50 * time.Millisecond)
+	if !targets[0].Healthy() {
+		t.Error("a self-signed target was marked unhealthy by a route that skips verification")
+	}
+}
+
+func TestProxyServerPreserveHostHeader(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer upstream.Close()
+	target := mustParseURL(t, upstream.URL)
+	s := newTestServer(t, map[string]*store.Route{
+		"upstream.example.com":  {Targets: []*url.URL{target}},
+		"preserved.example.com": {Targets: []*url.URL{target}, PreserveHostHeader: true},
+	})
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"upstream.example.com", target.Host},
+		{"preserved.example.com", "preserved.example.com"},
+		{"Preserved.example.com:9999", "Preserved.example.com:9999"},
+	}
+	for _, test := range tests {
+		rec := serve(s, http.MethodGet, test.host, "/")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", test.host, rec.Code, http.StatusOK)
+		}
+		if got := rec.Body.String(); got != test.want {
+			t.Errorf("%s: target received Host %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestProxyServerForwardedHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer upstream.Close()
+	tests := []struct {
+		name     string
+		enabled  bool
+		tls      bool
+		prior    string
+		expected string
+	}{
+		{name: "no prior", enabled: true, expected: "192.0.2.1|http|example.com:9999"},
+		{name: "prior", enabled: true, prior: "203.0.113.7", expected: "203.0.113.7, 192.0.2.1|http|example.com:9999"},
+		{name: "tls", enabled: true, tls: true, expected: "192.0.2.1|https|example.com:9999"},
+		{name: "disabled", expected: "||"},
+		{name: "disabled with prior", prior: "203.0.113.7", expected: "||"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]*store.Route{
+				"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+			})
+			s.ForwardedHeaders = test.enabled
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "example.com:9999"
+			if test.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if test.prior != "" {
+				req.Header.Set("X-Forwarded-For", test.prior)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if got := rec.Body.String(); got != test.expected {
+				t.Errorf("forwarded headers = %q, want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestProxyServerRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"host.example.com": {
+			Targets:   []*url.URL{mustParseURL(t, upstream.URL)},
+			RateLimit: &store.RateLimit{RequestsPerSecond: 0.5, Burst: 2},
+		},
+		"client.example.com": {
+			Targets:   []*url.URL{mustParseURL(t, upstream.URL)},
+			RateLimit: &store.RateLimit{RequestsPerSecond: 0.5, Burst: 1, PerClient: true},
+		},
+		"free.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.RateLimiter = ratelimit.New(time.Minute)
+	defer s.RateLimiter.Stop()
+
+	send := func(host, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := send("host.example.com", "192.0.2.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, rec.Code, http.StatusOK)
+		}
+	}
+	rec := send("host.example.com", "192.0.2.2:1234")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Retry-After = %q, want \"2\"", retryAfter)
+	}
+
+	if rec := send("client.example.com", "192.0.2.1:1234"); rec.Code != http.StatusOK {
+		t.Errorf("first client: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := send("client.example.com", "192.0.2.1:5678"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("first client again: status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if rec := send("client.example.com", "192.0.2.2:1234"); rec.Code != http.StatusOK {
+		t.Errorf("second client: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	for i := 0; i < 5; i++ {
+		if rec := send("free.example.com", "192.0.2.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("unlimited host: status = %d, want %d", rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestProxyServerIPFilter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	allow, _ := store.ParsePrefix("2001:db8::/32")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets:  []*url.URL{mustParseURL(t, upstream.URL)},
+			IPFilter: &store.IPFilter{Allow: []netip.Prefix{allow}},
+		},
+	})
+	tests := []struct {
+		name         string
+		depth        int
+		remoteAddr   string
+		forwardedFor []string
+		want         int
+	}{
+		{name: "allowed", remoteAddr: "[2001:db8::1]:1234", want: http.StatusOK},
+		{name: "blocked", remoteAddr: "192.0.2.1:1234", want: http.StatusForbidden},
+		{name: "untrusted header", remoteAddr: "192.0.2.1:1234", forwardedFor: []string{"2001:db8::1"}, want: http.StatusForbidden},
+		{name: "trusted header", depth: 1, remoteAddr: "192.0.2.1:1234", forwardedFor: []string{"2001:db8::1"}, want: http.StatusOK},
+		{name: "spoofed entry", depth: 1, remoteAddr: "192.0.2.1:1234", forwardedFor: []string{"2001:db8::1, 192.0.2.9"}, want: http.StatusForbidden},
+		{name: "depth two", depth: 2, remoteAddr: "192.0.2.1:1234", forwardedFor: []string{"192.0.2.9, 2001:db8::1", "192.0.2.10"}, want: http.StatusOK},
+		{name: "invalid entry", depth: 1, remoteAddr: "[2001:db8::1]:1234", forwardedFor: []string{"unknown"}, want: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.TrustedProxyDepth = test.depth
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "example.com"
+			req.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != test.want {
+				t.Errorf("status = %d, want %d", rec.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestProxyServerAllowedMethods(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"api.example.com": {
+			Targets:        []*url.URL{mustParseURL(t, upstream.URL)},
+			AllowedMethods: []string{http.MethodPost},
+		},
+	})
+	if rec := serve(s, http.MethodTrace, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("without an allowlist: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	s.AllowedMethods = []string{http.MethodGet, http.MethodHead}
+	tests := []struct {
+		host      string
+		method    string
+		want      int
+		wantAllow string
+	}{
+		{"example.com", http.MethodGet, http.StatusOK, ""},
+		{"example.com", http.MethodHead, http.StatusOK, ""},
+		{"example.com", http.MethodTrace, http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"example.com", http.MethodPost, http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"api.example.com", http.MethodPost, http.StatusOK, ""},
+		{"api.example.com", http.MethodGet, http.StatusMethodNotAllowed, "POST"},
+	}
+	for _, test := range tests {
+		rec := serve(s, test.method, test.host, "/")
+		if rec.Code != test.want {
+			t.Errorf("%s %s: status = %d, want %d", test.method, test.host, rec.Code, test.want)
+		}
+		if allow := rec.Header().Get("Allow"); allow != test.wantAllow {
+			t.Errorf("%s %s: Allow = %q, want %q", test.method, test.host, allow, test.wantAllow)
+		}
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	s := newTestServer(t, nil)
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/32"} {
+		prefix, _ := store.ParsePrefix(cidr)
+		s.TrustedProxies = append(s.TrustedProxies, prefix)
+	}
+	// the ranges take precedence over the depth
+	s.TrustedProxyDepth = 3
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{name: "direct client", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "spoofed by untrusted client", remoteAddr: "192.0.2.1:1234", forwardedFor: []string{"198.51.100.7"}, want: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"192.0.2.1"}, want: "192.0.2.1"},
+		{name: "spoofed through trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.7, 192.0.2.1"}, want: "192.0.2.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.7, 192.0.2.1", "2001:db8::1", "10.0.0.2"}, want: "192.0.2.1"},
+		{name: "ipv4 mapped proxy", remoteAddr: "[::ffff:10.0.0.1]:1234", forwardedFor: []string{"192.0.2.1, ::ffff:10.0.0.2"}, want: "192.0.2.1"},
+		{name: "only trusted entries", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"10.0.0.3, 10.0.0.2"}, want: "10.0.0.3"},
+		{name: "no header", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "invalid entry", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"192.0.2.1, unknown"}, want: "unknown"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if got := s.clientIP(req); got != test.want {
+			t.Errorf("%s: client IP = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestProxyServerIPFilterTrustedProxies(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	allow, _ := store.ParsePrefix("192.0.2.0/24")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets:  []*url.URL{mustParseURL(t, upstream.URL)},
+			IPFilter: &store.IPFilter{Allow: []netip.Prefix{allow}},
+		},
+	})
+	proxy, _ := store.ParsePrefix("10.0.0.1")
+	s.TrustedProxies = []netip.Prefix{proxy}
+	send := func(remoteAddr, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "example.com"
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if status := send("10.0.0.1:1234", "192.0.2.1"); status != http.StatusOK {
+		t.Errorf("allowed client through trusted proxy: status = %d, want %d", status, http.StatusOK)
+	}
+	if status := send("198.51.100.7:1234", "192.0.2.1"); status != http.StatusForbidden {
+		t.Errorf("client spoofing an allowed IP: status = %d, want %d", status, http.StatusForbidden)
+	}
+	if status := send("10.0.0.1:1234", "192.0.2.1, 198.51.100.7"); status != http.StatusForbidden {
+		t.Errorf("client spoofing an allowed IP through trusted proxy: status = %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestProxyServerPathRouting(t *testing.T) {
+	newEcho := func(name string) *httptest.Server {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		t.Cleanup(upstream.Close)
+		return upstream
+	}
+	root, api, v2 := newEcho("root"), newEcho("api"), newEcho("v2")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets: []*url.URL{mustParseURL(t, root.URL)},
+			Paths: []*store.PathRule{
+				{Prefix: "/api", Targets: []*url.URL{mustParseURL(t, api.URL)}, StripPrefix: true},
+				{Prefix: "/api/v2", Targets: []*url.URL{mustParseURL(t, v2.URL)}, RewritePrefix: "/v2"},
+			},
+		},
+		"paths.example.com": {
+			Paths: []*store.PathRule{
+				{Prefix: "/api", Targets: []*url.URL{mustParseURL(t, api.URL)}},
+			},
+		},
+	})
+	tests := []struct {
+		host string
+		path string
+		code int
+		body string
+	}{
+		{host: "example.com", path: "/", code: http.StatusOK, body: "root /"},
+		{host: "example.com", path: "/apis", code: http.StatusOK, body: "root /apis"},
+		{host: "example.com", path: "/api/users", code: http.StatusOK, body: "api /users"},
+		{host: "example.com", path: "/api", code: http.StatusOK, body: "api /"},
+		{host: "example.com", path: "/api/v2/users", code: http.StatusOK, body: "v2 /v2/users"},
+		{host: "paths.example.com", path: "/api/users", code: http.StatusOK, body: "api /api/users"},
+		{host: "paths.example.com", path: "/app", code: http.StatusNotFound, body: "path not found\n"},
+	}
+	for _, test := range tests {
+		rec := serve(s, http.MethodGet, test.host, test.path)
+		if rec.Code != test.code || rec.Body.String() != test.body {
+			t.Errorf("%s%s: got %d %q, want %d %q", test.host, test.path, rec.Code, rec.Body.String(), test.code, test.body)
+		}
+	}
+	keys := s.Cache.Keys()
+	sort.Strings(keys)
+	want := []string{"example.com", "example.com/api", "example.com/api/v2", "paths.example.com", "paths.example.com/api"}
+	if strings.Join(keys, ",") != strings.Join(want, ",") {
+		t.Errorf("cache keys = %v, want %v", keys, want)
+	}
+}
+
+func TestProxyServerResponseCache(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "%s?%s", r.URL.Path, r.URL.RawQuery)
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"a.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"b.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.ResponseCache = responsecache.New(time.Minute)
+	defer s.ResponseCache.Stop()
+
+	requests := []struct {
+		host  string
+		path  string
+		cache string
+	}{
+		{host: "a.example.com", path: "/page?q=1", cache: "MISS"},
+		{host: "a.example.com", path: "/page?q=1", cache: "HIT"},
+		{host: "a.example.com", path: "/page?q=2", cache: "MISS"},
+		{host: "b.example.com", path: "/page?q=1", cache: "MISS"},
+	}
+	for _, req := range requests {
+		rec := serve(s, http.MethodGet, req.host, req.path)
+		if got := rec.Header().Get("X-Cache"); got != req.cache {
+			t.Errorf("%s%s: X-Cache = %q, want %q", req.host, req.path, got, req.cache)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("upstream served %d requests, want 3", calls)
+	}
+}
+
+func TestProxyServerMaxRequestBodyBytes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"default.example.com":   {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"large.example.com":     {Targets: []*url.URL{mustParseURL(t, upstream.URL)}, MaxRequestBodyBytes: 20},
+		"unlimited.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}, MaxRequestBodyBytes: -1},
+	})
+	s.MaxRequestBodyBytes = 10
+	tests := []struct {
+		name    string
+		host    string
+		size    int
+		chunked bool
+		want    int
+	}{
+		{name: "under", host: "default.example.com", size: 10, want: http.StatusOK},
+		{name: "over", host: "default.example.com", size: 11, want: http.StatusRequestEntityTooLarge},
+		{name: "chunked under", host: "default.example.com", size: 10, chunked: true, want: http.StatusOK},
+		{name: "chunked over", host: "default.example.com", size: 11, chunked: true, want: http.StatusRequestEntityTooLarge},
+		{name: "override", host: "large.example.com", size: 20, want: http.StatusOK},
+		{name: "override over", host: "large.example.com", size: 21, want: http.StatusRequestEntityTooLarge},
+		{name: "unlimited", host: "unlimited.example.com", size: 1000, chunked: true, want: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(strings.Repeat("a", test.size))
+			if test.chunked {
+				// hide the length so that the limit is enforced while the body is read
+				body = io.MultiReader(body)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/", body)
+			req.Host = test.host
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+			if rec.Code != test.want {
+				t.Errorf("status = %d, want %d", rec.Code, test.want)
+			}
+			if test.want == http.StatusOK && rec.Body.String() != fmt.Sprint(test.size) {
+				t.Errorf("upstream received %s bytes, want %d", rec.Body.String(), test.size)
+			}
+		})
+	}
+}
+
+func TestProxyServerBasicAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "authorization=%q", r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets:   []*url.URL{mustParseURL(t, upstream.URL)},
+			BasicAuth: &store.BasicAuth{Realm: "private", Users: map[string][]byte{"alice": hash}},
+		},
+	})
+	send := func(username, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "example.com"
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, credentials := range [][2]string{{"", ""}, {"alice", "wrong"}, {"bob", "secret"}} {
+		rec := send(credentials[0], credentials[1])
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("credentials %v: status = %d, want %d", credentials, rec.Code, http.StatusUnauthorized)
+		}
+		if got := rec.Header().Get("WWW-Authenticate"); got != `Basic realm="private", charset="UTF-8"` {
+			t.Errorf("credentials %v: WWW-Authenticate = %q", credentials, got)
+		}
+	}
+	rec := send("alice", "secret")
+	if rec.Code != http.StatusOK || rec.Body.String() != `authorization=""` {
+		t.Errorf("valid credentials: got %d %q, want 200 without the credentials forwarded", rec.Code, rec.Body.String())
+	}
+}
+
+func TestProxyServerCircuitBreaker(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	var attempts atomic.Int64
+	s.Transport = failingTransport(2, &attempts)
+	s.CircuitBreakerThreshold = 2
+	s.CircuitBreakerCooldown = 50 * time.Millisecond
+	s.Metrics = metrics.New()
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusBadGateway {
+			t.Fatalf("failing request %d: status = %d, want %d", i, rec.Code, http.StatusBadGateway)
+		}
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("open circuit: status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("open circuit forwarded the request to the target")
+	}
+	rec := serve(AdminHandler(s), http.MethodGet, "admin", "/admin/health")
+	if !strings.Contains(rec.Body.String(), `"circuit":"open"`) {
+		t.Errorf("admin health = %s, want the circuit reported open", rec.Body.String())
+	}
+	rec = serve(AdminHandler(s), http.MethodGet, "admin", "/metrics")
+	if want := fmt.Sprintf(`proxy_host_circuit_state{target=%q} 2`, upstream.URL); !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics output is missing %s", want)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Fatalf("probe after the cooldown: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("closed circuit: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestProxyServerStickySessions(t *testing.T) {
+	a := newTestUpstream(t, "a")
+	b := newTestUpstream(t, "b")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets:        []*url.URL{mustParseURL(t, a.URL), mustParseURL(t, b.URL)},
+			StickySessions: &store.StickySessions{CookieName: "backend", TTL: time.Hour},
+		},
+	})
+	first := serve(s, http.MethodGet, "example.com", "/")
+	cookies := first.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "backend" {
+		t.Fatalf("cookies = %v, want the backend cookie", cookies)
+	}
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "example.com"
+		req.AddCookie(cookies[0])
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if rec.Body.String() != first.Body.String() {
+			t.Errorf("request %d reached %q, want %q", i, rec.Body, first.Body)
+		}
+	}
+	// without the cookie, requests are balanced round-robin
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Body.String() == first.Body.String() {
+		t.Errorf("request without the cookie reached %q again", rec.Body)
+	}
+}
+
+func TestProxyServerWeighted(t *testing.T) {
+	a := newTestUpstream(t, "a")
+	b := newTestUpstream(t, "b")
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {
+			Targets:  []*url.URL{mustParseURL(t, a.URL), mustParseURL(t, b.URL)},
+			Strategy: store.StrategyWeighted,
+			Weights:  []int{3, 1},
+		},
+	})
+	counts := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		counts[serve(s, http.MethodGet, "example.com", "/").Body.String()]++
+	}
+	if counts["a"] != 30 || counts["b"] != 10 {
+		t.Errorf("counts = %v, want 30 requests to a and 10 to b", counts)
+	}
+}
+
+func TestProxyServerWebSocket(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || !strings.EqualFold(r.Header.Get("Connection"), "upgrade") {
+			t.Errorf("upstream got Upgrade %q and Connection %q", r.Header.Get("Upgrade"), r.Header.Get("Connection"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		rw.WriteString("echo: " + line)
+		rw.Flush()
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"ws.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	proxyServer := httptest.NewServer(s)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /socket HTTP/1.1\r\nHost: ws.example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("failed to read upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if resp.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("Upgrade = %q, want websocket", resp.Header.Get("Upgrade"))
+	}
+	fmt.Fprint(conn, "hello\n")
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if line != "echo: hello\n" {
+		t.Errorf("echo = %q, want %q", line, "echo: hello\n")
+	}
+}
+
+// roundTripperFunc adapts a function to an http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestProxyServerTransport(t *testing.T) {
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, "http://upstream.internal")}},
+	})
+	var gotHost string
+	s.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		gotHost = r.Host
+		return &http.Response{
+			StatusCode: http.StatusTeapot,
+			Body:       http.NoBody,
+			Header:     make(http.Header),
+			Request:    r,
+		}, nil
+	})
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusTeapot)
+	}
+	if gotHost != "upstream.internal" {
+		t.Errorf("upstream Host = %q, want upstream.internal", gotHost)
+	}
+}
+
+func TestProxyServerMaxInFlight(t *testing.T) {
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, "http://upstream.internal")}},
+	})
+	s.MaxInFlight = 2
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	s.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/panic" {
+			panic("transport failed")
+		}
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: make(http.Header), Request: r}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(s, http.MethodGet, "example.com", "/slow")
+		}()
+		<-entered
+	}
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status beyond the limit = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q, want 1", rec.Header().Get("Retry-After"))
+	}
+	close(release)
+	wg.Wait()
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("status once the requests completed = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	for i := 0; i < 3; i++ {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("expected the panic of the transport to propagate")
+				}
+			}()
+			serve(s, http.MethodGet, "example.com", "/panic")
+		}()
+	}
+	if inFlight := s.inFlight.Load(); inFlight != 0 {
+		t.Errorf("%d requests in flight after the panics, want 0", inFlight)
+	}
+	if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("status after the panics = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+// newSlowUpstream creates an upstream that takes the specified delay to respond
+func newSlowUpstream(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+			w.Write([]byte("slow"))
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestProxyServerRequestTimeout(t *testing.T) {
+	upstream := newSlowUpstream(t, time.Second)
+	s := newTestServer(t, map[string]*store.Route{
+		"slow.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.RequestTimeout = 50 * time.Millisecond
+	start := time.Now()
+	rec := serve(s, http.MethodGet, "slow.example.com", "/")
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("request took %s, want about the 50ms timeout", elapsed)
+	}
+}
+
+func TestProxyServerRouteTimeoutOverride(t *testing.T) {
+	upstream := newSlowUpstream(t, 100*time.Millisecond)
+	s := newTestServer(t, map[string]*store.Route{
+		"patient.example.com": {
+			Targets: []*url.URL{mustParseURL(t, upstream.URL)},
+			Timeout: time.Second,
+		},
+		"impatient.example.com": {
+			Targets: []*url.URL{mustParseURL(t, upstream.URL)},
+		},
+	})
+	s.RequestTimeout = 20 * time.Millisecond
+	if rec := serve(s, http.MethodGet, "patient.example.com", "/"); rec.Code != http.StatusOK {
+		t.Errorf("route with a longer timeout: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if rec := serve(s, http.MethodGet, "impatient.example.com", "/"); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("route with the default timeout: status = %d, want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestProxyServerUnreachableUpstream(t *testing.T) {
+	// reserve a port and close it so nothing is listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	deadURL := "http://" + listener.Addr().String()
+	listener.Close()
+
+	s := newTestServer(t, map[string]*store.Route{
+		"dead.example.com": {Targets: []*url.URL{mustParseURL(t, deadURL)}},
+	})
+	var logs strings.Builder
+	s.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	rec := serve(s, http.MethodGet, "dead.example.com", "/")
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+	if !strings.Contains(rec.Body.String(), "dead.example.com") {
+		t.Errorf("body %q does not name the host", rec.Body.String())
+	}
+	if !strings.Contains(logs.String(), "connection refused") {
+		t.Errorf("log %q does not report connection refused", logs.String())
+	}
+}
+
+func TestProxyServerAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	var logs bytes.Buffer
+	s.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	serve(s, http.MethodPost, "example.com", "/items")
+	serve(s, http.MethodPost, "example.com", "/items")
+	var entries []map[string]interface{}
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("failed to decode log line: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d log lines, want 2", len(entries))
+	}
+	first := entries[0]
+	want := map[string]interface{}{
+		"msg":       "request",
+		"method":    "POST",
+		"host":      "example.com",
+		"path":      "/items",
+		"client_ip": "192.0.2.1",
+		"target":    upstream.URL,
+		"status":    float64(http.StatusCreated),
+		"bytes":     float64(len("created")),
+		"cache_hit": false,
+	}
+	for key, value := range want {
+		if first[key] != value {
+			t.Errorf("%s = %v, want %v", key, first[key], value)
+		}
+	}
+	if _, ok := first["duration"]; !ok {
+		t.Error("log line has no duration")
+	}
+	if entries[1]["cache_hit"] != true {
+		t.Error("second request was not logged as a cache hit")
+	}
+}
+
+func TestProxyErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.DeadlineExceeded, "timeout"},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "missing"}}, "dns lookup failed"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection refused"},
+		{errors.New("other"), "upstream error"},
+	}
+	for _, test := range tests {
+		if got := proxyErrorKind(test.err); got != test.want {
+			t.Errorf("proxyErrorKind(%v) = %q, want %q", test.err, got, test.want)
+		}
+	}
+}
+
+// errorStore is a HostStore whose lookups all fail with err
+type errorStore struct {
+	// err is returned by every lookup
+	err error
+}
+
+// Lookup returns the error of the store
+func (s errorStore) Lookup(host string) (*store.Route, error) {
+	return nil, s.err
+}
+
+func TestStoreErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", store.ErrHostNotFound, http.StatusNotFound},
+		{"unavailable", fmt.Errorf("failed to lookup host: %w", store.ErrUnavailable), http.StatusServiceUnavailable},
+		{"other", errors.New("invalid target"), http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, nil)
+			s.Store = errorStore{err: tt.err}
+			if rec := serve(s, http.MethodGet, "example.com", "/"); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if s.Cache.Len() != 0 {
+				t.Error("failed lookup was cached")
+			}
+		})
+	}
+}
+
+func TestProxyServerServerSentEvents(t *testing.T) {
+	const events, interval = 3, 200 * time.Millisecond
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		for i := 0; i < events; i++ {
+			if i > 0 {
+				time.Sleep(interval)
+			}
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"events.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	// the stream outlasts the request timeout, and passes through the middleware that buffers bodies
+	s.RequestTimeout = interval
+	s.Use(compress.New().Handler)
+	s.ResponseCache = responsecache.New(time.Minute)
+	defer s.ResponseCache.Stop()
+	front := httptest.NewServer(s)
+	defer front.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, front.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "events.example.com"
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Errorf("event stream has a Content-Length of %d", resp.ContentLength)
+	}
+
+	var arrivals []time.Time
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			if want := fmt.Sprintf("data: event %d", len(arrivals)); line != want {
+				t.Errorf("read %q, want %q", line, want)
+			}
+			arrivals = append(arrivals, time.Now())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("stream ended early: %v", err)
+	}
+	if len(arrivals) != events {
+		t.Fatalf("received %d events, want %d", len(arrivals), events)
+	}
+	for i := 1; i < events; i++ {
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < interval/2 {
+			t.Errorf("event %d arrived %v after the previous one, want them to arrive as they are written", i, gap)
+		}
+	}
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	tests := map[string]bool{
+		"text/event-stream":                   true,
+		"text/html, Text/Event-Stream;q=0.9":  true,
+		"text/html,application/xhtml+xml,*/*": false,
+		"":                                    false,
+		"text/event-stream-not, text/plain":   false,
+	}
+	for accept, want := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		if got := acceptsEventStream(r); got != want {
+			t.Errorf("acceptsEventStream(%q) = %t, want %t", accept, got, want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover is middleware that answers a request with 500 Internal Server Error if a later middleware, the
+// director or ModifyResponse panics, logging the panic with the request ID and stack. Otherwise net/http
+// closes the connection without a response. If the response was already started it cannot be replaced,
+// so the connection is aborted to tell the client the response is incomplete. It should be added first
+// so that it also covers the other middleware
+func (s *ProxyServer) Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				// the reverse proxy aborts responses whose body it failed to copy
+				panic(recovered)
+			}
+			var requestID string
+			if s.RequestIDHeader != "" {
+				requestID = w.Header().Get(s.RequestIDHeader)
+			}
+			s.logger().Error("panic serving request",
+				"method", r.Method,
+				"host", normalizeHost(r.Host),
+				"path", r.URL.Path,
+				"request_id", requestID,
+				"panic", fmt.Sprint(recovered),
+				"stack", string(debug.Stack()),
+			)
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			s.serveError(w, r, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+func TestRecover(t *testing.T) {
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, "http://upstream.internal")}},
+	})
+	var logs bytes.Buffer
+	s.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	s.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Path == "/panic" {
+			panic("transport failed")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: make(http.Header), Request: r}, nil
+	})
+	s.Use(s.Recover)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "example.com"
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := get("/panic")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if resp := get("/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("status after the panic = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var entry struct {
+		Msg       string `json:"msg"`
+		RequestID string `json:"request_id"`
+		Panic     string `json:"panic"`
+		Stack     string `json:"stack"`
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Msg == "panic serving request" {
+			break
+		}
+	}
+	if entry.Msg != "panic serving request" {
+		t.Fatalf("logs = %s, want the panic logged", logs.String())
+	}
+	if want := resp.Header.Get("X-Request-ID"); want == "" || entry.RequestID != want {
+		t.Errorf("logged request ID = %q, want %q", entry.RequestID, want)
+	}
+	if entry.Panic != "transport failed" {
+		t.Errorf("logged panic = %q, want transport failed", entry.Panic)
+	}
+	if !strings.Contains(entry.Stack, "TestRecover") {
+		t.Errorf("logged stack = %s, want the stack of the panic", entry.Stack)
+	}
+}
+
+func TestRecoverStartedResponse(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.Use(s.Recover, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			panic("middleware failed")
+		})
+	})
+	defer func() {
+		err, _ := recover().(error)
+		if !errors.Is(err, http.ErrAbortHandler) {
+			t.Errorf("panic = %v, want http.ErrAbortHandler to abort the started response", err)
+		}
+	}()
+	serve(s, http.MethodGet, "example.com", "/")
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// serveRedirect answers the request with the redirect of its host
+func serveRedirect(w http.ResponseWriter, r *http.Request, redirect *store.Redirect) {
+	http.Redirect(w, r, redirectURL(r.URL, redirect), redirect.Status)
+}
+
+// redirectURL returns the url the request for u is redirected to, which is the url of the redirect followed
+// by the path and query of u if the redirect preserves them
+func redirectURL(u *url.URL, redirect *store.Redirect) string {
+	if !redirect.PreservePath {
+		return redirect.URL.String()
+	}
+	target := *redirect.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + u.Path
+	target.RawPath = ""
+	if rawPath := u.EscapedPath(); rawPath != u.Path {
+		target.RawPath = strings.TrimSuffix(redirect.URL.EscapedPath(), "/") + rawPath
+	}
+	switch {
+	case target.RawQuery == "":
+		target.RawQuery = u.RawQuery
+	case u.RawQuery != "":
+		target.RawQuery += "&" + u.RawQuery
+	}
+	return target.String()
+}
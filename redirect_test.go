@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+func TestProxyServerRedirect(t *testing.T) {
+	tests := []struct {
+		name     string
+		redirect *store.Redirect
+		path     string
+		want     string
+	}{
+		{
+			"permanent",
+			&store.Redirect{URL: mustParseURL(t, "https://example.com"), Status: http.StatusMovedPermanently},
+			"/docs?page=2",
+			"https://example.com",
+		},
+		{
+			"temporary",
+			&store.Redirect{URL: mustParseURL(t, "https://example.com/moved"), Status: http.StatusTemporaryRedirect},
+			"/docs",
+			"https://example.com/moved",
+		},
+		{
+			"found",
+			&store.Redirect{URL: mustParseURL(t, "https://example.com/"), Status: http.StatusFound},
+			"/",
+			"https://example.com/",
+		},
+		{
+			"preserve path",
+			&store.Redirect{URL: mustParseURL(t, "https://example.com"), Status: http.StatusPermanentRedirect, PreservePath: true},
+			"/docs/a%2Fb?page=2",
+			"https://example.com/docs/a%2Fb?page=2",
+		},
+		{
+			"preserve path under a prefix",
+			&store.Redirect{URL: mustParseURL(t, "https://example.com/v2/?ref=www"), Status: http.StatusMovedPermanently, PreservePath: true},
+			"/docs?page=2",
+			"https://example.com/v2/docs?ref=www&page=2",
+		},
+	}
+	for _, test := range tests {
+		s := newTestServer(t, map[string]*store.Route{
+			"www.example.com": {Redirect: test.redirect},
+		})
+		rec := serve(s, http.MethodGet, "www.example.com", test.path)
+		if rec.Code != test.redirect.Status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.redirect.Status)
+		}
+		if location := rec.Header().Get("Location"); location != test.want {
+			t.Errorf("%s: Location = %q, want %q", test.name, location, test.want)
+		}
+	}
+}
+
+func TestProxyServerRedirectCachesNoProxy(t *testing.T) {
+	s := newTestServer(t, map[string]*store.Route{
+		"www.example.com": {Redirect: &store.Redirect{URL: mustParseURL(t, "https://example.com"), Status: http.StatusMovedPermanently}},
+	})
+	serve(s, http.MethodGet, "www.example.com", "/")
+	upstream, found := s.Cache.Get("www.example.com")
+	if !found {
+		t.Fatal("expected the route of the redirecting host to be cached")
+	}
+	if upstream.Balancer != nil {
+		t.Error("a proxy was created for a host that redirects")
+	}
+	// the upstream can be closed on eviction, and the admin api skips it
+	upstream.Close()
+	s.HealthCheckInterval = time.Hour
+	for _, path := range []string{"/admin/routes", "/admin/health"} {
+		if rec := serve(AdminHandler(s), http.MethodGet, "admin", path); rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d", path, rec.Code, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/config"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// loadRoutes reads the config file at path and returns its routes by host
+func loadRoutes(path string) (map[string]*store.Route, error) {
+	routeConfig, err := config.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return routeConfig.Routes()
+}
+
+// validateConfig validates the config file at path with the same checks as a reload, writing each problem or
+// a summary if there are none to w. It returns true if the config is valid
+func validateConfig(w io.Writer, path string) bool {
+	routeConfig, err := config.LoadFile(path)
+	if err == nil {
+		fmt.Fprintf(w, "%s: ok, %d hosts\n", path, len(routeConfig.Hosts))
+		return true
+	}
+	problems := []error{err}
+	// the problems of an invalid config are joined, so that all of them are reported at once
+	var joined interface{ Unwrap() []error }
+	if errors.As(err, &joined) {
+		problems = joined.Unwrap()
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(w, "%s: %v\n", path, problem)
+	}
+	fmt.Fprintf(w, "%s: %d problems found\n", path, len(problems))
+	return false
+}
+
+// reloadRoutes replaces the routes of the store with the routes of the config file at path and flushes the
+// proxy cache so no stale upstreams are used. Requests in flight keep the upstream they already resolved. If
+// the config file is invalid, the store is left unchanged. It returns the number of hosts whose route changed
+func reloadRoutes(path string, routeStore *store.MemoryStore, proxyCache *cache.TypedCache[*Upstream]) (int, error) {
+	routes, err := loadRoutes(path)
+	if err != nil {
+		return 0, err
+	}
+	changed := routeStore.Replace(routes)
+	proxyCache.Flush()
+	return changed, nil
+}
+
+// watchReloads reloads the routes of the config file at path each time a signal is received, until ctx is
+// done. main passes the SIGHUP notifications of the process
+func watchReloads(ctx context.Context, signals <-chan os.Signal, path string, routeStore *store.MemoryStore, proxyCache *cache.TypedCache[*Upstream], logger *slog.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			changed, err := reloadRoutes(path, routeStore, proxyCache)
+			if err != nil {
+				logger.Error("config reload failed, keeping the current routes", "path", path, "error", err)
+				continue
+			}
+			logger.Info("config reloaded", "path", path, "changed_routes", changed)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/cache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// writeConfig writes the yaml config to the file at path
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+}
+
+func TestReloadRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n  - host: b.example.com\n    target: http://10.0.0.2\n")
+	routes, err := loadRoutes(path)
+	if err != nil {
+		t.Fatalf("failed to load routes: %v", err)
+	}
+	routeStore := store.NewMemoryStore(routes)
+	proxyCache := cache.NewTypedCache[*Upstream](cache.NewCache(time.Minute, time.Minute))
+	defer proxyCache.Cache().StopCleanup()
+	proxyCache.Set("a.example.com", &Upstream{}, 0)
+
+	writeConfig(t, path, "hosts:\n  - host: a.example.com\n    target: http://10.0.0.10\n  - host: b.example.com\n    target: http://10.0.0.2\n  - host: c.example.com\n    target: http://10.0.0.3\n")
+	changed, err := reloadRoutes(path, routeStore, proxyCache)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed != 2 {
+		t.Errorf("changed = %d, want 2", changed)
+	}
+	if proxyCache.Len() != 0 {
+		t.Errorf("cache holds %v after reload, want it flushed", proxyCache.Keys())
+	}
+	route, err := routeStore.Lookup("a.example.com")
+	if err != nil || route.Targets[0].Host != "10.0.0.10" {
+		t.Errorf("Lookup after reload = %+v, %v", route, err)
+	}
+}
+
+func TestReloadRoutesInvalidConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n")
+	routes, err := loadRoutes(path)
+	if err != nil {
+		t.Fatalf("failed to load routes: %v", err)
+	}
+	routeStore := store.NewMemoryStore(routes)
+	proxyCache := cache.NewTypedCache[*Upstream](cache.NewCache(time.Minute, time.Minute))
+	defer proxyCache.Cache().StopCleanup()
+	proxyCache.Set("a.example.com", &Upstream{}, 0)
+
+	writeConfig(t, path, "hosts:\n  - host: a.example.com\n    target: ftp://10.0.0.1\n")
+	if _, err := reloadRoutes(path, routeStore, proxyCache); err == nil {
+		t.Fatal("expected an error for an invalid config")
+	}
+	if _, err := routeStore.Lookup("a.example.com"); err != nil {
+		t.Errorf("old route dropped after a failed reload: %v", err)
+	}
+	if proxyCache.Len() != 1 {
+		t.Errorf("cache flushed after a failed reload")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n")
+	var out strings.Builder
+	if !validateConfig(&out, path) {
+		t.Fatalf("valid config rejected: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "ok, 1 hosts") {
+		t.Errorf("output = %q, want the number of hosts", out.String())
+	}
+
+	writeConfig(t, path, "hosts:\n  - host: a.example.com\n    target: ftp://10.0.0.1\n  - host: a.example.com\n    target: http://10.0.0.2\n")
+	out.Reset()
+	if validateConfig(&out, path) {
+		t.Fatal("invalid config accepted")
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], "unsupported scheme") || !strings.Contains(lines[1], "already configured") || !strings.HasSuffix(lines[2], "2 problems found") {
+		t.Errorf("output = %q, want both problems on their own line", out.String())
+	}
+
+	out.Reset()
+	if validateConfig(&out, filepath.Join(t.TempDir(), "missing.yaml")) {
+		t.Error("missing config accepted")
+	}
+}
+
+func TestWatchReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "hosts:\n  - host: a.example.com\n    target: http://10.0.0.1\n")
+	routeStore := store.NewMemoryStore(nil)
+	proxyCache := cache.NewTypedCache[*Upstream](cache.NewCache(time.Minute, time.Minute))
+	defer proxyCache.Cache().StopCleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		watchReloads(ctx, signals, path, routeStore, proxyCache, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		close(done)
+	}()
+	signals <- syscall.SIGHUP
+	// a second signal is only received once the first reload has finished
+	signals <- syscall.SIGHUP
+	if _, err := routeStore.Lookup("a.example.com"); err != nil {
+		t.Errorf("route missing after SIGHUP: %v", err)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchReloads did not return after the context was canceled")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// maxRequestIDLength is the length above which a request ID sent by the client is replaced, so that it
+// cannot bloat the logs
+const maxRequestIDLength = 128
+
+// requestID returns the request ID sent by the client if it is usable, or a new random one otherwise.
+// IDs that are too long or contain characters other than printable ASCII are replaced, so that clients
+// cannot inject into the logs
+func requestID(sent string) string {
+	if sent != "" && len(sent) <= maxRequestIDLength && printableASCII(sent) {
+		return sent
+	}
+	return newRequestID()
+}
+
+// newRequestID returns a random request ID of 16 hex characters
+func newRequestID() string {
+	b := make([]byte, 8)
+	// crypto/rand.Read never fails on supported platforms
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// printableASCII reports whether s only contains printable ASCII characters other than space
+func printableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/responsecache"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// newRequestIDTestServer creates a proxy server for example.com whose upstream echoes the request ID it
+// received in X-Request-ID, recording it in received
+func newRequestIDTestServer(t *testing.T, received *string) *ProxyServer {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header.Get("X-Request-ID")
+		w.Header().Set("X-Request-ID", *received)
+	}))
+	t.Cleanup(upstream.Close)
+	return newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	var received string
+	s := newRequestIDTestServer(t, &received)
+	var logs bytes.Buffer
+	s.Logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if len(received) != 16 {
+		t.Fatalf("upstream received request ID %q, want 16 hex characters", received)
+	}
+	if got := rec.Header().Values("X-Request-ID"); len(got) != 1 || got[0] != received {
+		t.Errorf("response request IDs = %q, want [%s]", got, received)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to decode log line: %v", err)
+	}
+	if entry["request_id"] != received {
+		t.Errorf("logged request_id = %v, want %s", entry["request_id"], received)
+	}
+	serve(s, http.MethodGet, "example.com", "/")
+	if second := received; second == rec.Header().Get("X-Request-ID") {
+		t.Error("two requests were given the same ID")
+	}
+}
+
+func TestRequestIDPassthrough(t *testing.T) {
+	var received string
+	s := newRequestIDTestServer(t, &received)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com"
+	req.Header.Set("X-Request-ID", "client-id-123")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if received != "client-id-123" {
+		t.Errorf("upstream received request ID %q, want the client's", received)
+	}
+	if got := rec.Header().Get("X-Request-ID"); got != "client-id-123" {
+		t.Errorf("response request ID = %q, want the client's", got)
+	}
+}
+
+func TestRequestIDCachedResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("cached"))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.ResponseCache = responsecache.New(time.Minute)
+	defer s.ResponseCache.Stop()
+	for _, test := range []struct{ id, cache string }{{"first", "MISS"}, {"second", "HIT"}} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "example.com"
+		req.Header.Set("X-Request-ID", test.id)
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		if got := rec.Header().Get("X-Cache"); got != test.cache {
+			t.Fatalf("request %s: X-Cache = %q, want %s", test.id, got, test.cache)
+		}
+		if got := rec.Header().Values("X-Request-ID"); len(got) != 1 || got[0] != test.id {
+			t.Errorf("request %s: response request ID = %q, want its own", test.id, got)
+		}
+	}
+}
+
+func TestRequestIDReplacesUnusable(t *testing.T) {
+	for _, sent := range []string{"has space", "line\nbreak", strings.Repeat("a", maxRequestIDLength+1)} {
+		if got := requestID(sent); got == sent || len(got) != 16 {
+			t.Errorf("requestID(%q) = %q, want a new ID", sent, got)
+		}
+	}
+}
+
+func TestRequestIDCustomHeader(t *testing.T) {
+	var received string
+	s := newRequestIDTestServer(t, &received)
+	s.RequestIDHeader = "X-Correlation-ID"
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if received != "" {
+		t.Errorf("upstream received X-Request-ID %q with a custom header", received)
+	}
+	if got := rec.Header().Get("X-Correlation-ID"); len(got) != 16 {
+		t.Errorf("X-Correlation-ID = %q, want a generated ID", got)
+	}
+}
+
+func TestRequestIDDisabled(t *testing.T) {
+	var received string
+	s := newRequestIDTestServer(t, &received)
+	s.RequestIDHeader = ""
+	rec := serve(s, http.MethodGet, "example.com", "/")
+	if received != "" || rec.Header().Get("X-Request-ID") != "" {
+		t.Errorf("request ID %q was set with request IDs disabled", received)
+	}
+}
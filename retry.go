@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// retryTransport is an http.RoundTripper that retries requests whose round trip failed, such as when the
+// connection to the target was refused. Responses are never retried, whatever their status
+type retryTransport struct {
+	// next performs each attempt
+	next http.RoundTripper
+	// maxRetries is the number of retries after the first attempt
+	maxRetries int
+	// backoff is the wait before the first retry, doubled for each further retry
+	backoff time.Duration
+}
+
+// RoundTrip sends the request, retrying it up to maxRetries times if it may safely be replayed
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	if err == nil || !replayable(r) {
+		return resp, err
+	}
+	backoff := t.backoff
+	for retry := 0; retry < t.maxRetries; retry++ {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+		if r.GetBody != nil {
+			body, bodyErr := r.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		resp, err = t.next.RoundTrip(r)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// replayable reports whether the request is idempotent and its body, if any, can be read again
+func replayable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// failingTransport returns a transport whose first failures round trips fail with a refused connection before
+// it delegates to http.DefaultTransport, counting the attempts
+func failingTransport(failures int64, attempts *atomic.Int64) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if attempts.Add(1) <= failures {
+			return nil, syscall.ECONNREFUSED
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+}
+
+func TestProxyServerRetries(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	tests := []struct {
+		name       string
+		maxRetries int
+		failures   int64
+		method     string
+		want       int
+		attempts   int64
+	}{
+		{name: "fails once", maxRetries: 2, failures: 1, method: http.MethodGet, want: http.StatusOK, attempts: 2},
+		{name: "head", maxRetries: 2, failures: 2, method: http.MethodHead, want: http.StatusOK, attempts: 3},
+		{name: "exhausted", maxRetries: 2, failures: 5, method: http.MethodGet, want: http.StatusBadGateway, attempts: 3},
+		{name: "disabled", maxRetries: 0, failures: 1, method: http.MethodGet, want: http.StatusBadGateway, attempts: 1},
+		{name: "post", maxRetries: 2, failures: 1, method: http.MethodPost, want: http.StatusBadGateway, attempts: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, map[string]*store.Route{
+				"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+			})
+			var attempts atomic.Int64
+			s.Transport = failingTransport(test.failures, &attempts)
+			s.MaxRetries = test.maxRetries
+			s.RetryBackoff = time.Millisecond
+			if rec := serve(s, test.method, "example.com", "/"); rec.Code != test.want {
+				t.Errorf("status = %d, want %d", rec.Code, test.want)
+			}
+			if got := attempts.Load(); got != test.attempts {
+				t.Errorf("attempts = %d, want %d", got, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryTransportReplaysBody(t *testing.T) {
+	var attempts atomic.Int64
+	var bodies []string
+	transport := &retryTransport{
+		next: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			if attempts.Add(1) == 1 {
+				return nil, syscall.ECONNREFUSED
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+		}),
+		maxRetries: 1,
+		backoff:    time.Millisecond,
+	}
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com", strings.NewReader("payload"))
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(bodies) != 2 || bodies[1] != "payload" {
+		t.Errorf("bodies sent = %q, want the payload twice", bodies)
+	}
+}
+
+func TestRetryTransportStopsOnCancel(t *testing.T) {
+	transport := &retryTransport{
+		next: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			return nil, syscall.ECONNREFUSED
+		}),
+		maxRetries: 3,
+		backoff:    time.Hour,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://example.com", nil)
+	done := make(chan error, 1)
+	go func() {
+		_, err := transport.RoundTrip(req)
+		done <- err
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("err = %v, want the error of the last attempt", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry backoff was not interrupted by the canceled context")
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	tests := []struct {
+		method string
+		body   bool
+		want   bool
+	}{
+		{method: http.MethodGet, want: true},
+		{method: http.MethodHead, want: true},
+		{method: http.MethodDelete, want: true},
+		{method: http.MethodPut, body: true, want: true},
+		{method: http.MethodPost, want: false},
+		{method: http.MethodPatch, body: true, want: false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://example.com", nil)
+		if test.body {
+			req, _ = http.NewRequest(test.method, "http://example.com", strings.NewReader("body"))
+		}
+		if got := replayable(req); got != test.want {
+			t.Errorf("replayable(%s, body %v) = %v, want %v", test.method, test.body, got, test.want)
+		}
+	}
+	// a body that cannot be read again is never replayed
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader("body"))
+	req.GetBody = nil
+	if replayable(req) {
+		t.Error("request whose body cannot be read again is replayable")
+	}
+}
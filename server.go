@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/config"
+	"github.com/cbodonnell/proxy-host/pkg/proxyproto"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// withH2C serves cleartext HTTP/2 requests with the handler besides HTTP/1, for clients that connect with
+// prior knowledge or upgrade their HTTP/1 connection. Servers with a TLSConfig negotiate HTTP/2 without it
+func withH2C(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// applyTimeouts sets the read, write and idle timeouts of the server config on the servers
+func applyTimeouts(serverConfig *config.Server, servers ...*http.Server) {
+	for _, server := range servers {
+		server.ReadHeaderTimeout = serverConfig.ReadHeaderTimeout
+		server.ReadTimeout = serverConfig.ReadTimeout
+		server.WriteTimeout = serverConfig.WriteTimeout
+		server.IdleTimeout = serverConfig.IdleTimeout
+	}
+}
+
+// ListenFunc creates the listener a server is served on
+type ListenFunc func(server *http.Server) (net.Listener, error)
+
+// listenTCP listens on the address of the server, :http or :https if it has none, as ListenAndServe does
+func listenTCP(server *http.Server) (net.Listener, error) {
+	addr := server.Addr
+	if addr == "" && server.TLSConfig != nil {
+		addr = ":https"
+	} else if addr == "" {
+		addr = ":http"
+	}
+	return net.Listen("tcp", addr)
+}
+
+// listenProxyProtocol returns a ListenFunc that parses the PROXY protocol header of the connections of the
+// servers, except for the direct ones such as the admin server that load balancers do not forward to. Headers
+// must be sent within the header timeout, zero meaning no timeout
+func listenProxyProtocol(headerTimeout time.Duration, direct ...*http.Server) ListenFunc {
+	return func(server *http.Server) (net.Listener, error) {
+		listener, err := listenTCP(server)
+		if err != nil || slices.Contains(direct, server) {
+			return listener, err
+		}
+		return proxyproto.NewListener(listener, headerTimeout), nil
+	}
+}
+
+// Run starts the servers on the listeners created by listen, or on tcp listeners of their addresses if listen
+// is nil, and serves until ctx is cancelled or one of them fails, then shuts all of them down gracefully.
+// Shutdown stops accepting new connections and waits up to drainTimeout for in-flight requests to finish before
+// closing the remaining connections. Servers with a TLSConfig are served over https. The errors of all servers
+// that failed, starting with the one that caused the shutdown, and of those that did not drain in time are
+// returned joined, or nil if ctx was cancelled and the servers drained in time
+func Run(ctx context.Context, drainTimeout time.Duration, listen ListenFunc, servers ...*http.Server) error {
+	if listen == nil {
+		listen = listenTCP
+	}
+	errs := make(chan error, len(servers))
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			listener, err := listen(server)
+			if err == nil && server.TLSConfig != nil {
+				err = server.ServeTLS(listener, "", "")
+			} else if err == nil {
+				err = server.Serve(listener)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				errs <- fmt.Errorf("server on %s failed: %w", server.Addr, err)
+			}
+		}(server)
+	}
+
+	var failures []error
+	select {
+	case <-ctx.Done():
+	case err := <-errs:
+		failures = append(failures, err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			// the drain deadline passed, so the remaining connections are dropped
+			server.Close()
+			failures = append(failures, fmt.Errorf("failed to drain server on %s: %w", server.Addr, err))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		failures = append(failures, err)
+	}
+	return errors.Join(failures...)
+}
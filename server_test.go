@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/config"
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	"golang.org/x/net/http2"
+)
+
+// freeAddr returns a local address that nothing is listening on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// waitForServer waits until the address accepts connections
+func waitForServer(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("server on %s did not start", addr)
+}
+
+// slowHandler answers after the specified delay, signalling started once a request has arrived
+func slowHandler(delay time.Duration, started chan<- struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(delay)
+		w.Write([]byte("done"))
+	})
+}
+
+func TestRunDrainsInFlightRequests(t *testing.T) {
+	addr := freeAddr(t)
+	started := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Run(ctx, time.Second, nil, &http.Server{Addr: addr, Handler: slowHandler(100*time.Millisecond, started)})
+	}()
+	waitForServer(t, addr)
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+
+	if got := <-status; got != http.StatusOK {
+		t.Errorf("in-flight request status = %d, want %d", got, http.StatusOK)
+	}
+	if err := <-runErr; err != nil {
+		t.Errorf("Run returned %v, want nil", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+}
+
+func TestRunDrainTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	started := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Run(ctx, 50*time.Millisecond, nil, &http.Server{Addr: addr, Handler: slowHandler(time.Second, started)})
+	}()
+	waitForServer(t, addr)
+	go http.Get("http://" + addr)
+	<-started
+	cancel()
+
+	select {
+	case err := <-runErr:
+		if err == nil {
+			t.Error("Run returned nil although the drain deadline passed")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Run did not return after the drain deadline")
+	}
+}
+
+func TestRunBindFailureStopsOtherServers(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	healthyAddr := freeAddr(t)
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Run(context.Background(), time.Second, nil,
+			&http.Server{Addr: healthyAddr, Handler: http.NotFoundHandler()},
+			&http.Server{Addr: listener.Addr().String(), Handler: http.NotFoundHandler()},
+		)
+	}()
+	select {
+	case err := <-runErr:
+		if err == nil {
+			t.Error("Run returned nil although a server failed to bind")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after a bind failure")
+	}
+	if _, err := net.Dial("tcp", healthyAddr); err == nil {
+		t.Error("the other server is still running after a bind failure")
+	}
+}
+
+func TestRunReportsEveryDrainFailure(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	started := make(chan struct{}, len(addrs))
+	var servers []*http.Server
+	for _, addr := range addrs {
+		servers = append(servers, &http.Server{Addr: addr, Handler: slowHandler(time.Second, started)})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Run(ctx, 50*time.Millisecond, nil, servers...)
+	}()
+	for _, addr := range addrs {
+		waitForServer(t, addr)
+		go http.Get("http://" + addr)
+		<-started
+	}
+	cancel()
+
+	err := <-runErr
+	for _, addr := range addrs {
+		if err == nil || !strings.Contains(err.Error(), "failed to drain server on "+addr) {
+			t.Errorf("error = %v, want the drain failure of %s", err, addr)
+		}
+	}
+}
+
+func TestRunServesEveryListenAddr(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("same handler"))
+	})
+	var servers []*http.Server
+	for _, addr := range addrs {
+		servers = append(servers, &http.Server{Addr: addr, Handler: handler})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- Run(ctx, time.Second, nil, servers...)
+	}()
+	for _, addr := range addrs {
+		waitForServer(t, addr)
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			t.Fatalf("request to %s failed: %v", addr, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "same handler" {
+			t.Errorf("%s answered %q, want the shared handler", addr, body)
+		}
+	}
+	cancel()
+	if err := <-runErr; err != nil {
+		t.Errorf("Run = %v, want nil after the context was cancelled", err)
+	}
+	for _, addr := range addrs {
+		if _, err := net.Dial("tcp", addr); err == nil {
+			t.Errorf("server on %s is still running after shutdown", addr)
+		}
+	}
+}
+
+func TestRunProxyProtocol(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.ForwardedHeaders = true
+	proxyServer := &http.Server{Addr: freeAddr(t), Handler: s}
+	adminServer := &http.Server{Addr: freeAddr(t), Handler: AdminHandler(s)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Run(ctx, time.Second, listenProxyProtocol(time.Second, adminServer), proxyServer, adminServer)
+	waitForServer(t, proxyServer.Addr)
+	waitForServer(t, adminServer.Addr)
+
+	conn, err := net.Dial("tcp", proxyServer.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 56324 80\r\nGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "203.0.113.7" {
+		t.Errorf("X-Forwarded-For = %q, want the client address of the PROXY header", body)
+	}
+
+	// the admin server is reached directly, without a header
+	resp, err = http.Get("http://" + adminServer.Addr + "/healthz")
+	if err != nil {
+		t.Fatalf("admin request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("admin status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	// while the proxy rejects connections without one
+	if resp, err := http.Get("http://" + proxyServer.Addr); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("status without a PROXY header = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+// newHTTP2Upstream starts an https target that negotiates HTTP/2, answering with the protocol of each request
+func newHTTP2Upstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestHTTP2RoundTrip(t *testing.T) {
+	upstream := newHTTP2Upstream(t)
+	s := newTestServer(t, map[string]*store.Route{
+		"h2.example.com": {
+			Targets:            []*url.URL{mustParseURL(t, upstream.URL)},
+			InsecureSkipVerify: true,
+		},
+	})
+	s.InsecureTransport = NewTransport(DefaultTransportOptions(), true)
+	front := httptest.NewUnstartedServer(s)
+	front.EnableHTTP2 = true
+	front.StartTLS()
+	defer front.Close()
+	client := front.Client()
+	client.Timeout = 5 * time.Second
+
+	req, err := http.NewRequest(http.MethodGet, front.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "h2.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("client spoke %s to the proxy, want HTTP/2", resp.Proto)
+	}
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("proxy spoke %s to the target, want HTTP/2.0", body)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	upstream := newTestUpstream(t, "cleartext")
+	s := newTestServer(t, map[string]*store.Route{
+		"h2c.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	front := httptest.NewServer(withH2C(s))
+	defer front.Close()
+	// a client with prior knowledge of HTTP/2 speaks it over plain TCP
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, front.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "h2c.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "cleartext" {
+		t.Fatalf("got %d %q, want 200 \"cleartext\"", resp.StatusCode, body)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("response protocol = %s, want HTTP/2", resp.Proto)
+	}
+}
+
+// newGRPCLikeUpstream starts an https target speaking HTTP/2 that answers like a gRPC server: it streams the
+// first message, waits for release to be closed, then sends the status as trailers
+func newGRPCLikeUpstream(t *testing.T, release <-chan struct{}) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("second"))
+		w.Header().Set("Grpc-Status", "0")
+		// a trailer that was not announced up front
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done")
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestProxyServerStreamsTrailers(t *testing.T) {
+	for _, useHTTP2 := range []bool{false, true} {
+		release := make(chan struct{})
+		upstream := newGRPCLikeUpstream(t, release)
+		s := newTestServer(t, map[string]*store.Route{
+			"grpc.example.com": {
+				Targets:            []*url.URL{mustParseURL(t, upstream.URL)},
+				InsecureSkipVerify: true,
+			},
+		})
+		s.InsecureTransport = NewTransport(DefaultTransportOptions(), true)
+		front := httptest.NewUnstartedServer(s)
+		front.EnableHTTP2 = useHTTP2
+		front.StartTLS()
+		defer front.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, front.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "grpc.example.com"
+		resp, err := front.Client().Do(req)
+		if err != nil {
+			t.Fatalf("http2 %t: request failed: %v", useHTTP2, err)
+		}
+		defer resp.Body.Close()
+		// the first message must arrive while the target is still waiting, so it cannot be buffered
+		first := make([]byte, len("first"))
+		if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "first" {
+			t.Fatalf("http2 %t: read %q, %v before the stream ended, want \"first\"", useHTTP2, first, err)
+		}
+		close(release)
+		rest, err := io.ReadAll(resp.Body)
+		if err != nil || string(rest) != "second" {
+			t.Fatalf("http2 %t: read %q, %v, want \"second\"", useHTTP2, rest, err)
+		}
+		if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+			t.Errorf("http2 %t: Grpc-Status trailer = %q, want \"0\"", useHTTP2, got)
+		}
+		if got := resp.Trailer.Get("Grpc-Message"); got != "done" {
+			t.Errorf("http2 %t: Grpc-Message trailer = %q, want \"done\"", useHTTP2, got)
+		}
+	}
+}
+
+func TestProxyServerFlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	// a response of known length is only flushed as it is copied when a flush interval is configured
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("first"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		w.Write([]byte("later"))
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"flush.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.FlushInterval = -1
+	front := httptest.NewServer(s)
+	defer front.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, front.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "flush.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, len("first"))
+	if _, err := io.ReadFull(resp.Body, first); err != nil || string(first) != "first" {
+		t.Fatalf("read %q, %v before the target finished, want \"first\"", first, err)
+	}
+}
+
+// newTimeoutServer starts the handler behind a server with the timeouts of the server config
+func newTimeoutServer(t *testing.T, handler http.Handler, serverConfig *config.Server) *httptest.Server {
+	t.Helper()
+	front := httptest.NewUnstartedServer(handler)
+	applyTimeouts(serverConfig, front.Config)
+	front.Start()
+	t.Cleanup(front.Close)
+	return front
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	front := newTimeoutServer(t, http.NotFoundHandler(), &config.Server{ReadHeaderTimeout: 100 * time.Millisecond})
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// a slow client that never finishes its headers is disconnected
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") == "text/event-stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"slow.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	front := newTimeoutServer(t, s, &config.Server{ReadTimeout: 150 * time.Millisecond, WriteTimeout: 150 * time.Millisecond})
+
+	get := func(accept string) (string, error) {
+		req, err := http.NewRequest(http.MethodGet, front.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "slow.example.com"
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+	if body, err := get("text/plain"); err == nil && strings.Contains(body, "event 2") {
+		t.Error("expected the write timeout to cut off a response outlasting it")
+	}
+	body, err := get("text/event-stream")
+	if err != nil || !strings.Contains(body, "event 2") {
+		t.Errorf("event stream = %q, %v, want all events past the read and write timeouts", body, err)
+	}
+}
+
+func TestApplyTimeouts(t *testing.T) {
+	serverConfig := config.DefaultServer()
+	servers := []*http.Server{{Addr: ":80"}, {Addr: ":443"}}
+	applyTimeouts(serverConfig, servers...)
+	for _, server := range servers {
+		if server.ReadHeaderTimeout != serverConfig.ReadHeaderTimeout || server.ReadTimeout != serverConfig.ReadTimeout ||
+			server.WriteTimeout != serverConfig.WriteTimeout || server.IdleTimeout != serverConfig.IdleTimeout {
+			t.Errorf("server on %s has timeouts %v, %v, %v, %v, want those of the config", server.Addr,
+				server.ReadHeaderTimeout, server.ReadTimeout, server.WriteTimeout, server.IdleTimeout)
+		}
+	}
+}
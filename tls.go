@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newAutocertManager creates an autocert manager that only issues certificates for hosts configured in the
+// store, caching them in the specified directory
+func newAutocertManager(hostStore store.HostStore, cacheDir string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		HostPolicy: func(ctx context.Context, host string) error {
+			if _, err := hostStore.Lookup(normalizeHost(host)); err != nil {
+				return fmt.Errorf("refusing to issue certificate for %s: %w", host, err)
+			}
+			return nil
+		},
+	}
+}
+
+// newAutocertServers creates the servers for running with autocert: one serving the handler over https on
+// :443 using certificates from the manager, and one serving the ACME HTTP-01 challenge on :80 that redirects
+// all other http requests to https
+func newAutocertServers(manager *autocert.Manager, handler http.Handler) []*http.Server {
+	return []*http.Server{
+		{
+			Addr:      ":443",
+			Handler:   handler,
+			TLSConfig: manager.TLSConfig(),
+		},
+		{
+			Addr:    ":80",
+			Handler: manager.HTTPHandler(nil),
+		},
+	}
+}
+
+// newClientTLSConfig loads the client certificate and CA bundle of the client TLS config into a TLS config for
+// the connections to targets that require mutual TLS. If insecureSkipVerify is true, the certificates of the
+// targets are not verified
+func newClientTLSConfig(clientTLS *store.ClientTLS, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if clientTLS.CertFile != "" || clientTLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(clientTLS.CertFile, clientTLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if clientTLS.CAFile != "" {
+		pem, err := os.ReadFile(clientTLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", clientTLS.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	return tlsConfig, nil
+}
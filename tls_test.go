@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// newTestClientCert creates a self-signed client certificate with the common name and writes it and its key
+// to PEM files in a temporary directory, returning their paths and the parsed certificate
+func newTestClientCert(t *testing.T, commonName string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "PRIVATE KEY", keyDER)
+	return certFile, keyFile, cert
+}
+
+// writePEM writes the DER bytes to the file as a PEM block of the type
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newMutualTLSUpstream starts a TLS server that requires a client certificate signed by one of the clients,
+// responding with the common name of the certificate presented. It returns the server and the path of a CA
+// bundle holding its own certificate
+func newMutualTLSUpstream(t *testing.T, clients ...*x509.Certificate) (*httptest.Server, string) {
+	t.Helper()
+	clientCAs := x509.NewCertPool()
+	for _, client := range clients {
+		clientCAs.AddCert(client)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	upstream.StartTLS()
+	t.Cleanup(upstream.Close)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", upstream.Certificate().Raw)
+	return upstream, caFile
+}
+
+func TestProxyServerClientTLS(t *testing.T) {
+	globalCert, globalKey, global := newTestClientCert(t, "global")
+	hostCert, hostKey, host := newTestClientCert(t, "host")
+	upstream, caFile := newMutualTLSUpstream(t, global, host)
+	target := mustParseURL(t, upstream.URL)
+
+	tests := []struct {
+		name       string
+		global     *store.ClientTLS
+		route      *store.ClientTLS
+		wantStatus int
+		wantBody   string
+	}{
+		{"no client certificate", nil, nil, http.StatusBadGateway, ""},
+		{"global", &store.ClientTLS{CertFile: globalCert, KeyFile: globalKey, CAFile: caFile}, nil, http.StatusOK, "global"},
+		{"host", nil, &store.ClientTLS{CertFile: hostCert, KeyFile: hostKey, CAFile: caFile}, http.StatusOK, "host"},
+		{
+			"host overrides global",
+			&store.ClientTLS{CertFile: globalCert, KeyFile: globalKey, CAFile: caFile},
+			&store.ClientTLS{CertFile: hostCert, KeyFile: hostKey, CAFile: caFile},
+			http.StatusOK,
+			"host",
+		},
+		{"unverified upstream", &store.ClientTLS{CertFile: globalCert, KeyFile: globalKey}, nil, http.StatusBadGateway, ""},
+		{"missing certificate file", &store.ClientTLS{CertFile: "missing.pem", KeyFile: globalKey, CAFile: caFile}, nil, http.StatusBadGateway, ""},
+	}
+	for _, test := range tests {
+		s := newTestServer(t, map[string]*store.Route{
+			"mtls.example.com": {
+				Targets:   []*url.URL{target},
+				ClientTLS: test.route,
+			},
+		})
+		s.ClientTLS = test.global
+		rec := serve(s, http.MethodGet, "mtls.example.com", "/")
+		if rec.Code != test.wantStatus {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.wantStatus)
+			continue
+		}
+		if test.wantBody != "" && rec.Body.String() != test.wantBody {
+			t.Errorf("%s: presented certificate %q, want %q", test.name, rec.Body.String(), test.wantBody)
+		}
+	}
+}
+
+func TestProxyServerClientTLSDedicatedTransport(t *testing.T) {
+	certFile, keyFile, cert := newTestClientCert(t, "client")
+	upstream, caFile := newMutualTLSUpstream(t, cert)
+	routes := map[string]*store.Route{
+		"mtls.example.com": {
+			Targets:   []*url.URL{mustParseURL(t, upstream.URL)},
+			ClientTLS: &store.ClientTLS{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+		},
+	}
+	s := newTestServer(t, routes)
+	s.Transport = NewTransport(DefaultTransportOptions(), false)
+	if rec := serve(s, http.MethodGet, "mtls.example.com", "/"); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	cached, _ := s.Cache.Get("mtls.example.com")
+	if cached.transport == nil || cached.transport == s.Transport {
+		t.Fatal("expected the upstream to get a transport of its own presenting the certificate")
+	}
+	if shared := s.Transport.(*http.Transport).TLSClientConfig; shared != nil && len(shared.Certificates) > 0 {
+		t.Error("the client certificate leaked into the shared transport")
+	}
+}
+
+func TestNewClientTLSConfigInvalidCA(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newClientTLSConfig(&store.ClientTLS{CAFile: caFile}, false); err == nil {
+		t.Error("expected an error for a CA bundle without certificates")
+	}
+}
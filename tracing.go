@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the instrumentation library reported with the spans of the proxy
+const tracerName = "github.com/cbodonnell/proxy-host"
+
+// defaultPropagator propagates W3C trace context and baggage when no Propagator is configured
+var defaultPropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// propagator returns the propagator that extracts and injects the trace context of requests
+func (s *ProxyServer) propagator() propagation.TextMapPropagator {
+	if s.Propagator != nil {
+		return s.Propagator
+	}
+	return defaultPropagator
+}
+
+// startSpan starts the span of a request for the host as a child of the trace context sent by the client,
+// if any. It returns the request carrying the span in its context
+func (s *ProxyServer) startSpan(r *http.Request, host string) (*http.Request, trace.Span) {
+	ctx := s.propagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := s.TracerProvider.Tracer(tracerName).Start(ctx, "proxy "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", host),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// endSpan ends the span of a request with the target it was forwarded to and its status code. Responses
+// with a 5xx status mark the span as failed
+func endSpan(span trace.Span, info *requestInfo, status int) {
+	if info.target != "" {
+		span.SetAttributes(attribute.String("proxy.target", info.target))
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// injectTraceContext adds the trace context of the request to its headers so that the target can continue
+// the trace
+func (s *ProxyServer) injectTraceContext(r *http.Request) {
+	s.propagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+// newTracingTestServer creates a proxy server for example.com recording its spans, proxying to an upstream
+// that answers with the specified status and records the traceparent header it received
+func newTracingTestServer(t *testing.T, status int, traceparent *string) (*ProxyServer, *tracetest.SpanRecorder, string) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*traceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(upstream.Close)
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	recorder := tracetest.NewSpanRecorder()
+	s.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return s, recorder, upstream.URL
+}
+
+// spanAttributes returns the attributes of the span by key
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestTracingSpan(t *testing.T) {
+	var traceparent string
+	s, recorder, upstreamURL := newTracingTestServer(t, http.StatusOK, &traceparent)
+	serve(s, http.MethodGet, "example.com", "/items")
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.SpanKind() != trace.SpanKindServer {
+		t.Errorf("span kind = %v, want server", span.SpanKind())
+	}
+	attributes := spanAttributes(span)
+	for key, want := range map[attribute.Key]string{
+		"server.address":      "example.com",
+		"http.request.method": "GET",
+		"url.path":            "/items",
+		"proxy.target":        upstreamURL,
+	} {
+		if got := attributes[key].AsString(); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if got := attributes["http.response.status_code"].AsInt64(); got != http.StatusOK {
+		t.Errorf("http.response.status_code = %d, want %d", got, http.StatusOK)
+	}
+	if span.Status().Code == codes.Error {
+		t.Error("successful request marked the span as failed")
+	}
+	want := "00-" + span.SpanContext().TraceID().String() + "-" + span.SpanContext().SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("upstream received traceparent %q, want %q", traceparent, want)
+	}
+}
+
+func TestTracingServerError(t *testing.T) {
+	var traceparent string
+	s, recorder, _ := newTracingTestServer(t, http.StatusServiceUnavailable, &traceparent)
+	serve(s, http.MethodGet, "example.com", "/")
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Status().Code != codes.Error {
+		t.Fatalf("spans = %v, want one failed span", spans)
+	}
+}
+
+func TestTracingContinuesClientTrace(t *testing.T) {
+	var traceparent string
+	s, recorder, _ := newTracingTestServer(t, http.StatusOK, &traceparent)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com"
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	if got := spans[0].SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the client's", got)
+	}
+	if got := spans[0].Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent span ID = %s, want the client's", got)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	var traceparent string
+	s, recorder, _ := newTracingTestServer(t, http.StatusOK, &traceparent)
+	s.TracerProvider = nil
+	serve(s, http.MethodGet, "example.com", "/")
+	if len(recorder.Ended()) != 0 || traceparent != "" {
+		t.Error("request was traced with tracing disabled")
+	}
+}
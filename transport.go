@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// socketHost is the Host sent to targets listening on a Unix domain socket, which have no host name
+const socketHost = "localhost"
+
+// TransportOptions configures the connections of the transport shared by the proxies to their targets
+type TransportOptions struct {
+	// DialTimeout bounds how long connecting to a target may take
+	DialTimeout time.Duration
+	// KeepAlive is the interval between keep-alive probes of connections to targets. Negative disables them
+	KeepAlive time.Duration
+	// TLSHandshakeTimeout bounds how long the TLS handshake with an https target may take
+	TLSHandshakeTimeout time.Duration
+	// MaxIdleConns is the number of idle connections kept open across all targets. Zero means no limit
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the number of idle connections kept open to each target
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open before it is closed. Zero means no limit
+	IdleConnTimeout time.Duration
+}
+
+// DefaultTransportOptions returns the options of http.DefaultTransport, except that more idle connections
+// are kept to each target since every request of a host goes to the same few targets
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// NewTransport creates a transport with the specified options that uses HTTP/2 with the https targets that
+// support it. If insecureSkipVerify is true, the certificates presented by https targets are not verified
+func NewTransport(opts TransportOptions, insecureSkipVerify bool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	// speak HTTP/2 to https targets that negotiate it, which the transport would otherwise only do without a
+	// custom dialer or TLS config
+	transport.ForceAttemptHTTP2 = true
+	if insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+	return transport
+}
+
+// socketTransport sends the requests for unix urls to the targets of an upstream that listen on Unix domain
+// sockets, and all other requests with next. The path of such a request is the path of the socket followed by
+// the path requested from the target, as joined by the reverse proxy to the target
+type socketTransport struct {
+	// next sends the requests to the targets that do not listen on a socket
+	next http.RoundTripper
+	// sockets contains the transport dialing each socket, keyed by the path of the socket
+	sockets map[string]*http.Transport
+}
+
+// newSocketTransport creates a transport to the targets that listen on a Unix domain socket, whose
+// connections are configured like those of next if it is an *http.Transport. If none of the targets
+// listen on a socket, nil is returned
+func newSocketTransport(next http.RoundTripper, targets []*url.URL) *socketTransport {
+	var sockets map[string]*http.Transport
+	for _, target := range targets {
+		if target.Scheme != "unix" {
+			continue
+		}
+		var transport *http.Transport
+		if shared, ok := next.(*http.Transport); ok {
+			transport = shared.Clone()
+		} else {
+			transport = NewTransport(DefaultTransportOptions(), false)
+		}
+		socketPath := target.Path
+		var dialer net.Dialer
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		if sockets == nil {
+			sockets = make(map[string]*http.Transport)
+		}
+		sockets[socketPath] = transport
+	}
+	if sockets == nil {
+		return nil
+	}
+	return &socketTransport{
+		next:    next,
+		sockets: sockets,
+	}
+}
+
+// RoundTrip sends a request for a unix url as an http request over the socket its path starts with
+func (t *socketTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme != "unix" {
+		return t.next.RoundTrip(r)
+	}
+	// the longest match wins, in case the path of a socket is the prefix of another
+	var socketPath string
+	for candidate := range t.sockets {
+		path, ok := strings.CutPrefix(r.URL.Path, candidate)
+		if ok && (path == "" || path[0] == '/') && len(candidate) > len(socketPath) {
+			socketPath = candidate
+		}
+	}
+	transport, ok := t.sockets[socketPath]
+	if !ok {
+		return nil, fmt.Errorf("no target listens on a socket for %s", r.URL)
+	}
+	// a RoundTripper must not modify the request it was given
+	r = r.Clone(r.Context())
+	r.URL.Scheme = "http"
+	r.URL.Host = socketHost
+	r.URL.Path = strings.TrimPrefix(r.URL.Path, socketPath)
+	if r.URL.RawPath != "" {
+		r.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, (&url.URL{Path: socketPath}).EscapedPath())
+	}
+	return transport.RoundTrip(r)
+}
+
+// CloseIdleConnections closes the idle connections to the sockets, but not those of next, which may be
+// shared with other upstreams
+func (t *socketTransport) CloseIdleConnections() {
+	for _, transport := range t.sockets {
+		transport.CloseIdleConnections()
+	}
+}
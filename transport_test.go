@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbodonnell/proxy-host/pkg/store"
+)
+
+func TestNewTransport(t *testing.T) {
+	opts := TransportOptions{
+		DialTimeout:         time.Second,
+		KeepAlive:           -1,
+		TLSHandshakeTimeout: 2 * time.Second,
+		MaxIdleConns:        10,
+		MaxIdleConnsPerHost: 5,
+		IdleConnTimeout:     time.Minute,
+	}
+	transport := NewTransport(opts, false)
+	if transport.MaxIdleConns != 10 || transport.MaxIdleConnsPerHost != 5 || transport.IdleConnTimeout != time.Minute || transport.TLSHandshakeTimeout != 2*time.Second {
+		t.Errorf("transport = %+v, want the configured pool", transport)
+	}
+	if transport.TLSClientConfig != nil && transport.TLSClientConfig.InsecureSkipVerify {
+		t.Error("secure transport skips certificate verification")
+	}
+	if insecure := NewTransport(opts, true); insecure.TLSClientConfig == nil || !insecure.TLSClientConfig.InsecureSkipVerify {
+		t.Error("insecure transport verifies certificates")
+	}
+}
+
+func TestNewTransportDialTimeout(t *testing.T) {
+	opts := DefaultTransportOptions()
+	opts.DialTimeout = time.Nanosecond
+	client := &http.Client{Transport: NewTransport(opts, false)}
+	// 192.0.2.0/24 is reserved for documentation, so connecting never succeeds before the timeout
+	if _, err := client.Get("http://192.0.2.1"); err == nil {
+		t.Error("request succeeded despite the dial timeout")
+	}
+}
+
+func TestProxiesShareTransport(t *testing.T) {
+	upstream := newTestUpstream(t, "ok")
+	s := newTestServer(t, map[string]*store.Route{
+		"a.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"b.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"insecure.example.com": {
+			Targets:            []*url.URL{mustParseURL(t, upstream.URL)},
+			InsecureSkipVerify: true,
+		},
+	})
+	s.Transport = NewTransport(DefaultTransportOptions(), false)
+	s.InsecureTransport = NewTransport(DefaultTransportOptions(), true)
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		route, _ := s.Store.Lookup(host)
+		if proxy := s.newReverseProxy(route, route.Targets[0], s.transport(route), nil); proxy.Transport != s.Transport {
+			t.Errorf("proxy of %s does not use the shared transport", host)
+		}
+	}
+	route, _ := s.Store.Lookup("insecure.example.com")
+	if proxy := s.newReverseProxy(route, route.Targets[0], s.transport(route), nil); proxy.Transport != s.InsecureTransport {
+		t.Error("proxy of an insecure route does not use the insecure transport")
+	}
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		if rec := serve(s, http.MethodGet, host, "/"); rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d", host, rec.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestProxiesReuseConnections(t *testing.T) {
+	connections := 0
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections++
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+	s := newTestServer(t, map[string]*store.Route{
+		"a.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+		"b.example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.Transport = NewTransport(DefaultTransportOptions(), false)
+	for i := 0; i < 3; i++ {
+		serve(s, http.MethodGet, "a.example.com", "/")
+		serve(s, http.MethodGet, "b.example.com", "/")
+	}
+	if connections != 1 {
+		t.Errorf("upstream accepted %d connections, want 1 reused by both hosts", connections)
+	}
+}
+
+// countingUpstream creates an upstream that counts the connections it has closed
+func countingUpstream(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var closed atomic.Int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return upstream, &closed
+}
+
+// waitClosed waits for the upstream to have closed want connections
+func waitClosed(closed *atomic.Int64, want int64) int64 {
+	deadline := time.Now().Add(time.Second)
+	for closed.Load() < want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return closed.Load()
+}
+
+func TestEvictionClosesDedicatedTransport(t *testing.T) {
+	upstream, closed := countingUpstream(t)
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.Transport = NewTransport(DefaultTransportOptions(), false)
+	s.DedicatedTransports = true
+	s.Cache.OnEvicted(func(key string, upstream *Upstream) {
+		upstream.Close()
+	})
+	serve(s, http.MethodGet, "example.com", "/")
+	cached, _ := s.Cache.Get("example.com")
+	if cached.transport == nil || cached.transport == s.Transport {
+		t.Fatal("upstream did not get a dedicated transport")
+	}
+	s.Cache.Delete("example.com")
+	if n := waitClosed(closed, 1); n != 1 {
+		t.Errorf("upstream closed %d connections after eviction, want 1", n)
+	}
+}
+
+func TestEvictionKeepsSharedTransport(t *testing.T) {
+	upstream, closed := countingUpstream(t)
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, upstream.URL)}},
+	})
+	s.Transport = NewTransport(DefaultTransportOptions(), false)
+	s.Cache.OnEvicted(func(key string, upstream *Upstream) {
+		upstream.Close()
+	})
+	serve(s, http.MethodGet, "example.com", "/")
+	if cached, _ := s.Cache.Get("example.com"); cached.transport != nil {
+		t.Fatal("upstream owns the shared transport")
+	}
+	s.Cache.Delete("example.com")
+	time.Sleep(20 * time.Millisecond)
+	if n := closed.Load(); n != 0 {
+		t.Errorf("evicting an upstream closed %d connections of the shared transport", n)
+	}
+}
+
+func TestDedicatedTransportsRequireHTTPTransport(t *testing.T) {
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{mustParseURL(t, "http://upstream.internal")}},
+	})
+	s.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Header: make(http.Header), Request: r}, nil
+	})
+	s.DedicatedTransports = true
+	serve(s, http.MethodGet, "example.com", "/")
+	if cached, _ := s.Cache.Get("example.com"); cached.transport != nil {
+		t.Error("a transport that is not an *http.Transport was cloned")
+	}
+}
+
+// newSocketUpstream creates an upstream listening on a Unix domain socket in a temporary directory that
+// responds with the Host and the path of each request, returning the unix url of the socket
+func newSocketUpstream(t *testing.T) *url.URL {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "app.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %s: %v", socketPath, err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.RequestURI())
+	}))
+	upstream.Listener = listener
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return &url.URL{Scheme: "unix", Path: socketPath}
+}
+
+func TestProxyToUnixSocket(t *testing.T) {
+	target := newSocketUpstream(t)
+	s := newTestServer(t, map[string]*store.Route{
+		"example.com": {Targets: []*url.URL{target}},
+	})
+	rec := serve(s, http.MethodGet, "example.com", "/items/1?q=x")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if got, want := rec.Body.String(), "localhost /items/1?q=x"; got != want {
+		t.Errorf("upstream received %q, want %q", got, want)
+	}
+	cached, _ := s.Cache.Get("example.com")
+	if cached.sockets == nil {
+		t.Fatal("upstream has no socket transport")
+	}
+	if cached.transport != nil {
+		t.Error("socket transport made the shared transport dedicated")
+	}
+}
+
+func TestSocketTransportProbes(t *testing.T) {
+	target := newSocketUpstream(t)
+	transport := newSocketTransport(http.DefaultTransport, []*url.URL{target})
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get(target.JoinPath("/healthz").String())
+	if err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if got, want := string(body), "localhost /healthz"; got != want {
+		t.Errorf("upstream received %q, want %q", got, want)
+	}
+	if _, err := client.Get("unix:///nonexistent.sock/"); err == nil {
+		t.Error("request to an unknown socket succeeded")
+	}
+}
+
+func TestSocketTransportWithoutSockets(t *testing.T) {
+	if transport := newSocketTransport(http.DefaultTransport, []*url.URL{mustParseURL(t, "http://upstream.internal")}); transport != nil {
+		t.Error("socket transport created without unix targets")
+	}
+}